@@ -0,0 +1,93 @@
+// Package apikey keeps hashed api keys of clients, loaded from yaml file and reloaded on change.
+package apikey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Client defines api key of the client. Hash is hex-encoded sha256 of the key, with optional "sha256:" prefix.
+type Client struct {
+	Name     string `yaml:"name"`
+	Hash     string `yaml:"hash"`
+	Disabled bool   `yaml:"disabled"`
+}
+
+// Store keeps enabled clients by hash of the key
+type Store struct {
+	path string
+
+	lock    sync.RWMutex
+	clients map[string]string // hex sha256 of the key -> client name
+}
+
+// NewStore makes store and loads keys from the file
+func NewStore(path string) (*Store, error) {
+	res := &Store{path: path}
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Load reads keys from the file, replacing the current ones. Keys kept unchanged on error.
+func (s *Store) Load() error {
+	data, err := os.ReadFile(s.path) //nolint:gosec // path is from the options
+	if err != nil {
+		return fmt.Errorf("failed to read api keys file %s: %w", s.path, err)
+	}
+	var file struct {
+		Keys []Client `yaml:"keys"`
+	}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse api keys file %s: %w", s.path, err)
+	}
+
+	clients := make(map[string]string, len(file.Keys))
+	for i, c := range file.Keys {
+		if c.Name == "" {
+			return fmt.Errorf("no name of api key #%d in %s", i+1, s.path)
+		}
+		hash := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.Hash), "sha256:"))
+		if b, herr := hex.DecodeString(hash); herr != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid hash of api key %q in %s, should be hex sha256", c.Name, s.path)
+		}
+		if name, dup := clients[hash]; dup {
+			return fmt.Errorf("api key of %q duplicates key of %q in %s", c.Name, name, s.path)
+		}
+		if c.Disabled {
+			continue
+		}
+		clients[hash] = c.Name
+	}
+
+	s.lock.Lock()
+	s.clients = clients
+	s.lock.Unlock()
+	return nil
+}
+
+// Lookup returns name of the client with the key, false for unknown and disabled keys
+func (s *Store) Lookup(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(key))
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	name, ok := s.clients[hex.EncodeToString(sum[:])]
+	return name, ok
+}
+
+// Len returns number of enabled keys
+func (s *Store) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.clients)
+}
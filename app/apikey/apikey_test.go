@@ -0,0 +1,88 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.yml")
+	writeKeys(t, file, "keys:\n"+
+		"  - {name: billing, hash: \"sha256:"+hash("key-1")+"\"}\n"+
+		"  - {name: reports, hash: \""+hash("key-2")+"\"}\n"+
+		"  - {name: legacy, hash: \""+hash("key-3")+"\", disabled: true}\n")
+
+	s, err := NewStore(file)
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+
+	name, ok := s.Lookup("key-1")
+	assert.True(t, ok)
+	assert.Equal(t, "billing", name)
+	name, ok = s.Lookup("key-2")
+	assert.True(t, ok)
+	assert.Equal(t, "reports", name)
+	_, ok = s.Lookup("key-3")
+	assert.False(t, ok, "disabled key")
+	_, ok = s.Lookup("key-4")
+	assert.False(t, ok, "unknown key")
+	_, ok = s.Lookup("")
+	assert.False(t, ok, "empty key")
+
+	// enable legacy, disable billing
+	writeKeys(t, file, "keys:\n"+
+		"  - {name: billing, hash: \""+hash("key-1")+"\", disabled: true}\n"+
+		"  - {name: legacy, hash: \""+hash("key-3")+"\"}\n")
+	require.NoError(t, s.Load())
+	_, ok = s.Lookup("key-1")
+	assert.False(t, ok)
+	name, ok = s.Lookup("key-3")
+	assert.True(t, ok)
+	assert.Equal(t, "legacy", name)
+
+	// broken file keeps current keys
+	writeKeys(t, file, "keys:\n  - {name: legacy, hash: bad}\n")
+	require.EqualError(t, s.Load(), `invalid hash of api key "legacy" in `+file+`, should be hex sha256`)
+	_, ok = s.Lookup("key-3")
+	assert.True(t, ok)
+}
+
+func TestStore_LoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tbl := []struct {
+		name, data, err string
+	}{
+		{"no name", "keys:\n  - {hash: \"" + hash("k") + "\"}\n", "no name of api key #1"},
+		{"short hash", "keys:\n  - {name: a, hash: \"abcd\"}\n", `invalid hash of api key "a"`},
+		{"duplicate", "keys:\n  - {name: a, hash: \"" + hash("k") + "\"}\n  - {name: b, hash: \"" + hash("k") + "\"}\n",
+			`api key of "b" duplicates key of "a"`},
+		{"bad yaml", "keys: [", "failed to parse api keys file"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name+".yml")
+			writeKeys(t, file, tt.data)
+			_, err := NewStore(file)
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	_, err := NewStore(filepath.Join(dir, "no-such-file.yml"))
+	require.ErrorContains(t, err, "failed to read api keys file")
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeKeys(t *testing.T, file, data string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(file, []byte(data), 0o600))
+}
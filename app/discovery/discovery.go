@@ -8,12 +8,18 @@ import (
 	"container/list"
 	"context"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	log "github.com/go-pkgz/lgr"
 )
@@ -27,6 +33,7 @@ type Service struct {
 	mappersCache  map[string]*list.Element
 	cacheOrder    *list.List
 	serverRegexps map[string]*regexp.Regexp
+	canonical     map[string]CanonicalHost // server-level canonicalization keyed by server
 	lock          sync.RWMutex
 	// cacheLock guards mappersCache on the lazy read/write path in findMatchingMappers, which runs under
 	// lock.RLock; the wholesale cache reset in Run runs under the exclusive lock.Lock and so needs no cacheLock
@@ -50,12 +57,31 @@ type URLMapper struct {
 	PingURL             string
 	MatchType           MatchType
 	RedirectType        RedirectType
+	RedirectQuery       RedirectQuery // query string handling of redirect, empty = location as is
+	RedirectHost        bool          // host-level redirect, keeps the request path and uses scheme and host of Dst only
 	KeepHost            *bool
 	ForwardHealthChecks bool
 	OnlyFromIPs         []string
-	AuthUsers           []string      // basic auth credentials as user:bcrypt_hash pairs
-	Timeout             time.Duration // per-route request timeout, 0 = use global
-	Throttle            int           // per-route req/sec per user, 0 = use global throttle.user
+	AuthUsers           []string         // basic auth credentials as user:bcrypt_hash pairs
+	AuthFile            string           // name of htpasswd file for basic auth, empty = not used
+	Timeout             time.Duration    // per-route request timeout, 0 = use global
+	Throttle            RateLimit        // per-route rate limit per user, zero value = use global throttle.user
+	ThrottleKey         ThrottleKey      // per-route rate limiter key, zero value = client ip
+	AccessLog           AccessLogPolicy  // per-route access log control, zero value logs all requests
+	MaxBodySize         int64            // per-route max request body size, 0 = use global max
+	Concurrency         ConcurrencyLimit // per-route limit of concurrent requests, zero value = unlimited
+	Bandwidth           BandwidthLimit   // per-route limit of response rate, zero value = unlimited
+	ErrorPages          string           // per-route directory of error page templates, overrides global ones
+	ErrorFormat         ErrorFormat      // per-route format of error responses, empty = negotiated by Accept header
+	Canonical           CanonicalHost    // canonical host and trailing slash policy of the whole server, zero value = off
+	SecurityHeaders     SecurityHeaders  // per-route security headers preset, overrides and opt-outs, zero value = global
+	CORS                CORSPolicy       // per-route CORS policy, zero value = disabled
+	JWT                 JWTPolicy        // per-route bearer token validation, zero value = disabled
+	ForwardAuth         ForwardAuth      // per-route external authentication, zero value = disabled
+	OIDC                OIDCPolicy       // per-route oidc login, zero value = disabled
+	APIKey              APIKeyPolicy     // per-route api key auth, zero value = disabled
+	GeoIP               GeoIPPolicy      // per-route country and asn restrictions, zero value = disabled
+	WAF                 WAFPolicy        // per-route request filtering rules, zero value = global rules only
 
 	AssetsLocation string // local FS root location
 	AssetsWebRoot  string // web root location
@@ -64,6 +90,92 @@ type URLMapper struct {
 	dead bool
 }
 
+// AccessLogPolicy defines which requests of the route get to the access log (file and stdout).
+// Requests matching ErrorsOnly or Slow filters always logged, others logged at SampleRate if set.
+type AccessLogPolicy struct {
+	Disabled   bool          // don't log requests of the route at all
+	SampleRate float64       // ratio of logged requests, (0..1), 0 means all (or none if any filter is set)
+	ErrorsOnly bool          // log responses with status >= 400
+	Slow       time.Duration // log requests taking longer than the threshold, 0 = disabled
+}
+
+// RateLimit defines token bucket rate limit, Rate requests per Window with Burst requests allowed at once
+type RateLimit struct {
+	Rate   int           // requests per window, 0 = unlimited
+	Window time.Duration // 0 means a second
+	Burst  int           // bucket size, 0 means the same as Rate
+}
+
+// PerSecond returns refill rate of the bucket in requests per second
+func (l RateLimit) PerSecond() float64 {
+	if l.Window <= 0 {
+		return float64(l.Rate)
+	}
+	return float64(l.Rate) / l.Window.Seconds()
+}
+
+// BurstSize returns bucket size, defaults to Rate if Burst not set
+func (l RateLimit) BurstSize() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// String returns limit in the format parsed by ParseRateLimit, i.e. "100/1m0s burst 20"
+func (l RateLimit) String() string {
+	res := strconv.Itoa(l.Rate)
+	if l.Window > 0 && l.Window != time.Second {
+		res += "/" + l.Window.String()
+	}
+	if l.Burst > 0 {
+		res += " burst " + strconv.Itoa(l.Burst)
+	}
+	return res
+}
+
+// ThrottleKeyKind defines source of the rate limiter key
+type ThrottleKeyKind string
+
+// enum of all throttle key kinds
+const (
+	TKIP        ThrottleKeyKind = "ip"
+	TKHeader    ThrottleKeyKind = "header"
+	TKCookie    ThrottleKeyKind = "cookie"
+	TKBasicAuth ThrottleKeyKind = "basic-auth"
+	TKJWT       ThrottleKeyKind = "jwt"
+)
+
+// ThrottleKey defines how per-route rate limiter identifies the client. Requests without the key value
+// (i.e. missing header or invalid token) limited by client ip.
+type ThrottleKey struct {
+	Kind ThrottleKeyKind // empty is the same as TKIP
+	Name string          // header, cookie or jwt claim name
+}
+
+// String returns key definition in the same format as parsed by ParseThrottleKey
+func (k ThrottleKey) String() string {
+	if k.Name == "" {
+		return string(k.Kind)
+	}
+	return string(k.Kind) + ":" + k.Name
+}
+
+// ConcurrencyLimit defines max number of requests of the route processed at the same time. Requests above the limit
+// wait in the queue of the given size up to Timeout, requests which can't be queued or timed out are rejected.
+type ConcurrencyLimit struct {
+	MaxInFlight int           // max concurrent requests, 0 = unlimited
+	Queue       int           // max waiting requests, 0 = reject immediately
+	Timeout     time.Duration // max wait time in the queue, 0 = wait until the request is canceled
+}
+
+// BandwidthLimit defines max rate of responses of the route in bytes per second, for all clients together
+// and for each client ip. Responses above the limit are paced, not rejected.
+type BandwidthLimit struct {
+	Route  int64 // bytes/sec for all responses of the route, 0 = unlimited
+	Client int64 // bytes/sec for responses to a single client ip, 0 = unlimited
+}
+
 // Matches returns result of url mapping. May have multiple routes. Lack of any routes means no match was wound
 type Matches struct {
 	MatchType MatchType
@@ -96,6 +208,272 @@ const (
 
 var reGroup = regexp.MustCompile(`(^.*)/\(.*\)`) // capture regex group lil (anything) from src like /blah/foo/(.*)
 
+// ErrorFormat defines format of error responses
+type ErrorFormat string
+
+// enum of all error formats
+const (
+	EFAuto ErrorFormat = ""     // negotiated by Accept header
+	EFHTML ErrorFormat = "html" // html page made from error template
+	EFJSON ErrorFormat = "json" // application/problem+json
+	EFText ErrorFormat = "text" // text/plain
+)
+
+// CanonicalHost defines server-level canonicalization applied to requests before route matching.
+// It can be set on any route of the server and applies to all requests of the server.
+type CanonicalHost struct {
+	Host      HostPolicy  // redirect to www or apex host, empty = as is
+	Lowercase bool        // redirect hosts with upper case letters to lower case
+	Slash     SlashPolicy // trailing slash policy of the path, empty = ignore
+}
+
+// HostPolicy defines canonical form of the host
+type HostPolicy string
+
+// enum of all host policies
+const (
+	HPAsIs HostPolicy = ""     // host as is
+	HPWWW  HostPolicy = "www"  // example.com redirected to www.example.com
+	HPApex HostPolicy = "apex" // www.example.com redirected to example.com
+)
+
+// SlashPolicy defines handling of the trailing slash in the path
+type SlashPolicy string
+
+// enum of all slash policies
+const (
+	SPIgnore SlashPolicy = ""      // path as is
+	SPAdd    SlashPolicy = "add"   // /blah redirected to /blah/, paths with file extension in the last segment skipped
+	SPStrip  SlashPolicy = "strip" // /blah/ redirected to /blah
+)
+
+// SecurityHeaders defines security response headers as a preset with overridden and opted out headers
+type SecurityHeaders struct {
+	Preset     SecurityPreset    // base set of headers, empty inherits the global one
+	Set        map[string]string // header values keyed by header name, override values of the preset
+	Drop       []string          // header names opted out
+	ReportOnly bool              // send Content-Security-Policy as Content-Security-Policy-Report-Only
+}
+
+// IsZero reports whether the policy is not set
+func (sh SecurityHeaders) IsZero() bool {
+	return sh.Preset == SHInherit && len(sh.Set) == 0 && len(sh.Drop) == 0 && !sh.ReportOnly
+}
+
+// SecurityPreset defines named set of security headers
+type SecurityPreset string
+
+// enum of all security presets
+const (
+	SHInherit SecurityPreset = ""       // use global preset
+	SHOff     SecurityPreset = "off"    // no security headers
+	SHBasic   SecurityPreset = "basic"  // headers safe for any site
+	SHStrict  SecurityPreset = "strict" // restrictive headers, including content security policy
+)
+
+// securityHeaderNames maps short keys of security headers to header names
+var securityHeaderNames = map[string]string{
+	"hsts":            "Strict-Transport-Security",
+	"frame":           "X-Frame-Options",
+	"nosniff":         "X-Content-Type-Options",
+	"referrer":        "Referrer-Policy",
+	"csp":             "Content-Security-Policy",
+	"csp-report-only": "Content-Security-Policy-Report-Only",
+	"permissions":     "Permissions-Policy",
+	"coop":            "Cross-Origin-Opener-Policy",
+	"corp":            "Cross-Origin-Resource-Policy",
+}
+
+// SecurityHeaderName returns header name for the short key, i.e. "hsts" for Strict-Transport-Security
+func SecurityHeaderName(key string) (string, bool) {
+	res, ok := securityHeaderNames[strings.ToLower(strings.TrimSpace(key))]
+	return res, ok
+}
+
+// CORSPolicy defines allowed cross-origin requests of the route
+type CORSPolicy struct {
+	Origins     []string      // allowed origins, exact, "*" for any, with wildcard (*.example.com) or regex prefixed by ~
+	Methods     []string      // allowed methods of the actual request
+	Headers     []string      // allowed request headers, empty allows headers requested by preflight
+	Expose      []string      // response headers exposed to the client
+	Credentials bool          // allow credentials (cookies, authorization)
+	MaxAge      time.Duration // how long preflight response can be cached, 0 = browser default
+	Override    bool          // replace CORS headers set by upstream
+
+	anyOrigin bool             // origins has "*"
+	originRes []*regexp.Regexp // compiled wildcard and regex origins
+}
+
+// Enabled reports whether the policy is set
+func (c CORSPolicy) Enabled() bool {
+	return len(c.Origins) > 0
+}
+
+// AnyOrigin reports whether any origin allowed with "*"
+func (c CORSPolicy) AnyOrigin() bool {
+	return c.anyOrigin
+}
+
+// AllowOrigin checks if the origin is allowed by the policy
+func (c CORSPolicy) AllowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if c.anyOrigin {
+		return true
+	}
+	for _, o := range c.Origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	for _, re := range c.originRes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowMethod checks if the method is allowed by the policy
+func (c CORSPolicy) AllowMethod(method string) bool {
+	for _, m := range c.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowHeader checks if the request header is allowed, any header allowed if policy has no headers
+func (c CORSPolicy) AllowHeader(header string) bool {
+	if len(c.Headers) == 0 {
+		return true
+	}
+	for _, h := range c.Headers {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTPolicy defines bearer token validation of the route. Token signature and time claims checked by the global
+// verifier, issuer, audience and required claims by the policy.
+type JWTPolicy struct {
+	Enabled  bool
+	Issuer   string              // required iss claim, empty = any
+	Audience []string            // token's aud should have any of these, empty = any
+	Claims   []JWTClaimRule      // required claims
+	Forward  []JWTForwardedClaim // claims passed to upstream as request headers
+}
+
+// JWTClaimRule requires the claim to be present and, if Values set, to have any of the values
+type JWTClaimRule struct {
+	Name   string
+	Values []string
+}
+
+// JWTForwardedClaim defines request header set to the claim value
+type JWTForwardedClaim struct {
+	Claim  string
+	Header string
+}
+
+// ForwardAuth defines external authentication of the route. Subrequest sent to URL before proxying,
+// 2xx response lets the request through, any other response returned to the client as is.
+type ForwardAuth struct {
+	URL      string
+	Headers  []string      // request headers sent to auth service
+	Copy     []string      // auth response headers copied to upstream request
+	CacheTTL time.Duration // how long allowed decisions cached, 0 = no caching
+	Timeout  time.Duration // subrequest timeout, 0 = default
+}
+
+// Enabled reports whether forward auth is set
+func (f ForwardAuth) Enabled() bool {
+	return f.URL != ""
+}
+
+// OIDCPolicy defines oidc login of the route and users allowed after the login. Empty lists allow any
+// authenticated user, otherwise the user should match any of the lists.
+type OIDCPolicy struct {
+	Enabled bool
+	Users   []string // allowed user names or subjects
+	Emails  []string // allowed emails, "@domain" or "*@domain" allows the whole domain
+	Groups  []string // allowed groups
+}
+
+// Allow checks if the user with email and groups allowed by the policy
+func (p OIDCPolicy) Allow(user, email string, groups []string) bool {
+	if len(p.Users) == 0 && len(p.Emails) == 0 && len(p.Groups) == 0 {
+		return true
+	}
+	if user != "" && slices.Contains(p.Users, user) {
+		return true
+	}
+	if email != "" {
+		_, domain, _ := strings.Cut(email, "@")
+		for _, e := range p.Emails {
+			if strings.EqualFold(e, email) || (domain != "" && strings.EqualFold(strings.TrimPrefix(e, "*"), "@"+domain)) {
+				return true
+			}
+		}
+	}
+	for _, g := range groups {
+		if slices.Contains(p.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyPolicy defines api key auth of the route. Key taken from the header or, if Query set, from the query
+// parameter, and checked against keys of the global api keys file.
+type APIKeyPolicy struct {
+	Enabled bool
+	Header  string   // request header with the key
+	Query   string   // query parameter with the key, empty = not accepted
+	Clients []string // allowed client names, empty = any client with a valid key
+	Forward string   // request header with client name passed upstream
+}
+
+// default headers of api key policy
+const (
+	DefaultAPIKeyHeader  = "X-Api-Key"
+	DefaultAPIKeyForward = "X-Api-Client"
+)
+
+// GeoIPPolicy defines access to the route by country and autonomous system (ASN) of the client ip.
+// Deny lists checked first, if any allow list set the client has to match one of them.
+type GeoIPPolicy struct {
+	Enabled        bool
+	AllowCountries []string // ISO 3166-1 alpha-2 country codes, upper case
+	DenyCountries  []string
+	AllowASN       []uint
+	DenyASN        []uint
+}
+
+// Allow checks if the client with country and asn allowed by the policy. Empty country and zero asn are unknown,
+// never match any list.
+func (p GeoIPPolicy) Allow(country string, asn uint) bool {
+	inCountries := func(list []string) bool { return country != "" && slices.Contains(list, country) }
+	inASN := func(list []uint) bool { return asn != 0 && slices.Contains(list, asn) }
+	if inCountries(p.DenyCountries) || inASN(p.DenyASN) {
+		return false
+	}
+	if len(p.AllowCountries) == 0 && len(p.AllowASN) == 0 {
+		return true
+	}
+	return inCountries(p.AllowCountries) || inASN(p.AllowASN)
+}
+
+// WAFPolicy defines request filtering rules of the route, in addition to or instead of the global rules
+type WAFPolicy struct {
+	Sets       []string // named rule sets of the waf rules file, checked before the global rules
+	SkipGlobal bool     // don't check the global rules
+}
+
 // MatchType defines the type of mapper (rule)
 type MatchType int
 
@@ -121,9 +499,21 @@ type RedirectType int
 
 // enum of all redirect types
 const (
-	RTNone RedirectType = 0
-	RTPerm RedirectType = 301
-	RTTemp RedirectType = 302
+	RTNone           RedirectType = 0
+	RTPerm           RedirectType = 301
+	RTTemp           RedirectType = 302
+	RTTempKeepMethod RedirectType = 307
+	RTPermKeepMethod RedirectType = 308
+)
+
+// RedirectQuery defines how redirect handles query string of the request
+type RedirectQuery string
+
+// enum of all redirect query modes
+const (
+	RQDefault RedirectQuery = ""     // location as made from the destination, query of the request lost
+	RQKeep    RedirectQuery = "keep" // query of the request appended to the location
+	RQDrop    RedirectQuery = "drop" // location without any query, even if the destination has it
 )
 
 // NewService makes service with given providers
@@ -172,8 +562,10 @@ func (s *Service) Run(ctx context.Context) error {
 			s.mappersCache = make(map[string]*list.Element)
 			s.cacheOrder = list.New()
 			s.serverRegexps = make(map[string]*regexp.Regexp)
+			s.canonical = make(map[string]CanonicalHost)
 			for _, m := range lst {
 				s.mappers[m.Server] = append(s.mappers[m.Server], m)
+				s.setCanonical(m)
 			}
 			for server := range s.mappers {
 				if isDefaultServer(server) || strings.HasPrefix(server, "*.") {
@@ -403,6 +795,54 @@ func (s *Service) ScheduleHealthCheck(ctx context.Context, interval time.Duratio
 	}()
 }
 
+// CanonicalHost returns canonicalization policy for the request's host, lower-cased by caller.
+// Policy of the host itself checked first, then the one of apex server for www host (with apex policy)
+// and www server for apex host (with www policy), then policy of the default server. The default server has no host
+// of its own, so its www or apex policy is not applied to other hosts, only lowercase and slash ones.
+func (s *Service) CanonicalHost(host string) (CanonicalHost, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.canonical) == 0 {
+		return CanonicalHost{}, false
+	}
+	if c, ok := s.canonical[host]; ok {
+		return c, true
+	}
+	if apex, ok := strings.CutPrefix(host, "www."); ok {
+		if c, found := s.canonical[apex]; found && c.Host == HPApex {
+			return c, true
+		}
+	} else if c, found := s.canonical["www."+host]; found && c.Host == HPWWW {
+		return c, true
+	}
+	for _, srv := range []string{"*", ""} {
+		if c, ok := s.canonical[srv]; ok {
+			c.Host = HPAsIs // i.e. www policy shouldn't turn api.example.com into www.api.example.com
+			return c, c != (CanonicalHost{})
+		}
+	}
+	return CanonicalHost{}, false
+}
+
+// setCanonical adds server's canonicalization policy of the mapper, the first one wins on conflict.
+// Caller must hold s.lock.
+func (s *Service) setCanonical(m URLMapper) {
+	if m.Canonical == (CanonicalHost{}) {
+		return
+	}
+	server := strings.ToLower(m.Server)
+	if isDefaultServer(server) && m.Canonical.Host != HPAsIs {
+		log.Printf("[WARN] %s host policy of default server %q ignored, set it on the server of the host", m.Canonical.Host, m.Server)
+	}
+	if c, ok := s.canonical[server]; ok {
+		if c != m.Canonical {
+			log.Printf("[WARN] conflicting canonical host policy for server %s, %+v ignored", m.Server, m.Canonical)
+		}
+		return
+	}
+	s.canonical[server] = m.Canonical
+}
+
 // Servers return list of all servers, skips "*" (catch-all/default)
 func (s *Service) Servers() (servers []string) {
 	s.lock.RLock()
@@ -572,12 +1012,31 @@ func (s *Service) extendMapper(m URLMapper) URLMapper {
 		AssetsLocation:      m.AssetsLocation,
 		AssetsSPA:           m.AssetsSPA,
 		RedirectType:        m.RedirectType,
+		RedirectQuery:       m.RedirectQuery,
+		RedirectHost:        m.RedirectHost,
 		KeepHost:            m.KeepHost,
 		ForwardHealthChecks: m.ForwardHealthChecks,
 		OnlyFromIPs:         m.OnlyFromIPs,
 		AuthUsers:           m.AuthUsers,
+		AuthFile:            m.AuthFile,
 		Timeout:             m.Timeout,
 		Throttle:            m.Throttle,
+		ThrottleKey:         m.ThrottleKey,
+		AccessLog:           m.AccessLog,
+		MaxBodySize:         m.MaxBodySize,
+		Concurrency:         m.Concurrency,
+		Bandwidth:           m.Bandwidth,
+		ErrorPages:          m.ErrorPages,
+		ErrorFormat:         m.ErrorFormat,
+		Canonical:           m.Canonical,
+		SecurityHeaders:     m.SecurityHeaders,
+		CORS:                m.CORS,
+		JWT:                 m.JWT,
+		ForwardAuth:         m.ForwardAuth,
+		OIDC:                m.OIDC,
+		APIKey:              m.APIKey,
+		GeoIP:               m.GeoIP,
+		WAF:                 m.WAF,
 	}
 	rx, err := regexp.Compile("^" + strings.TrimSuffix(src, "/") + "/(.*)")
 	if err != nil {
@@ -588,23 +1047,53 @@ func (s *Service) extendMapper(m URLMapper) URLMapper {
 	return res
 }
 
-// redirects process @code prefix and sets redirect type, i.e. "@302 /something"
+// redirects process @code prefix and sets redirect type, i.e. "@302 /something".
+// The code can be followed by colon-separated options, i.e. "@308:keep-query:host https://example.com":
+// keep-query and drop-query set query handling, host makes host-level redirect keeping the request path.
 func (s *Service) redirects(m URLMapper) URLMapper {
-	switch {
-	case strings.HasPrefix(m.Dst, "@301 ") && len(m.Dst) > 4:
-		m.Dst = m.Dst[5:]
-		m.RedirectType = RTPerm
-	case strings.HasPrefix(m.Dst, "@perm ") && len(m.Dst) > 5:
-		m.Dst = m.Dst[6:]
+	m.RedirectType, m.RedirectQuery, m.RedirectHost = RTNone, RQDefault, false
+	prefix, dst, ok := strings.Cut(m.Dst, " ")
+	if !ok || dst == "" || !strings.HasPrefix(prefix, "@") {
+		return m
+	}
+
+	code, opts, _ := strings.Cut(prefix[1:], ":")
+	switch code {
+	case "301", "perm":
 		m.RedirectType = RTPerm
-	case (strings.HasPrefix(m.Dst, "@302 ") || strings.HasPrefix(m.Dst, "@tmp ")) && len(m.Dst) > 4:
-		m.Dst = m.Dst[5:]
-		m.RedirectType = RTTemp
-	case strings.HasPrefix(m.Dst, "@temp ") && len(m.Dst) > 5:
-		m.Dst = m.Dst[6:]
+	case "302", "tmp", "temp":
 		m.RedirectType = RTTemp
+	case "307":
+		m.RedirectType = RTTempKeepMethod
+	case "308":
+		m.RedirectType = RTPermKeepMethod
 	default:
-		m.RedirectType = RTNone
+		return m
+	}
+	m.Dst = dst
+
+	if opts != "" {
+		for opt := range strings.SplitSeq(opts, ":") {
+			switch opt {
+			case "keep-query":
+				m.RedirectQuery = RQKeep
+			case "drop-query":
+				m.RedirectQuery = RQDrop
+			case "host":
+				m.RedirectHost = true
+			default:
+				log.Printf("[WARN] unknown redirect option %q in %s, ignored", opt, prefix)
+			}
+		}
+	}
+
+	if m.RedirectHost {
+		if u, err := url.Parse(dst); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Printf("[WARN] host redirect to %s needs scheme and host, redirected as is", dst)
+			m.RedirectHost = false
+		} else if m.RedirectQuery == RQDefault {
+			m.RedirectQuery = RQKeep // host-level redirect moves the whole request, query included
+		}
 	}
 	return m
 }
@@ -672,11 +1161,629 @@ func ParseOnlyFrom(s string) []string {
 	return parseCommaSeparated(s)
 }
 
+// ParseIPNet parses ip or CIDR, i.e. "10.0.0.0/8" or "192.168.1.1". Single ip makes /32 or /128 network,
+// ipv4-mapped ipv6 address is the same as ipv4 one.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		s += "/128"
+	}
+	_, res, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // ParseAuth parses comma separated list of user:bcrypt_hash pairs for basic auth
 func ParseAuth(s string) []string {
 	return parseCommaSeparated(s)
 }
 
+// ParseAccessLog parses per-route access log policy defined as comma separated list of
+// "off" (no logging), "errors" (errors only), "slow=<duration>" and "sample=<ratio>", i.e. "errors,slow=1s"
+func ParseAccessLog(s string) (res AccessLogPolicy, err error) {
+	for _, v := range parseCommaSeparated(s) {
+		key, val, _ := strings.Cut(v, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "off", "disabled", "false", "no":
+			res.Disabled = true
+		case "errors", "errors-only":
+			res.ErrorsOnly = true
+		case "slow":
+			dur, e := time.ParseDuration(strings.TrimSpace(val))
+			if e != nil || dur <= 0 {
+				return AccessLogPolicy{}, fmt.Errorf("invalid slow threshold %q", val)
+			}
+			res.Slow = dur
+		case "sample":
+			ratio, e := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if e != nil || ratio <= 0 || ratio > 1 {
+				return AccessLogPolicy{}, fmt.Errorf("invalid sample ratio %q, should be in (0..1]", val)
+			}
+			res.SampleRate = ratio
+		default:
+			return AccessLogPolicy{}, fmt.Errorf("unknown access log option %q", v)
+		}
+	}
+	return res, nil
+}
+
+// ParseErrorFormat parses per-route error format, one of "auto", "html", "json" or "text" (case-insensitive).
+// Empty string is the same as "auto".
+func ParseErrorFormat(s string) (ErrorFormat, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case "", "auto":
+		return EFAuto, nil
+	case "html", "json", "text":
+		return ErrorFormat(v), nil
+	default:
+		return EFAuto, fmt.Errorf("unknown error format %q", s)
+	}
+}
+
+// ParseCanonicalHost parses server-level canonicalization policy defined as comma separated list of
+// "www" or "apex", "lowercase" and "slash=add|strip|ignore", i.e. "apex,lowercase,slash=strip"
+func ParseCanonicalHost(s string) (res CanonicalHost, err error) {
+	for _, v := range parseCommaSeparated(s) {
+		key, val, _ := strings.Cut(strings.ToLower(v), "=")
+		switch strings.TrimSpace(key) {
+		case "www", "apex":
+			if res.Host != HPAsIs && res.Host != HostPolicy(key) {
+				return CanonicalHost{}, fmt.Errorf("both www and apex set in %q", s)
+			}
+			res.Host = HostPolicy(key)
+		case "lowercase":
+			res.Lowercase = true
+		case "slash":
+			switch val = strings.TrimSpace(val); val {
+			case "add", "strip":
+				res.Slash = SlashPolicy(val)
+			case "ignore":
+				res.Slash = SPIgnore
+			default:
+				return CanonicalHost{}, fmt.Errorf("invalid slash policy %q, should be add, strip or ignore", val)
+			}
+		default:
+			return CanonicalHost{}, fmt.Errorf("unknown canonical option %q", v)
+		}
+	}
+	return res, nil
+}
+
+// ParseSecurityHeaders parses security headers policy defined as comma separated list of preset name ("off",
+// "basic" or "strict"), "report-only", opted out headers ("-hsts") and overridden headers ("frame=DENY").
+// Values with commas should be quoted, i.e. strict,-hsts,permissions="camera=(), geolocation=()"
+func ParseSecurityHeaders(s string) (res SecurityHeaders, err error) {
+	for _, v := range splitQuoted(s) {
+		if key, val, ok := strings.Cut(v, "="); ok {
+			name, known := SecurityHeaderName(key)
+			if !known {
+				return SecurityHeaders{}, fmt.Errorf("unknown security header %q", key)
+			}
+			if res.Set == nil {
+				res.Set = map[string]string{}
+			}
+			res.Set[name] = strings.Trim(strings.TrimSpace(val), `"`)
+			continue
+		}
+		if key, ok := strings.CutPrefix(v, "-"); ok {
+			name, known := SecurityHeaderName(key)
+			if !known {
+				return SecurityHeaders{}, fmt.Errorf("unknown security header %q", key)
+			}
+			res.Drop = append(res.Drop, name)
+			continue
+		}
+		switch strings.ToLower(v) {
+		case "off", "none":
+			res.Preset = SHOff
+		case "basic", "strict":
+			res.Preset = SecurityPreset(strings.ToLower(v))
+		case "report-only":
+			res.ReportOnly = true
+		default:
+			return SecurityHeaders{}, fmt.Errorf("unknown security headers option %q", v)
+		}
+	}
+	return res, nil
+}
+
+// ParseCORS parses CORS policy defined as comma separated list of "origins=<list>", "methods=<list>",
+// "headers=<list>", "expose=<list>", "credentials", "max-age=<duration>" and "override", lists separated by spaces.
+// Origins can be exact, "*", with wildcard (https://*.example.com, scheme is optional) or regex prefixed by ~.
+// Values with commas should be quoted, i.e. origins="https://app.example.com ~^https://pr-[0-9]{1,4}\.example\.com$"
+func ParseCORS(s string) (res CORSPolicy, err error) {
+	for _, v := range splitQuoted(s) {
+		key, val, _ := strings.Cut(v, "=")
+		list := strings.Fields(strings.Trim(strings.TrimSpace(val), `"`))
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "origins", "origin":
+			res.Origins = append(res.Origins, list...)
+		case "methods":
+			for _, m := range list {
+				res.Methods = append(res.Methods, strings.ToUpper(m))
+			}
+		case "headers":
+			res.Headers = append(res.Headers, list...)
+		case "expose":
+			res.Expose = append(res.Expose, list...)
+		case "credentials":
+			res.Credentials = true
+		case "max-age":
+			if res.MaxAge, err = time.ParseDuration(strings.TrimSpace(val)); err != nil || res.MaxAge < 0 {
+				return CORSPolicy{}, fmt.Errorf("invalid max-age %q", val)
+			}
+		case "override":
+			res.Override = true
+		default:
+			return CORSPolicy{}, fmt.Errorf("unknown cors option %q", v)
+		}
+	}
+	if len(res.Origins) == 0 {
+		if s != "" {
+			return CORSPolicy{}, fmt.Errorf("no origins in cors policy %q", s)
+		}
+		return CORSPolicy{}, nil
+	}
+	if len(res.Methods) == 0 {
+		res.Methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	for _, o := range res.Origins {
+		switch {
+		case o == "*":
+			res.anyOrigin = true
+		case strings.HasPrefix(o, "~"):
+			re, e := regexp.Compile(o[1:])
+			if e != nil {
+				return CORSPolicy{}, fmt.Errorf("invalid origin regex %q: %w", o, e)
+			}
+			res.originRes = append(res.originRes, re)
+		case strings.Contains(o, "*"):
+			rx := strings.ReplaceAll(regexp.QuoteMeta(o), `\*`, `[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*`)
+			if !strings.Contains(o, "://") {
+				rx = `https?://` + rx
+			}
+			re, e := regexp.Compile("(?i)^" + rx + "$")
+			if e != nil {
+				return CORSPolicy{}, fmt.Errorf("invalid origin wildcard %q: %w", o, e)
+			}
+			res.originRes = append(res.originRes, re)
+		}
+	}
+	if res.anyOrigin && res.Credentials {
+		log.Printf("[WARN] cors policy %q allows credentials for any origin, origin of the request is sent back", s)
+	}
+	return res, nil
+}
+
+// ParseJWT parses bearer token policy defined as comma separated list of "on", "iss=<issuer>", "aud=<list>",
+// "claim=<name>[:<list>]" and "forward=<claim>:<header> ...", lists separated by spaces. Any option enables
+// the policy, "on" enables it without extra checks. Claim rules and forwarded claims can be repeated,
+// i.e. "iss=https://idp.example.com, aud=api, claim=role:admin editor, forward=sub:X-User email:X-Email"
+func ParseJWT(s string) (res JWTPolicy, err error) {
+	for _, v := range splitQuoted(s) {
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "on", "true", "yes":
+		case "iss", "issuer":
+			if val == "" {
+				return JWTPolicy{}, fmt.Errorf("empty issuer in %q", v)
+			}
+			res.Issuer = val
+		case "aud", "audience":
+			res.Audience = append(res.Audience, strings.Fields(val)...)
+		case "claim":
+			name, values, _ := strings.Cut(val, ":")
+			if name = strings.TrimSpace(name); name == "" {
+				return JWTPolicy{}, fmt.Errorf("empty claim name in %q", v)
+			}
+			res.Claims = append(res.Claims, JWTClaimRule{Name: name, Values: strings.Fields(values)})
+		case "forward":
+			for _, f := range strings.Fields(val) {
+				claim, header, ok := strings.Cut(f, ":")
+				if !ok || claim == "" || header == "" {
+					return JWTPolicy{}, fmt.Errorf("invalid forwarded claim %q, should be claim:header", f)
+				}
+				res.Forward = append(res.Forward, JWTForwardedClaim{Claim: claim, Header: http.CanonicalHeaderKey(header)})
+			}
+		default:
+			return JWTPolicy{}, fmt.Errorf("unknown jwt option %q", v)
+		}
+		res.Enabled = true
+	}
+	return res, nil
+}
+
+// ParseForwardAuth parses forward auth defined as comma separated list of "url=<auth url>", "headers=<list>",
+// "copy=<list>", "cache=<duration>" and "timeout=<duration>", lists separated by spaces. Url can be set without
+// the key. Authorization and Cookie headers sent if headers not set,
+// i.e. "http://auth:8080/verify, copy=X-User X-Email, cache=30s"
+func ParseForwardAuth(s string) (res ForwardAuth, err error) {
+	for _, v := range splitQuoted(s) {
+		if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+			v = "url=" + v
+		}
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "url":
+			u, e := url.Parse(val)
+			if e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return ForwardAuth{}, fmt.Errorf("invalid forward auth url %q", val)
+			}
+			res.URL = val
+		case "headers":
+			for _, h := range strings.Fields(val) {
+				res.Headers = append(res.Headers, http.CanonicalHeaderKey(h))
+			}
+		case "copy":
+			for _, h := range strings.Fields(val) {
+				res.Copy = append(res.Copy, http.CanonicalHeaderKey(h))
+			}
+		case "cache", "timeout":
+			d, e := time.ParseDuration(val)
+			if e != nil || d < 0 {
+				return ForwardAuth{}, fmt.Errorf("invalid %s %q", key, val)
+			}
+			if key == "cache" {
+				res.CacheTTL = d
+			} else {
+				res.Timeout = d
+			}
+		default:
+			return ForwardAuth{}, fmt.Errorf("unknown forward auth option %q", v)
+		}
+	}
+	if res.URL == "" {
+		if s != "" {
+			return ForwardAuth{}, fmt.Errorf("no url in forward auth %q", s)
+		}
+		return ForwardAuth{}, nil
+	}
+	if len(res.Headers) == 0 {
+		res.Headers = []string{"Authorization", "Cookie"}
+	}
+	return res, nil
+}
+
+// ParseOIDC parses oidc login policy defined as comma separated list of "on", "users=<list>", "emails=<list>"
+// and "groups=<list>", lists separated by spaces. Any option enables the policy, "on" allows any authenticated
+// user, i.e. "emails=@example.com bob@partner.com, groups=admins"
+func ParseOIDC(s string) (res OIDCPolicy, err error) {
+	for _, v := range splitQuoted(s) {
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch key {
+		case "on", "true", "yes":
+		case "users", "emails", "groups":
+			if len(strings.Fields(val)) == 0 {
+				return OIDCPolicy{}, fmt.Errorf("empty %s in %q", key, v)
+			}
+			switch key {
+			case "users":
+				res.Users = append(res.Users, strings.Fields(val)...)
+			case "emails":
+				res.Emails = append(res.Emails, strings.Fields(val)...)
+			case "groups":
+				res.Groups = append(res.Groups, strings.Fields(val)...)
+			}
+		default:
+			return OIDCPolicy{}, fmt.Errorf("unknown oidc option %q", v)
+		}
+		res.Enabled = true
+	}
+	return res, nil
+}
+
+// ParseAPIKey parses api key policy defined as comma separated list of "on", "header=<name>", "query=<param>",
+// "clients=<list>" and "forward=<header>", list separated by spaces. Any option enables the policy, key taken
+// from X-Api-Key header and client name passed in X-Api-Client header by default,
+// i.e. "query=api_key, clients=billing reports"
+func ParseAPIKey(s string) (res APIKeyPolicy, err error) {
+	for _, v := range splitQuoted(s) {
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch key {
+		case "on", "true", "yes":
+		case "header", "query", "forward":
+			if val == "" || strings.ContainsAny(val, " \t") {
+				return APIKeyPolicy{}, fmt.Errorf("invalid %s %q", key, val)
+			}
+			switch key {
+			case "header":
+				res.Header = http.CanonicalHeaderKey(val)
+			case "query":
+				res.Query = val
+			case "forward":
+				res.Forward = http.CanonicalHeaderKey(val)
+			}
+		case "clients":
+			if len(strings.Fields(val)) == 0 {
+				return APIKeyPolicy{}, fmt.Errorf("empty clients in %q", v)
+			}
+			res.Clients = append(res.Clients, strings.Fields(val)...)
+		default:
+			return APIKeyPolicy{}, fmt.Errorf("unknown api key option %q", v)
+		}
+		res.Enabled = true
+	}
+	if !res.Enabled {
+		return res, nil
+	}
+	if res.Header == "" {
+		res.Header = DefaultAPIKeyHeader
+	}
+	if res.Forward == "" {
+		res.Forward = DefaultAPIKeyForward
+	}
+	return res, nil
+}
+
+// ParseGeoIP parses geoip policy defined as comma separated list of "allow=<countries>", "deny=<countries>",
+// "allow-asn=<numbers>" and "deny-asn=<numbers>", list separated by spaces, i.e. "allow=US CA, deny-asn=64500"
+func ParseGeoIP(s string) (res GeoIPPolicy, err error) {
+	for _, v := range splitQuoted(s) {
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		key = strings.ToLower(strings.TrimSpace(key))
+		items := strings.Fields(val)
+		if len(items) == 0 {
+			return GeoIPPolicy{}, fmt.Errorf("empty geoip option %q", v)
+		}
+		switch key {
+		case "allow", "deny":
+			codes := make([]string, 0, len(items))
+			for _, c := range items {
+				if len(c) != 2 || strings.Trim(strings.ToUpper(c), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+					return GeoIPPolicy{}, fmt.Errorf("invalid country code %q", c)
+				}
+				codes = append(codes, strings.ToUpper(c))
+			}
+			if key == "allow" {
+				res.AllowCountries = append(res.AllowCountries, codes...)
+			} else {
+				res.DenyCountries = append(res.DenyCountries, codes...)
+			}
+		case "allow-asn", "deny-asn":
+			numbers := make([]uint, 0, len(items))
+			for _, n := range items {
+				asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(n), "AS"), 10, 32)
+				if err != nil || asn == 0 {
+					return GeoIPPolicy{}, fmt.Errorf("invalid asn %q", n)
+				}
+				numbers = append(numbers, uint(asn))
+			}
+			if key == "allow-asn" {
+				res.AllowASN = append(res.AllowASN, numbers...)
+			} else {
+				res.DenyASN = append(res.DenyASN, numbers...)
+			}
+		default:
+			return GeoIPPolicy{}, fmt.Errorf("unknown geoip option %q", v)
+		}
+		res.Enabled = true
+	}
+	return res, nil
+}
+
+// ParseWAF parses waf policy defined as comma separated list of "sets=<names>", names separated by spaces,
+// and "skip-global", i.e. "sets=wordpress api, skip-global"
+func ParseWAF(s string) (res WAFPolicy, err error) {
+	for _, v := range splitQuoted(s) {
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "sets":
+			if len(strings.Fields(val)) == 0 {
+				return WAFPolicy{}, fmt.Errorf("empty sets in %q", v)
+			}
+			res.Sets = append(res.Sets, strings.Fields(val)...)
+		case "skip-global":
+			res.SkipGlobal = true
+		default:
+			return WAFPolicy{}, fmt.Errorf("unknown waf option %q", v)
+		}
+	}
+	return res, nil
+}
+
+// ParseConcurrency parses per-route concurrency limit defined as max in-flight requests with optional queue size
+// and queue timeout, i.e. "10" or "10,queue=50,timeout=5s"
+func ParseConcurrency(s string) (res ConcurrencyLimit, err error) {
+	elems := parseCommaSeparated(s)
+	if len(elems) == 0 {
+		return res, nil
+	}
+	if res.MaxInFlight, err = strconv.Atoi(elems[0]); err != nil || res.MaxInFlight < 0 {
+		return ConcurrencyLimit{}, fmt.Errorf("invalid max in-flight requests %q", elems[0])
+	}
+	for _, v := range elems[1:] {
+		key, val, _ := strings.Cut(v, "=")
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "queue":
+			if res.Queue, err = strconv.Atoi(val); err != nil || res.Queue < 0 {
+				return ConcurrencyLimit{}, fmt.Errorf("invalid queue size %q", val)
+			}
+		case "timeout":
+			if res.Timeout, err = time.ParseDuration(val); err != nil || res.Timeout < 0 {
+				return ConcurrencyLimit{}, fmt.Errorf("invalid queue timeout %q", val)
+			}
+		default:
+			return ConcurrencyLimit{}, fmt.Errorf("unknown concurrency option %q", v)
+		}
+	}
+	return res, nil
+}
+
+// ParseRateLimit parses rate limit defined as "<rate>[/<window>][ burst <size>]", i.e. "10", "100/m burst 20"
+// or "1000/10m". Window is a unit (s, m, h) or Go duration, a second if not set. Empty string means no limit.
+func ParseRateLimit(s string) (res RateLimit, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return res, nil
+	}
+
+	rateStr, windowStr, hasWindow := strings.Cut(fields[0], "/")
+	if res.Rate, err = strconv.Atoi(rateStr); err != nil || res.Rate < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q", rateStr)
+	}
+	if hasWindow {
+		switch strings.ToLower(windowStr) {
+		case "s", "sec", "second":
+			res.Window = time.Second
+		case "m", "min", "minute":
+			res.Window = time.Minute
+		case "h", "hour":
+			res.Window = time.Hour
+		default:
+			if res.Window, err = time.ParseDuration(windowStr); err != nil || res.Window <= 0 {
+				return RateLimit{}, fmt.Errorf("invalid rate window %q", windowStr)
+			}
+		}
+	}
+
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 3 && strings.EqualFold(fields[1], "burst"):
+		if res.Burst, err = strconv.Atoi(fields[2]); err != nil || res.Burst < 0 {
+			return RateLimit{}, fmt.Errorf("invalid burst %q", fields[2])
+		}
+	default:
+		return RateLimit{}, fmt.Errorf("unknown rate limit options %q", strings.Join(fields[1:], " "))
+	}
+	return res, nil
+}
+
+// ParseThrottleKey parses per-route rate limiter key, one of "ip", "header:<name>", "cookie:<name>", "basic-auth"
+// or "jwt:<claim>". Empty string means default, client ip.
+func ParseThrottleKey(s string) (ThrottleKey, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ThrottleKey{}, nil
+	}
+	kind, name, _ := strings.Cut(s, ":")
+	res := ThrottleKey{Kind: ThrottleKeyKind(strings.ToLower(strings.TrimSpace(kind))), Name: strings.TrimSpace(name)}
+	switch res.Kind {
+	case TKIP, TKBasicAuth:
+		if res.Name != "" {
+			return ThrottleKey{}, fmt.Errorf("throttle key %q doesn't take a name", res.Kind)
+		}
+	case TKHeader, TKCookie, TKJWT:
+		if res.Name == "" {
+			return ThrottleKey{}, fmt.Errorf("throttle key %q requires a name, i.e. %s:name", res.Kind, res.Kind)
+		}
+	default:
+		return ThrottleKey{}, fmt.Errorf("unknown throttle key %q", s)
+	}
+	if res.Kind == TKHeader {
+		res.Name = http.CanonicalHeaderKey(res.Name)
+	}
+	return res, nil
+}
+
+// ParseBandwidth parses per-route bandwidth limit defined as comma separated list of route=<size> and client=<size>
+// in bytes per second, i.e. "route=10M,client=1M". Leading size without the key is the route limit, i.e. "10M".
+func ParseBandwidth(s string) (res BandwidthLimit, err error) {
+	for i, v := range parseCommaSeparated(s) {
+		key, val, found := strings.Cut(v, "=")
+		if !found && i == 0 {
+			key, val = "route", v
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "route":
+			if res.Route, err = ParseSize(val); err != nil {
+				return BandwidthLimit{}, fmt.Errorf("invalid route bandwidth %q: %w", val, err)
+			}
+		case "client":
+			if res.Client, err = ParseSize(val); err != nil {
+				return BandwidthLimit{}, fmt.Errorf("invalid client bandwidth %q: %w", val, err)
+			}
+		default:
+			return BandwidthLimit{}, fmt.Errorf("unknown bandwidth option %q", v)
+		}
+	}
+	return res, nil
+}
+
+// ParseSize parses size with optional k, m, g or t suffix (case-insensitive, 1024 based), i.e. "64K" or "2G".
+// Empty string is 0. Used for both per-route sizes and size options.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	num, mult := s, int64(1)
+	if i := strings.IndexByte("kmgt", byte(unicode.ToLower(rune(s[len(s)-1])))); i >= 0 {
+		num, mult = s[:len(s)-1], int64(1)<<(10*(i+1))
+	}
+	val, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse size %s: %w", s, err)
+	}
+	if val < 0 {
+		return 0, fmt.Errorf("size must be non-negative, got %s", s)
+	}
+	if val > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %s is too large", s)
+	}
+	return val * mult, nil
+}
+
+// ParseRequiredLabel parses auth or access restriction label, like jwt or waf, with parse func. Unlike other labels,
+// invalid value is an error, not ignored, as the route can't be served without the restriction it defines.
+// Missing label is passed to parse as an empty string.
+func ParseRequiredLabel[T any](label func(name string) string, name string, parse func(string) (T, error)) (T, error) {
+	v := label(name)
+	res, err := parse(v)
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("invalid %s label value %s: %w", name, v, err)
+	}
+	return res, nil
+}
+
+// SplitQuoted splits s by sep, ignoring separators inside double quoted strings. Quotes can be escaped
+// with backslash inside quoted strings. Elements returned as is, not trimmed and including empty ones.
+func SplitQuoted(s string, sep rune) []string {
+	var res []string
+	inQuotes, escaped, start := false, false, 0
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+// splitQuoted splits comma separated list, commas inside double quotes are not separators.
+// Returns trimmed non-empty elements.
+func splitQuoted(s string) (res []string) {
+	for _, v := range SplitQuoted(s, ',') {
+		if trimmed := strings.TrimSpace(v); trimmed != "" {
+			res = append(res, trimmed)
+		}
+	}
+	return res
+}
+
 // parseCommaSeparated splits a comma-separated string and returns trimmed non-empty values
 func parseCommaSeparated(s string) (res []string) {
 	if s == "" {
@@ -817,18 +817,18 @@ func TestService_extendRule(t *testing.T) {
 		{ // simple-extension src must preserve Timeout and Throttle
 			URLMapper{Server: "t.example.com", ProviderID: "file",
 				SrcMatch: *regexp.MustCompile("/api/"), Dst: "http://upstream/",
-				Timeout: 5 * time.Minute, Throttle: 7},
+				Timeout: 5 * time.Minute, Throttle: RateLimit{Rate: 7, Window: time.Minute, Burst: 2}},
 			URLMapper{Server: "t.example.com", ProviderID: "file",
 				SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://upstream/$1",
-				Timeout: 5 * time.Minute, Throttle: 7},
+				Timeout: 5 * time.Minute, Throttle: RateLimit{Rate: 7, Window: time.Minute, Burst: 2}},
 		},
 		{ // non-extension src (already has capture group) also preserves Timeout and Throttle
 			URLMapper{Server: "t.example.com", ProviderID: "file",
 				SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://upstream/$1",
-				Timeout: 30 * time.Second, Throttle: 3},
+				Timeout: 30 * time.Second, Throttle: RateLimit{Rate: 3}},
 			URLMapper{Server: "t.example.com", ProviderID: "file",
 				SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://upstream/$1",
-				Timeout: 30 * time.Second, Throttle: 3},
+				Timeout: 30 * time.Second, Throttle: RateLimit{Rate: 3}},
 		},
 	}
 
@@ -878,6 +878,42 @@ func TestService_redirects(t *testing.T) {
 			URLMapper{Dst: "@blah http://example.com/blah"},
 			URLMapper{Dst: "@blah http://example.com/blah", RedirectType: RTNone},
 		},
+		{
+			URLMapper{Dst: "@307 http://example.com/blah"},
+			URLMapper{Dst: "http://example.com/blah", RedirectType: RTTempKeepMethod},
+		},
+		{
+			URLMapper{Dst: "@308:keep-query http://example.com/blah"},
+			URLMapper{Dst: "http://example.com/blah", RedirectType: RTPermKeepMethod, RedirectQuery: RQKeep},
+		},
+		{
+			URLMapper{Dst: "@perm:drop-query http://example.com/blah?a=1"},
+			URLMapper{Dst: "http://example.com/blah?a=1", RedirectType: RTPerm, RedirectQuery: RQDrop},
+		},
+		{
+			URLMapper{Dst: "@301:host https://example.com"},
+			URLMapper{Dst: "https://example.com", RedirectType: RTPerm, RedirectQuery: RQKeep, RedirectHost: true},
+		},
+		{
+			URLMapper{Dst: "@308:host:drop-query https://example.com"},
+			URLMapper{Dst: "https://example.com", RedirectType: RTPermKeepMethod, RedirectQuery: RQDrop, RedirectHost: true},
+		},
+		{
+			URLMapper{Dst: "@302:host /blah"},
+			URLMapper{Dst: "/blah", RedirectType: RTTemp},
+		},
+		{
+			URLMapper{Dst: "@302:bad http://example.com/blah"},
+			URLMapper{Dst: "http://example.com/blah", RedirectType: RTTemp},
+		},
+		{
+			URLMapper{Dst: "@303 http://example.com/blah"},
+			URLMapper{Dst: "@303 http://example.com/blah", RedirectType: RTNone},
+		},
+		{
+			URLMapper{Dst: "@301 "},
+			URLMapper{Dst: "@301 ", RedirectType: RTNone},
+		},
 	}
 
 	svc := &Service{}
@@ -1081,6 +1117,31 @@ func TestParseOnlyFrom(t *testing.T) {
 	}
 }
 
+func TestParseIPNet(t *testing.T) {
+	tbl := []struct {
+		in, res, err string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", ""},
+		{" 192.168.1.10 ", "192.168.1.10/32", ""},
+		{"10.1.2.3/16", "10.1.0.0/16", ""},
+		{"2001:db8::1", "2001:db8::1/128", ""},
+		{"2001:db8::/32", "2001:db8::/32", ""},
+		{"::ffff:1.2.3.4", "1.2.3.4/32", ""},
+		{"10.0.0.0/33", "", "invalid CIDR address: 10.0.0.0/33"},
+		{"bad", "", "invalid CIDR address: bad/128"},
+		{"", "", "invalid CIDR address: /128"},
+	}
+	for _, tt := range tbl {
+		res, err := ParseIPNet(tt.in)
+		if tt.err != "" {
+			require.EqualError(t, err, tt.err, tt.in)
+			continue
+		}
+		require.NoError(t, err, tt.in)
+		assert.Equal(t, tt.res, res.String(), tt.in)
+	}
+}
+
 func TestParseAuth(t *testing.T) {
 	tbl := []struct {
 		name     string
@@ -1113,3 +1174,707 @@ func TestParseAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAccessLog(t *testing.T) {
+	tbl := []struct {
+		name    string
+		input   string
+		want    AccessLogPolicy
+		wantErr string
+	}{
+		{name: "empty string", input: "", want: AccessLogPolicy{}},
+		{name: "off", input: "off", want: AccessLogPolicy{Disabled: true}},
+		{name: "disabled", input: "disabled", want: AccessLogPolicy{Disabled: true}},
+		{name: "errors only", input: "errors", want: AccessLogPolicy{ErrorsOnly: true}},
+		{name: "slow", input: "slow=1.5s", want: AccessLogPolicy{Slow: 1500 * time.Millisecond}},
+		{name: "sample", input: "sample=0.25", want: AccessLogPolicy{SampleRate: 0.25}},
+		{name: "combined", input: " errors , slow = 1s, sample=0.01 ",
+			want: AccessLogPolicy{ErrorsOnly: true, Slow: time.Second, SampleRate: 0.01}},
+		{name: "bad slow", input: "slow=abc", wantErr: `invalid slow threshold "abc"`},
+		{name: "zero slow", input: "slow=0s", wantErr: `invalid slow threshold "0s"`},
+		{name: "bad sample", input: "sample=1.5", wantErr: `invalid sample ratio "1.5"`},
+		{name: "zero sample", input: "sample=0", wantErr: `invalid sample ratio "0"`},
+		{name: "unknown", input: "errors,blah", wantErr: `unknown access log option "blah"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseAccessLog(tt.input)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tbl := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{" 64K ", 64 * 1024, false},
+		{"64k", 64 * 1024, false},
+		{"10M", 10 * 1024 * 1024, false},
+		{"2G", 2 * 1024 * 1024 * 1024, false},
+		{"1t", 1024 * 1024 * 1024 * 1024, false},
+		{"170g", 170 * 1024 * 1024 * 1024, false},
+		{"17T", 17 * 1024 * 1024 * 1024 * 1024, false},
+		{"abc", 0, true},
+		{"123aT", 0, true},
+		{"123a", 0, true},
+		{"123.45", 0, true},
+		{"10X", 0, true},
+		{"K", 0, true},
+		{"-1", 0, true},
+		{"9999999999999T", 0, true},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.input, func(t *testing.T) {
+			res, err := ParseSize(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestParseConcurrency(t *testing.T) {
+	tbl := []struct {
+		name    string
+		input   string
+		want    ConcurrencyLimit
+		wantErr string
+	}{
+		{name: "empty string", input: "", want: ConcurrencyLimit{}},
+		{name: "max only", input: "10", want: ConcurrencyLimit{MaxInFlight: 10}},
+		{name: "with queue", input: "10, queue=50", want: ConcurrencyLimit{MaxInFlight: 10, Queue: 50}},
+		{name: "with queue and timeout", input: "10,queue=50,timeout=5s",
+			want: ConcurrencyLimit{MaxInFlight: 10, Queue: 50, Timeout: 5 * time.Second}},
+		{name: "bad max", input: "abc", wantErr: `invalid max in-flight requests "abc"`},
+		{name: "negative max", input: "-1", wantErr: `invalid max in-flight requests "-1"`},
+		{name: "bad queue", input: "10,queue=x", wantErr: `invalid queue size "x"`},
+		{name: "bad timeout", input: "10,queue=1,timeout=1", wantErr: `invalid queue timeout "1"`},
+		{name: "unknown", input: "10,blah=1", wantErr: `unknown concurrency option "blah=1"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseConcurrency(tt.input)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestParseThrottleKey(t *testing.T) {
+	tbl := []struct {
+		name    string
+		input   string
+		want    ThrottleKey
+		wantErr string
+	}{
+		{name: "empty string", input: "", want: ThrottleKey{}},
+		{name: "ip", input: "ip", want: ThrottleKey{Kind: TKIP}},
+		{name: "header", input: "header:x-api-key", want: ThrottleKey{Kind: TKHeader, Name: "X-Api-Key"}},
+		{name: "cookie", input: " Cookie: session ", want: ThrottleKey{Kind: TKCookie, Name: "session"}},
+		{name: "basic auth", input: "basic-auth", want: ThrottleKey{Kind: TKBasicAuth}},
+		{name: "jwt claim", input: "jwt:sub", want: ThrottleKey{Kind: TKJWT, Name: "sub"}},
+		{name: "header without name", input: "header", wantErr: `throttle key "header" requires a name`},
+		{name: "jwt without name", input: "jwt:", wantErr: `throttle key "jwt" requires a name`},
+		{name: "ip with name", input: "ip:1.2.3.4", wantErr: `throttle key "ip" doesn't take a name`},
+		{name: "unknown", input: "query:key", wantErr: `unknown throttle key "query:key"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseThrottleKey(tt.input)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestThrottleKey_String(t *testing.T) {
+	assert.Empty(t, ThrottleKey{}.String())
+	assert.Equal(t, "basic-auth", ThrottleKey{Kind: TKBasicAuth}.String())
+	assert.Equal(t, "header:X-Api-Key", ThrottleKey{Kind: TKHeader, Name: "X-Api-Key"}.String())
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tbl := []struct {
+		name    string
+		input   string
+		want    RateLimit
+		wantErr string
+	}{
+		{name: "empty string", input: "", want: RateLimit{}},
+		{name: "rate only", input: "10", want: RateLimit{Rate: 10}},
+		{name: "per second", input: "10/s", want: RateLimit{Rate: 10, Window: time.Second}},
+		{name: "per minute with burst", input: "100/m burst 20", want: RateLimit{Rate: 100, Window: time.Minute, Burst: 20}},
+		{name: "per hour", input: " 1000/hour ", want: RateLimit{Rate: 1000, Window: time.Hour}},
+		{name: "duration window", input: "50/10s BURST 5", want: RateLimit{Rate: 50, Window: 10 * time.Second, Burst: 5}},
+		{name: "burst without window", input: "5 burst 10", want: RateLimit{Rate: 5, Burst: 10}},
+		{name: "bad rate", input: "abc", wantErr: `invalid rate "abc"`},
+		{name: "negative rate", input: "-1", wantErr: `invalid rate "-1"`},
+		{name: "bad window", input: "10/week", wantErr: `invalid rate window "week"`},
+		{name: "zero window", input: "10/0s", wantErr: `invalid rate window "0s"`},
+		{name: "bad burst", input: "10/m burst x", wantErr: `invalid burst "x"`},
+		{name: "burst without value", input: "10/m burst", wantErr: `unknown rate limit options "burst"`},
+		{name: "unknown option", input: "10/m boost 5", wantErr: `unknown rate limit options "boost 5"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseRateLimit(tt.input)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tbl := []struct {
+		limit     RateLimit
+		perSecond float64
+		burst     int
+		str       string
+	}{
+		{RateLimit{Rate: 10}, 10, 10, "10"},
+		{RateLimit{Rate: 10, Window: time.Second}, 10, 10, "10"},
+		{RateLimit{Rate: 120, Window: time.Minute, Burst: 20}, 2, 20, "120/1m0s burst 20"},
+		{RateLimit{Rate: 5, Burst: 1}, 5, 1, "5 burst 1"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.str, func(t *testing.T) {
+			assert.InDelta(t, tt.perSecond, tt.limit.PerSecond(), 0.0001)
+			assert.Equal(t, tt.burst, tt.limit.BurstSize())
+			assert.Equal(t, tt.str, tt.limit.String())
+			parsed, err := ParseRateLimit(tt.limit.String())
+			require.NoError(t, err)
+			assert.Equal(t, tt.limit.PerSecond(), parsed.PerSecond(), "string form parsed back")
+		})
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	tbl := []struct {
+		name    string
+		input   string
+		want    BandwidthLimit
+		wantErr string
+	}{
+		{name: "empty string", input: "", want: BandwidthLimit{}},
+		{name: "route only", input: "10M", want: BandwidthLimit{Route: 10 << 20}},
+		{name: "route key", input: "route=512k", want: BandwidthLimit{Route: 512 << 10}},
+		{name: "client only", input: "client=1M", want: BandwidthLimit{Client: 1 << 20}},
+		{name: "route and client", input: "10M, client=1M", want: BandwidthLimit{Route: 10 << 20, Client: 1 << 20}},
+		{name: "keys in any order", input: "client=100, route=1000", want: BandwidthLimit{Route: 1000, Client: 100}},
+		{name: "bad route", input: "10X", wantErr: `invalid route bandwidth "10X"`},
+		{name: "bad client", input: "client=-1", wantErr: `invalid client bandwidth "-1"`},
+		{name: "bare size not first", input: "client=1M,10M", wantErr: `unknown bandwidth option "10M"`},
+		{name: "unknown", input: "10M,server=1M", wantErr: `unknown bandwidth option "server=1M"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseBandwidth(tt.input)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestParseCanonicalHost(t *testing.T) {
+	tbl := []struct {
+		input   string
+		want    CanonicalHost
+		wantErr string
+	}{
+		{input: "", want: CanonicalHost{}},
+		{input: "apex", want: CanonicalHost{Host: HPApex}},
+		{input: "WWW, lowercase", want: CanonicalHost{Host: HPWWW, Lowercase: true}},
+		{input: "slash=add", want: CanonicalHost{Slash: SPAdd}},
+		{input: "apex,slash=strip,apex", want: CanonicalHost{Host: HPApex, Slash: SPStrip}},
+		{input: "lowercase,slash=ignore", want: CanonicalHost{Lowercase: true}},
+		{input: "www,apex", wantErr: `both www and apex set in "www,apex"`},
+		{input: "slash=both", wantErr: `invalid slash policy "both", should be add, strip or ignore`},
+		{input: "slash", wantErr: `invalid slash policy "", should be add, strip or ignore`},
+		{input: "upper", wantErr: `unknown canonical option "upper"`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.input, func(t *testing.T) {
+			res, err := ParseCanonicalHost(tt.input)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
+
+func TestService_CanonicalHost(t *testing.T) {
+	svc := &Service{}
+	_, ok := svc.CanonicalHost("example.com")
+	assert.False(t, ok, "no policies")
+
+	svc.canonical = map[string]CanonicalHost{}
+	svc.setCanonical(URLMapper{Server: "Example.com", Canonical: CanonicalHost{Host: HPApex, Slash: SPStrip}})
+	svc.setCanonical(URLMapper{Server: "example.com", Canonical: CanonicalHost{Host: HPWWW}}) // conflict, ignored
+	svc.setCanonical(URLMapper{Server: "www.example.org", Canonical: CanonicalHost{Host: HPWWW}})
+	svc.setCanonical(URLMapper{Server: "app.example.net", Canonical: CanonicalHost{Host: HPApex}})
+	svc.setCanonical(URLMapper{Server: "other.example.com"})
+
+	tbl := []struct {
+		host string
+		want CanonicalHost
+		ok   bool
+	}{
+		{"example.com", CanonicalHost{Host: HPApex, Slash: SPStrip}, true},
+		{"www.example.com", CanonicalHost{Host: HPApex, Slash: SPStrip}, true},
+		{"example.org", CanonicalHost{Host: HPWWW}, true},
+		{"www.example.org", CanonicalHost{Host: HPWWW}, true},
+		{"www.app.example.net", CanonicalHost{Host: HPApex}, true},
+		{"app.example.net", CanonicalHost{Host: HPApex}, true},
+		{"www.www.example.org", CanonicalHost{}, false},
+		{"other.example.com", CanonicalHost{}, false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.host, func(t *testing.T) {
+			res, found := svc.CanonicalHost(tt.host)
+			assert.Equal(t, tt.ok, found)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+
+	svc.setCanonical(URLMapper{Server: "*", Canonical: CanonicalHost{Host: HPWWW, Lowercase: true}})
+	res, found := svc.CanonicalHost("other.example.com")
+	assert.True(t, found)
+	assert.Equal(t, CanonicalHost{Lowercase: true}, res, "default server policy, without www")
+	res, found = svc.CanonicalHost("example.com")
+	assert.True(t, found)
+	assert.Equal(t, CanonicalHost{Host: HPApex, Slash: SPStrip}, res, "own policy of the host")
+
+	svc.canonical = map[string]CanonicalHost{}
+	svc.setCanonical(URLMapper{Server: "*", Canonical: CanonicalHost{Host: HPWWW}})
+	_, found = svc.CanonicalHost("api.example.com")
+	assert.False(t, found, "www policy of default server not applied to other hosts")
+}
+
+func TestParseSecurityHeaders(t *testing.T) {
+	tbl := []struct {
+		input   string
+		want    SecurityHeaders
+		wantErr string
+	}{
+		{input: "", want: SecurityHeaders{}},
+		{input: "strict", want: SecurityHeaders{Preset: SHStrict}},
+		{input: "None", want: SecurityHeaders{Preset: SHOff}},
+		{input: "basic, -hsts, frame=DENY", want: SecurityHeaders{Preset: SHBasic, Drop: []string{"Strict-Transport-Security"},
+			Set: map[string]string{"X-Frame-Options": "DENY"}}},
+		{input: `strict,report-only,csp="default-src 'self'; img-src *",permissions="camera=(), geolocation=()"`,
+			want: SecurityHeaders{Preset: SHStrict, ReportOnly: true, Set: map[string]string{
+				"Content-Security-Policy": "default-src 'self'; img-src *", "Permissions-Policy": "camera=(), geolocation=()"}}},
+		{input: "-CSP,-coop", want: SecurityHeaders{Drop: []string{"Content-Security-Policy", "Cross-Origin-Opener-Policy"}}},
+		{input: "paranoid", wantErr: `unknown security headers option "paranoid"`},
+		{input: "x-custom=1", wantErr: `unknown security header "x-custom"`},
+		{input: "-server", wantErr: `unknown security header "server"`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.input, func(t *testing.T) {
+			res, err := ParseSecurityHeaders(tt.input)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+			assert.Equal(t, tt.input == "", res.IsZero())
+		})
+	}
+}
+
+func TestParseCORS(t *testing.T) {
+	res, err := ParseCORS("")
+	require.NoError(t, err)
+	assert.False(t, res.Enabled())
+
+	res, err = ParseCORS(`origins=https://app.example.com *.example.org ~^https://pr-[0-9]+\.example\.net$, methods=get put,` +
+		` headers=Content-Type Authorization, expose=X-Total, credentials, max-age=10m, override`)
+	require.NoError(t, err)
+	assert.True(t, res.Enabled())
+	assert.Equal(t, []string{"https://app.example.com", "*.example.org", `~^https://pr-[0-9]+\.example\.net$`}, res.Origins)
+	assert.Equal(t, []string{"GET", "PUT"}, res.Methods)
+	assert.Equal(t, []string{"Content-Type", "Authorization"}, res.Headers)
+	assert.Equal(t, []string{"X-Total"}, res.Expose)
+	assert.True(t, res.Credentials)
+	assert.True(t, res.Override)
+	assert.Equal(t, 10*time.Minute, res.MaxAge)
+
+	res, err = ParseCORS(`origins="https://a.example.com ~^https://pr-[0-9]{1,4}\.example\.net$"`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET", "HEAD", "POST"}, res.Methods, "default methods")
+	assert.True(t, res.AllowOrigin("https://pr-123.example.net"))
+
+	for input, wantErr := range map[string]string{
+		"methods=GET":             `no origins in cors policy "methods=GET"`,
+		"origins=*, max-age=long": `invalid max-age "long"`,
+		"origins=*, max-age=-1s":  `invalid max-age "-1s"`,
+		"origins=*, cookies":      `unknown cors option "cookies"`,
+		"origins=~^https://(bad$": "invalid origin regex",
+	} {
+		_, err = ParseCORS(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	res, err := ParseJWT("")
+	require.NoError(t, err)
+	assert.False(t, res.Enabled)
+
+	res, err = ParseJWT("on")
+	require.NoError(t, err)
+	assert.Equal(t, JWTPolicy{Enabled: true}, res)
+
+	res, err = ParseJWT("iss=https://idp.example.com, aud=api web, claim=role:admin editor, claim=email_verified," +
+		" forward=sub:x-user-id email:X-Email")
+	require.NoError(t, err)
+	assert.Equal(t, JWTPolicy{Enabled: true, Issuer: "https://idp.example.com", Audience: []string{"api", "web"},
+		Claims:  []JWTClaimRule{{Name: "role", Values: []string{"admin", "editor"}}, {Name: "email_verified", Values: []string{}}},
+		Forward: []JWTForwardedClaim{{Claim: "sub", Header: "X-User-Id"}, {Claim: "email", Header: "X-Email"}}}, res)
+
+	for input, wantErr := range map[string]string{
+		"iss=":                `empty issuer in "iss="`,
+		"claim=:admin":        `empty claim name in "claim=:admin"`,
+		"forward=sub":         `invalid forwarded claim "sub", should be claim:header`,
+		"aud=api, secret=abc": `unknown jwt option "secret=abc"`,
+	} {
+		_, err = ParseJWT(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseForwardAuth(t *testing.T) {
+	res, err := ParseForwardAuth("")
+	require.NoError(t, err)
+	assert.False(t, res.Enabled())
+
+	res, err = ParseForwardAuth("http://auth:8080/verify?app=1")
+	require.NoError(t, err)
+	assert.Equal(t, ForwardAuth{URL: "http://auth:8080/verify?app=1", Headers: []string{"Authorization", "Cookie"}}, res)
+
+	res, err = ParseForwardAuth("url=https://sso.example.com/auth, headers=cookie x-api-key, copy=x-user X-Email," +
+		" cache=30s, timeout=2s")
+	require.NoError(t, err)
+	assert.True(t, res.Enabled())
+	assert.Equal(t, ForwardAuth{URL: "https://sso.example.com/auth", Headers: []string{"Cookie", "X-Api-Key"},
+		Copy: []string{"X-User", "X-Email"}, CacheTTL: 30 * time.Second, Timeout: 2 * time.Second}, res)
+
+	for input, wantErr := range map[string]string{
+		"copy=X-User":                     `no url in forward auth "copy=X-User"`,
+		"url=auth:8080/verify":            `invalid forward auth url "auth:8080/verify"`,
+		"url=ftp://auth/verify":           `invalid forward auth url "ftp://auth/verify"`,
+		"http://auth/verify, cache=long":  `invalid cache "long"`,
+		"http://auth/verify, timeout=-1s": `invalid timeout "-1s"`,
+		"http://auth/verify, method=POST": `unknown forward auth option "method=POST"`,
+	} {
+		_, err = ParseForwardAuth(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseOIDC(t *testing.T) {
+	res, err := ParseOIDC("")
+	require.NoError(t, err)
+	assert.Equal(t, OIDCPolicy{}, res)
+
+	res, err = ParseOIDC("on")
+	require.NoError(t, err)
+	assert.Equal(t, OIDCPolicy{Enabled: true}, res)
+
+	res, err = ParseOIDC("users=alice bob, emails=@example.com carol@partner.com, groups=admins, groups=ops")
+	require.NoError(t, err)
+	assert.Equal(t, OIDCPolicy{Enabled: true, Users: []string{"alice", "bob"},
+		Emails: []string{"@example.com", "carol@partner.com"}, Groups: []string{"admins", "ops"}}, res)
+
+	for input, wantErr := range map[string]string{
+		"users=":        `empty users in "users="`,
+		"on, groups= ":  `empty groups in "groups="`,
+		"roles=admin":   `unknown oidc option "roles=admin"`,
+		"emails=a, off": `unknown oidc option "off"`,
+	} {
+		_, err = ParseOIDC(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseAPIKey(t *testing.T) {
+	res, err := ParseAPIKey("")
+	require.NoError(t, err)
+	assert.Equal(t, APIKeyPolicy{}, res)
+
+	res, err = ParseAPIKey("on")
+	require.NoError(t, err)
+	assert.Equal(t, APIKeyPolicy{Enabled: true, Header: "X-Api-Key", Forward: "X-Api-Client"}, res)
+
+	res, err = ParseAPIKey("header=x-token, query=api_key, clients=billing reports, forward=x-client-name")
+	require.NoError(t, err)
+	assert.Equal(t, APIKeyPolicy{Enabled: true, Header: "X-Token", Query: "api_key", Clients: []string{"billing", "reports"},
+		Forward: "X-Client-Name"}, res)
+
+	for input, wantErr := range map[string]string{
+		"header=":       `invalid header ""`,
+		"query=api key": `invalid query "api key"`,
+		"on, clients=":  `empty clients in "clients="`,
+		"hash=sha256":   `unknown api key option "hash=sha256"`,
+	} {
+		_, err = ParseAPIKey(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseGeoIP(t *testing.T) {
+	res, err := ParseGeoIP("")
+	require.NoError(t, err)
+	assert.Equal(t, GeoIPPolicy{}, res)
+
+	res, err = ParseGeoIP("allow=us ca, deny=RU, allow-asn=AS15169 64500, deny-asn=as64501")
+	require.NoError(t, err)
+	assert.Equal(t, GeoIPPolicy{Enabled: true, AllowCountries: []string{"US", "CA"}, DenyCountries: []string{"RU"},
+		AllowASN: []uint{15169, 64500}, DenyASN: []uint{64501}}, res)
+
+	res, err = ParseGeoIP(`deny="CN KP"`)
+	require.NoError(t, err)
+	assert.Equal(t, GeoIPPolicy{Enabled: true, DenyCountries: []string{"CN", "KP"}}, res)
+
+	for input, wantErr := range map[string]string{
+		"allow=":              `empty geoip option "allow="`,
+		"allow=USA":           `invalid country code "USA"`,
+		"deny=U1":             `invalid country code "U1"`,
+		"allow-asn=google":    `invalid asn "google"`,
+		"deny-asn=0":          `invalid asn "0"`,
+		"deny-asn=4294967296": `invalid asn "4294967296"`,
+		"country=US":          `unknown geoip option "country=US"`,
+	} {
+		_, err = ParseGeoIP(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseWAF(t *testing.T) {
+	res, err := ParseWAF("")
+	require.NoError(t, err)
+	assert.Equal(t, WAFPolicy{}, res)
+
+	res, err = ParseWAF("sets=wordpress api, skip-global")
+	require.NoError(t, err)
+	assert.Equal(t, WAFPolicy{Sets: []string{"wordpress", "api"}, SkipGlobal: true}, res)
+
+	res, err = ParseWAF(`sets="scanners"`)
+	require.NoError(t, err)
+	assert.Equal(t, WAFPolicy{Sets: []string{"scanners"}}, res)
+
+	for input, wantErr := range map[string]string{
+		"sets=":    `empty sets in "sets="`,
+		"rules=a":  `unknown waf option "rules=a"`,
+		"disabled": `unknown waf option "disabled"`,
+	} {
+		_, err = ParseWAF(input)
+		require.ErrorContains(t, err, wantErr, input)
+	}
+}
+
+func TestParseRequiredLabel(t *testing.T) {
+	labels := map[string]string{"jwt": "iss=https://idp.example.com, aud=api", "waf": "off"}
+	label := func(name string) string { return labels[name] }
+
+	res, err := ParseRequiredLabel(label, "jwt", ParseJWT)
+	require.NoError(t, err)
+	assert.Equal(t, JWTPolicy{Enabled: true, Issuer: "https://idp.example.com", Audience: []string{"api"}}, res)
+
+	res, err = ParseRequiredLabel(label, "oidc", ParseJWT)
+	require.NoError(t, err, "missing label is not an error")
+	assert.False(t, res.Enabled)
+
+	waf, err := ParseRequiredLabel(label, "waf", ParseWAF)
+	require.ErrorContains(t, err, "invalid waf label value off")
+	assert.Equal(t, WAFPolicy{}, waf)
+}
+
+func TestSplitQuoted(t *testing.T) {
+	tbl := []struct {
+		in  string
+		sep rune
+		res []string
+	}{
+		{"", ',', []string{""}},
+		{"a, b,,c", ',', []string{"a", " b", "", "c"}},
+		{`a="x, y", b`, ',', []string{`a="x, y"`, " b"}},
+		{`a="x\", y", b`, ',', []string{`a="x\", y"`, " b"}},
+		{`for=1.2.3.4;proto="a;b";host=x`, ';', []string{"for=1.2.3.4", `proto="a;b"`, "host=x"}},
+		{`a\,b`, ',', []string{`a\`, "b"}},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, SplitQuoted(tt.in, tt.sep), tt.in)
+	}
+
+	assert.Equal(t, []string{"a", `b="x, y"`}, splitQuoted(` a , ,b="x, y" `))
+	assert.Nil(t, splitQuoted(" "))
+}
+
+func TestGeoIPPolicy_Allow(t *testing.T) {
+	assert.True(t, GeoIPPolicy{Enabled: true}.Allow("", 0), "no lists, anyone allowed")
+
+	tbl := []struct {
+		name    string
+		policy  GeoIPPolicy
+		country string
+		asn     uint
+		want    bool
+	}{
+		{"deny country", GeoIPPolicy{DenyCountries: []string{"RU"}}, "RU", 1, false},
+		{"not denied country", GeoIPPolicy{DenyCountries: []string{"RU"}}, "US", 1, true},
+		{"unknown not denied", GeoIPPolicy{DenyCountries: []string{"RU"}, DenyASN: []uint{5}}, "", 0, true},
+		{"deny asn", GeoIPPolicy{DenyASN: []uint{5}}, "US", 5, false},
+		{"allow country", GeoIPPolicy{AllowCountries: []string{"US", "CA"}}, "CA", 0, true},
+		{"not allowed country", GeoIPPolicy{AllowCountries: []string{"US", "CA"}}, "DE", 0, false},
+		{"unknown not allowed", GeoIPPolicy{AllowCountries: []string{"US"}}, "", 0, false},
+		{"allow asn", GeoIPPolicy{AllowCountries: []string{"US"}, AllowASN: []uint{5}}, "DE", 5, true},
+		{"deny wins", GeoIPPolicy{AllowCountries: []string{"US"}, DenyASN: []uint{5}}, "US", 5, false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Allow(tt.country, tt.asn))
+		})
+	}
+}
+
+func TestOIDCPolicy_Allow(t *testing.T) {
+	assert.True(t, OIDCPolicy{Enabled: true}.Allow("anyone", "", nil), "no lists, any user allowed")
+
+	policy := OIDCPolicy{Enabled: true, Users: []string{"alice"}, Emails: []string{"@example.com", "*@corp.example.org",
+		"Bob@Partner.com"}, Groups: []string{"admins"}}
+	tbl := []struct {
+		user, email string
+		groups      []string
+		want        bool
+	}{
+		{"alice", "", nil, true},
+		{"Alice", "", nil, false},
+		{"u1", "u1@example.com", nil, true},
+		{"u1", "u1@EXAMPLE.com", nil, true},
+		{"u1", "u1@sub.example.com", nil, false},
+		{"u1", "u1@corp.example.org", nil, true},
+		{"u1", "bob@partner.com", nil, true},
+		{"u1", "alice@partner.com", nil, false},
+		{"u1", "example.com", nil, false},
+		{"u1", "", []string{"dev", "admins"}, true},
+		{"u1", "", []string{"dev"}, false},
+		{"", "", nil, false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.want, policy.Allow(tt.user, tt.email, tt.groups), "%s %s %v", tt.user, tt.email, tt.groups)
+	}
+}
+
+func TestCORSPolicy_Allow(t *testing.T) {
+	policy, err := ParseCORS(`origins=https://app.example.com *.example.org https://*.example.net:8443 ~^https://pr-\d+\.example\.io$,` +
+		` methods=GET POST, headers=Content-Type X-Api-Key`)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.example.com", true},
+		{"https://app.example.com:8080", false},
+		{"https://evil.com", false},
+		{"", false},
+		{"https://a.example.org", true},
+		{"http://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://a.example.org.evil.com", false},
+		{"https://evil.com/.example.org", false},
+		{"https://a.example.net:8443", true},
+		{"http://a.example.net:8443", false},
+		{"https://a.example.net", false},
+		{"https://pr-42.example.io", true},
+		{"https://pr-x.example.io", false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.want, policy.AllowOrigin(tt.origin), tt.origin)
+	}
+
+	assert.True(t, policy.AllowMethod("post"))
+	assert.False(t, policy.AllowMethod("DELETE"))
+	assert.True(t, policy.AllowHeader("x-api-key"))
+	assert.False(t, policy.AllowHeader("X-Other"))
+	assert.False(t, policy.AnyOrigin())
+
+	anyOrigin, err := ParseCORS("origins=*")
+	require.NoError(t, err)
+	assert.True(t, anyOrigin.AnyOrigin())
+	assert.True(t, anyOrigin.AllowOrigin("https://evil.com"))
+	assert.True(t, anyOrigin.AllowHeader("X-Anything"), "any header allowed without headers list")
+}
+
+func TestParseErrorFormat(t *testing.T) {
+	tbl := []struct {
+		input   string
+		want    ErrorFormat
+		wantErr bool
+	}{
+		{"", EFAuto, false},
+		{"auto", EFAuto, false},
+		{"html", EFHTML, false},
+		{" JSON ", EFJSON, false},
+		{"Text", EFText, false},
+		{"xml", EFAuto, true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.input, func(t *testing.T) {
+			res, err := ParseErrorFormat(tt.input)
+			if tt.wantErr {
+				require.EqualError(t, err, `unknown error format "`+tt.input+`"`)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, res)
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -225,19 +224,90 @@ func (cc *ConsulCatalog) List() ([]discovery.URLMapper, error) {
 			}
 		}
 
-		throttle := 0
+		var throttle discovery.RateLimit
 		if v, ok := c.Labels["reproxy.throttle"]; ok && v != "" {
-			num, perr := strconv.Atoi(v)
-			switch {
-			case perr != nil:
-				log.Printf("[WARN] throttle label value %s is not valid, ignoring", v)
-			case num < 0:
-				log.Printf("[WARN] throttle label value %s is negative, ignoring", v)
-			default:
-				throttle = num
+			limit, perr := discovery.ParseRateLimit(v)
+			if perr != nil {
+				log.Printf("[WARN] throttle label value %s is not valid, ignoring: %v", v, perr)
+			} else {
+				throttle = limit
+			}
+		}
+
+		var throttleKey discovery.ThrottleKey
+		if v, ok := c.Labels["reproxy.throttle-key"]; ok && v != "" {
+			key, perr := discovery.ParseThrottleKey(v)
+			if perr != nil {
+				log.Printf("[WARN] throttle-key label value %s is not valid, ignoring: %v", v, perr)
+			} else {
+				throttleKey = key
+			}
+		}
+
+		var maxBody int64
+		if v, ok := c.Labels["reproxy.max-body"]; ok && v != "" {
+			size, perr := discovery.ParseSize(v)
+			if perr != nil {
+				log.Printf("[WARN] max-body label value %s is not valid, ignoring: %v", v, perr)
+			} else {
+				maxBody = size
+			}
+		}
+
+		var concurrency discovery.ConcurrencyLimit
+		if v, ok := c.Labels["reproxy.concurrency"]; ok && v != "" {
+			limit, perr := discovery.ParseConcurrency(v)
+			if perr != nil {
+				log.Printf("[WARN] concurrency label value %s is not valid, ignoring: %v", v, perr)
+			} else {
+				concurrency = limit
+			}
+		}
+
+		var bandwidth discovery.BandwidthLimit
+		if v, ok := c.Labels["reproxy.bandwidth"]; ok && v != "" {
+			limit, perr := discovery.ParseBandwidth(v)
+			if perr != nil {
+				log.Printf("[WARN] bandwidth label value %s is not valid, ignoring: %v", v, perr)
+			} else {
+				bandwidth = limit
 			}
 		}
 
+		errorFormat, perr := discovery.ParseErrorFormat(c.Labels["reproxy.error-format"])
+		if perr != nil {
+			log.Printf("[WARN] error-format label value %s is not valid, ignoring: %v", c.Labels["reproxy.error-format"], perr)
+		}
+
+		canonical, perr := discovery.ParseCanonicalHost(c.Labels["reproxy.canonical"])
+		if perr != nil {
+			log.Printf("[WARN] canonical label value %s is not valid, ignoring: %v", c.Labels["reproxy.canonical"], perr)
+		}
+
+		securityHeaders, perr := discovery.ParseSecurityHeaders(c.Labels["reproxy.security-headers"])
+		if perr != nil {
+			log.Printf("[WARN] security-headers label value %s is not valid, ignoring: %v", c.Labels["reproxy.security-headers"], perr)
+		}
+
+		cors, perr := discovery.ParseCORS(c.Labels["reproxy.cors"])
+		if perr != nil {
+			log.Printf("[WARN] cors label value %s is not valid, ignoring: %v", c.Labels["reproxy.cors"], perr)
+		}
+
+		label := func(name string) string { return c.Labels["reproxy."+name] }
+		jwtPolicy, jwtErr := discovery.ParseRequiredLabel(label, "jwt", discovery.ParseJWT)
+		forwardAuth, forwardAuthErr := discovery.ParseRequiredLabel(label, "forward-auth", discovery.ParseForwardAuth)
+		oidcPolicy, oidcErr := discovery.ParseRequiredLabel(label, "oidc", discovery.ParseOIDC)
+		apiKey, apiKeyErr := discovery.ParseRequiredLabel(label, "api-key", discovery.ParseAPIKey)
+		geoIP, geoIPErr := discovery.ParseRequiredLabel(label, "geoip", discovery.ParseGeoIP)
+		wafPolicy, wafErr := discovery.ParseRequiredLabel(label, "waf", discovery.ParseWAF)
+
+		// invalid auth or access restriction labels disable the service instead of serving it unprotected
+		if err := errors.Join(jwtErr, forwardAuthErr, oidcErr, apiKeyErr, geoIPErr, wafErr); err != nil {
+			log.Printf("[ERROR] service %s disabled, %v", c.ServiceID, err)
+			continue
+		}
+
 		srcRegex, err := regexp.Compile(srcURL)
 		if err != nil {
 			return nil, fmt.Errorf("invalid src regex %s: %w", srcURL, err)
@@ -248,7 +318,11 @@ func (cc *ConsulCatalog) List() ([]discovery.URLMapper, error) {
 			res = append(res, discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex, Dst: destURL,
 				PingURL: pingURL, ProviderID: discovery.PIConsulCatalog, KeepHost: keepHost,
 				ForwardHealthChecks: forwardHealthChecks, OnlyFromIPs: onlyFrom, AuthUsers: authUsers,
-				Timeout: timeout, Throttle: throttle})
+				Timeout: timeout, Throttle: throttle, ThrottleKey: throttleKey, MaxBodySize: maxBody, Concurrency: concurrency,
+				Bandwidth: bandwidth, ErrorPages: c.Labels["reproxy.error-pages"],
+				ErrorFormat: errorFormat, Canonical: canonical, SecurityHeaders: securityHeaders,
+				CORS: cors, JWT: jwtPolicy, ForwardAuth: forwardAuth, OIDC: oidcPolicy, APIKey: apiKey,
+				AuthFile: strings.TrimSpace(c.Labels["reproxy.auth-file"]), GeoIP: geoIP, WAF: wafPolicy})
 		}
 	}
 
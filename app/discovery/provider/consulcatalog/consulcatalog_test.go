@@ -94,7 +94,8 @@ func TestConsulCatalog_List(t *testing.T) {
 				ServiceAddress: "adr7",
 				ServicePort:    7000,
 				Labels: map[string]string{"reproxy.route": "^/secure/(.*)", "reproxy.dest": "/$1",
-					"reproxy.server": "secure.example.com", "reproxy.auth": "user1:$2y$05$hash1, user2:$2y$05$hash2"},
+					"reproxy.server": "secure.example.com", "reproxy.auth": "user1:$2y$05$hash1, user2:$2y$05$hash2",
+					"reproxy.auth-file": "admins"},
 			},
 		}, nil
 	}}
@@ -120,6 +121,8 @@ func TestConsulCatalog_List(t *testing.T) {
 	assert.Equal(t, (*bool)(nil), res[0].KeepHost)
 	assert.Equal(t, []string{}, res[0].OnlyFromIPs)
 	assert.Equal(t, []string{"user1:$2y$05$hash1", "user2:$2y$05$hash2"}, res[0].AuthUsers)
+	assert.Equal(t, "admins", res[0].AuthFile)
+	assert.Empty(t, res[1].AuthFile)
 
 	// res[1]: example.com with remote IPs
 	assert.Equal(t, "^/api/123/(.*)", res[1].SrcMatch.String())
@@ -178,7 +181,7 @@ func TestConsulCatalog_List(t *testing.T) {
 	for i := range 7 {
 		assert.False(t, res[i].ForwardHealthChecks, "route %d should not have forward-health-checks", i)
 		assert.Equal(t, time.Duration(0), res[i].Timeout, "route %d should not have timeout", i)
-		assert.Equal(t, 0, res[i].Throttle, "route %d should not have throttle", i)
+		assert.Equal(t, 0, res[i].Throttle.Rate, "route %d should not have throttle", i)
 	}
 }
 
@@ -316,21 +319,21 @@ func TestConsulCatalog_ListTimeoutThrottle(t *testing.T) {
 	}
 
 	assert.Equal(t, 5*time.Minute, byServer["v.example.com"].Timeout)
-	assert.Equal(t, 10, byServer["v.example.com"].Throttle)
+	assert.Equal(t, 10, byServer["v.example.com"].Throttle.Rate)
 
 	assert.Equal(t, time.Duration(0), byServer["bd.example.com"].Timeout)
-	assert.Equal(t, 0, byServer["bd.example.com"].Throttle)
+	assert.Equal(t, 0, byServer["bd.example.com"].Throttle.Rate)
 
 	assert.Equal(t, time.Duration(0), byServer["nd.example.com"].Timeout)
 
-	assert.Equal(t, 0, byServer["bt.example.com"].Throttle)
-	assert.Equal(t, 0, byServer["nt.example.com"].Throttle)
+	assert.Equal(t, 0, byServer["bt.example.com"].Throttle.Rate)
+	assert.Equal(t, 0, byServer["nt.example.com"].Throttle.Rate)
 
 	assert.Equal(t, time.Duration(0), byServer["e.example.com"].Timeout)
-	assert.Equal(t, 0, byServer["e.example.com"].Throttle)
+	assert.Equal(t, 0, byServer["e.example.com"].Throttle.Rate)
 
 	assert.Equal(t, time.Duration(0), byServer["n.example.com"].Timeout)
-	assert.Equal(t, 0, byServer["n.example.com"].Throttle)
+	assert.Equal(t, 0, byServer["n.example.com"].Throttle.Rate)
 }
 
 func TestConsulCatalog_serviceListWasChanged(t *testing.T) {
@@ -546,3 +549,109 @@ func TestConsulCatalog_Events(t *testing.T) {
 	require.NoError(t, err)
 	assert.Len(t, list, 1)
 }
+
+func TestConsulCatalog_ListLimits(t *testing.T) {
+	clientMock := &ConsulClientMock{GetFunc: func() ([]consulService, error) {
+		return []consulService{
+			{
+				ServiceID: "valid", ServiceName: "valid", ServiceAddress: "addr-v", ServicePort: 9000,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "v.example.com", "reproxy.max-body": "2G",
+					"reproxy.concurrency": "10,queue=20,timeout=3s", "reproxy.throttle-key": "header:X-API-Key",
+					"reproxy.throttle": "100/m burst 20", "reproxy.bandwidth": "10M,client=1M",
+					"reproxy.error-pages": "/srv/errors/v", "reproxy.error-format": "json",
+					"reproxy.canonical": "www,slash=add", "reproxy.security-headers": "strict,report-only",
+					"reproxy.cors": "origins=*, max-age=1h", "reproxy.jwt": "iss=https://idp.example.com",
+					"reproxy.forward-auth": "http://auth:8080/verify", "reproxy.oidc": "groups=admins",
+					"reproxy.api-key": "query=key", "reproxy.geoip": "allow=US CA", "reproxy.waf": "sets=api"},
+			},
+			{
+				ServiceID: "bad", ServiceName: "bad", ServiceAddress: "addr-b", ServicePort: 9001,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "b.example.com", "reproxy.max-body": "big",
+					"reproxy.concurrency": "ten", "reproxy.throttle-key": "query:key",
+					"reproxy.bandwidth": "fast", "reproxy.error-format": "xml", "reproxy.canonical": "mixed",
+					"reproxy.security-headers": "paranoid", "reproxy.cors": "origins=*, max-age=forever"},
+			},
+			{
+				ServiceID: "bad-jwt", ServiceName: "bad-jwt", ServiceAddress: "addr-bj", ServicePort: 9003,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "bj.example.com", "reproxy.jwt": "iss="},
+			},
+			{
+				ServiceID: "bad-forward-auth", ServiceName: "bad-forward-auth", ServiceAddress: "addr-bf", ServicePort: 9004,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "bf.example.com", "reproxy.forward-auth": "auth:8080"},
+			},
+			{
+				ServiceID: "bad-oidc", ServiceName: "bad-oidc", ServiceAddress: "addr-bo", ServicePort: 9005,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "bo.example.com", "reproxy.oidc": "roles=x"},
+			},
+			{
+				ServiceID: "bad-api-key", ServiceName: "bad-api-key", ServiceAddress: "addr-ba", ServicePort: 9006,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "ba.example.com", "reproxy.api-key": "header="},
+			},
+			{
+				ServiceID: "bad-geoip", ServiceName: "bad-geoip", ServiceAddress: "addr-bg", ServicePort: 9007,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "bg.example.com", "reproxy.geoip": "allow=USA"},
+			},
+			{
+				ServiceID: "bad-waf", ServiceName: "bad-waf", ServiceAddress: "addr-bw", ServicePort: 9008,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "bw.example.com", "reproxy.waf": "sets="},
+			},
+			{
+				ServiceID: "none", ServiceName: "none", ServiceAddress: "addr-n", ServicePort: 9002,
+				Labels: map[string]string{"reproxy.enabled": "true", "reproxy.server": "n.example.com"},
+			},
+		}, nil
+	}}
+
+	cc := &ConsulCatalog{client: clientMock}
+	res, err := cc.List()
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+
+	byServer := map[string]discovery.URLMapper{}
+	for _, r := range res {
+		byServer[r.Server] = r
+	}
+	assert.Equal(t, int64(2<<30), byServer["v.example.com"].MaxBodySize)
+	assert.Equal(t, int64(0), byServer["b.example.com"].MaxBodySize, "invalid value ignored")
+	assert.Equal(t, int64(0), byServer["n.example.com"].MaxBodySize)
+
+	assert.Equal(t, discovery.ConcurrencyLimit{MaxInFlight: 10, Queue: 20, Timeout: 3 * time.Second},
+		byServer["v.example.com"].Concurrency)
+	assert.Equal(t, discovery.ConcurrencyLimit{}, byServer["b.example.com"].Concurrency, "invalid value ignored")
+	assert.Equal(t, discovery.ConcurrencyLimit{}, byServer["n.example.com"].Concurrency)
+
+	assert.Equal(t, discovery.ThrottleKey{Kind: discovery.TKHeader, Name: "X-Api-Key"}, byServer["v.example.com"].ThrottleKey)
+	assert.Equal(t, discovery.RateLimit{Rate: 100, Window: time.Minute, Burst: 20}, byServer["v.example.com"].Throttle)
+
+	assert.Equal(t, discovery.BandwidthLimit{Route: 10 << 20, Client: 1 << 20}, byServer["v.example.com"].Bandwidth)
+	assert.Equal(t, discovery.BandwidthLimit{}, byServer["b.example.com"].Bandwidth, "invalid value ignored")
+	assert.Equal(t, discovery.BandwidthLimit{}, byServer["n.example.com"].Bandwidth)
+
+	assert.Equal(t, "/srv/errors/v", byServer["v.example.com"].ErrorPages)
+	assert.Empty(t, byServer["n.example.com"].ErrorPages)
+
+	assert.Equal(t, discovery.EFJSON, byServer["v.example.com"].ErrorFormat)
+	assert.Equal(t, discovery.EFAuto, byServer["b.example.com"].ErrorFormat, "invalid value ignored")
+	assert.Equal(t, discovery.CanonicalHost{Host: discovery.HPWWW, Slash: discovery.SPAdd}, byServer["v.example.com"].Canonical)
+	assert.Equal(t, discovery.CanonicalHost{}, byServer["b.example.com"].Canonical, "invalid value ignored")
+	assert.Equal(t, discovery.SecurityHeaders{Preset: discovery.SHStrict, ReportOnly: true}, byServer["v.example.com"].SecurityHeaders)
+	assert.True(t, byServer["b.example.com"].SecurityHeaders.IsZero(), "invalid value ignored")
+	assert.True(t, byServer["v.example.com"].CORS.AnyOrigin())
+	assert.Equal(t, time.Hour, byServer["v.example.com"].CORS.MaxAge)
+	assert.False(t, byServer["b.example.com"].CORS.Enabled(), "invalid value ignored")
+	assert.Equal(t, "https://idp.example.com", byServer["v.example.com"].JWT.Issuer)
+	assert.NotContains(t, byServer, "bj.example.com", "service with invalid jwt label disabled")
+	assert.Equal(t, "http://auth:8080/verify", byServer["v.example.com"].ForwardAuth.URL)
+	assert.NotContains(t, byServer, "bf.example.com", "service with invalid forward-auth label disabled")
+	assert.Equal(t, discovery.OIDCPolicy{Enabled: true, Groups: []string{"admins"}}, byServer["v.example.com"].OIDC)
+	assert.NotContains(t, byServer, "bo.example.com", "service with invalid oidc label disabled")
+	assert.Equal(t, discovery.APIKeyPolicy{Enabled: true, Header: "X-Api-Key", Query: "key", Forward: "X-Api-Client"},
+		byServer["v.example.com"].APIKey)
+	assert.NotContains(t, byServer, "ba.example.com", "service with invalid api-key label disabled")
+	assert.Equal(t, discovery.GeoIPPolicy{Enabled: true, AllowCountries: []string{"US", "CA"}}, byServer["v.example.com"].GeoIP)
+	assert.NotContains(t, byServer, "bg.example.com", "service with invalid geoip label disabled")
+	assert.Equal(t, discovery.WAFPolicy{Sets: []string{"api"}}, byServer["v.example.com"].WAF)
+	assert.NotContains(t, byServer, "bw.example.com", "service with invalid waf label disabled")
+	assert.Equal(t, discovery.ThrottleKey{}, byServer["b.example.com"].ThrottleKey, "invalid value ignored")
+	assert.Equal(t, discovery.ThrottleKey{}, byServer["n.example.com"].ThrottleKey)
+}
@@ -145,6 +145,7 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 		if v, ok := d.labelN(c.Labels, n, "auth"); ok {
 			authUsers = discovery.ParseAuth(v)
 		}
+		authFile, _ := d.labelN(c.Labels, n, "auth-file")
 
 		if v, ok := d.labelN(c.Labels, n, "ping"); ok {
 			enabled = true
@@ -177,11 +178,34 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 
 		timeout := d.getTimeoutValue(c.Labels, n)
 		throttle := d.getThrottleValue(c.Labels, n)
+		throttleKey := d.getThrottleKeyValue(c.Labels, n)
+		accessLog := d.getAccessLogValue(c.Labels, n)
+		maxBody := d.getMaxBodyValue(c.Labels, n)
+		concurrency := d.getConcurrencyValue(c.Labels, n)
+		bandwidth := d.getBandwidthValue(c.Labels, n)
+		errorPages, _ := d.labelN(c.Labels, n, "error-pages")
+		errorFormat := d.getErrorFormatValue(c.Labels, n)
+		canonical := d.getCanonicalValue(c.Labels, n)
+		securityHeaders := d.getSecurityHeadersValue(c.Labels, n)
+		cors := d.getCORSValue(c.Labels, n)
+		label := func(name string) string { v, _ := d.labelN(c.Labels, n, name); return v }
+		jwtPolicy, jwtErr := discovery.ParseRequiredLabel(label, "jwt", discovery.ParseJWT)
+		forwardAuth, forwardAuthErr := discovery.ParseRequiredLabel(label, "forward-auth", discovery.ParseForwardAuth)
+		oidcPolicy, oidcErr := discovery.ParseRequiredLabel(label, "oidc", discovery.ParseOIDC)
+		apiKey, apiKeyErr := discovery.ParseRequiredLabel(label, "api-key", discovery.ParseAPIKey)
+		geoIP, geoIPErr := discovery.ParseRequiredLabel(label, "geoip", discovery.ParseGeoIP)
+		wafPolicy, wafErr := discovery.ParseRequiredLabel(label, "waf", discovery.ParseWAF)
 
 		if !enabled {
 			continue
 		}
 
+		// invalid auth or access restriction labels disable the route instead of serving it unprotected
+		if err := errors.Join(jwtErr, forwardAuthErr, oidcErr, apiKeyErr, geoIPErr, wafErr); err != nil {
+			log.Printf("[ERROR] container %s (route: %d) disabled, %v", c.Name, n, err)
+			continue
+		}
+
 		srcRegex, err := regexp.Compile(srcURL)
 		if err != nil {
 			log.Printf("[DEBUG] container %s (route: %d) disabled, invalid src regex: %v", c.Name, n, err)
@@ -193,7 +217,11 @@ func (d *Docker) parseContainerInfo(c containerInfo) (res []discovery.URLMapper)
 			mp := discovery.URLMapper{Server: strings.TrimSpace(srv), SrcMatch: *srcRegex, Dst: destURL,
 				PingURL: pingURL, ProviderID: discovery.PIDocker, MatchType: discovery.MTProxy,
 				KeepHost: keepHost, ForwardHealthChecks: forwardHealthChecks, OnlyFromIPs: onlyFrom, AuthUsers: authUsers,
-				Timeout: timeout, Throttle: throttle}
+				Timeout: timeout, Throttle: throttle, ThrottleKey: throttleKey, AccessLog: accessLog, MaxBodySize: maxBody,
+				Concurrency: concurrency, Bandwidth: bandwidth, ErrorPages: errorPages,
+				ErrorFormat: errorFormat, Canonical: canonical, SecurityHeaders: securityHeaders,
+				CORS: cors, JWT: jwtPolicy, ForwardAuth: forwardAuth, OIDC: oidcPolicy,
+				APIKey: apiKey, AuthFile: strings.TrimSpace(authFile), GeoIP: geoIP, WAF: wafPolicy}
 
 			// for assets we add the second proxy mapping only if explicitly requested
 			if assetsWebRoot != "" && explicit {
@@ -488,21 +516,134 @@ func (d *Docker) getTimeoutValue(labels map[string]string, n int) time.Duration
 	return dur
 }
 
-func (d *Docker) getThrottleValue(labels map[string]string, n int) int {
+func (d *Docker) getThrottleValue(labels map[string]string, n int) discovery.RateLimit {
 	v, ok := d.labelN(labels, n, "throttle")
 	if !ok || v == "" {
-		return 0
+		return discovery.RateLimit{}
 	}
-	num, err := strconv.Atoi(v)
+	res, err := discovery.ParseRateLimit(v)
 	if err != nil {
-		log.Printf("[WARN] throttle label value %s is not valid, ignoring", v)
+		log.Printf("[WARN] throttle label value %s is not valid, ignoring: %v", v, err)
+		return discovery.RateLimit{}
+	}
+	return res
+}
+
+func (d *Docker) getThrottleKeyValue(labels map[string]string, n int) discovery.ThrottleKey {
+	v, ok := d.labelN(labels, n, "throttle-key")
+	if !ok || v == "" {
+		return discovery.ThrottleKey{}
+	}
+	res, err := discovery.ParseThrottleKey(v)
+	if err != nil {
+		log.Printf("[WARN] throttle-key label value %s is not valid, ignoring: %v", v, err)
+		return discovery.ThrottleKey{}
+	}
+	return res
+}
+
+func (d *Docker) getMaxBodyValue(labels map[string]string, n int) int64 {
+	v, ok := d.labelN(labels, n, "max-body")
+	if !ok || v == "" {
 		return 0
 	}
-	if num < 0 {
-		log.Printf("[WARN] throttle label value %s is negative, ignoring", v)
+	size, err := discovery.ParseSize(v)
+	if err != nil {
+		log.Printf("[WARN] max-body label value %s is not valid, ignoring: %v", v, err)
 		return 0
 	}
-	return num
+	return size
+}
+
+func (d *Docker) getConcurrencyValue(labels map[string]string, n int) discovery.ConcurrencyLimit {
+	v, ok := d.labelN(labels, n, "concurrency")
+	if !ok || v == "" {
+		return discovery.ConcurrencyLimit{}
+	}
+	res, err := discovery.ParseConcurrency(v)
+	if err != nil {
+		log.Printf("[WARN] concurrency label value %s is not valid, ignoring: %v", v, err)
+		return discovery.ConcurrencyLimit{}
+	}
+	return res
+}
+
+func (d *Docker) getBandwidthValue(labels map[string]string, n int) discovery.BandwidthLimit {
+	v, ok := d.labelN(labels, n, "bandwidth")
+	if !ok || v == "" {
+		return discovery.BandwidthLimit{}
+	}
+	res, err := discovery.ParseBandwidth(v)
+	if err != nil {
+		log.Printf("[WARN] bandwidth label value %s is not valid, ignoring: %v", v, err)
+		return discovery.BandwidthLimit{}
+	}
+	return res
+}
+
+func (d *Docker) getErrorFormatValue(labels map[string]string, n int) discovery.ErrorFormat {
+	v, ok := d.labelN(labels, n, "error-format")
+	if !ok {
+		return discovery.EFAuto
+	}
+	res, err := discovery.ParseErrorFormat(v)
+	if err != nil {
+		log.Printf("[WARN] error-format label value %s is not valid, ignoring: %v", v, err)
+		return discovery.EFAuto
+	}
+	return res
+}
+
+func (d *Docker) getCanonicalValue(labels map[string]string, n int) discovery.CanonicalHost {
+	v, ok := d.labelN(labels, n, "canonical")
+	if !ok {
+		return discovery.CanonicalHost{}
+	}
+	res, err := discovery.ParseCanonicalHost(v)
+	if err != nil {
+		log.Printf("[WARN] canonical label value %s is not valid, ignoring: %v", v, err)
+		return discovery.CanonicalHost{}
+	}
+	return res
+}
+
+func (d *Docker) getSecurityHeadersValue(labels map[string]string, n int) discovery.SecurityHeaders {
+	v, ok := d.labelN(labels, n, "security-headers")
+	if !ok {
+		return discovery.SecurityHeaders{}
+	}
+	res, err := discovery.ParseSecurityHeaders(v)
+	if err != nil {
+		log.Printf("[WARN] security-headers label value %s is not valid, ignoring: %v", v, err)
+		return discovery.SecurityHeaders{}
+	}
+	return res
+}
+
+func (d *Docker) getCORSValue(labels map[string]string, n int) discovery.CORSPolicy {
+	v, ok := d.labelN(labels, n, "cors")
+	if !ok {
+		return discovery.CORSPolicy{}
+	}
+	res, err := discovery.ParseCORS(v)
+	if err != nil {
+		log.Printf("[WARN] cors label value %s is not valid, ignoring: %v", v, err)
+		return discovery.CORSPolicy{}
+	}
+	return res
+}
+
+func (d *Docker) getAccessLogValue(labels map[string]string, n int) discovery.AccessLogPolicy {
+	v, ok := d.labelN(labels, n, "access-log")
+	if !ok || v == "" {
+		return discovery.AccessLogPolicy{}
+	}
+	res, err := discovery.ParseAccessLog(v)
+	if err != nil {
+		log.Printf("[WARN] access-log label value %s is not valid, ignoring: %v", v, err)
+		return discovery.AccessLogPolicy{}
+	}
+	return res
 }
 
 func (d *Docker) getKeepHostValue(labels map[string]string, n int) *bool {
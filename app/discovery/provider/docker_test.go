@@ -55,7 +55,8 @@ func TestDocker_List(t *testing.T) {
 				{
 					Name: "c6", State: "running", IP: "127.0.0.6", Ports: []int{8080},
 					Labels: map[string]string{"reproxy.route": "^/secure/(.*)", "reproxy.dest": "/$1",
-						"reproxy.server": "secure.example.com", "reproxy.auth": "user1:$2y$05$hash1, user2:$2y$05$hash2"},
+						"reproxy.server": "secure.example.com", "reproxy.auth": "user1:$2y$05$hash1, user2:$2y$05$hash2",
+						"reproxy.auth-file": " admins "},
 				},
 			}, nil
 		},
@@ -84,6 +85,8 @@ func TestDocker_List(t *testing.T) {
 	assert.Equal(t, "http://127.0.0.6:8080/$1", res[2].Dst)
 	assert.Equal(t, "secure.example.com", res[2].Server)
 	assert.Equal(t, []string{"user1:$2y$05$hash1", "user2:$2y$05$hash2"}, res[2].AuthUsers)
+	assert.Equal(t, "admins", res[2].AuthFile)
+	assert.Empty(t, res[3].AuthFile)
 
 	assert.Equal(t, "^/c2/(.*)", res[3].SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.3:12346/$1", res[3].Dst)
@@ -355,12 +358,13 @@ func TestDocker_ListTimeoutThrottle(t *testing.T) {
 				{
 					Name: "multi-route", State: "running", IP: "127.0.0.28", Ports: []int{8080},
 					Labels: map[string]string{
-						"reproxy.0.route":    "^/api/(.*)",
-						"reproxy.0.dest":     "/api/$1",
-						"reproxy.1.route":    "^/web/(.*)",
-						"reproxy.1.dest":     "/web/$1",
-						"reproxy.1.timeout":  "1m",
-						"reproxy.1.throttle": "20",
+						"reproxy.0.route":       "^/api/(.*)",
+						"reproxy.0.dest":        "/api/$1",
+						"reproxy.1.route":       "^/web/(.*)",
+						"reproxy.1.dest":        "/web/$1",
+						"reproxy.1.timeout":     "1m",
+						"reproxy.1.throttle":    "20",
+						"reproxy.1.error-pages": "/srv/errors/web",
 					},
 				},
 			}, nil
@@ -375,7 +379,7 @@ func TestDocker_ListTimeoutThrottle(t *testing.T) {
 	throttleByServer := map[string]int{}
 	for _, r := range res {
 		timeoutByServer[r.Server] = r.Timeout
-		throttleByServer[r.Server] = r.Throttle
+		throttleByServer[r.Server] = r.Throttle.Rate
 	}
 
 	assert.Equal(t, 5*time.Minute, timeoutByServer["tmo.example.com"], "timeout label parsed")
@@ -400,12 +404,54 @@ func TestDocker_ListTimeoutThrottle(t *testing.T) {
 	throttleByRoute := map[string]int{}
 	for _, r := range res {
 		timeoutByRoute[r.SrcMatch.String()] = r.Timeout
-		throttleByRoute[r.SrcMatch.String()] = r.Throttle
+		throttleByRoute[r.SrcMatch.String()] = r.Throttle.Rate
 	}
 	assert.Equal(t, time.Duration(0), timeoutByRoute["^/api/(.*)"], "multi-route 0 has no timeout")
 	assert.Equal(t, 0, throttleByRoute["^/api/(.*)"], "multi-route 0 has no throttle")
 	assert.Equal(t, time.Minute, timeoutByRoute["^/web/(.*)"], "multi-route 1 timeout parsed")
 	assert.Equal(t, 20, throttleByRoute["^/web/(.*)"], "multi-route 1 throttle parsed")
+
+	errPagesByRoute := map[string]string{}
+	for _, r := range res {
+		errPagesByRoute[r.SrcMatch.String()] = r.ErrorPages
+	}
+	assert.Empty(t, errPagesByRoute["^/api/(.*)"], "multi-route 0 has no error pages")
+	assert.Equal(t, "/srv/errors/web", errPagesByRoute["^/web/(.*)"], "multi-route 1 error pages set")
+}
+
+func TestDocker_ListInvalidAuthLabels(t *testing.T) {
+	container := func(name, label, value string) containerInfo {
+		return containerInfo{Name: name, State: "running", IP: "127.0.0.30", Ports: []int{8080},
+			Labels: map[string]string{"reproxy.server": name + ".example.com", "reproxy.route": "^/(.*)", "reproxy." + label: value}}
+	}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func() ([]containerInfo, error) {
+			return []containerInfo{
+				container("good", "jwt", "on"),
+				container("bad-jwt", "jwt", "forward=sub"),
+				container("bad-forward-auth", "forward-auth", "copy=X-User"),
+				container("bad-oidc", "oidc", "roles=admin"),
+				container("bad-api-key", "api-key", "hash=abc"),
+				container("bad-geoip", "geoip", "allow=USA"),
+				container("bad-waf", "waf", "off"),
+				{Name: "multi", State: "running", IP: "127.0.0.31", Ports: []int{8080},
+					Labels: map[string]string{"reproxy.0.route": "^/api/(.*)", "reproxy.0.jwt": "forward=sub",
+						"reproxy.1.route": "^/web/(.*)", "reproxy.1.jwt": "aud=web"}},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List()
+	require.NoError(t, err)
+
+	routes := []string{}
+	for _, r := range res {
+		routes = append(routes, r.Server+" "+r.SrcMatch.String())
+		assert.True(t, r.JWT.Enabled, "valid jwt label of %s applied", r.SrcMatch.String())
+	}
+	assert.ElementsMatch(t, []string{"good.example.com ^/(.*)", "* ^/web/(.*)"}, routes,
+		"routes with invalid auth labels not created")
 }
 
 func TestDocker_getTimeoutValue(t *testing.T) {
@@ -438,15 +484,17 @@ func TestDocker_getThrottleValue(t *testing.T) {
 		name   string
 		labels map[string]string
 		n      int
-		want   int
+		want   discovery.RateLimit
 	}{
-		{"missing", map[string]string{}, 0, 0},
-		{"empty value", map[string]string{"reproxy.throttle": ""}, 0, 0},
-		{"valid 10", map[string]string{"reproxy.throttle": "10"}, 0, 10},
-		{"invalid", map[string]string{"reproxy.throttle": "abc"}, 0, 0},
-		{"negative", map[string]string{"reproxy.throttle": "-1"}, 0, 0},
-		{"numbered route 1", map[string]string{"reproxy.1.throttle": "5"}, 1, 5},
-		{"numbered route 0 explicit", map[string]string{"reproxy.0.throttle": "7"}, 0, 7},
+		{"missing", map[string]string{}, 0, discovery.RateLimit{}},
+		{"empty value", map[string]string{"reproxy.throttle": ""}, 0, discovery.RateLimit{}},
+		{"valid 10", map[string]string{"reproxy.throttle": "10"}, 0, discovery.RateLimit{Rate: 10}},
+		{"window and burst", map[string]string{"reproxy.throttle": "100/m burst 20"}, 0,
+			discovery.RateLimit{Rate: 100, Window: time.Minute, Burst: 20}},
+		{"invalid", map[string]string{"reproxy.throttle": "abc"}, 0, discovery.RateLimit{}},
+		{"negative", map[string]string{"reproxy.throttle": "-1"}, 0, discovery.RateLimit{}},
+		{"numbered route 1", map[string]string{"reproxy.1.throttle": "5"}, 1, discovery.RateLimit{Rate: 5}},
+		{"numbered route 0 explicit", map[string]string{"reproxy.0.throttle": "7"}, 0, discovery.RateLimit{Rate: 7}},
 	}
 	for _, tt := range tbl {
 		t.Run(tt.name, func(t *testing.T) {
@@ -455,6 +503,181 @@ func TestDocker_getThrottleValue(t *testing.T) {
 	}
 }
 
+func TestDocker_getThrottleKeyValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.ThrottleKey
+	}{
+		{"missing", map[string]string{}, 0, discovery.ThrottleKey{}},
+		{"empty value", map[string]string{"reproxy.throttle-key": ""}, 0, discovery.ThrottleKey{}},
+		{"header", map[string]string{"reproxy.throttle-key": "header:X-API-Key"}, 0,
+			discovery.ThrottleKey{Kind: discovery.TKHeader, Name: "X-Api-Key"}},
+		{"jwt claim", map[string]string{"reproxy.throttle-key": "jwt:sub"}, 0, discovery.ThrottleKey{Kind: discovery.TKJWT, Name: "sub"}},
+		{"invalid", map[string]string{"reproxy.throttle-key": "cookie"}, 0, discovery.ThrottleKey{}},
+		{"numbered route 1", map[string]string{"reproxy.1.throttle-key": "basic-auth"}, 1,
+			discovery.ThrottleKey{Kind: discovery.TKBasicAuth}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getThrottleKeyValue(tt.labels, tt.n))
+		})
+	}
+}
+
+func TestDocker_getConcurrencyValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.ConcurrencyLimit
+	}{
+		{"missing", map[string]string{}, 0, discovery.ConcurrencyLimit{}},
+		{"empty value", map[string]string{"reproxy.concurrency": ""}, 0, discovery.ConcurrencyLimit{}},
+		{"max only", map[string]string{"reproxy.concurrency": "10"}, 0, discovery.ConcurrencyLimit{MaxInFlight: 10}},
+		{"with queue", map[string]string{"reproxy.concurrency": "10,queue=5,timeout=1s"}, 0,
+			discovery.ConcurrencyLimit{MaxInFlight: 10, Queue: 5, Timeout: time.Second}},
+		{"invalid", map[string]string{"reproxy.concurrency": "abc"}, 0, discovery.ConcurrencyLimit{}},
+		{"numbered route 1", map[string]string{"reproxy.1.concurrency": "2"}, 1, discovery.ConcurrencyLimit{MaxInFlight: 2}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getConcurrencyValue(tt.labels, tt.n))
+		})
+	}
+}
+
+func TestDocker_getBandwidthValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.BandwidthLimit
+	}{
+		{"missing", map[string]string{}, 0, discovery.BandwidthLimit{}},
+		{"empty value", map[string]string{"reproxy.bandwidth": ""}, 0, discovery.BandwidthLimit{}},
+		{"route only", map[string]string{"reproxy.bandwidth": "10M"}, 0, discovery.BandwidthLimit{Route: 10 << 20}},
+		{"route and client", map[string]string{"reproxy.bandwidth": "route=10M,client=512K"}, 0,
+			discovery.BandwidthLimit{Route: 10 << 20, Client: 512 << 10}},
+		{"invalid", map[string]string{"reproxy.bandwidth": "fast"}, 0, discovery.BandwidthLimit{}},
+		{"numbered route 1", map[string]string{"reproxy.1.bandwidth": "client=1K"}, 1, discovery.BandwidthLimit{Client: 1024}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getBandwidthValue(tt.labels, tt.n))
+		})
+	}
+}
+
+func TestDocker_getErrorFormatValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.ErrorFormat
+	}{
+		{"missing", map[string]string{}, 0, discovery.EFAuto},
+		{"json", map[string]string{"reproxy.error-format": "json"}, 0, discovery.EFJSON},
+		{"text upper case", map[string]string{"reproxy.error-format": "TEXT"}, 0, discovery.EFText},
+		{"invalid", map[string]string{"reproxy.error-format": "xml"}, 0, discovery.EFAuto},
+		{"numbered route 2", map[string]string{"reproxy.2.error-format": "html"}, 2, discovery.EFHTML},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getErrorFormatValue(tt.labels, tt.n))
+		})
+	}
+}
+
+func TestDocker_getCanonicalValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.CanonicalHost
+	}{
+		{"missing", map[string]string{}, 0, discovery.CanonicalHost{}},
+		{"apex", map[string]string{"reproxy.canonical": "apex"}, 0, discovery.CanonicalHost{Host: discovery.HPApex}},
+		{"all", map[string]string{"reproxy.canonical": "www, lowercase, slash=add"}, 0,
+			discovery.CanonicalHost{Host: discovery.HPWWW, Lowercase: true, Slash: discovery.SPAdd}},
+		{"invalid", map[string]string{"reproxy.canonical": "www,slash=both"}, 0, discovery.CanonicalHost{}},
+		{"numbered route 2", map[string]string{"reproxy.2.canonical": "slash=strip"}, 2,
+			discovery.CanonicalHost{Slash: discovery.SPStrip}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getCanonicalValue(tt.labels, tt.n))
+		})
+	}
+}
+
+func TestDocker_getSecurityHeadersValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.SecurityHeaders
+	}{
+		{"missing", map[string]string{}, 0, discovery.SecurityHeaders{}},
+		{"preset with opt-out", map[string]string{"reproxy.security-headers": "strict,-csp"}, 0,
+			discovery.SecurityHeaders{Preset: discovery.SHStrict, Drop: []string{"Content-Security-Policy"}}},
+		{"invalid", map[string]string{"reproxy.security-headers": "strict,-server"}, 0, discovery.SecurityHeaders{}},
+		{"numbered route 2", map[string]string{"reproxy.2.security-headers": "off"}, 2,
+			discovery.SecurityHeaders{Preset: discovery.SHOff}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getSecurityHeadersValue(tt.labels, tt.n))
+		})
+	}
+}
+
+func TestDocker_getCORSValue(t *testing.T) {
+	d := Docker{}
+	assert.False(t, d.getCORSValue(map[string]string{}, 0).Enabled())
+
+	res := d.getCORSValue(map[string]string{"reproxy.cors": "origins=https://app.example.com, methods=GET PUT, credentials"}, 0)
+	assert.Equal(t, []string{"https://app.example.com"}, res.Origins)
+	assert.Equal(t, []string{"GET", "PUT"}, res.Methods)
+	assert.True(t, res.Credentials)
+
+	res = d.getCORSValue(map[string]string{"reproxy.2.cors": "origins=*.example.com"}, 2)
+	assert.True(t, res.AllowOrigin("https://app.example.com"))
+
+	assert.False(t, d.getCORSValue(map[string]string{"reproxy.cors": "methods=GET"}, 0).Enabled(), "invalid value ignored")
+}
+
+func TestDocker_getAccessLogValue(t *testing.T) {
+	d := Docker{}
+	tbl := []struct {
+		name   string
+		labels map[string]string
+		n      int
+		want   discovery.AccessLogPolicy
+	}{
+		{"missing", map[string]string{}, 0, discovery.AccessLogPolicy{}},
+		{"empty value", map[string]string{"reproxy.access-log": ""}, 0, discovery.AccessLogPolicy{}},
+		{"off", map[string]string{"reproxy.access-log": "off"}, 0, discovery.AccessLogPolicy{Disabled: true}},
+		{"errors and slow", map[string]string{"reproxy.access-log": "errors, slow=500ms"}, 0,
+			discovery.AccessLogPolicy{ErrorsOnly: true, Slow: 500 * time.Millisecond}},
+		{"invalid", map[string]string{"reproxy.access-log": "blah"}, 0, discovery.AccessLogPolicy{}},
+		{"numbered route 1", map[string]string{"reproxy.1.access-log": "sample=0.1"}, 1,
+			discovery.AccessLogPolicy{SampleRate: 0.1}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, d.getAccessLogValue(tt.labels, tt.n))
+		})
+	}
+}
+
 func TestDocker_ListMultiFallBack(t *testing.T) {
 	dclient := &DockerClientMock{
 		ListContainersFunc: func() ([]containerInfo, error) {
@@ -6,6 +6,7 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -101,8 +102,25 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 		ForwardHealthChecks bool   `yaml:"forward-health-checks"`
 		OnlyFrom            string `yaml:"remote"`
 		Auth                string `yaml:"auth"`
+		AuthFile            string `yaml:"auth-file"`
 		Timeout             string `yaml:"timeout"`
-		Throttle            int    `yaml:"throttle"`
+		Throttle            string `yaml:"throttle"`
+		ThrottleKey         string `yaml:"throttle-key"`
+		AccessLog           string `yaml:"access-log"`
+		MaxBody             string `yaml:"max-body"`
+		Concurrency         string `yaml:"concurrency"`
+		Bandwidth           string `yaml:"bandwidth"`
+		ErrorPages          string `yaml:"error-pages"`
+		ErrorFormat         string `yaml:"error-format"`
+		Canonical           string `yaml:"canonical"`
+		SecurityHeaders     string `yaml:"security-headers"`
+		CORS                string `yaml:"cors"`
+		JWT                 string `yaml:"jwt"`
+		ForwardAuth         string `yaml:"forward-auth"`
+		OIDC                string `yaml:"oidc"`
+		APIKey              string `yaml:"api-key"`
+		GeoIP               string `yaml:"geoip"`
+		WAF                 string `yaml:"waf"`
 	}
 	fh, err := os.Open(d.FileName)
 	if err != nil {
@@ -135,8 +153,69 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 				}
 				timeout = dur
 			}
-			if f.Throttle < 0 {
-				return nil, fmt.Errorf("throttle must be non-negative, got %d", f.Throttle)
+			throttle, perr := discovery.ParseRateLimit(f.Throttle)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse throttle %s: %w", f.Throttle, perr)
+			}
+			throttleKey, perr := discovery.ParseThrottleKey(f.ThrottleKey)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse throttle-key %s: %w", f.ThrottleKey, perr)
+			}
+			accessLog, perr := discovery.ParseAccessLog(f.AccessLog)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse access-log %s: %w", f.AccessLog, perr)
+			}
+			maxBody, perr := discovery.ParseSize(f.MaxBody)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse max-body %s: %w", f.MaxBody, perr)
+			}
+			concurrency, perr := discovery.ParseConcurrency(f.Concurrency)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse concurrency %s: %w", f.Concurrency, perr)
+			}
+			bandwidth, perr := discovery.ParseBandwidth(f.Bandwidth)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse bandwidth %s: %w", f.Bandwidth, perr)
+			}
+			errorFormat, perr := discovery.ParseErrorFormat(f.ErrorFormat)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse error-format %s: %w", f.ErrorFormat, perr)
+			}
+			canonical, perr := discovery.ParseCanonicalHost(f.Canonical)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse canonical %s: %w", f.Canonical, perr)
+			}
+			securityHeaders, perr := discovery.ParseSecurityHeaders(f.SecurityHeaders)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse security-headers %s: %w", f.SecurityHeaders, perr)
+			}
+			cors, perr := discovery.ParseCORS(f.CORS)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse cors %s: %w", f.CORS, perr)
+			}
+			jwtPolicy, perr := discovery.ParseJWT(f.JWT)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse jwt %s: %w", f.JWT, perr)
+			}
+			forwardAuth, perr := discovery.ParseForwardAuth(f.ForwardAuth)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse forward-auth %s: %w", f.ForwardAuth, perr)
+			}
+			oidcPolicy, perr := discovery.ParseOIDC(f.OIDC)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse oidc %s: %w", f.OIDC, perr)
+			}
+			apiKey, perr := discovery.ParseAPIKey(f.APIKey)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse api-key %s: %w", f.APIKey, perr)
+			}
+			geoIP, perr := discovery.ParseGeoIP(f.GeoIP)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse geoip %s: %w", f.GeoIP, perr)
+			}
+			wafPolicy, perr := discovery.ParseWAF(f.WAF)
+			if perr != nil {
+				return nil, fmt.Errorf("can't parse waf %s: %w", f.WAF, perr)
 			}
 			mapper := discovery.URLMapper{
 				Server:              srv,
@@ -149,8 +228,25 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 				MatchType:           discovery.MTProxy,
 				OnlyFromIPs:         discovery.ParseOnlyFrom(f.OnlyFrom),
 				AuthUsers:           discovery.ParseAuth(f.Auth),
+				AuthFile:            strings.TrimSpace(f.AuthFile),
 				Timeout:             timeout,
-				Throttle:            f.Throttle,
+				Throttle:            throttle,
+				ThrottleKey:         throttleKey,
+				AccessLog:           accessLog,
+				MaxBodySize:         maxBody,
+				Concurrency:         concurrency,
+				Bandwidth:           bandwidth,
+				ErrorPages:          f.ErrorPages,
+				ErrorFormat:         errorFormat,
+				Canonical:           canonical,
+				SecurityHeaders:     securityHeaders,
+				CORS:                cors,
+				JWT:                 jwtPolicy,
+				ForwardAuth:         forwardAuth,
+				OIDC:                oidcPolicy,
+				APIKey:              apiKey,
+				GeoIP:               geoIP,
+				WAF:                 wafPolicy,
 			}
 			if f.AssetsEnabled || f.AssetsSPA {
 				mapper.MatchType = discovery.MTStatic
@@ -238,8 +238,9 @@ func TestFile_List(t *testing.T) {
 	assert.False(t, authEntry.ForwardHealthChecks)
 	assert.Equal(t, []string{}, authEntry.OnlyFromIPs)
 	assert.Equal(t, []string{"user1:$2y$05$hash1", "user2:$2y$05$hash2"}, authEntry.AuthUsers)
+	assert.Equal(t, "admins", authEntry.AuthFile)
 	assert.Equal(t, time.Duration(0), authEntry.Timeout)
-	assert.Equal(t, 0, authEntry.Throttle)
+	assert.Equal(t, 0, authEntry.Throttle.Rate)
 
 	fhcEntry := byServer["fhc.example.com"]
 	assert.Equal(t, "^/(.*)", fhcEntry.SrcMatch.String())
@@ -248,25 +249,56 @@ func TestFile_List(t *testing.T) {
 	assert.Equal(t, discovery.MTProxy, fhcEntry.MatchType)
 	assert.True(t, fhcEntry.ForwardHealthChecks)
 	assert.Equal(t, time.Duration(0), fhcEntry.Timeout)
-	assert.Equal(t, 0, fhcEntry.Throttle)
+	assert.Equal(t, 0, fhcEntry.Throttle.Rate)
 
 	timeoutEntry := byServer["to.example.com"]
 	assert.Equal(t, "^/upload/(.*)", timeoutEntry.SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.6:8080/$1", timeoutEntry.Dst)
 	assert.Equal(t, 5*time.Minute, timeoutEntry.Timeout)
-	assert.Equal(t, 0, timeoutEntry.Throttle)
+	assert.Equal(t, 0, timeoutEntry.Throttle.Rate)
+	assert.Equal(t, int64(2<<30), timeoutEntry.MaxBodySize)
+	assert.Equal(t, discovery.BandwidthLimit{Route: 10 << 20, Client: 1 << 20}, timeoutEntry.Bandwidth)
+	assert.Equal(t, "/srv/errors/upload", timeoutEntry.ErrorPages)
+	assert.Equal(t, discovery.EFJSON, timeoutEntry.ErrorFormat)
+	assert.Equal(t, discovery.CanonicalHost{Host: discovery.HPApex, Lowercase: true, Slash: discovery.SPStrip},
+		timeoutEntry.Canonical)
+	assert.Equal(t, discovery.SecurityHeaders{Preset: discovery.SHBasic, Set: map[string]string{"X-Frame-Options": "DENY"}},
+		timeoutEntry.SecurityHeaders)
+	assert.Equal(t, []string{"https://app.example.com", "*.example.org"}, timeoutEntry.CORS.Origins)
+	assert.True(t, timeoutEntry.CORS.Credentials)
+	assert.True(t, timeoutEntry.CORS.AllowOrigin("https://a.example.org"))
+	assert.False(t, byServer["th.example.com"].CORS.Enabled())
+	assert.Equal(t, discovery.JWTPolicy{Enabled: true, Audience: []string{"api"},
+		Claims: []discovery.JWTClaimRule{{Name: "role", Values: []string{"admin"}}}}, timeoutEntry.JWT)
+	assert.False(t, byServer["th.example.com"].JWT.Enabled)
+	assert.Equal(t, discovery.ForwardAuth{URL: "http://auth:8080/verify", Headers: []string{"Authorization", "Cookie"},
+		Copy: []string{"X-User"}, CacheTTL: 15 * time.Second}, timeoutEntry.ForwardAuth)
+	assert.False(t, byServer["th.example.com"].ForwardAuth.Enabled())
+	assert.Equal(t, discovery.OIDCPolicy{Enabled: true, Emails: []string{"@example.com"}}, timeoutEntry.OIDC)
+	assert.False(t, byServer["th.example.com"].OIDC.Enabled)
+	assert.Equal(t, discovery.APIKeyPolicy{Enabled: true, Header: "X-Api-Key", Clients: []string{"billing"}, Forward: "X-Api-Client"},
+		timeoutEntry.APIKey)
+	assert.False(t, byServer["th.example.com"].APIKey.Enabled)
+	assert.Equal(t, discovery.GeoIPPolicy{Enabled: true, DenyCountries: []string{"RU"}, DenyASN: []uint{64500}}, timeoutEntry.GeoIP)
+	assert.False(t, byServer["th.example.com"].GeoIP.Enabled)
+	assert.Equal(t, discovery.WAFPolicy{Sets: []string{"uploads"}, SkipGlobal: true}, timeoutEntry.WAF)
+	assert.Equal(t, discovery.WAFPolicy{}, byServer["th.example.com"].WAF)
 
 	throttleEntry := byServer["th.example.com"]
 	assert.Equal(t, "^/login/(.*)", throttleEntry.SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.7:8080/$1", throttleEntry.Dst)
 	assert.Equal(t, time.Duration(0), throttleEntry.Timeout)
-	assert.Equal(t, 10, throttleEntry.Throttle)
+	assert.Equal(t, 10, throttleEntry.Throttle.Rate)
+	assert.Equal(t, discovery.AccessLogPolicy{}, throttleEntry.AccessLog)
+	assert.Equal(t, discovery.ConcurrencyLimit{MaxInFlight: 5, Queue: 10, Timeout: 2 * time.Second}, throttleEntry.Concurrency)
+	assert.Equal(t, discovery.ThrottleKey{Kind: discovery.TKHeader, Name: "X-Api-Key"}, throttleEntry.ThrottleKey)
 
 	bothEntry := byServer["tt.example.com"]
 	assert.Equal(t, "^/api/(.*)", bothEntry.SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.8:8080/$1", bothEntry.Dst)
 	assert.Equal(t, 30*time.Second, bothEntry.Timeout)
-	assert.Equal(t, 5, bothEntry.Throttle)
+	assert.Equal(t, discovery.RateLimit{Rate: 5, Window: time.Second, Burst: 10}, bothEntry.Throttle)
+	assert.Equal(t, discovery.AccessLogPolicy{ErrorsOnly: true, Slow: time.Second}, bothEntry.AccessLog)
 
 	srvEntry := byServer["srv.example.com"]
 	assert.Equal(t, "^/api/svc2/(.*)", srvEntry.SrcMatch.String())
@@ -339,7 +371,82 @@ func TestFile_ListErrors(t *testing.T) {
 		{
 			name:    "negative throttle",
 			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", throttle: -1}\n",
-			wantErr: "throttle must be non-negative, got -1",
+			wantErr: "can't parse throttle -1",
+		},
+		{
+			name:    "invalid access-log",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", access-log: \"sample=2\"}\n",
+			wantErr: "can't parse access-log sample=2",
+		},
+		{
+			name:    "invalid max-body",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", max-body: 10X}\n",
+			wantErr: "can't parse max-body 10X",
+		},
+		{
+			name:    "invalid throttle-key",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", throttle-key: \"header\"}\n",
+			wantErr: "can't parse throttle-key header",
+		},
+		{
+			name:    "invalid error format",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", error-format: xml}\n",
+			wantErr: "can't parse error-format xml",
+		},
+		{
+			name:    "invalid canonical",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", canonical: \"www,apex\"}\n",
+			wantErr: "can't parse canonical www,apex",
+		},
+		{
+			name:    "invalid security headers",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", security-headers: \"paranoid\"}\n",
+			wantErr: "can't parse security-headers paranoid",
+		},
+		{
+			name:    "invalid cors",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", cors: \"credentials\"}\n",
+			wantErr: "can't parse cors credentials",
+		},
+		{
+			name:    "invalid jwt",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", jwt: \"secret=abc\"}\n",
+			wantErr: "can't parse jwt secret=abc",
+		},
+		{
+			name:    "invalid forward-auth",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", forward-auth: \"copy=X-User\"}\n",
+			wantErr: "can't parse forward-auth copy=X-User",
+		},
+		{
+			name:    "invalid oidc",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", oidc: \"roles=admin\"}\n",
+			wantErr: "can't parse oidc roles=admin",
+		},
+		{
+			name:    "invalid api-key",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", api-key: \"header=\"}\n",
+			wantErr: "can't parse api-key header=",
+		},
+		{
+			name:    "invalid geoip",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", geoip: \"allow=USA\"}\n",
+			wantErr: "can't parse geoip allow=USA",
+		},
+		{
+			name:    "invalid waf",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", waf: \"rules=a\"}\n",
+			wantErr: "can't parse waf rules=a",
+		},
+		{
+			name:    "invalid bandwidth",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", bandwidth: \"client=fast\"}\n",
+			wantErr: "can't parse bandwidth client=fast",
+		},
+		{
+			name:    "invalid concurrency",
+			yaml:    "default:\n  - {route: \"^/a/(.*)\", dest: \"http://127.0.0.1/\", concurrency: \"10,queue=-1\"}\n",
+			wantErr: "can't parse concurrency 10,queue=-1",
 		},
 	}
 
@@ -4,16 +4,15 @@ import (
 	"context"
 	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/umputun/reproxy/app/discovery"
 )
 
-// Static provider, rules are server,source_url,destination[,ping[,forward-health-checks[,timeout[,throttle]]]]
+// Static provider, rules are server,source_url,destination[,ping[,forward-health-checks[,timeout[,throttle[,max-body]]]]]
 type Static struct {
-	Rules []string // each rule is up to 7 elements comma separated - server,source_url,destination,ping,forward-health-checks,timeout,throttle
+	Rules []string // each rule is up to 8 elements comma separated - server,source_url,destination,ping,forward-health-checks,timeout,throttle,max-body
 }
 
 // Events returns channel updating once
@@ -26,8 +25,8 @@ func (s *Static) Events(_ context.Context) <-chan discovery.ProviderID {
 // List all src dst pairs
 func (s *Static) List() (res []discovery.URLMapper, err error) {
 
-	// inp is up to 7 elements string server,source_url,destination[,ping[,forward-health-checks[,timeout[,throttle]]]]
-	// ping, forward-health-checks, timeout and throttle can be omitted
+	// inp is up to 8 elements string server,source_url,destination[,ping[,forward-health-checks[,timeout[,throttle[,max-body]]]]]
+	// ping, forward-health-checks, timeout, throttle and max-body can be omitted
 	parse := func(inp string) (discovery.URLMapper, error) {
 		elems := strings.Split(inp, ",")
 		if len(elems) < 3 {
@@ -42,13 +41,16 @@ func (s *Static) List() (res []discovery.URLMapper, err error) {
 			v := strings.TrimSpace(elems[4])
 			forwardHealthChecks = v == "true" || v == "yes" || v == "y" || v == "1"
 		}
-		var timeoutStr, throttleStr string
+		var timeoutStr, throttleStr, maxBodyStr string
 		if len(elems) >= 6 {
 			timeoutStr = strings.TrimSpace(elems[5])
 		}
 		if len(elems) >= 7 {
 			throttleStr = strings.TrimSpace(elems[6])
 		}
+		if len(elems) >= 8 {
+			maxBodyStr = strings.TrimSpace(elems[7])
+		}
 		timeout, err := s.parseTimeout(timeoutStr)
 		if err != nil {
 			return discovery.URLMapper{}, err
@@ -57,6 +59,10 @@ func (s *Static) List() (res []discovery.URLMapper, err error) {
 		if err != nil {
 			return discovery.URLMapper{}, err
 		}
+		maxBody, err := discovery.ParseSize(maxBodyStr)
+		if err != nil {
+			return discovery.URLMapper{}, fmt.Errorf("can't parse max-body %s: %w", maxBodyStr, err)
+		}
 		rx, err := regexp.Compile(strings.TrimSpace(elems[1]))
 		if err != nil {
 			return discovery.URLMapper{}, fmt.Errorf("can't parse regex %s: %w", elems[1], err)
@@ -82,6 +88,7 @@ func (s *Static) List() (res []discovery.URLMapper, err error) {
 			ForwardHealthChecks: forwardHealthChecks,
 			Timeout:             timeout,
 			Throttle:            throttle,
+			MaxBodySize:         maxBody,
 			ProviderID:          discovery.PIStatic,
 			MatchType:           discovery.MTProxy,
 		}
@@ -120,16 +127,10 @@ func (s *Static) parseTimeout(v string) (time.Duration, error) {
 	return d, nil
 }
 
-func (s *Static) parseThrottle(v string) (int, error) {
-	if v == "" {
-		return 0, nil
-	}
-	n, err := strconv.Atoi(v)
+func (s *Static) parseThrottle(v string) (discovery.RateLimit, error) {
+	res, err := discovery.ParseRateLimit(v)
 	if err != nil {
-		return 0, fmt.Errorf("can't parse throttle %s: %w", v, err)
+		return discovery.RateLimit{}, fmt.Errorf("can't parse throttle %s: %w", v, err)
 	}
-	if n < 0 {
-		return 0, fmt.Errorf("throttle must be non-negative, got %d", n)
-	}
-	return n, nil
+	return res, nil
 }
@@ -59,7 +59,7 @@ func TestStatic_List(t *testing.T) {
 			assert.Equal(t, tt.ping, res[0].PingURL)
 			assert.Equal(t, tt.forwardHealthChecks, res[0].ForwardHealthChecks)
 			assert.Equal(t, tt.timeout, res[0].Timeout)
-			assert.Equal(t, tt.throttle, res[0].Throttle)
+			assert.Equal(t, tt.throttle, res[0].Throttle.Rate)
 			if tt.static {
 				assert.Equal(t, discovery.MTStatic, res[0].MatchType)
 				assert.Equal(t, tt.spa, res[0].AssetsSPA)
@@ -70,3 +70,61 @@ func TestStatic_List(t *testing.T) {
 	}
 
 }
+
+func TestStatic_ListMaxBody(t *testing.T) {
+	tbl := []struct {
+		rule    string
+		maxBody int64
+		err     bool
+	}{
+		{"example.com,^/up/(.*),/$1", 0, false},
+		{"example.com,^/up/(.*),/$1,,,,,", 0, false},
+		{"example.com,^/up/(.*),/$1,,,,,2G", 2 << 30, false},
+		{"example.com,^/up/(.*),/$1,/ping,true,5m,10, 64k ", 64 << 10, false},
+		{"example.com,^/up/(.*),/$1,,,,,1024", 1024, false},
+		{"example.com,^/up/(.*),/$1,,,,,bad", 0, true},
+		{"example.com,^/up/(.*),/$1,,,,,-1", 0, true},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			s := Static{Rules: []string{tt.rule}}
+			res, err := s.List()
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, res, 1)
+			assert.Equal(t, tt.maxBody, res[0].MaxBodySize)
+		})
+	}
+}
+
+func TestStatic_ListThrottle(t *testing.T) {
+	tbl := []struct {
+		rule     string
+		throttle discovery.RateLimit
+		err      bool
+	}{
+		{"example.com,^/up/(.*),/$1", discovery.RateLimit{}, false},
+		{"example.com,^/up/(.*),/$1,,,,10", discovery.RateLimit{Rate: 10}, false},
+		{"example.com,^/up/(.*),/$1,,,,100/m burst 20", discovery.RateLimit{Rate: 100, Window: time.Minute, Burst: 20}, false},
+		{"example.com,^/up/(.*),/$1,,,, 5/10s ,1k", discovery.RateLimit{Rate: 5, Window: 10 * time.Second}, false},
+		{"example.com,^/up/(.*),/$1,,,,100/week", discovery.RateLimit{}, true},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			s := Static{Rules: []string{tt.rule}}
+			res, err := s.List()
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, res, 1)
+			assert.Equal(t, tt.throttle, res[0].Throttle)
+		})
+	}
+}
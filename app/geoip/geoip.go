@@ -0,0 +1,122 @@
+// Package geoip resolves country and autonomous system (ASN) of ip addresses with local MaxMind DB files,
+// i.e. GeoLite2-Country, GeoLite2-City or GeoLite2-ASN. Databases loaded by DB and can be reloaded on change.
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Record is geo information of ip address, empty fields are unknown
+type Record struct {
+	Country string // ISO 3166-1 alpha-2 country code, upper case
+	ASN     uint   // autonomous system number
+	Org     string // organization of autonomous system
+}
+
+// DB is MaxMind DB file with country or asn data
+type DB struct {
+	path string
+
+	lock   sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+// record is a subset of GeoLite2 country, city and asn records used by Lookup
+type record struct {
+	Country           country `maxminddb:"country"`
+	RegisteredCountry country `maxminddb:"registered_country"`
+	ASN               uint    `maxminddb:"autonomous_system_number"`
+	Org               string  `maxminddb:"autonomous_system_organization"`
+}
+
+type country struct {
+	ISOCode string `maxminddb:"iso_code"`
+}
+
+// NewDB makes DB and loads the database file
+func NewDB(path string) (*DB, error) {
+	res := &DB{path: path}
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Load reads the database file, replacing the current one. The current database kept unchanged on error.
+func (d *DB) Load() error {
+	data, err := os.ReadFile(d.path) //nolint:gosec // path is from the options
+	if err != nil {
+		return fmt.Errorf("failed to read geoip database %s: %w", d.path, err)
+	}
+	reader, err := maxminddb.OpenBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse geoip database %s: %w", d.path, err)
+	}
+	d.lock.Lock()
+	d.reader = reader
+	d.lock.Unlock()
+	return nil
+}
+
+// Metadata returns metadata of the loaded database
+func (d *DB) Metadata() maxminddb.Metadata {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.reader.Metadata
+}
+
+// Lookup returns geo record of ip. Country taken from the country of the network or, if not set,
+// from the registered country, ASN and organization from asn fields. Unknown ip returns empty record.
+func (d *DB) Lookup(ip net.IP) (Record, error) {
+	d.lock.RLock()
+	reader := d.reader
+	d.lock.RUnlock()
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Record{}, fmt.Errorf("invalid ip %v", ip)
+	}
+	var rec record
+	if err := reader.Lookup(addr.Unmap()).Decode(&rec); err != nil {
+		return Record{}, fmt.Errorf("failed to lookup %s: %w", addr.Unmap(), err)
+	}
+	res := Record{ASN: rec.ASN, Org: rec.Org, Country: strings.ToUpper(rec.Country.ISOCode)}
+	if res.Country == "" {
+		res.Country = strings.ToUpper(rec.RegisteredCountry.ISOCode)
+	}
+	return res, nil
+}
+
+// Resolver looks up ip in several databases, i.e. country and asn ones, and merges the results.
+// The first non-empty value of each field wins.
+type Resolver []*DB
+
+// Lookup returns country code and asn of ip, empty for unknown or invalid ip
+func (r Resolver) Lookup(ip string) (country string, asn uint) {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return "", 0
+	}
+	for _, db := range r {
+		rec, err := db.Lookup(parsed)
+		if err != nil {
+			log.Printf("[WARN] geoip lookup of %s failed, %v", ip, err)
+			continue
+		}
+		if country == "" {
+			country = rec.Country
+		}
+		if asn == 0 {
+			asn = rec.ASN
+		}
+	}
+	return country, asn
+}
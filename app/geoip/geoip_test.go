@@ -0,0 +1,103 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/geoip/geoiptest"
+)
+
+func TestDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "country.mmdb")
+	require.NoError(t, geoiptest.WriteFile(file, geoiptest.Options{}, map[string]map[string]any{
+		"1.2.3.0/24":    {"country": map[string]any{"iso_code": "us"}, "registered_country": map[string]any{"iso_code": "CA"}},
+		"5.6.7.0/24":    {"registered_country": map[string]any{"iso_code": "DE"}},
+		"2001:db8::/32": {"continent": map[string]any{"code": "EU"}},
+	}))
+
+	db, err := NewDB(file)
+	require.NoError(t, err)
+	assert.Equal(t, "GeoLite2-Country", db.Metadata().DatabaseType)
+
+	rec, err := db.Lookup(net.ParseIP("1.2.3.4"))
+	require.NoError(t, err)
+	assert.Equal(t, Record{Country: "US"}, rec, "country preferred over registered country")
+	rec, err = db.Lookup(net.ParseIP("5.6.7.8"))
+	require.NoError(t, err)
+	assert.Equal(t, Record{Country: "DE"}, rec, "registered country")
+	rec, err = db.Lookup(net.ParseIP("2001:db8::1"))
+	require.NoError(t, err)
+	assert.Equal(t, Record{}, rec, "no country")
+	rec, err = db.Lookup(net.ParseIP("9.9.9.9"))
+	require.NoError(t, err)
+	assert.Equal(t, Record{}, rec, "not found")
+
+	// replace with asn database
+	require.NoError(t, geoiptest.WriteFile(file, geoiptest.Options{DatabaseType: "GeoLite2-ASN"}, map[string]map[string]any{
+		"1.2.3.0/24": {"autonomous_system_number": uint32(64500), "autonomous_system_organization": "EXAMPLE"},
+	}))
+	require.NoError(t, db.Load())
+	rec, err = db.Lookup(net.ParseIP("1.2.3.4"))
+	require.NoError(t, err)
+	assert.Equal(t, Record{ASN: 64500, Org: "EXAMPLE"}, rec)
+
+	// broken file keeps current database
+	require.NoError(t, os.WriteFile(file, []byte("bad"), 0o600))
+	require.ErrorContains(t, db.Load(), "failed to parse geoip database "+file+": error opening database: invalid MaxMind DB file")
+	assert.Equal(t, "GeoLite2-ASN", db.Metadata().DatabaseType)
+
+	// ipv4 database with small records
+	require.NoError(t, geoiptest.WriteFile(file, geoiptest.Options{IPVersion: 4, RecordSize: 24}, map[string]map[string]any{
+		"10.0.0.0/8": {"country": map[string]any{"iso_code": "FR"}},
+	}))
+	require.NoError(t, db.Load())
+	assert.Equal(t, uint(4), db.Metadata().IPVersion)
+	rec, err = db.Lookup(net.ParseIP("10.1.2.3"))
+	require.NoError(t, err)
+	assert.Equal(t, Record{Country: "FR"}, rec)
+	_, err = db.Lookup(net.ParseIP("2001:db8::1"))
+	require.Error(t, err, "ipv6 lookup in ipv4 database")
+
+	_, err = NewDB("/no-such-file.mmdb")
+	require.ErrorContains(t, err, "failed to read geoip database /no-such-file.mmdb")
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	dir := t.TempDir()
+	countryFile, asnFile := filepath.Join(dir, "country.mmdb"), filepath.Join(dir, "asn.mmdb")
+	require.NoError(t, geoiptest.WriteFile(countryFile, geoiptest.Options{}, map[string]map[string]any{
+		"1.2.3.0/24":    {"country": map[string]any{"iso_code": "US"}},
+		"2001:db8::/32": {"country": map[string]any{"iso_code": "NL"}},
+	}))
+	require.NoError(t, geoiptest.WriteFile(asnFile, geoiptest.Options{DatabaseType: "GeoLite2-ASN"}, map[string]map[string]any{
+		"1.2.0.0/16": {"autonomous_system_number": uint32(64500)},
+	}))
+	country, err := NewDB(countryFile)
+	require.NoError(t, err)
+	asn, err := NewDB(asnFile)
+	require.NoError(t, err)
+	r := Resolver{country, asn}
+
+	tbl := []struct {
+		ip      string
+		country string
+		asn     uint
+	}{
+		{"1.2.3.4", "US", 64500},
+		{" 1.2.9.9 ", "", 64500},
+		{"2001:db8::1", "NL", 0},
+		{"8.8.8.8", "", 0},
+		{"bad", "", 0},
+		{"", "", 0},
+	}
+	for _, tt := range tbl {
+		c, a := r.Lookup(tt.ip)
+		assert.Equal(t, tt.country, c, tt.ip)
+		assert.Equal(t, tt.asn, a, tt.ip)
+	}
+}
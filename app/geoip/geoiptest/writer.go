@@ -0,0 +1,100 @@
+// Package geoiptest makes MaxMind DB files for tests
+package geoiptest
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// Options define format of the database
+type Options struct {
+	IPVersion    int    // 4 or 6, 6 by default
+	RecordSize   int    // 24, 28 or 32, 28 by default
+	DatabaseType string // GeoLite2-Country by default
+}
+
+// WriteFile makes database with records of networks and writes it to the file.
+// Networks are CIDRs, i.e. "1.2.3.0/24" or "2001:db8::/32", records are maps with string keys and
+// string, numeric, bool, slice or map values, like the ones of GeoLite2 databases.
+func WriteFile(path string, opts Options, networks map[string]map[string]any) error {
+	if opts.DatabaseType == "" {
+		opts.DatabaseType = "GeoLite2-Country"
+	}
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: opts.DatabaseType, IPVersion: opts.IPVersion,
+		RecordSize: opts.RecordSize, IncludeReservedNetworks: true})
+	if err != nil {
+		return fmt.Errorf("failed to make database: %w", err)
+	}
+	for cidr, rec := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %w", cidr, err)
+		}
+		value, err := dataType(rec)
+		if err != nil {
+			return fmt.Errorf("invalid record of %s: %w", cidr, err)
+		}
+		if err := tree.Insert(ipNet, value); err != nil {
+			return fmt.Errorf("failed to insert %s: %w", cidr, err)
+		}
+	}
+
+	fh, err := os.Create(path) //nolint:gosec // test file path
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := tree.WriteTo(fh); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+	return nil
+}
+
+// dataType converts go value to the data type of the database
+func dataType(v any) (mmdbtype.DataType, error) {
+	switch val := v.(type) {
+	case string:
+		return mmdbtype.String(val), nil
+	case bool:
+		return mmdbtype.Bool(val), nil
+	case int:
+		return mmdbtype.Int32(val), nil //nolint:gosec // test values are small
+	case uint16:
+		return mmdbtype.Uint16(val), nil
+	case uint32:
+		return mmdbtype.Uint32(val), nil
+	case uint64:
+		return mmdbtype.Uint64(val), nil
+	case float64:
+		return mmdbtype.Float64(val), nil
+	case []any:
+		res := make(mmdbtype.Slice, 0, len(val))
+		for _, item := range val {
+			dt, err := dataType(item)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, dt)
+		}
+		return res, nil
+	case map[string]any:
+		res := make(mmdbtype.Map, len(val))
+		for k, item := range val {
+			dt, err := dataType(item)
+			if err != nil {
+				return nil, err
+			}
+			res[mmdbtype.String(k)] = dt
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
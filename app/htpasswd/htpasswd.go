@@ -0,0 +1,290 @@
+// Package htpasswd checks passwords against htpasswd files with bcrypt, APR1-MD5 and SHA-crypt hashes.
+// Files loaded by File and can be reloaded on change.
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5" //nolint:gosec // apr1 is md5 based by definition
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash used to verify passwords of unknown users, keeping response time the same as for known ones
+const dummyHash = "$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW"
+
+// File keeps users and password hashes of htpasswd file
+type File struct {
+	path string
+
+	lock  sync.RWMutex
+	users map[string]string
+}
+
+// NewFile makes File and loads users from the htpasswd file
+func NewFile(path string) (*File, error) {
+	res := &File{path: path}
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Load reads users from the file, replacing the current ones. Users kept unchanged on error.
+// Empty lines and comments are ignored, as well as lines without user or hash.
+func (f *File) Load() error {
+	data, err := os.ReadFile(f.path) //nolint:gosec // path is from the options
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file %s: %w", f.path, err)
+	}
+	users := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			continue
+		}
+		users[user] = strings.TrimSpace(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read htpasswd file %s: %w", f.path, err)
+	}
+
+	f.lock.Lock()
+	f.users = users
+	f.lock.Unlock()
+	return nil
+}
+
+// Match checks if the user is in the file and the password matches the user's hash
+func (f *File) Match(user, password string) bool {
+	f.lock.RLock()
+	hash, ok := f.users[user]
+	f.lock.RUnlock()
+	if !ok || user == "" {
+		Verify(dummyHash, password)
+		return false
+	}
+	return Verify(hash, password)
+}
+
+// Len returns number of users
+func (f *File) Len() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return len(f.users)
+}
+
+// Verify checks the password against bcrypt ($2a$, $2b$, $2y$), APR1-MD5 ($apr1$) or SHA-crypt ($5$, $6$) hash.
+// Hashes of other formats never match.
+func Verify(hash, password string) bool {
+	var expected string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		expected = apr1(password, salt)
+	case strings.HasPrefix(hash, "$5$"):
+		expected = shaCrypt(sha256.New, "$5$", hash, password)
+	case strings.HasPrefix(hash, "$6$"):
+		expected = shaCrypt(sha512.New, "$6$", hash, password)
+	default:
+		return false
+	}
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+// apr1 makes apache variant of md5-crypt hash of the password, salt limited to 8 characters
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New() //nolint:gosec // part of the algorithm
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	d := md5.New() //nolint:gosec // part of the algorithm
+	d.Write(pw)
+	d.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := range 1000 {
+		r := md5.New() //nolint:gosec // part of the algorithm
+		if i&1 != 0 {
+			r.Write(pw)
+		} else {
+			r.Write(sum)
+		}
+		if i%3 != 0 {
+			r.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 != 0 {
+			r.Write(sum)
+		} else {
+			r.Write(pw)
+		}
+		sum = r.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode24(&b, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+	}
+	encode24(&b, 0, 0, sum[11], 2)
+	return b.String()
+}
+
+// byte order of sha256-crypt and sha512-crypt encoding, each triple encoded to 4 characters
+var (
+	sha256Order = [][3]int{{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14}, {15, 25, 5}, {6, 16, 26},
+		{27, 7, 17}, {18, 28, 8}, {9, 19, 29}}
+	sha512Order = [][3]int{{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41}}
+)
+
+// shaCrypt makes SHA-crypt hash of the password with salt and rounds of the expected hash,
+// as defined by https://www.akkadia.org/drepper/SHA-crypt.txt. Returns empty string for malformed hash.
+func shaCrypt(newHash func() hash.Hash, magic, expected, password string) string {
+	const defaultRounds, minRounds, maxRounds = 5000, 1000, 999_999_999
+	params := strings.TrimPrefix(expected, magic)
+	rounds, customRounds := defaultRounds, false
+	if v, ok := strings.CutPrefix(params, "rounds="); ok {
+		n, rest, found := strings.Cut(v, "$")
+		r, err := strconv.Atoi(n)
+		if !found || err != nil || r < 0 {
+			return ""
+		}
+		rounds, customRounds, params = min(max(r, minRounds), maxRounds), true, rest
+	}
+	salt, _, _ := strings.Cut(params, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, sl := []byte(password), []byte(salt)
+
+	alt := newHash()
+	alt.Write(pw)
+	alt.Write(sl)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	a := newHash()
+	a.Write(pw)
+	a.Write(sl)
+	for i := len(pw); i > 0; i -= len(altSum) {
+		a.Write(altSum[:min(i, len(altSum))])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := newHash()
+	for range len(pw) {
+		dp.Write(pw)
+	}
+	p := repeatTo(dp.Sum(nil), len(pw))
+
+	ds := newHash()
+	for range 16 + int(sum[0]) {
+		ds.Write(sl)
+	}
+	s := repeatTo(ds.Sum(nil), len(sl))
+
+	for i := range rounds {
+		c := newHash()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic)
+	if customRounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt + "$")
+	if len(sum) == sha256.Size {
+		for _, g := range sha256Order {
+			encode24(&b, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+		}
+		encode24(&b, 0, sum[31], sum[30], 3)
+		return b.String()
+	}
+	for _, g := range sha512Order {
+		encode24(&b, sum[g[0]], sum[g[1]], sum[g[2]], 4)
+	}
+	encode24(&b, 0, 0, sum[63], 2)
+	return b.String()
+}
+
+// repeatTo returns data repeated to the size
+func repeatTo(data []byte, size int) []byte {
+	res := make([]byte, 0, size)
+	for len(res) < size {
+		res = append(res, data[:min(len(data), size-len(res))]...)
+	}
+	return res
+}
+
+// encode24 writes n characters of crypt's base64 encoding of 24 bits made from b2, b1 and b0
+func encode24(b *strings.Builder, b2, b1, b0 byte, n int) {
+	const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		b.WriteByte(alphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,78 @@
+package htpasswd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	tbl := []struct {
+		hash, password string
+		want           bool
+	}{
+		{"$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW", "passwd", true},
+		{"$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW", "passwd2", false},
+		{"$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0", "passwd", true},
+		{"$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0", "Passwd", false},
+		{"$apr1$x$tMwYqBfQwi3FYAr0aJc8M/", "", true},
+		{"$apr1$longsalt$o/fJiX7PiitUf.G4HpCH9.", "pw with a rather long text over 16 bytes", true},
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!", true},
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world", false},
+		{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!", true},
+		{"$5$salt$HrcUzzoef72uxM/YhTU5BAi419Fblqlq//zyM.rIOG0", "", true},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			"Hello world!", true},
+		{"$6$rounds=1400$anotherlongsalts$5FGyu8c4BZDX4wJgs0Un26YOw2XibT5eTkHF1I1aP3QqStoJI9BHD2YPJYsAjEePVGUyBjdZxcNqMWlrrbIOC.",
+			"Hello world!", true},
+		{"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+			"a very much longer text to encrypt.  This one even stretches over morethan one line.", true},
+		{"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+			"Hello world!", false},
+		{"$5$rounds=abc$salt$HrcUzzoef72uxM/YhTU5BAi419Fblqlq//zyM.rIOG0", "", false},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", false},
+		{"plain", "plain", false},
+		{"", "", false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.want, Verify(tt.hash, tt.password), "%s %q", tt.hash, tt.password)
+	}
+}
+
+func TestFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(file, []byte(`# users
+bcrypt:$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW
+	apr:$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0
+
+sha:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5
+bad bad
+:nouser
+`), 0o600))
+
+	f, err := NewFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, 3, f.Len())
+	assert.True(t, f.Match("bcrypt", "passwd"))
+	assert.True(t, f.Match("apr", "passwd"))
+	assert.True(t, f.Match("sha", "Hello world!"))
+	assert.False(t, f.Match("apr", "Hello world!"))
+	assert.False(t, f.Match("unknown", "passwd"))
+	assert.False(t, f.Match("", "passwd"))
+
+	require.NoError(t, os.WriteFile(file, []byte("apr:$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0\n"), 0o600))
+	require.NoError(t, f.Load())
+	assert.Equal(t, 1, f.Len())
+	assert.False(t, f.Match("bcrypt", "passwd"), "removed user")
+	assert.True(t, f.Match("apr", "passwd"))
+
+	require.NoError(t, os.Remove(file))
+	require.ErrorContains(t, f.Load(), "failed to read htpasswd file")
+	assert.True(t, f.Match("apr", "passwd"), "users kept on failed load")
+
+	_, err = NewFile(file)
+	require.Error(t, err)
+}
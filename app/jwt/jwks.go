@@ -0,0 +1,275 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const (
+	minReloadInterval = 30 * time.Second // key set not reloaded more often, even for unknown key ids
+	maxJWKSSize       = 1 << 20          // max size of JWKS document
+)
+
+// KeySet is a set of keys loaded from JWKS (RFC 7517) file or url. Keys reloaded every Refresh period
+// and on unknown key id, but not more often than once in minReloadInterval. Failed reload keeps previous keys.
+// Lookups are not blocked by reload, concurrent callers needing reload share a single request.
+type KeySet struct {
+	Source  string        // file path or http(s) url of JWKS document
+	Refresh time.Duration // reload interval, 0 = load once
+	Client  *http.Client  // client for url source, default client with 10s timeout used if nil
+
+	lock     sync.RWMutex
+	keys     []jwk
+	loadedAt time.Time
+	triedAt  time.Time
+	loading  chan struct{} // closed when reload in progress done, nil if no reload
+	loadErr  error         // error of the last reload
+}
+
+// jwk is a parsed key of the set
+type jwk struct {
+	kid string
+	alg string
+	key any // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// Load reads and parses JWKS from the source, replaces keys of the set
+func (ks *KeySet) Load(ctx context.Context) error {
+	ks.lock.Lock()
+	ks.triedAt = time.Now()
+	ks.lock.Unlock()
+	return ks.fetch(ctx)
+}
+
+// Key returns key for the algorithm and key id, key id ignored if empty. Stale set and set without
+// the requested key reloaded first, waiting for reload stops when ctx is done.
+func (ks *KeySet) Key(ctx context.Context, alg, kid string) (any, error) {
+	ks.lock.RLock()
+	key, found := ks.find(alg, kid)
+	stale := ks.loadedAt.IsZero() || (ks.Refresh > 0 && time.Since(ks.loadedAt) > ks.Refresh)
+	reload := (stale || !found) && (ks.loading != nil || time.Since(ks.triedAt) > minReloadInterval)
+	ks.lock.RUnlock()
+
+	if reload {
+		if err := ks.reload(ctx); err != nil {
+			log.Printf("[WARN] failed to reload jwks, %v", err)
+		}
+		ks.lock.RLock()
+		key, found = ks.find(alg, kid)
+		ks.lock.RUnlock()
+	}
+	if !found {
+		return nil, fmt.Errorf("%w, no key %q for algorithm %q", ErrSignature, kid, alg)
+	}
+	return key, nil
+}
+
+// reload starts loading of the keys in background, or joins the one in progress, and waits for it.
+// Loading is not canceled with ctx of the caller, as other callers may wait for it too.
+func (ks *KeySet) reload(ctx context.Context) error {
+	ks.lock.Lock()
+	if ks.loading == nil {
+		if time.Since(ks.triedAt) <= minReloadInterval {
+			ks.lock.Unlock()
+			return nil // reloaded by another caller just now
+		}
+		ks.triedAt, ks.loading = time.Now(), make(chan struct{})
+		go func(done chan struct{}) {
+			err := ks.fetch(context.WithoutCancel(ctx))
+			ks.lock.Lock()
+			ks.loading, ks.loadErr = nil, err
+			ks.lock.Unlock()
+			close(done)
+		}(ks.loading)
+	}
+	done := ks.loading
+	ks.lock.Unlock()
+
+	select {
+	case <-done:
+		ks.lock.RLock()
+		defer ks.lock.RUnlock()
+		return ks.loadErr
+	case <-ctx.Done():
+		return fmt.Errorf("stopped waiting for jwks: %w", ctx.Err())
+	}
+}
+
+// find returns the key, caller must hold ks.lock
+func (ks *KeySet) find(alg, kid string) (any, bool) {
+	for _, k := range ks.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		if keyFits(alg, k.key) {
+			return k.key, true
+		}
+	}
+	return nil, false
+}
+
+// fetch reads and parses keys from the source without holding the lock, replaces keys of the set on success
+func (ks *KeySet) fetch(ctx context.Context) error {
+	data, err := ks.read(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse jwks from %s: %w", ks.Source, err)
+	}
+	ks.lock.Lock()
+	ks.keys, ks.loadedAt = keys, time.Now()
+	ks.lock.Unlock()
+	log.Printf("[DEBUG] loaded %d keys from jwks %s", len(keys), ks.Source)
+	return nil
+}
+
+// read returns JWKS document from url or file
+func (ks *KeySet) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(ks.Source, "http://") && !strings.HasPrefix(ks.Source, "https://") {
+		data, err := os.ReadFile(ks.Source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwks file: %w", err)
+		}
+		return data, nil
+	}
+
+	client := ks.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.Source, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make jwks request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get jwks from %s: %w", ks.Source, err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get jwks from %s, status %d", ks.Source, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks from %s: %w", ks.Source, err)
+	}
+	return data, nil
+}
+
+// parseJWKS parses keys of JWKS document. Encryption keys and keys of unsupported types skipped.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+
+	res := make([]jwk, 0, len(doc.Keys))
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key any
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k.N, k.E)
+		case "EC":
+			key, err = ecKey(k.Crv, k.X, k.Y)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(k.K)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key #%d %q: %w", i, k.Kid, err)
+		}
+		res = append(res, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return res, nil
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil || len(nb) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil || len(eb) == 0 || len(eb) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	exp := 0
+	for _, b := range eb {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: exp}, nil
+}
+
+func ecKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	curve, ok := curves[crv]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	xb, errX := base64.RawURLEncoding.DecodeString(x)
+	yb, errY := base64.RawURLEncoding.DecodeString(y)
+	if errX != nil || errY != nil || len(xb) != size || len(yb) != size {
+		return nil, errors.New("invalid coordinates")
+	}
+	pub, err := ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, xb...), yb...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid point: %w", err)
+	}
+	return pub, nil
+}
+
+// keyFits checks if the key type matches the algorithm, prevents using public keys as HMAC secrets
+func keyFits(alg string, key any) bool {
+	switch k := key.(type) {
+	case []byte:
+		return strings.HasPrefix(alg, "HS")
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		curves := map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+		return curves[alg] == k.Curve.Params().BitSize
+	default:
+		return false
+	}
+}
@@ -0,0 +1,248 @@
+// Package jwt implements minimal validation of JSON Web Tokens used by proxy handlers,
+// i.e. to authenticate requests or to pick a claim for rate limiter keys. Only compact JWS serialization
+// is supported, tokens signed with HMAC (HS*), RSA (RS*, PS*) and ECDSA (ES*) algorithms.
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256 hash
+	_ "crypto/sha512" // register SHA-384 and SHA-512 hashes
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Claims is a set of token claims, values decoded from json as-is
+type Claims map[string]any
+
+// Verifier validates token signature and checks exp and nbf claims. HMAC tokens verified with Secret
+// or with symmetric key of the Keys, RSA and ECDSA tokens with public keys of the Keys.
+type Verifier struct {
+	Secret     []byte        // HMAC secret
+	Keys       *KeySet       // keys loaded from JWKS, optional
+	Leeway     time.Duration // allowed clock skew for exp and nbf checks
+	RequireExp bool          // reject tokens without exp claim
+
+	now func() time.Time // time source, overridden in tests
+}
+
+// algHashes maps supported algorithms to hash functions
+var algHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+var (
+	// ErrMalformed returned for tokens which can't be decoded
+	ErrMalformed = errors.New("malformed token")
+	// ErrSignature returned for tokens with invalid signature or unsupported algorithm
+	ErrSignature = errors.New("invalid token signature")
+	// ErrExpired returned for expired or not yet valid tokens
+	ErrExpired = errors.New("token expired or not valid yet")
+)
+
+// Verify checks token signature and time claims, returns token claims. Ctx limits waiting for reload of the key set.
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if err := v.verifySignature(ctx, header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkTime(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature checks signature of the signed part with the key matching algorithm and key id
+func (v *Verifier) verifySignature(ctx context.Context, alg, kid string, signed, sig []byte) error {
+	hash, ok := algHashes[alg]
+	if !ok {
+		return fmt.Errorf("%w, algorithm %q", ErrSignature, alg)
+	}
+	key, err := v.key(ctx, alg, kid)
+	if err != nil {
+		return err
+	}
+
+	if secret, ok := key.([]byte); ok {
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrSignature
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		}
+		if err != nil {
+			return ErrSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrSignature
+		}
+	default:
+		return fmt.Errorf("%w, algorithm %q", ErrSignature, alg)
+	}
+	return nil
+}
+
+// key returns verification key for the algorithm. Keys looked up in the key set, HMAC secret used for HS*
+// tokens not matching any key of the set.
+func (v *Verifier) key(ctx context.Context, alg, kid string) (any, error) {
+	hmacSecret := strings.HasPrefix(alg, "HS") && len(v.Secret) > 0
+	if v.Keys == nil || (hmacSecret && kid == "") {
+		if hmacSecret {
+			return v.Secret, nil
+		}
+		return nil, fmt.Errorf("%w, no key for algorithm %q", ErrSignature, alg)
+	}
+	key, err := v.Keys.Key(ctx, alg, kid)
+	if err != nil && hmacSecret {
+		return v.Secret, nil
+	}
+	return key, err
+}
+
+// checkTime validates exp and nbf claims if present, exp required if RequireExp set
+func (v *Verifier) checkTime(claims Claims) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	if _, ok := claims["exp"].(float64); !ok && v.RequireExp {
+		return ErrExpired
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-v.Leeway)) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// String returns claim value as string. Numbers and booleans formatted, other types and missing claims return empty string.
+func (c Claims) String(name string) string {
+	return formatClaim(c[name])
+}
+
+// formatClaim returns string, number and boolean claim values as string, empty string for other types
+func formatClaim(v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64, bool:
+		return fmt.Sprint(val)
+	default:
+		return ""
+	}
+}
+
+// List returns values of array claim formatted as strings, single value list for string, number and boolean claims
+func (c Claims) List(name string) []string {
+	arr, ok := c[name].([]any)
+	if !ok {
+		if v := formatClaim(c[name]); v != "" {
+			return []string{v}
+		}
+		return nil
+	}
+	res := make([]string, 0, len(arr))
+	for _, elem := range arr {
+		if v := formatClaim(elem); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Contains checks if the claim has the value. Array claims match any of the elements, string claims match
+// as a whole or any of space separated items, i.e. "read" matches scope claim "read write".
+func (c Claims) Contains(name, value string) bool {
+	switch val := c[name].(type) {
+	case []any:
+		for _, elem := range val {
+			if formatClaim(elem) == value {
+				return true
+			}
+		}
+		return false
+	case string:
+		if val == value {
+			return true
+		}
+		for item := range strings.FieldsSeq(val) {
+			if item == value {
+				return true
+			}
+		}
+		return false
+	default:
+		return value != "" && formatClaim(val) == value
+	}
+}
+
+// BearerToken extracts token from "Authorization: Bearer <token>" header value, returns empty string if not bearer
+func BearerToken(authHeader string) string {
+	scheme, token, ok := strings.Cut(authHeader, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
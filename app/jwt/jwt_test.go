@@ -0,0 +1,385 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	secret := []byte("secret")
+
+	tbl := []struct {
+		name   string
+		token  string
+		leeway time.Duration
+		err    error
+		sub    string
+	}{
+		{name: "valid", token: makeToken(t, "HS256", secret, Claims{"sub": "user1", "exp": now.Add(time.Minute).Unix()}),
+			sub: "user1"},
+		{name: "no time claims", token: makeToken(t, "HS256", secret, Claims{"sub": "user2"}), sub: "user2"},
+		{name: "expired", token: makeToken(t, "HS256", secret, Claims{"sub": "user1", "exp": now.Add(-time.Minute).Unix()}),
+			err: ErrExpired},
+		{name: "expired within leeway", token: makeToken(t, "HS256", secret,
+			Claims{"sub": "user1", "exp": now.Add(-time.Minute).Unix()}), leeway: 2 * time.Minute, sub: "user1"},
+		{name: "not valid yet", token: makeToken(t, "HS256", secret, Claims{"nbf": now.Add(time.Minute).Unix()}),
+			err: ErrExpired},
+		{name: "wrong secret", token: makeToken(t, "HS256", []byte("other"), Claims{"sub": "user1"}), err: ErrSignature},
+		{name: "unsupported alg", token: makeToken(t, "none", secret, Claims{"sub": "user1"}), err: ErrSignature},
+		{name: "two parts", token: "abc.def", err: ErrMalformed},
+		{name: "bad header", token: "!!.e30.sig", err: ErrMalformed},
+		{name: "bad signature encoding", token: "eyJhbGciOiJIUzI1NiJ9.e30.!!", err: ErrMalformed},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			v := Verifier{Secret: secret, Leeway: tt.leeway, now: func() time.Time { return now }}
+			claims, err := v.Verify(context.Background(), tt.token)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.sub, claims.String("sub"))
+		})
+	}
+}
+
+func TestVerifier_VerifyWithKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ks := &KeySet{Source: writeJWKS(t, rsaKey, ecKey, []byte("oct-secret"))}
+	require.NoError(t, ks.Load(context.Background()))
+
+	tbl := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "rs256", token: signToken(t, "RS256", "rsa1", rsaKey, Claims{"sub": "user1"})},
+		{name: "rs512", token: signToken(t, "RS512", "rsa1", rsaKey, Claims{"sub": "user1"})},
+		{name: "ps256", token: signToken(t, "PS256", "rsa1", rsaKey, Claims{"sub": "user1"})},
+		{name: "rs256 without kid", token: signToken(t, "RS256", "", rsaKey, Claims{"sub": "user1"})},
+		{name: "es256", token: signToken(t, "ES256", "ec1", ecKey, Claims{"sub": "user1"})},
+		{name: "hs256 with jwks key", token: signToken(t, "HS256", "oct1", []byte("oct-secret"), Claims{"sub": "user1"})},
+		{name: "hs256 with secret", token: signToken(t, "HS256", "", []byte("secret"), Claims{"sub": "user1"})},
+		{name: "unknown kid", token: signToken(t, "RS256", "rsa2", rsaKey, Claims{"sub": "user1"}), err: ErrSignature},
+		{name: "es384 with p256 key", token: signToken(t, "ES384", "ec1", ecKey, Claims{"sub": "user1"}), err: ErrSignature},
+		{name: "rs key as hmac secret", token: signToken(t, "HS256", "rsa1", rsaPublicKeyBytes(t, rsaKey), Claims{"sub": "user1"}),
+			err: ErrSignature},
+		{name: "tampered", token: signToken(t, "ES256", "ec1", ecKey, Claims{"sub": "user1"})[:20] + "x.e30.abc", err: ErrMalformed},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			v := Verifier{Secret: []byte("secret"), Keys: ks}
+			claims, err := v.Verify(context.Background(), tt.token)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "user1", claims.String("sub"))
+		})
+	}
+
+	t.Run("rs256 without key set", func(t *testing.T) {
+		v := Verifier{Secret: []byte("secret")}
+		_, err := v.Verify(context.Background(), signToken(t, "RS256", "rsa1", rsaKey, Claims{"sub": "user1"}))
+		require.ErrorIs(t, err, ErrSignature)
+	})
+}
+
+func TestVerifier_RequireExp(t *testing.T) {
+	v := Verifier{Secret: []byte("secret"), RequireExp: true}
+	_, err := v.Verify(context.Background(), makeToken(t, "HS256", []byte("secret"), Claims{"sub": "user1"}))
+	require.ErrorIs(t, err, ErrExpired)
+	_, err = v.Verify(context.Background(), makeToken(t, "HS256", []byte("secret"), Claims{"sub": "user1", "exp": time.Now().Add(time.Minute).Unix()}))
+	require.NoError(t, err)
+}
+
+func TestKeySet_Reload(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var requests atomic.Int32
+	jwks := atomic.Value{}
+	jwks.Store(jwksDoc(t, map[string]any{"rsa1": &key1.PublicKey}))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		data := jwks.Load().([]byte)
+		if len(data) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	defer ts.Close()
+
+	ks := &KeySet{Source: ts.URL, Refresh: time.Hour}
+	v := Verifier{Keys: ks}
+	_, err = v.Verify(context.Background(), signToken(t, "RS256", "rsa1", key1, Claims{"sub": "user1"}))
+	require.NoError(t, err, "loaded on first use")
+	assert.Equal(t, int32(1), requests.Load())
+
+	// rotate keys, unknown key id triggers reload
+	jwks.Store(jwksDoc(t, map[string]any{"rsa2": &key2.PublicKey}))
+	_, err = v.Verify(context.Background(), signToken(t, "RS256", "rsa2", key2, Claims{"sub": "user1"}))
+	require.ErrorIs(t, err, ErrSignature, "reload throttled")
+	assert.Equal(t, int32(1), requests.Load())
+
+	ks.triedAt = time.Now().Add(-time.Minute)
+	_, err = v.Verify(context.Background(), signToken(t, "RS256", "rsa2", key2, Claims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// failed reload keeps previous keys
+	jwks.Store([]byte{})
+	ks.triedAt, ks.loadedAt = time.Time{}, time.Now().Add(-2*time.Hour)
+	_, err = v.Verify(context.Background(), signToken(t, "RS256", "rsa2", key2, Claims{"sub": "user1"}))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestKeySet_ReloadNotBlocking(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1) > 1 {
+			<-release // reloads hang until released
+		}
+		_, _ = w.Write(jwksDoc(t, map[string]any{"rsa1": &key1.PublicKey}))
+	}))
+	defer ts.Close()
+	ks := &KeySet{Source: ts.URL}
+	require.NoError(t, ks.Load(context.Background()))
+	ks.triedAt = time.Now().Add(-time.Minute)
+
+	// unknown key ids trigger a single reload, waiters stop on their ctx
+	for range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err = ks.Key(ctx, "RS256", "rsa2")
+		cancel()
+		require.ErrorIs(t, err, ErrSignature)
+	}
+	assert.Equal(t, int32(2), requests.Load(), "single reload request")
+
+	// known key returned while reload in progress
+	st := time.Now()
+	_, err = ks.Key(context.Background(), "RS256", "rsa1")
+	require.NoError(t, err)
+	assert.Less(t, time.Since(st), 50*time.Millisecond)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		ks.lock.RLock()
+		defer ks.lock.RUnlock()
+		return ks.loading == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestParseJWKS(t *testing.T) {
+	tbl := []struct {
+		name string
+		data string
+		keys int
+		err  string
+	}{
+		{name: "oct and enc keys", data: `{"keys":[{"kty":"oct","kid":"a","k":"c2VjcmV0"},{"kty":"oct","use":"enc","k":"c2VjcmV0"}]}`,
+			keys: 1},
+		{name: "unsupported kty skipped", data: `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"abc"},{"kty":"oct","k":"c2VjcmV0"}]}`,
+			keys: 1},
+		{name: "no keys", data: `{"keys":[]}`, err: "no signing keys"},
+		{name: "bad json", data: `{"keys":`, err: "invalid json"},
+		{name: "bad rsa", data: `{"keys":[{"kty":"RSA","kid":"r","n":"","e":"AQAB"}]}`, err: `invalid key #0 "r": invalid modulus`},
+		{name: "bad curve", data: `{"keys":[{"kty":"EC","crv":"P-192","x":"AA","y":"AA"}]}`, err: `unsupported curve "P-192"`},
+		{name: "bad point", data: `{"keys":[{"kty":"EC","crv":"P-256","x":"` + strings.Repeat("A", 43) + `","y":"` +
+			strings.Repeat("A", 43) + `"}]}`, err: "invalid point"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(tt.data))
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, keys, tt.keys)
+		})
+	}
+}
+
+func TestKeySet_LoadFailed(t *testing.T) {
+	ks := &KeySet{Source: "/tmp/not-found-jwks.json"}
+	require.ErrorContains(t, ks.Load(context.Background()), "failed to read jwks file")
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	ks = &KeySet{Source: ts.URL}
+	require.ErrorContains(t, ks.Load(context.Background()), "status 404")
+}
+
+func TestClaims_Contains(t *testing.T) {
+	c := Claims{"aud": []any{"api", "web"}, "scope": "read write", "iss": "https://idp.example.com",
+		"admin": true, "level": float64(3), "obj": map[string]any{"k": "v"}}
+	assert.True(t, c.Contains("aud", "web"))
+	assert.False(t, c.Contains("aud", "other"))
+	assert.True(t, c.Contains("scope", "write"))
+	assert.True(t, c.Contains("scope", "read write"))
+	assert.False(t, c.Contains("scope", "admin"))
+	assert.True(t, c.Contains("iss", "https://idp.example.com"))
+	assert.True(t, c.Contains("admin", "true"))
+	assert.True(t, c.Contains("level", "3"))
+	assert.False(t, c.Contains("obj", ""))
+	assert.False(t, c.Contains("missing", ""))
+}
+
+func TestClaims_List(t *testing.T) {
+	c := Claims{"groups": []any{"admin", float64(2), map[string]any{}}, "sub": "user1", "o": map[string]any{"k": "v"}}
+	assert.Equal(t, []string{"admin", "2"}, c.List("groups"))
+	assert.Equal(t, []string{"user1"}, c.List("sub"))
+	assert.Empty(t, c.List("o"))
+	assert.Empty(t, c.List("missing"))
+}
+
+func TestClaims_String(t *testing.T) {
+	c := Claims{"s": "str", "n": float64(123), "b": true, "o": map[string]any{"k": "v"}}
+	assert.Equal(t, "str", c.String("s"))
+	assert.Equal(t, "123", c.String("n"))
+	assert.Equal(t, "true", c.String("b"))
+	assert.Empty(t, c.String("o"))
+	assert.Empty(t, c.String("missing"))
+}
+
+func TestBearerToken(t *testing.T) {
+	assert.Equal(t, "abc.def.ghi", BearerToken("Bearer abc.def.ghi"))
+	assert.Equal(t, "abc", BearerToken("bearer  abc"))
+	assert.Empty(t, BearerToken("Basic dXNlcjpwYXNz"))
+	assert.Empty(t, BearerToken("Bearer"))
+	assert.Empty(t, BearerToken(""))
+}
+
+// makeToken creates token signed with HS256 regardless of alg in the header
+func makeToken(t *testing.T, alg string, secret []byte, claims Claims) string {
+	t.Helper()
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+	unsigned := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken creates token signed with the key for the algorithm, key is []byte, *rsa.PrivateKey or *ecdsa.PrivateKey
+func signToken(t *testing.T, alg, kid string, key any, claims Claims) string {
+	t.Helper()
+	hdr := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	hdrData, err := json.Marshal(hdr)
+	require.NoError(t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(t, err)
+	unsigned := base64.RawURLEncoding.EncodeToString(hdrData) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	hash := algHashes[alg]
+	h := hash.New()
+	h.Write([]byte(unsigned))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(unsigned))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, h.Sum(nil))
+		}
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, serr := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		require.NoError(t, serr)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeJWKS writes JWKS file with public keys of rsa (kid rsa1) and ec (kid ec1) keys and oct key (kid oct1)
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey, secret []byte) string {
+	t.Helper()
+	fname := filepath.Join(t.TempDir(), "jwks.json")
+	data := jwksDoc(t, map[string]any{"rsa1": &rsaKey.PublicKey, "ec1": &ecKey.PublicKey, "oct1": secret})
+	require.NoError(t, os.WriteFile(fname, data, 0o600))
+	return fname
+}
+
+// jwksDoc makes JWKS document with the keys, map key is kid
+func jwksDoc(t *testing.T, keys map[string]any) []byte {
+	t.Helper()
+	enc := base64.RawURLEncoding.EncodeToString
+	doc := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case []byte:
+			doc.Keys = append(doc.Keys, map[string]string{"kty": "oct", "kid": kid, "k": enc(k)})
+		case *rsa.PublicKey:
+			doc.Keys = append(doc.Keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+				"n": enc(k.N.Bytes()), "e": enc([]byte{1, 0, 1})})
+		case *ecdsa.PublicKey:
+			point, err := k.Bytes()
+			require.NoError(t, err)
+			size := (len(point) - 1) / 2
+			doc.Keys = append(doc.Keys, map[string]string{"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name,
+				"x": enc(point[1 : 1+size]), "y": enc(point[1+size:])})
+		}
+	}
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	return data
+}
+
+// rsaPublicKeyBytes returns DER encoded public key, used to try it as HMAC secret
+func rsaPublicKeyBytes(t *testing.T, key *rsa.PrivateKey) []byte {
+	t.Helper()
+	data, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return data
+}
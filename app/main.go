@@ -5,12 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
+	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -29,14 +28,24 @@ import (
 	"github.com/libdns/route53"
 	"github.com/libdns/scaleway"
 	"github.com/umputun/go-flags"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v3"
 
+	"github.com/umputun/reproxy/app/apikey"
 	"github.com/umputun/reproxy/app/discovery"
 	"github.com/umputun/reproxy/app/discovery/provider"
 	"github.com/umputun/reproxy/app/discovery/provider/consulcatalog"
+	"github.com/umputun/reproxy/app/geoip"
+	"github.com/umputun/reproxy/app/htpasswd"
+	"github.com/umputun/reproxy/app/jwt"
+	"github.com/umputun/reproxy/app/maintenance"
 	"github.com/umputun/reproxy/app/mgmt"
+	"github.com/umputun/reproxy/app/oidc"
 	"github.com/umputun/reproxy/app/plugin"
 	"github.com/umputun/reproxy/app/proxy"
+	"github.com/umputun/reproxy/app/tracing"
+	"github.com/umputun/reproxy/app/waf"
 )
 
 var opts struct {
@@ -47,6 +56,8 @@ var opts struct {
 	DropHeaders         []string `long:"drop-header" env:"DROP_HEADERS" description:"incoming headers to drop" env-delim:","`
 	AuthBasicHtpasswd   string   `long:"basic-htpasswd" env:"BASIC_HTPASSWD" description:"htpasswd file for basic auth"`
 	RemoteLookupHeaders bool     `long:"remote-lookup-headers" env:"REMOTE_LOOKUP_HEADERS" description:"enable remote lookup headers, trust only behind a trusted proxy"`
+	TrustedProxies      []string `long:"trusted-proxy" env:"TRUSTED_PROXY" env-delim:"," description:"trusted proxy ip or CIDR, enables remote lookup headers from them only"`
+	ForwardedHeader     bool     `long:"forwarded-header" env:"FORWARDED_HEADER" description:"add RFC 7239 Forwarded header to proxied requests"`
 	LBType              string   `long:"lb-type" env:"LB_TYPE" description:"load balancer type" choice:"random" choice:"failover" choice:"roundrobin" default:"random"` // nolint
 	Insecure            bool     `long:"insecure" env:"INSECURE" description:"skip SSL certificate verification for the destination host"`
 	KeepHost            bool     `long:"keep-host" env:"KEEP_HOST" description:"pass the Host header from the client as-is, instead of rewriting it"`
@@ -129,6 +140,7 @@ var opts struct {
 		FileName   string `long:"file" env:"FILE"  default:"access.log" description:"location of access log"`
 		MaxSize    string `long:"max-size" env:"MAX_SIZE" default:"100M" description:"maximum size before it gets rotated"`
 		MaxBackups int    `long:"max-backups" env:"MAX_BACKUPS" default:"10" description:"maximum number of old log files to retain"`
+		Format     string `long:"format" env:"FORMAT" description:"access log format" choice:"combined" choice:"json" choice:"logfmt" default:"combined"` // nolint
 	} `group:"logger" namespace:"logger" env-namespace:"LOGGER"`
 
 	Docker struct {
@@ -177,21 +189,91 @@ var opts struct {
 		LowCardinality bool   `long:"low-cardinality" env:"LOW_CARDINALITY" description:"use route patterns instead of raw paths for metrics labels"`
 	} `group:"mgmt" namespace:"mgmt" env-namespace:"MGMT"`
 
+	Maintenance struct {
+		Enabled bool   `long:"enabled" env:"ENABLED" description:"enable maintenance mode, managed by management API"`
+		File    string `long:"file" env:"FILE" default:"./var/maintenance.json" description:"maintenance state file"`
+		Token   string `long:"token" env:"TOKEN" description:"bearer token of maintenance API, required unless mgmt listens on loopback"`
+	} `group:"maintenance" namespace:"maintenance" env-namespace:"MAINTENANCE"`
+
+	SecurityHeaders struct {
+		Preset     string   `long:"preset" env:"PRESET" description:"security headers preset" choice:"none" choice:"basic" choice:"strict" default:"none"` // nolint
+		Set        []string `long:"set" env:"SET" env-delim:";" description:"security header value, key=value, i.e. frame=DENY"`
+		Drop       []string `long:"drop" env:"DROP" env-delim:"," description:"security header to opt out, i.e. hsts"`
+		ReportOnly bool     `long:"csp-report-only" env:"CSP_REPORT_ONLY" description:"send content security policy as report-only"`
+	} `group:"security-headers" namespace:"security-headers" env-namespace:"SECURITY_HEADERS"`
+
 	ErrorReport struct {
-		Enabled  bool   `long:"enabled" env:"ENABLED" description:"enable html errors reporting"`
-		Template string `long:"template" env:"TEMPLATE" description:"error message template file"`
+		Enabled   bool   `long:"enabled" env:"ENABLED" description:"enable html errors reporting and error format negotiation"`
+		Template  string `long:"template" env:"TEMPLATE" description:"error message template file"`
+		Dir       string `long:"dir" env:"DIR" description:"directory with error templates keyed by status code"`
+		Intercept bool   `long:"intercept" env:"INTERCEPT" description:"replace upstream 5xx responses with error page"`
 	} `group:"error" namespace:"error" env-namespace:"ERROR"`
 
+	RequestID struct {
+		Enabled bool   `long:"enabled" env:"ENABLED" description:"enable request id"`
+		Header  string `long:"header" env:"HEADER" default:"X-Request-ID" description:"request id header"`
+		Trust   bool   `long:"trust" env:"TRUST" description:"accept incoming request id, only from trusted proxies if defined"`
+	} `group:"request-id" namespace:"request-id" env-namespace:"REQUEST_ID"`
+
+	Tracing struct {
+		Enabled     bool     `long:"enabled" env:"ENABLED" description:"enable OpenTelemetry tracing"`
+		Exporter    string   `long:"exporter" env:"EXPORTER" description:"spans exporter" choice:"otlp" choice:"stdout" default:"otlp"` // nolint
+		Endpoint    string   `long:"endpoint" env:"ENDPOINT" default:"http://localhost:4318" description:"OTLP/HTTP collector url"`
+		Headers     []string `long:"header" env:"HEADER" env-delim:"," description:"OTLP request header, key:value"`
+		SampleRatio float64  `long:"sample-ratio" env:"SAMPLE_RATIO" default:"1" description:"ratio of sampled traces, 0..1"`
+		ServiceName string   `long:"service-name" env:"SERVICE_NAME" default:"reproxy" description:"service name reported to tracing backend"`
+	} `group:"tracing" namespace:"tracing" env-namespace:"TRACING"`
+
 	HealthCheck struct {
 		Enabled  bool          `long:"enabled" env:"ENABLED" description:"enable automatic health-check"`
 		Interval time.Duration `long:"interval" env:"INTERVAL" default:"300s" description:"automatic health-check interval"`
 	} `group:"health-check" namespace:"health-check" env-namespace:"HEALTH_CHECK"`
 
 	Throttle struct {
-		System int `long:"system" env:"SYSTEM" default:"0" description:"throttle overall activity'"`
-		User   int `long:"user" env:"USER"  default:"0" description:"limit req/sec per user and per proxy destination"`
+		System   int    `long:"system" env:"SYSTEM" default:"0" description:"throttle overall activity'"`
+		User     int    `long:"user" env:"USER"  default:"0" description:"limit req/sec per user and per proxy destination"`
+		KeysFile string `long:"keys-file" env:"KEYS_FILE" description:"per-key rate overrides of route throttle, yaml"`
 	} `group:"throttle" namespace:"throttle" env-namespace:"THROTTLE"`
 
+	JWT struct {
+		Secret      string        `long:"secret" env:"SECRET" description:"HMAC secret to validate bearer tokens"`
+		Leeway      time.Duration `long:"leeway" env:"LEEWAY" default:"0s" description:"allowed clock skew for exp and nbf claims"`
+		JWKS        string        `long:"jwks" env:"JWKS" description:"JWKS file or url with keys to validate bearer tokens"`
+		JWKSRefresh time.Duration `long:"jwks-refresh" env:"JWKS_REFRESH" default:"1h" description:"JWKS reload interval"`
+		RequireExp  bool          `long:"require-exp" env:"REQUIRE_EXP" description:"reject bearer tokens without exp claim"`
+	} `group:"jwt" namespace:"jwt" env-namespace:"JWT"`
+
+	OIDC struct {
+		Issuer       string        `long:"issuer" env:"ISSUER" description:"OIDC issuer url, enables oidc login"`
+		ClientID     string        `long:"client-id" env:"CLIENT_ID" description:"OIDC client id"`
+		ClientSecret string        `long:"client-secret" env:"CLIENT_SECRET" description:"OIDC client secret"`
+		Scopes       []string      `long:"scopes" env:"SCOPES" env-delim:"," default:"openid" default:"email" default:"profile" description:"OIDC scopes"`
+		CallbackPath string        `long:"callback-path" env:"CALLBACK_PATH" default:"/oauth2/callback" description:"OIDC callback path"`
+		CookieName   string        `long:"cookie-name" env:"COOKIE_NAME" default:"reproxy_session" description:"session cookie name"`
+		CookieSecret string        `long:"cookie-secret" env:"COOKIE_SECRET" description:"session cookie encryption secret, 16+ characters"`
+		SessionTTL   time.Duration `long:"session-ttl" env:"SESSION_TTL" default:"12h" description:"session lifetime"`
+		GroupsClaim  string        `long:"groups-claim" env:"GROUPS_CLAIM" default:"groups" description:"id token claim with user's groups"`
+	} `group:"oidc" namespace:"oidc" env-namespace:"OIDC"`
+
+	Htpasswd struct {
+		Files map[string]string `long:"file" env:"FILE" env-delim:"," description:"named htpasswd file for routes' auth-file, name:path"`
+	} `group:"htpasswd" namespace:"htpasswd" env-namespace:"HTPASSWD"`
+
+	APIKeys struct {
+		File string `long:"file" env:"FILE" description:"api keys file with hashed keys of clients, yaml"`
+	} `group:"api-keys" namespace:"api-keys" env-namespace:"API_KEYS"`
+
+	GeoIP struct {
+		CountryDB string `long:"country-db" env:"COUNTRY_DB" description:"maxmind country or city database file, mmdb"`
+		ASNDB     string `long:"asn-db" env:"ASN_DB" description:"maxmind asn database file, mmdb"`
+		Header    string `long:"header" env:"HEADER" default:"X-Country-Code" description:"request header with client's country"`
+	} `group:"geoip" namespace:"geoip" env-namespace:"GEOIP"`
+
+	WAF struct {
+		File      string `long:"file" env:"FILE" description:"waf rules file, yaml"`
+		TagHeader string `long:"tag-header" env:"TAG_HEADER" default:"X-Waf-Tags" description:"request header with tags of matched rules"`
+	} `group:"waf" namespace:"waf" env-namespace:"WAF"`
+
 	Upstream struct {
 		MaxIdleConns    int `long:"max-idle-conns" env:"MAX_IDLE_CONNS" default:"100" description:"max idle connections total"`
 		MaxConnsPerHost int `long:"max-conns" env:"MAX_CONNS" default:"0" description:"max connections per upstream host (0=unlimited)"`
@@ -321,7 +403,7 @@ func run() error {
 	addr := listenAddress(opts.Listen, opts.SSL.Type)
 	log.Printf("[DEBUG] listen address %s", addr)
 
-	maxBodySize, perr := sizeParse(opts.MaxSize)
+	maxBodySize, perr := sizeOption(opts.MaxSize)
 	if perr != nil {
 		return fmt.Errorf("failed to convert MaxSize: %w", perr)
 	}
@@ -331,30 +413,81 @@ func run() error {
 		proxyHeaders = splitAtCommas(os.Getenv("HEADER")) // env value may have comma inside "", parsed separately
 	}
 
-	basicAuthAllowed, baErr := makeBasicAuth(opts.AuthBasicHtpasswd)
+	basicAuthFile, baErr := makeBasicAuth(ctx, opts.AuthBasicHtpasswd)
 	if baErr != nil {
 		return fmt.Errorf("failed to load basic auth: %w", baErr)
 	}
 
+	htpasswdFiles, hfErr := makeHtpasswdFiles(ctx, opts.Htpasswd.Files)
+	if hfErr != nil {
+		return fmt.Errorf("failed to load htpasswd files: %w", hfErr)
+	}
+
+	throttleOverrides, toErr := makeThrottleOverrides(opts.Throttle.KeysFile)
+	if toErr != nil {
+		return fmt.Errorf("failed to load throttle keys: %w", toErr)
+	}
+
+	tracer, trErr := makeTracer(ctx)
+	if trErr != nil {
+		return fmt.Errorf("failed to make tracer: %w", trErr)
+	}
+
+	realIP, riErr := makeRealIP()
+	if riErr != nil {
+		return fmt.Errorf("failed to make real ip resolver: %w", riErr)
+	}
+
+	securityHeaders, shErr := makeSecurityHeaders()
+	if shErr != nil {
+		return fmt.Errorf("failed to make security headers: %w", shErr)
+	}
+
+	oidcProvider, oiErr := makeOIDC()
+	if oiErr != nil {
+		return fmt.Errorf("failed to make oidc provider: %w", oiErr)
+	}
+
+	apiKeys, akErr := makeAPIKeys(ctx)
+	if akErr != nil {
+		return fmt.Errorf("failed to load api keys: %w", akErr)
+	}
+
+	geoIP, geoErr := makeGeoIP(ctx)
+	if geoErr != nil {
+		return fmt.Errorf("failed to load geoip database: %w", geoErr)
+	}
+
+	wafRules, wafErr := makeWAF(ctx)
+	if wafErr != nil {
+		return fmt.Errorf("failed to load waf rules: %w", wafErr)
+	}
+
+	mntStore, mntErr := makeMaintenanceStore()
+	if mntErr != nil {
+		return fmt.Errorf("failed to make maintenance store: %w", mntErr)
+	}
+
 	px := &proxy.Http{
-		Version:        revision,
-		Matcher:        svc,
-		Address:        addr,
-		MaxBodySize:    int64(maxBodySize), //nolint
-		AssetsLocation: opts.Assets.Location,
-		AssetsWebRoot:  opts.Assets.WebRoot,
-		Assets404:      opts.Assets.NotFound,
-		AssetsSPA:      opts.Assets.SPA,
-		CacheControl:   cacheControl,
-		GzEnabled:      opts.GzipEnabled,
-		SSLConfig:      sslConfig,
-		Insecure:       opts.Insecure,
-		ProxyHeaders:   proxyHeaders,
-		DropHeader:     opts.DropHeaders,
-		AccessLog:      accessLog,
-		StdOutEnabled:  opts.Logger.StdOut,
-		Signature:      opts.Signature,
-		LBSelector:     makeLBSelector(),
+		Version:         revision,
+		Matcher:         svc,
+		Address:         addr,
+		MaxBodySize:     maxBodySize,
+		AssetsLocation:  opts.Assets.Location,
+		AssetsWebRoot:   opts.Assets.WebRoot,
+		Assets404:       opts.Assets.NotFound,
+		AssetsSPA:       opts.Assets.SPA,
+		CacheControl:    cacheControl,
+		GzEnabled:       opts.GzipEnabled,
+		SSLConfig:       sslConfig,
+		Insecure:        opts.Insecure,
+		ProxyHeaders:    proxyHeaders,
+		DropHeader:      opts.DropHeaders,
+		AccessLog:       accessLog,
+		AccessLogFormat: opts.Logger.Format,
+		StdOutEnabled:   opts.Logger.StdOut,
+		Signature:       opts.Signature,
+		LBSelector:      makeLBSelector(),
 		Timeouts: proxy.Timeouts{
 			ReadHeader:     opts.Timeouts.ReadHeader,
 			Write:          opts.Timeouts.Write,
@@ -366,15 +499,32 @@ func run() error {
 			ExpectContinue: opts.Timeouts.ExpectContinue,
 			ResponseHeader: opts.Timeouts.ResponseHeader,
 		},
-		Metrics:                 makeMetrics(ctx, svc),
+		Metrics:                 makeMetrics(ctx, svc, mntStore),
 		Reporter:                errReporter,
-		PluginConductor:         makePluginConductor(ctx),
+		ErrorIntercept:          opts.ErrorReport.Intercept,
+		PluginConductor:         makePluginConductor(ctx, tracer),
 		ThrottleSystem:          opts.Throttle.System * 3,
 		ThrottleUser:            opts.Throttle.User,
-		BasicAuthEnabled:        len(basicAuthAllowed) > 0,
-		BasicAuthAllowed:        basicAuthAllowed,
+		ThrottleOverrides:       throttleOverrides,
+		TokenVerifier:           makeTokenVerifier(ctx),
+		OIDC:                    oidcProvider,
+		APIKeys:                 apiKeys,
+		GeoIP:                   geoIP,
+		GeoIPHeader:             opts.GeoIP.Header,
+		WAF:                     wafRules,
+		WAFTagHeader:            opts.WAF.TagHeader,
+		Maintenance:             maintenanceMatcher(mntStore),
+		SecurityHeaders:         securityHeaders,
+		BasicAuthEnabled:        basicAuthFile != nil,
+		BasicAuthFile:           basicAuthFile,
+		HtpasswdFiles:           htpasswdFiles,
 		KeepHost:                opts.KeepHost,
 		OnlyFrom:                makeOnlyFromMiddleware(),
+		RealIP:                  realIP,
+		ForwardedHeader:         opts.ForwardedHeader,
+		RequestIDHeader:         makeRequestIDHeader(),
+		RequestIDTrust:          opts.RequestID.Trust,
+		Tracer:                  tracer,
 		UpstreamMaxIdleConns:    opts.Upstream.MaxIdleConns,
 		UpstreamMaxConnsPerHost: opts.Upstream.MaxConnsPerHost,
 	}
@@ -390,22 +540,268 @@ func run() error {
 	return nil
 }
 
-// makeBasicAuth returns a list of allowed basic auth users and password hashes.
-// if no htpasswd file is specified, an empty list is returned.
-func makeBasicAuth(htpasswdFile string) ([]string, error) {
-	var basicAuthAllowed []string
-	if htpasswdFile != "" {
-		data, err := os.ReadFile(htpasswdFile) //nolint:gosec //read file with opts passed path
+// makeBasicAuth returns global basic auth users loaded from htpasswd file and reloaded on change.
+// if no htpasswd file is specified, nil is returned.
+func makeBasicAuth(ctx context.Context, htpasswdFile string) (proxy.Htpasswd, error) {
+	if htpasswdFile == "" {
+		return nil, nil
+	}
+	f, err := loadHtpasswd(ctx, htpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// makeHtpasswdFiles loads named htpasswd files referenced by routes, each file reloaded on change
+func makeHtpasswdFiles(ctx context.Context, files map[string]string) (map[string]proxy.Htpasswd, error) {
+	res := make(map[string]proxy.Htpasswd, len(files))
+	for name, fileName := range files {
+		f, err := loadHtpasswd(ctx, fileName)
+		if err != nil {
+			return nil, fmt.Errorf("htpasswd %q: %w", name, err)
+		}
+		res[name] = f
+	}
+	return res, nil
+}
+
+// loadHtpasswd loads htpasswd file and watches it for changes, failed reload keeps the current users
+func loadHtpasswd(ctx context.Context, fileName string) (*htpasswd.File, error) {
+	f, err := htpasswd.NewFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] loaded %d users from htpasswd %s", f.Len(), fileName)
+	watchFile(ctx, fileName, func() error {
+		if err := f.Load(); err != nil {
+			return err
+		}
+		log.Printf("[INFO] reloaded %d users from htpasswd %s", f.Len(), fileName)
+		return nil
+	})
+	return f, nil
+}
+
+// makeThrottleOverrides loads per-key limits from yaml file with key: limit pairs, limit defined the same way
+// as route's throttle, i.e. "100/m burst 20". If no file is specified, no overrides are returned.
+func makeThrottleOverrides(keysFile string) (map[string]discovery.RateLimit, error) {
+	if keysFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(keysFile) //nolint:gosec //read file with opts passed path
+	if err != nil {
+		return nil, fmt.Errorf("failed to read throttle keys file %s: %w", keysFile, err)
+	}
+	keys := map[string]string{}
+	if err = yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse throttle keys file %s: %w", keysFile, err)
+	}
+	res := make(map[string]discovery.RateLimit, len(keys))
+	for k, v := range keys {
+		limit, perr := discovery.ParseRateLimit(v)
+		if perr != nil {
+			return nil, fmt.Errorf("invalid limit %q for throttle key %q: %w", v, k, perr)
+		}
+		res[k] = limit
+	}
+	log.Printf("[INFO] loaded %d throttle key overrides from %s", len(res), keysFile)
+	return res, nil
+}
+
+// makeTokenVerifier returns bearer token verifier if jwt secret or jwks is set, nil otherwise.
+// JWKS loaded on start, failed load is not fatal as keys reloaded on the first use.
+func makeTokenVerifier(ctx context.Context) proxy.TokenVerifier {
+	if opts.JWT.Secret == "" && opts.JWT.JWKS == "" {
+		return nil
+	}
+	res := &jwt.Verifier{Secret: []byte(opts.JWT.Secret), Leeway: opts.JWT.Leeway, RequireExp: opts.JWT.RequireExp}
+	if opts.JWT.JWKS != "" {
+		res.Keys = &jwt.KeySet{Source: opts.JWT.JWKS, Refresh: opts.JWT.JWKSRefresh}
+		if err := res.Keys.Load(ctx); err != nil {
+			log.Printf("[WARN] can't load jwks, %v", err)
+		}
+	}
+	return res
+}
+
+// makeOIDC returns oidc login provider if oidc issuer is set, nil otherwise.
+// Provider discovered on the first login, unavailable provider is not fatal.
+func makeOIDC() (proxy.OIDCProvider, error) {
+	if opts.OIDC.Issuer == "" {
+		return nil, nil
+	}
+	res, err := oidc.NewClient(oidc.Config{
+		Issuer:       opts.OIDC.Issuer,
+		ClientID:     opts.OIDC.ClientID,
+		ClientSecret: opts.OIDC.ClientSecret,
+		Scopes:       opts.OIDC.Scopes,
+		CallbackPath: opts.OIDC.CallbackPath,
+		CookieName:   opts.OIDC.CookieName,
+		CookieSecret: opts.OIDC.CookieSecret,
+		SessionTTL:   opts.OIDC.SessionTTL,
+		GroupsClaim:  opts.OIDC.GroupsClaim,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] oidc login with %s, callback %s", opts.OIDC.Issuer, opts.OIDC.CallbackPath)
+	return res, nil
+}
+
+// makeAPIKeys returns api keys store if api keys file is set, nil otherwise.
+// The file reloaded on change, failed reload keeps the current keys.
+func makeAPIKeys(ctx context.Context) (proxy.APIKeyStore, error) {
+	if opts.APIKeys.File == "" {
+		return nil, nil
+	}
+	fileName := opts.APIKeys.File
+	store, err := apikey.NewStore(fileName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] loaded %d api keys from %s", store.Len(), fileName)
+	watchFile(ctx, fileName, func() error {
+		if err := store.Load(); err != nil {
+			return err
+		}
+		log.Printf("[INFO] reloaded %d api keys from %s", store.Len(), fileName)
+		return nil
+	})
+	return store, nil
+}
+
+// makeWAF returns waf rules if waf rules file is set, nil otherwise.
+// Rules reloaded on change.
+func makeWAF(ctx context.Context) (proxy.WAF, error) {
+	if opts.WAF.File == "" {
+		return nil, nil
+	}
+	fileName := opts.WAF.File
+	rules, err := waf.NewRules(fileName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] loaded %d waf rules from %s", rules.Len(), fileName)
+	watchFile(ctx, fileName, func() error {
+		if err := rules.Load(); err != nil {
+			return err
+		}
+		log.Printf("[INFO] reloaded %d waf rules from %s", rules.Len(), fileName)
+		return nil
+	})
+	return rules, nil
+}
+
+// makeGeoIP returns geoip resolver with country and asn databases, nil if no database is set.
+// Databases reloaded on change.
+func makeGeoIP(ctx context.Context) (proxy.GeoIP, error) {
+	res := geoip.Resolver{}
+	for _, fileName := range []string{opts.GeoIP.CountryDB, opts.GeoIP.ASNDB} {
+		if fileName == "" {
+			continue
+		}
+		db, err := geoip.NewDB(fileName)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read htpasswd file %s: %w", htpasswdFile, err)
+			return nil, err
 		}
-		basicAuthAllowed = strings.Split(string(data), "\n")
-		for i, v := range basicAuthAllowed {
-			basicAuthAllowed[i] = strings.TrimSpace(v)
-			basicAuthAllowed[i] = strings.ReplaceAll(basicAuthAllowed[i], "\t", "")
+		log.Printf("[INFO] loaded geoip database %s from %s", db.Metadata().DatabaseType, fileName)
+		watchFile(ctx, fileName, func() error {
+			if err := db.Load(); err != nil {
+				return err
+			}
+			log.Printf("[INFO] reloaded geoip database %s from %s", db.Metadata().DatabaseType, fileName)
+			return nil
+		})
+		res = append(res, db)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// watchFile calls reload on each change of the file, changes detected and debounced the same way as by file provider
+func watchFile(ctx context.Context, fileName string, reload func() error) {
+	fp := &provider.File{FileName: fileName, CheckInterval: opts.File.CheckInterval, Delay: opts.File.Delay}
+	events := fp.Events(ctx)
+	go func() {
+		for range events {
+			if err := reload(); err != nil {
+				log.Printf("[WARN] can't reload %s, %v", fileName, err)
+			}
 		}
+	}()
+}
+
+// makeSecurityHeaders makes global security headers policy from preset, header values and opted out headers
+func makeSecurityHeaders() (res discovery.SecurityHeaders, err error) {
+	if opts.SecurityHeaders.Preset != "none" {
+		res.Preset = discovery.SecurityPreset(opts.SecurityHeaders.Preset)
+	}
+	res.ReportOnly = opts.SecurityHeaders.ReportOnly
+	for _, v := range opts.SecurityHeaders.Set {
+		key, val, ok := strings.Cut(v, "=")
+		name, known := discovery.SecurityHeaderName(key)
+		if !ok || !known {
+			return discovery.SecurityHeaders{}, fmt.Errorf("invalid security header %q, expected key=value with known key", v)
+		}
+		if res.Set == nil {
+			res.Set = map[string]string{}
+		}
+		res.Set[name] = strings.TrimSpace(val)
+	}
+	for _, key := range opts.SecurityHeaders.Drop {
+		name, known := discovery.SecurityHeaderName(key)
+		if !known {
+			return discovery.SecurityHeaders{}, fmt.Errorf("unknown security header %q", key)
+		}
+		res.Drop = append(res.Drop, name)
 	}
-	return basicAuthAllowed, nil
+	return res, nil
+}
+
+// makeMaintenanceStore loads maintenance state if maintenance mode enabled, nil otherwise
+func makeMaintenanceStore() (*maintenance.Store, error) {
+	if !opts.Maintenance.Enabled {
+		return nil, nil
+	}
+	if !opts.Management.Enabled {
+		log.Printf("[WARN] maintenance mode enabled without management API, state can't be changed")
+	}
+	if opts.Management.Enabled && opts.Maintenance.Token == "" && !isLoopbackListen(opts.Management.Listen) {
+		return nil, fmt.Errorf("maintenance mode requires --maintenance.token, management API listens on non-loopback %s",
+			opts.Management.Listen)
+	}
+	store, err := maintenance.NewStore(opts.Maintenance.File)
+	if err != nil {
+		return nil, fmt.Errorf("can't load maintenance state: %w", err)
+	}
+	for _, e := range store.List() {
+		log.Printf("[INFO] %s maintenance active, server %q, route %q, since %s", e.Scope(), e.Server, e.Route, e.Since)
+	}
+	return store, nil
+}
+
+// isLoopbackListen checks if listen address (host:port) is bound to loopback interface only
+func isLoopbackListen(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// maintenanceMatcher returns store as proxy.MaintenanceMatcher, avoiding non-nil interface with nil store
+func maintenanceMatcher(store *maintenance.Store) proxy.MaintenanceMatcher {
+	if store == nil {
+		return nil
+	}
+	return store
 }
 
 // make all providers. the order is matter, defines which provider will have priority in case of conflicting rules
@@ -454,13 +850,14 @@ func makeProviders() ([]discovery.Provider, error) {
 	return res, nil
 }
 
-func makePluginConductor(ctx context.Context) proxy.MiddlewareProvider {
+func makePluginConductor(ctx context.Context, tracer *tracing.Tracer) proxy.MiddlewareProvider {
 	if !opts.Plugin.Enabled {
 		return nil
 	}
 
 	conductor := &plugin.Conductor{
 		Address: opts.Plugin.Listen,
+		Tracer:  tracer,
 		RPCDialer: plugin.RPCDialerFunc(func(_, address string) (plugin.RPCClient, error) {
 			return rpc.Dial("tcp", address)
 		}),
@@ -473,7 +870,51 @@ func makePluginConductor(ctx context.Context) proxy.MiddlewareProvider {
 	return conductor
 }
 
-func makeMetrics(ctx context.Context, informer mgmt.Informer) proxy.MiddlewareProvider {
+// makeTracer makes tracer with otlp or stdout exporter, remaining spans exported on ctx cancellation.
+// Returns nil tracer if tracing disabled.
+func makeTracer(ctx context.Context) (*tracing.Tracer, error) {
+	if !opts.Tracing.Enabled {
+		return nil, nil
+	}
+	if opts.Tracing.SampleRatio < 0 || opts.Tracing.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid sample ratio %v, should be in 0..1", opts.Tracing.SampleRatio)
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Tracing.Exporter {
+	case "stdout":
+		exporter, err = tracing.NewStdoutExporter(os.Stdout)
+	default:
+		headers := map[string]string{}
+		for _, h := range opts.Tracing.Headers {
+			k, v, ok := strings.Cut(h, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid tracing header %q, should be key:value", h)
+			}
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		exporter, err = tracing.NewOTLPExporter(ctx, opts.Tracing.Endpoint, headers)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] tracing enabled, exporter %s, sample ratio %v", opts.Tracing.Exporter, opts.Tracing.SampleRatio)
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exporter, SampleRatio: opts.Tracing.SampleRatio,
+		Service: opts.Tracing.ServiceName, Version: revision})
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[WARN] %v", err)
+		}
+	}()
+	return tracer, nil
+}
+
+func makeMetrics(ctx context.Context, informer mgmt.Informer, mntStore *maintenance.Store) proxy.MiddlewareProvider {
 	if !opts.Management.Enabled {
 		return nil
 	}
@@ -482,11 +923,13 @@ func makeMetrics(ctx context.Context, informer mgmt.Informer) proxy.MiddlewarePr
 	})
 	go func() {
 		mgSrv := mgmt.Server{
-			Listen:         opts.Management.Listen,
-			Informer:       informer,
-			AssetsLocation: opts.Assets.Location,
-			AssetsWebRoot:  opts.Assets.WebRoot,
-			Version:        revision,
+			Listen:           opts.Management.Listen,
+			Informer:         informer,
+			AssetsLocation:   opts.Assets.Location,
+			AssetsWebRoot:    opts.Assets.WebRoot,
+			Version:          revision,
+			Maintenance:      mntStore,
+			MaintenanceToken: opts.Maintenance.Token,
 		}
 		if err := mgSrv.Run(ctx); err != nil {
 			log.Printf("[WARN] management service failed, %v", err)
@@ -591,15 +1034,47 @@ func makeLBSelector() proxy.LBSelector {
 }
 
 func makeOnlyFromMiddleware() *proxy.OnlyFrom {
-	if opts.RemoteLookupHeaders {
-		return proxy.NewOnlyFrom(proxy.OFRealIP, proxy.OFForwarded, proxy.OFRemoteAddr)
+	if opts.RemoteLookupHeaders || len(opts.TrustedProxies) > 0 {
+		return proxy.NewOnlyFrom(proxy.OFRealIP, proxy.OFForwarded, proxy.OFForwardedRFC, proxy.OFRemoteAddr)
 	}
 	return proxy.NewOnlyFrom(proxy.OFRemoteAddr)
 }
 
+// makeRealIP makes client ip resolver. With trusted proxies X-Forwarded-For and Forwarded are checked first,
+// as they carry the whole chain of hops, and X-Real-IP is used only if none of them set.
+func makeRealIP() (*proxy.RealIP, error) {
+	switch {
+	case len(opts.TrustedProxies) > 0:
+		log.Printf("[INFO] trusted proxies: %v", opts.TrustedProxies)
+		return proxy.NewRealIP(opts.TrustedProxies, proxy.OFForwarded, proxy.OFForwardedRFC, proxy.OFRealIP, proxy.OFRemoteAddr)
+	case opts.RemoteLookupHeaders:
+		return proxy.NewRealIP(nil, proxy.OFRealIP, proxy.OFForwarded, proxy.OFForwardedRFC, proxy.OFRemoteAddr)
+	default:
+		return proxy.NewRealIP(nil, proxy.OFRemoteAddr)
+	}
+}
+
+// makeRequestIDHeader returns request id header name, empty if request id disabled
+func makeRequestIDHeader() string {
+	if !opts.RequestID.Enabled || opts.RequestID.Header == "" {
+		return ""
+	}
+	log.Printf("[INFO] request id enabled, header %s", opts.RequestID.Header)
+	return http.CanonicalHeaderKey(opts.RequestID.Header)
+}
+
 func makeErrorReporter() (proxy.Reporter, error) {
 	result := &proxy.ErrorReporter{
 		Nice: opts.ErrorReport.Enabled,
+		Dir:  opts.ErrorReport.Dir,
+	}
+	if opts.ErrorReport.Dir != "" {
+		if fi, err := os.Stat(opts.ErrorReport.Dir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("error templates directory %s is not accessible", opts.ErrorReport.Dir)
+		}
+		if !opts.ErrorReport.Enabled {
+			log.Printf("[WARN] error templates directory %s ignored, html errors reporting disabled", opts.ErrorReport.Dir)
+		}
 	}
 	if opts.ErrorReport.Template != "" {
 		data, err := os.ReadFile(opts.ErrorReport.Template)
@@ -616,7 +1091,7 @@ func makeAccessLogWriter() (accessLog io.WriteCloser, err error) {
 		return nopWriteCloser{io.Discard}, nil
 	}
 
-	maxSize, perr := sizeParse(opts.Logger.MaxSize)
+	maxSize, perr := sizeOption(opts.Logger.MaxSize)
 	if perr != nil {
 		return nil, fmt.Errorf("can't parse logger MaxSize: %w", perr)
 	}
@@ -675,65 +1150,28 @@ func fqdns(inp []string) (res []string) {
 	return res
 }
 
-func sizeParse(inp string) (uint64, error) {
-	if inp == "" {
-		return 0, errors.New("empty value")
-	}
-	for i, sfx := range []string{"k", "m", "g", "t"} {
-		if strings.HasSuffix(inp, strings.ToUpper(sfx)) || strings.HasSuffix(inp, strings.ToLower(sfx)) {
-			val, err := strconv.Atoi(inp[:len(inp)-1])
-			if err != nil {
-				return 0, fmt.Errorf("can't parse %s: %w", inp, err)
-			}
-			return uint64(float64(val) * math.Pow(float64(1024), float64(i+1))), nil
-		}
+// sizeOption parses size option with discovery.ParseSize, empty value rejected to not turn the limit off
+// with empty env, i.e. MAX_SIZE=
+func sizeOption(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, errors.New("empty size")
 	}
-	res, err := strconv.ParseUint(inp, 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse size %s: %w", inp, err)
-	}
-	return res, nil
+	return discovery.ParseSize(s)
 }
 
 // splitAtCommas split s at commas, ignoring commas in strings.
 // Eliminate leading and trailing dbl quotes in each element only if both presented
-// based on https://stackoverflow.com/a/59318708
 func splitAtCommas(s string) []string {
-
-	cleanup := func(s string) string {
-		if s == "" {
-			return s
-		}
-		res := strings.TrimSpace(s)
-		if res[0] == '"' && res[len(res)-1] == '"' {
-			res = strings.TrimPrefix(res, `"`)
-			res = strings.TrimSuffix(res, `"`)
-		}
-		return res
+	if s == "" {
+		return []string{}
 	}
-
-	var res []string
-	var beg int
-	var inString bool
-
-	for i := 0; i < len(s); i++ {
-		if s[i] == ',' && !inString {
-			res = append(res, cleanup(s[beg:i]))
-			beg = i + 1
-			continue
+	res := discovery.SplitQuoted(s, ',')
+	for i, v := range res {
+		v = strings.TrimSpace(v)
+		if v != "" && v[0] == '"' && v[len(v)-1] == '"' {
+			v = strings.TrimSuffix(strings.TrimPrefix(v, `"`), `"`)
 		}
-
-		if s[i] == '"' {
-			if !inString {
-				inString = true
-			} else if i > 0 && s[i-1] != '\\' { // also allow \"
-				inString = false
-			}
-		}
-	}
-	res = append(res, cleanup(s[beg:]))
-	if len(res) == 1 && res[0] == "" {
-		return []string{}
+		res[i] = v
 	}
 	return res
 }
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"syscall"
@@ -18,6 +22,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/geoip/geoiptest"
+	"github.com/umputun/reproxy/app/jwt"
+	"github.com/umputun/reproxy/app/oidc"
 	"github.com/umputun/reproxy/app/proxy"
 	"github.com/umputun/reproxy/lib"
 )
@@ -302,31 +310,23 @@ func Test_redirHTTPPort(t *testing.T) {
 	}
 }
 
-func Test_sizeParse(t *testing.T) {
-	setupLogger()
-
+func Test_sizeOption(t *testing.T) {
 	tbl := []struct {
 		inp string
-		res uint64
+		res int64
 		err bool
 	}{
 		{"1000", 1000, false},
 		{"0", 0, false},
 		{"", 0, true},
+		{"  ", 0, true},
 		{"10K", 10240, false},
-		{"1k", 1024, false},
-		{"14m", 14 * 1024 * 1024, false},
-		{"7G", 7 * 1024 * 1024 * 1024, false},
-		{"170g", 170 * 1024 * 1024 * 1024, false},
-		{"17T", 17 * 1024 * 1024 * 1024 * 1024, false},
-		{"123aT", 0, true},
 		{"123a", 0, true},
-		{"123.45", 0, true},
 	}
 
 	for i, tt := range tbl {
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			res, err := sizeParse(tt.inp)
+			res, err := sizeOption(tt.inp)
 			if tt.err {
 				require.Error(t, err)
 				return
@@ -413,6 +413,8 @@ func Test_splitAtCommas(t *testing.T) {
 
 func Test_makeBasicAuth(t *testing.T) {
 	setupLogger()
+	defer func() { opts.File.CheckInterval, opts.File.Delay = 0, 0 }()
+	opts.File.CheckInterval, opts.File.Delay = 10*time.Millisecond, 20*time.Millisecond
 
 	pf := `test:$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW
 		test2:$2y$05$TLQqHh6VT4JxysdKGPOlJeSkkMsv.Ku/G45i7ssIm80XuouCrES12
@@ -426,10 +428,334 @@ func Test_makeBasicAuth(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, len(pf), n)
 
-	res, err := makeBasicAuth(fh.Name())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res, err := makeBasicAuth(ctx, fh.Name())
+	require.NoError(t, err)
+	assert.True(t, res.Match("test", "passwd"))
+	assert.True(t, res.Match("test2", "passwd2"))
+	assert.False(t, res.Match("bad", "bad"), "malformed line ignored")
+
+	res, err = makeBasicAuth(ctx, "")
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	_, err = makeBasicAuth(ctx, "/no-such-file")
+	require.Error(t, err)
+}
+
+func Test_makeHtpasswdFiles(t *testing.T) {
+	defer func() { opts.File.CheckInterval, opts.File.Delay = 0, 0 }()
+	opts.File.CheckInterval, opts.File.Delay = 10*time.Millisecond, 20*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admins := filepath.Join(t.TempDir(), "admins")
+	require.NoError(t, os.WriteFile(admins, []byte("admin:$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0\n"), 0o600))
+	res, err := makeHtpasswdFiles(ctx, map[string]string{"admins": admins})
 	require.NoError(t, err)
-	assert.Len(t, res, 3)
-	assert.Equal(t, []string{"test:$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW", "test2:$2y$05$TLQqHh6VT4JxysdKGPOlJeSkkMsv.Ku/G45i7ssIm80XuouCrES12", "bad bad"}, res)
+	require.Len(t, res, 1)
+	assert.True(t, res["admins"].Match("admin", "passwd"))
+
+	// sha-crypt user added, apr1 user removed
+	require.NoError(t, os.WriteFile(admins,
+		[]byte("other:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n"), 0o600))
+	require.NoError(t, os.Chtimes(admins, time.Now().Add(time.Second), time.Now().Add(time.Second)))
+	require.Eventually(t, func() bool {
+		return res["admins"].Match("other", "Hello world!")
+	}, 2*time.Second, 10*time.Millisecond, "htpasswd reloaded")
+	assert.False(t, res["admins"].Match("admin", "passwd"))
+
+	_, err = makeHtpasswdFiles(ctx, map[string]string{"bad": "/no-such-file"})
+	require.ErrorContains(t, err, `htpasswd "bad": failed to read htpasswd file /no-such-file`)
+}
+
+func Test_makeThrottleOverrides(t *testing.T) {
+	setupLogger()
+
+	res, err := makeThrottleOverrides("")
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	fname := filepath.Join(t.TempDir(), "keys.yml")
+	require.NoError(t, os.WriteFile(fname, []byte("key1: 100\n\"10.0.0.1\": 50/m burst 10\nfree: 0\n"), 0o600))
+	res, err = makeThrottleOverrides(fname)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]discovery.RateLimit{"key1": {Rate: 100}, "10.0.0.1": {Rate: 50, Window: time.Minute, Burst: 10},
+		"free": {}}, res)
+
+	require.NoError(t, os.WriteFile(fname, []byte("key1: -1\n"), 0o600))
+	_, err = makeThrottleOverrides(fname)
+	require.ErrorContains(t, err, `invalid limit "-1" for throttle key "key1"`)
+
+	require.NoError(t, os.WriteFile(fname, []byte("key1: [1, 2]\n"), 0o600))
+	_, err = makeThrottleOverrides(fname)
+	require.ErrorContains(t, err, "failed to parse throttle keys file")
+
+	_, err = makeThrottleOverrides("/no-such-file")
+	require.ErrorContains(t, err, "failed to read throttle keys file /no-such-file")
+}
+
+func Test_makeTokenVerifier(t *testing.T) {
+	defer func() { opts.JWT.Secret, opts.JWT.JWKS, opts.JWT.JWKSRefresh, opts.JWT.RequireExp = "", "", 0, false }()
+
+	assert.Nil(t, makeTokenVerifier(context.Background()))
+
+	opts.JWT.Secret, opts.JWT.RequireExp = "secret", true
+	v, ok := makeTokenVerifier(context.Background()).(*jwt.Verifier)
+	require.True(t, ok)
+	assert.Equal(t, []byte("secret"), v.Secret)
+	assert.True(t, v.RequireExp)
+	assert.Nil(t, v.Keys)
+
+	opts.JWT.Secret, opts.JWT.JWKS, opts.JWT.JWKSRefresh = "", "/no-such-file.json", time.Hour
+	v, ok = makeTokenVerifier(context.Background()).(*jwt.Verifier)
+	require.True(t, ok, "failed jwks load is not fatal")
+	require.NotNil(t, v.Keys)
+	assert.Equal(t, "/no-such-file.json", v.Keys.Source)
+	assert.Equal(t, time.Hour, v.Keys.Refresh)
+}
+
+func Test_makeOIDC(t *testing.T) {
+	defer func() { opts.OIDC.Issuer, opts.OIDC.ClientID, opts.OIDC.CookieSecret = "", "", "" }()
+
+	res, err := makeOIDC()
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	opts.OIDC.Issuer, opts.OIDC.ClientID, opts.OIDC.CookieSecret = "https://idp.example.com", "reproxy", "short"
+	opts.OIDC.CallbackPath, opts.OIDC.CookieName = "/oauth2/callback", "reproxy_session"
+	_, err = makeOIDC()
+	require.EqualError(t, err, "cookie secret should be at least 16 characters")
+
+	opts.OIDC.CookieSecret = "0123456789abcdef"
+	res, err = makeOIDC()
+	require.NoError(t, err)
+	_, ok := res.(*oidc.Client)
+	assert.True(t, ok)
+}
+
+func Test_makeAPIKeys(t *testing.T) {
+	defer func() { opts.APIKeys.File, opts.File.CheckInterval, opts.File.Delay = "", 0, 0 }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res, err := makeAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	hash := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	opts.APIKeys.File = filepath.Join(t.TempDir(), "keys.yml")
+	opts.File.CheckInterval, opts.File.Delay = 10*time.Millisecond, 20*time.Millisecond
+	require.NoError(t, os.WriteFile(opts.APIKeys.File, []byte("keys:\n  - {name: billing, hash: "+hash("key-1")+"}\n"), 0o600))
+	res, err = makeAPIKeys(ctx)
+	require.NoError(t, err)
+	client, ok := res.Lookup("key-1")
+	require.True(t, ok)
+	assert.Equal(t, "billing", client)
+
+	require.NoError(t, os.WriteFile(opts.APIKeys.File,
+		[]byte("keys:\n  - {name: billing, hash: "+hash("key-1")+", disabled: true}\n"), 0o600))
+	require.NoError(t, os.Chtimes(opts.APIKeys.File, time.Now().Add(time.Second), time.Now().Add(time.Second)))
+	require.Eventually(t, func() bool {
+		_, ok := res.Lookup("key-1")
+		return !ok
+	}, 2*time.Second, 10*time.Millisecond, "disabled key reloaded")
+
+	opts.APIKeys.File = "/no-such-file.yml"
+	_, err = makeAPIKeys(ctx)
+	require.Error(t, err)
+}
+
+func Test_makeWAF(t *testing.T) {
+	defer func() { opts.WAF.File, opts.File.CheckInterval, opts.File.Delay = "", 0, 0 }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res, err := makeWAF(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	opts.WAF.File = filepath.Join(t.TempDir(), "waf.yml")
+	opts.File.CheckInterval, opts.File.Delay = 10*time.Millisecond, 20*time.Millisecond
+	require.NoError(t, os.WriteFile(opts.WAF.File, []byte("global:\n  - {name: env, path: '\\.env', action: deny}\n"), 0o600))
+	res, err = makeWAF(ctx)
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/.env", http.NoBody)
+	assert.True(t, res.Check(req, "", nil, true).Deny)
+
+	require.NoError(t, os.WriteFile(opts.WAF.File, []byte("global:\n  - {name: env, path: '\\.env', action: log}\n"), 0o600))
+	require.NoError(t, os.Chtimes(opts.WAF.File, time.Now().Add(time.Second), time.Now().Add(time.Second)))
+	require.Eventually(t, func() bool {
+		return !res.Check(req, "", nil, true).Deny
+	}, 2*time.Second, 10*time.Millisecond, "rules reloaded")
+
+	opts.WAF.File = "/no-such-file.yml"
+	_, err = makeWAF(ctx)
+	require.ErrorContains(t, err, "failed to read waf rules file /no-such-file.yml")
+}
+
+func Test_makeGeoIP(t *testing.T) {
+	defer func() {
+		opts.GeoIP.CountryDB, opts.GeoIP.ASNDB, opts.File.CheckInterval, opts.File.Delay = "", "", 0, 0
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res, err := makeGeoIP(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	dir := t.TempDir()
+	opts.GeoIP.CountryDB, opts.GeoIP.ASNDB = filepath.Join(dir, "country.mmdb"), filepath.Join(dir, "asn.mmdb")
+	opts.File.CheckInterval, opts.File.Delay = 10*time.Millisecond, 20*time.Millisecond
+	require.NoError(t, geoiptest.WriteFile(opts.GeoIP.CountryDB, geoiptest.Options{},
+		map[string]map[string]any{"1.2.3.0/24": {"country": map[string]any{"iso_code": "US"}}}))
+	require.NoError(t, geoiptest.WriteFile(opts.GeoIP.ASNDB, geoiptest.Options{DatabaseType: "GeoLite2-ASN"},
+		map[string]map[string]any{"1.2.0.0/16": {"autonomous_system_number": uint32(64500)}}))
+	res, err = makeGeoIP(ctx)
+	require.NoError(t, err)
+	country, asn := res.Lookup("1.2.3.4")
+	assert.Equal(t, "US", country)
+	assert.Equal(t, uint(64500), asn)
+
+	require.NoError(t, geoiptest.WriteFile(opts.GeoIP.CountryDB, geoiptest.Options{},
+		map[string]map[string]any{"1.2.3.0/24": {"country": map[string]any{"iso_code": "CA"}}}))
+	require.NoError(t, os.Chtimes(opts.GeoIP.CountryDB, time.Now().Add(time.Second), time.Now().Add(time.Second)))
+	require.Eventually(t, func() bool {
+		country, _ := res.Lookup("1.2.3.4")
+		return country == "CA"
+	}, 2*time.Second, 10*time.Millisecond, "country database reloaded")
+
+	opts.GeoIP.ASNDB = "/no-such-file.mmdb"
+	_, err = makeGeoIP(ctx)
+	require.ErrorContains(t, err, "failed to read geoip database /no-such-file.mmdb")
+}
+
+func Test_makeSecurityHeaders(t *testing.T) {
+	defer func() {
+		opts.SecurityHeaders.Preset, opts.SecurityHeaders.Set, opts.SecurityHeaders.Drop = "", nil, nil
+		opts.SecurityHeaders.ReportOnly = false
+	}()
+
+	opts.SecurityHeaders.Preset = "none"
+	res, err := makeSecurityHeaders()
+	require.NoError(t, err)
+	assert.True(t, res.IsZero())
+
+	opts.SecurityHeaders.Preset = "strict"
+	opts.SecurityHeaders.Set = []string{"permissions=camera=(), microphone=()", "frame=SAMEORIGIN"}
+	opts.SecurityHeaders.Drop = []string{"hsts"}
+	opts.SecurityHeaders.ReportOnly = true
+	res, err = makeSecurityHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, discovery.SecurityHeaders{Preset: discovery.SHStrict, ReportOnly: true,
+		Set:  map[string]string{"Permissions-Policy": "camera=(), microphone=()", "X-Frame-Options": "SAMEORIGIN"},
+		Drop: []string{"Strict-Transport-Security"}}, res)
+
+	opts.SecurityHeaders.Set = []string{"server=reproxy"}
+	_, err = makeSecurityHeaders()
+	require.EqualError(t, err, `invalid security header "server=reproxy", expected key=value with known key`)
+
+	opts.SecurityHeaders.Set = nil
+	opts.SecurityHeaders.Drop = []string{"server"}
+	_, err = makeSecurityHeaders()
+	require.EqualError(t, err, `unknown security header "server"`)
+}
+
+func Test_makeMaintenanceStore(t *testing.T) {
+	setupLogger()
+	defer func() { opts.Maintenance.Enabled, opts.Maintenance.File = false, "" }()
+	opts.Management.Enabled = false
+
+	opts.Maintenance.Enabled = false
+	store, err := makeMaintenanceStore()
+	require.NoError(t, err)
+	assert.Nil(t, store)
+	assert.Nil(t, maintenanceMatcher(store))
+
+	opts.Maintenance.Enabled = true
+	opts.Maintenance.File = filepath.Join(t.TempDir(), "maintenance.json")
+	require.NoError(t, os.WriteFile(opts.Maintenance.File, []byte(`[{"server":"app.example.com","retry_after":30}]`), 0o600))
+	store, err = makeMaintenanceStore()
+	require.NoError(t, err)
+	require.NotNil(t, maintenanceMatcher(store))
+	e, ok := store.Match("app.example.com", "", "")
+	require.True(t, ok)
+	assert.Equal(t, 30, e.RetryAfter)
+
+	require.NoError(t, os.WriteFile(opts.Maintenance.File, []byte(`not json`), 0o600))
+	_, err = makeMaintenanceStore()
+	require.ErrorContains(t, err, "can't load maintenance state")
+}
+
+func Test_makeMaintenanceStoreToken(t *testing.T) {
+	setupLogger()
+	defer func() {
+		opts.Maintenance.Enabled, opts.Maintenance.File, opts.Maintenance.Token = false, "", ""
+		opts.Management.Enabled, opts.Management.Listen = false, ""
+	}()
+	opts.Maintenance.Enabled, opts.Management.Enabled = true, true
+	opts.Maintenance.File = filepath.Join(t.TempDir(), "maintenance.json")
+
+	opts.Management.Listen = "0.0.0.0:8081"
+	_, err := makeMaintenanceStore()
+	require.EqualError(t, err, "maintenance mode requires --maintenance.token, management API listens on non-loopback 0.0.0.0:8081")
+
+	opts.Maintenance.Token = "secret"
+	store, err := makeMaintenanceStore()
+	require.NoError(t, err)
+	assert.NotNil(t, store)
+
+	opts.Maintenance.Token, opts.Management.Listen = "", "127.0.0.1:8081"
+	store, err = makeMaintenanceStore()
+	require.NoError(t, err, "no token required on loopback")
+	assert.NotNil(t, store)
+}
+
+func Test_isLoopbackListen(t *testing.T) {
+	tbl := []struct {
+		listen string
+		res    bool
+	}{
+		{"127.0.0.1:8081", true},
+		{"localhost:8081", true},
+		{"[::1]:8081", true},
+		{"127.0.0.2:8081", true},
+		{"0.0.0.0:8081", false},
+		{":8081", false},
+		{"[::]:8081", false},
+		{"192.168.1.1:8081", false},
+		{"example.com:8081", false},
+		{"bad", false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, isLoopbackListen(tt.listen), tt.listen)
+	}
+}
+
+func Test_makeErrorReporter(t *testing.T) {
+	setupLogger()
+	defer func() { opts.ErrorReport.Enabled, opts.ErrorReport.Dir, opts.ErrorReport.Template = false, "", "" }()
+
+	opts.ErrorReport.Enabled = true
+	opts.ErrorReport.Dir = t.TempDir()
+	rep, err := makeErrorReporter()
+	require.NoError(t, err)
+	assert.Equal(t, opts.ErrorReport.Dir, rep.(*proxy.ErrorReporter).Dir)
+	assert.True(t, rep.(*proxy.ErrorReporter).Nice)
+
+	opts.ErrorReport.Dir = "/no-such-dir"
+	_, err = makeErrorReporter()
+	require.EqualError(t, err, "error templates directory /no-such-dir is not accessible")
+
+	opts.ErrorReport.Dir = ""
+	opts.ErrorReport.Template = "/no-such-file"
+	_, err = makeErrorReporter()
+	require.ErrorContains(t, err, "failed to load error html template from /no-such-file")
 }
 
 func Test_makeSSLConfig(t *testing.T) {
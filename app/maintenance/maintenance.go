@@ -0,0 +1,245 @@
+// Package maintenance keeps the state of maintenance mode for routes, servers or all requests.
+// The state is changed by management API, persisted to a local file and checked by proxy for each request.
+package maintenance
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// DefaultRetryAfter used for entries without retry_after
+const DefaultRetryAfter = time.Minute
+
+// Scope of the maintenance entry
+type Scope string
+
+// enum of all scopes
+const (
+	ScopeGlobal Scope = "global" // all requests
+	ScopeServer Scope = "server" // all routes of the server
+	ScopeRoute  Scope = "route"  // single route, optionally limited to the server
+)
+
+// Entry defines maintenance for global, server or route scope. Empty Server and Route means global,
+// Server without Route is the whole server, Route is the route's source match as reported by /routes.
+type Entry struct {
+	Server       string    `json:"server,omitempty"`
+	Route        string    `json:"route,omitempty"`
+	RetryAfter   int       `json:"retry_after,omitempty"`   // seconds, DefaultRetryAfter if not set
+	AllowedIPs   []string  `json:"allowed_ips,omitempty"`   // ips or CIDRs let through
+	BypassCookie string    `json:"bypass_cookie,omitempty"` // name=value of the cookie let through
+	Since        time.Time `json:"since"`
+
+	nets []*net.IPNet // parsed AllowedIPs
+}
+
+// Scope returns scope of the entry
+func (e Entry) Scope() Scope {
+	switch {
+	case e.Route != "":
+		return ScopeRoute
+	case e.Server != "":
+		return ScopeServer
+	default:
+		return ScopeGlobal
+	}
+}
+
+// Bypass checks if the request is allowed during maintenance by client ip or bypass cookie
+func (e Entry) Bypass(r *http.Request, ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, n := range e.nets {
+			if n.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	if e.BypassCookie == "" {
+		return false
+	}
+	name, value, _ := strings.Cut(e.BypassCookie, "=")
+	c, err := r.Cookie(name)
+	return err == nil && subtle.ConstantTimeCompare([]byte(c.Value), []byte(value)) == 1
+}
+
+// Store keeps maintenance entries and persists them to the file on each change
+type Store struct {
+	path string
+
+	lock    sync.RWMutex
+	entries map[string]Entry // keyed by server\x00route
+	now     func() time.Time
+}
+
+// NewStore makes store and loads entries from the file if it exists. Empty path disables persistence.
+func NewStore(path string) (*Store, error) {
+	res := &Store{path: path, entries: map[string]Entry{}, now: time.Now}
+	if path == "" {
+		return res, nil
+	}
+	data, err := os.ReadFile(path) //nolint:gosec // path is from the options
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read maintenance state %s: %w", path, err)
+	}
+	var entries []Entry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("can't parse maintenance state %s: %w", path, err)
+	}
+	for _, e := range entries {
+		if err = e.prepare(); err != nil {
+			return nil, fmt.Errorf("invalid maintenance entry in %s: %w", path, err)
+		}
+		res.entries[key(e.Server, e.Route)] = e
+	}
+	return res, nil
+}
+
+// Enable adds or replaces maintenance entry with the same server and route and saves the state
+func (s *Store) Enable(e Entry) (Entry, error) {
+	if err := e.prepare(); err != nil {
+		return Entry{}, err
+	}
+	if e.RetryAfter <= 0 {
+		e.RetryAfter = int(DefaultRetryAfter.Seconds())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e.Since = s.now().UTC().Truncate(time.Second)
+	k := key(e.Server, e.Route)
+	prev, existed := s.entries[k]
+	s.entries[k] = e
+	if err := s.save(); err != nil {
+		if existed {
+			s.entries[k] = prev
+		} else {
+			delete(s.entries, k)
+		}
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// Disable removes maintenance entry and saves the state. Returns false if entry not found.
+func (s *Store) Disable(server, route string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	k := key(server, route)
+	prev, ok := s.entries[k]
+	if !ok {
+		return false, nil
+	}
+	delete(s.entries, k)
+	if err := s.save(); err != nil {
+		s.entries[k] = prev
+		return false, err
+	}
+	return true, nil
+}
+
+// List returns all entries sorted by server and route
+func (s *Store) List() []Entry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.list()
+}
+
+// Match returns entry applied to the request with the given host, matched route's server and route.
+// The most specific entry wins, route first, then server and global. Server and route are empty
+// for requests without matched route.
+func (s *Store) Match(host, server, route string) (Entry, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.entries) == 0 {
+		return Entry{}, false
+	}
+
+	var keys []string
+	if route != "" {
+		keys = append(keys, key(server, route), key(host, route), key("", route))
+	}
+	if server != "" {
+		keys = append(keys, key(server, ""))
+	}
+	keys = append(keys, key(host, ""), key("", ""))
+	for _, k := range keys {
+		if e, ok := s.entries[k]; ok {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+func (s *Store) list() []Entry {
+	res := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Server != res[j].Server {
+			return res[i].Server < res[j].Server
+		}
+		return res[i].Route < res[j].Route
+	})
+	return res
+}
+
+// save writes entries to the temp file and renames it, so the state file is never partially written
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't marshal maintenance state: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return fmt.Errorf("can't make maintenance state directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("can't write maintenance state: %w", err)
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("can't save maintenance state: %w", err)
+	}
+	return nil
+}
+
+// prepare validates the entry and parses allowed ips
+func (e *Entry) prepare() error {
+	if e.BypassCookie != "" {
+		if name, value, ok := strings.Cut(e.BypassCookie, "="); !ok || name == "" || value == "" {
+			return fmt.Errorf("invalid bypass cookie %q, expected name=value", e.BypassCookie)
+		}
+	}
+	e.nets = make([]*net.IPNet, 0, len(e.AllowedIPs))
+	for _, ip := range e.AllowedIPs {
+		n, err := discovery.ParseIPNet(ip)
+		if err != nil {
+			return fmt.Errorf("invalid allowed ip %q: %w", ip, err)
+		}
+		e.nets = append(e.nets, n)
+	}
+	return nil
+}
+
+// key makes map key, NUL separator is invalid in hostnames and regex source, avoiding key collisions
+func key(server, route string) string {
+	return server + "\x00" + route
+}
@@ -0,0 +1,160 @@
+package maintenance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_EnableDisablePersist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state", "maintenance.json")
+	st, err := NewStore(file)
+	require.NoError(t, err)
+	assert.Empty(t, st.List())
+
+	now := time.Date(2025, 5, 1, 10, 0, 0, 0, time.UTC)
+	st.now = func() time.Time { return now }
+
+	e, err := st.Enable(Entry{Server: "app.example.com", AllowedIPs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	assert.Equal(t, 60, e.RetryAfter, "default retry after")
+	assert.Equal(t, now, e.Since)
+	_, err = st.Enable(Entry{Route: "^/api/(.*)", RetryAfter: 300, BypassCookie: "mnt=secret"})
+	require.NoError(t, err)
+	_, err = st.Enable(Entry{})
+	require.NoError(t, err)
+	assert.Len(t, st.List(), 3)
+
+	// reload from the file
+	st2, err := NewStore(file)
+	require.NoError(t, err)
+	list := st2.List()
+	require.Len(t, list, 3)
+	assert.Equal(t, ScopeGlobal, list[0].Scope())
+	assert.Equal(t, ScopeRoute, list[1].Scope())
+	assert.Equal(t, 300, list[1].RetryAfter)
+	assert.Equal(t, ScopeServer, list[2].Scope())
+	assert.Equal(t, []string{"10.0.0.0/8"}, list[2].AllowedIPs)
+	assert.True(t, list[2].Bypass(httptest.NewRequest("GET", "/", http.NoBody), "10.1.2.3"), "allowed ips parsed on load")
+
+	ok, err := st2.Disable("app.example.com", "")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = st2.Disable("app.example.com", "")
+	require.NoError(t, err)
+	assert.False(t, ok, "already disabled")
+
+	st3, err := NewStore(file)
+	require.NoError(t, err)
+	assert.Len(t, st3.List(), 2)
+}
+
+func TestStore_EnableInvalid(t *testing.T) {
+	st, err := NewStore("")
+	require.NoError(t, err)
+
+	_, err = st.Enable(Entry{AllowedIPs: []string{"bad"}})
+	require.EqualError(t, err, `invalid allowed ip "bad": invalid CIDR address: bad/128`)
+	_, err = st.Enable(Entry{BypassCookie: "novalue"})
+	require.EqualError(t, err, `invalid bypass cookie "novalue", expected name=value`)
+	assert.Empty(t, st.List())
+}
+
+func TestNewStore_Errors(t *testing.T) {
+	dir := t.TempDir()
+
+	st, err := NewStore(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err, "missing file is not an error")
+	assert.Empty(t, st.List())
+
+	bad := filepath.Join(dir, "bad.json")
+	require.NoError(t, os.WriteFile(bad, []byte("{not json"), 0o600))
+	_, err = NewStore(bad)
+	require.ErrorContains(t, err, "can't parse maintenance state")
+
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`[{"allowed_ips":["x.x"]}]`), 0o600))
+	_, err = NewStore(invalid)
+	require.ErrorContains(t, err, "invalid maintenance entry")
+}
+
+func TestStore_Match(t *testing.T) {
+	st, err := NewStore("")
+	require.NoError(t, err)
+
+	_, ok := st.Match("example.com", "example.com", "^/api/(.*)")
+	assert.False(t, ok, "no entries")
+
+	for _, e := range []Entry{
+		{Server: "app.example.com", Route: "^/api/(.*)", RetryAfter: 1},
+		{Route: "^/files/(.*)", RetryAfter: 2},
+		{Server: "app.example.com", RetryAfter: 3},
+		{Server: "*", RetryAfter: 4},
+	} {
+		_, err = st.Enable(e)
+		require.NoError(t, err)
+	}
+
+	tbl := []struct {
+		name         string
+		host, server string
+		route        string
+		retry        int // 0 for no match
+	}{
+		{"route of server", "app.example.com", "app.example.com", "^/api/(.*)", 1},
+		{"route of server matched by host", "app.example.com", "*", "^/api/(.*)", 1},
+		{"route of any server", "other.example.com", "other.example.com", "^/files/(.*)", 2},
+		{"other route of server", "app.example.com", "app.example.com", "^/web/(.*)", 3},
+		{"default server routes", "other.example.com", "*", "^/web/(.*)", 4},
+		{"not matched", "other.example.com", "other.example.com", "^/web/(.*)", 0},
+		{"unmatched request of server", "app.example.com", "", "", 3},
+		{"unmatched request", "other.example.com", "", "", 0},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := st.Match(tt.host, tt.server, tt.route)
+			assert.Equal(t, tt.retry != 0, ok)
+			assert.Equal(t, tt.retry, e.RetryAfter)
+		})
+	}
+
+	_, err = st.Enable(Entry{RetryAfter: 5})
+	require.NoError(t, err)
+	e, ok := st.Match("other.example.com", "", "")
+	assert.True(t, ok)
+	assert.Equal(t, 5, e.RetryAfter, "global")
+	e, ok = st.Match("app.example.com", "app.example.com", "^/api/(.*)")
+	assert.True(t, ok)
+	assert.Equal(t, 1, e.RetryAfter, "route wins over global")
+}
+
+func TestEntry_Bypass(t *testing.T) {
+	st, err := NewStore("")
+	require.NoError(t, err)
+	e, err := st.Enable(Entry{AllowedIPs: []string{"192.168.1.0/24", "10.0.0.1", "::1"}, BypassCookie: "mnt=secret"})
+	require.NoError(t, err)
+
+	req := func(cookie string) *http.Request {
+		r := httptest.NewRequest("GET", "/", http.NoBody)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		return r
+	}
+	assert.True(t, e.Bypass(req(""), "192.168.1.10"))
+	assert.True(t, e.Bypass(req(""), "10.0.0.1"))
+	assert.True(t, e.Bypass(req(""), "::1"))
+	assert.False(t, e.Bypass(req(""), "10.0.0.2"))
+	assert.False(t, e.Bypass(req(""), ""))
+	assert.True(t, e.Bypass(req("mnt=secret"), "10.0.0.2"))
+	assert.False(t, e.Bypass(req("mnt=wrong"), "10.0.0.2"))
+	assert.False(t, e.Bypass(req("other=secret"), "10.0.0.2"))
+
+	assert.False(t, Entry{}.Bypass(req("mnt=secret"), "10.0.0.1"), "nothing allowed")
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -26,6 +27,11 @@ type Metrics struct {
 	totalRequests  *prometheus.CounterVec
 	responseStatus *prometheus.CounterVec
 	httpDuration   *prometheus.HistogramVec
+	inFlight       *prometheus.GaugeVec
+	queued         *prometheus.GaugeVec
+	bytesSent      *prometheus.CounterVec
+	throttled      *prometheus.CounterVec
+	wafHits        *prometheus.CounterVec
 	lowCardinality bool
 }
 
@@ -55,6 +61,31 @@ func NewMetrics(cfg MetricsConfig) *Metrics {
 		Buckets: []float64{0.01, 0.1, 0.5, 1, 2, 3, 5},
 	}, []string{"path"})
 
+	res.inFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_requests_in_flight",
+		Help: "Number of requests in flight for routes with concurrency limit.",
+	}, []string{"server", "route"})
+
+	res.queued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "route_requests_queued",
+		Help: "Number of requests waiting in the queue for routes with concurrency limit.",
+	}, []string{"server", "route"})
+
+	res.bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "route_bandwidth_bytes_total",
+		Help: "Number of response bytes sent for routes with bandwidth limit.",
+	}, []string{"server", "route"})
+
+	res.throttled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "route_bandwidth_throttled_seconds_total",
+		Help: "Time responses were delayed by bandwidth limit.",
+	}, []string{"server", "route"})
+
+	res.wafHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "waf_rule_hits_total",
+		Help: "Number of requests matched by waf rules.",
+	}, []string{"rule", "action"})
+
 	prometheus.Unregister(prometheus.NewGoCollector()) //nolint
 
 	if err := prometheus.Register(res.totalRequests); err != nil {
@@ -66,6 +97,21 @@ func NewMetrics(cfg MetricsConfig) *Metrics {
 	if err := prometheus.Register(res.httpDuration); err != nil {
 		log.Printf("[WARN] can't register prometheus httpDuration, %v", err)
 	}
+	if err := prometheus.Register(res.inFlight); err != nil {
+		log.Printf("[WARN] can't register prometheus inFlight, %v", err)
+	}
+	if err := prometheus.Register(res.queued); err != nil {
+		log.Printf("[WARN] can't register prometheus queued, %v", err)
+	}
+	if err := prometheus.Register(res.bytesSent); err != nil {
+		log.Printf("[WARN] can't register prometheus bytesSent, %v", err)
+	}
+	if err := prometheus.Register(res.throttled); err != nil {
+		log.Printf("[WARN] can't register prometheus throttled, %v", err)
+	}
+	if err := prometheus.Register(res.wafHits); err != nil {
+		log.Printf("[WARN] can't register prometheus wafHits, %v", err)
+	}
 
 	return res
 }
@@ -97,6 +143,31 @@ func (m *Metrics) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// SetInFlight sets number of requests in flight for the route
+func (m *Metrics) SetInFlight(mapper discovery.URLMapper, val int) {
+	m.inFlight.WithLabelValues(mapper.Server, mapper.SrcMatch.String()).Set(float64(val))
+}
+
+// SetQueued sets number of queued requests for the route
+func (m *Metrics) SetQueued(mapper discovery.URLMapper, val int) {
+	m.queued.WithLabelValues(mapper.Server, mapper.SrcMatch.String()).Set(float64(val))
+}
+
+// AddBytesSent increments number of response bytes sent for the route
+func (m *Metrics) AddBytesSent(mapper discovery.URLMapper, n int) {
+	m.bytesSent.WithLabelValues(mapper.Server, mapper.SrcMatch.String()).Add(float64(n))
+}
+
+// AddThrottled increments time responses of the route were delayed by bandwidth limit
+func (m *Metrics) AddThrottled(mapper discovery.URLMapper, d time.Duration) {
+	m.throttled.WithLabelValues(mapper.Server, mapper.SrcMatch.String()).Add(d.Seconds())
+}
+
+// AddWAFHit increments number of requests matched by the waf rule with the action
+func (m *Metrics) AddWAFHit(rule, action string) {
+	m.wafHits.WithLabelValues(rule, action).Inc()
+}
+
 // getRoutePattern extracts the route pattern from request context.
 // Falls back to "[unmatched]" if no match found (e.g., 404 requests).
 func (m *Metrics) getRoutePattern(r *http.Request) string {
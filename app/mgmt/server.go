@@ -3,8 +3,11 @@ package mgmt
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -13,18 +16,21 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/maintenance"
 )
 
 //go:generate moq -out informer_mock.go -fmt goimports . Informer
 
 // Server represents management server
 type Server struct {
-	Listen         string
-	Informer       Informer
-	Version        string
-	AssetsLocation string
-	AssetsWebRoot  string
-	Metrics        *Metrics
+	Listen           string
+	Informer         Informer
+	Version          string
+	AssetsLocation   string
+	AssetsWebRoot    string
+	Metrics          *Metrics
+	Maintenance      *maintenance.Store // enables /maintenance api if set
+	MaintenanceToken string             // bearer token required by /maintenance, if set
 }
 
 // Informer wraps interface to get info about servers and mappers
@@ -39,6 +45,9 @@ func (s *Server) Run(ctx context.Context) error {
 	handler := http.NewServeMux()
 	handler.HandleFunc("/routes", s.routesCtrl())
 	handler.Handle("/metrics", promhttp.Handler())
+	if s.Maintenance != nil {
+		handler.HandleFunc("/maintenance", s.maintenanceCtrl())
+	}
 	h := rest.Wrap(handler,
 		rest.Recoverer(log.Default()),
 		rest.AppInfo("reproxy-mgmt", "umputun", s.Version),
@@ -95,3 +104,59 @@ func (s *Server) routesCtrl() func(w http.ResponseWriter, r *http.Request) {
 		rest.RenderJSON(w, res)
 	}
 }
+
+// maintenanceCtrl - manages maintenance mode
+// GET /maintenance returns the list of entries, POST /maintenance with json entry enables maintenance
+// and DELETE /maintenance?server=x&route=y disables it. Entry without server and route is global.
+// All methods require "Authorization: Bearer <token>" header if MaintenanceToken is set, the list
+// has bypass cookies and allowed ips of the entries.
+func (s *Server) maintenanceCtrl() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.maintenanceAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="reproxy-mgmt"`)
+			rest.SendErrorJSON(w, r, log.Default(), http.StatusUnauthorized, nil, "unauthorized")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			rest.RenderJSON(w, s.Maintenance.List())
+		case "POST":
+			var entry maintenance.Entry
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&entry); err != nil {
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't decode maintenance entry")
+				return
+			}
+			res, err := s.Maintenance.Enable(entry)
+			if err != nil {
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusBadRequest, err, "can't enable maintenance: "+err.Error())
+				return
+			}
+			log.Printf("[INFO] %s maintenance enabled, server %q, route %q", res.Scope(), res.Server, res.Route)
+			rest.RenderJSON(w, res)
+		case "DELETE":
+			server, route := r.URL.Query().Get("server"), r.URL.Query().Get("route")
+			found, err := s.Maintenance.Disable(server, route)
+			if err != nil {
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusInternalServerError, err, "can't disable maintenance")
+				return
+			}
+			if !found {
+				rest.SendErrorJSON(w, r, log.Default(), http.StatusNotFound, nil, "maintenance entry not found")
+				return
+			}
+			log.Printf("[INFO] maintenance disabled, server %q, route %q", server, route)
+			rest.RenderJSON(w, rest.JSON{"deleted": true, "server": server, "route": route})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// maintenanceAuthorized checks bearer token of the request against MaintenanceToken, always true if no key set
+func (s *Server) maintenanceAuthorized(r *http.Request) bool {
+	if s.MaintenanceToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(s.MaintenanceToken)) == 1
+}
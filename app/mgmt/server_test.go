@@ -10,15 +10,21 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/maintenance"
 	"github.com/umputun/reproxy/app/plugin"
 )
 
@@ -147,6 +153,53 @@ func TestMetrics_Middleware(t *testing.T) {
 	})
 }
 
+func TestMetrics_RouteGauges(t *testing.T) {
+	metrics := NewMetrics(MetricsConfig{})
+	mapper := discovery.URLMapper{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)")}
+	metrics.SetInFlight(mapper, 5)
+	metrics.SetQueued(mapper, 2)
+	metrics.SetInFlight(mapper, 3)
+
+	gaugeValue := func(g *prometheus.GaugeVec) float64 {
+		m := &dto.Metric{}
+		require.NoError(t, g.WithLabelValues("example.com", "^/api/(.*)").Write(m))
+		return m.GetGauge().GetValue()
+	}
+	assert.InDelta(t, 3.0, gaugeValue(metrics.inFlight), 0.001)
+	assert.InDelta(t, 2.0, gaugeValue(metrics.queued), 0.001)
+}
+
+func TestMetrics_BandwidthCounters(t *testing.T) {
+	metrics := NewMetrics(MetricsConfig{})
+	mapper := discovery.URLMapper{Server: "files.example.com", SrcMatch: *regexp.MustCompile("^/files/(.*)")}
+	metrics.AddBytesSent(mapper, 1000)
+	metrics.AddBytesSent(mapper, 500)
+	metrics.AddThrottled(mapper, 1500*time.Millisecond)
+
+	counterValue := func(c *prometheus.CounterVec) float64 {
+		m := &dto.Metric{}
+		require.NoError(t, c.WithLabelValues("files.example.com", "^/files/(.*)").Write(m))
+		return m.GetCounter().GetValue()
+	}
+	assert.InDelta(t, 1500.0, counterValue(metrics.bytesSent), 0.001)
+	assert.InDelta(t, 1.5, counterValue(metrics.throttled), 0.001)
+}
+
+func TestMetrics_WAFHits(t *testing.T) {
+	metrics := NewMetrics(MetricsConfig{})
+	metrics.AddWAFHit("env-files", "deny")
+	metrics.AddWAFHit("env-files", "deny")
+	metrics.AddWAFHit("scanners", "log")
+
+	counterValue := func(rule, action string) float64 {
+		m := &dto.Metric{}
+		require.NoError(t, metrics.wafHits.WithLabelValues(rule, action).Write(m))
+		return m.GetCounter().GetValue()
+	}
+	assert.InDelta(t, 2.0, counterValue("env-files", "deny"), 0.001)
+	assert.InDelta(t, 1.0, counterValue("scanners", "log"), 0.001)
+}
+
 func TestMetrics_LowCardinality(t *testing.T) {
 	t.Run("low cardinality uses route pattern when match in context", func(t *testing.T) {
 		metrics := NewMetrics(MetricsConfig{LowCardinality: true})
@@ -325,3 +378,97 @@ func TestResponseWriter_HijackSupported(t *testing.T) {
 	assert.True(t, hw.hijacked)
 	_ = conn.Close()
 }
+
+func TestServer_maintenanceCtrl(t *testing.T) {
+	store, err := maintenance.NewStore(filepath.Join(t.TempDir(), "maintenance.json"))
+	require.NoError(t, err)
+	srv := Server{Maintenance: store}
+	h := srv.maintenanceCtrl()
+
+	call := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		return rr
+	}
+
+	rr := call("POST", "/maintenance", `{"server":"app.example.com","route":"^/api/(.*)","retry_after":300,
+		"allowed_ips":["10.0.0.0/8"],"bypass_cookie":"mnt=secret"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var entry maintenance.Entry
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &entry))
+	assert.Equal(t, 300, entry.RetryAfter)
+	assert.False(t, entry.Since.IsZero())
+
+	rr = call("POST", "/maintenance", `{}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = call("POST", "/maintenance", `{"allowed_ips":["bad"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `invalid allowed ip`)
+	rr = call("POST", "/maintenance", `{bad json`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = call("GET", "/maintenance", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var list []maintenance.Entry
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	require.Len(t, list, 2)
+	assert.Equal(t, maintenance.ScopeGlobal, list[0].Scope())
+	assert.Equal(t, "app.example.com", list[1].Server)
+	assert.Equal(t, []string{"10.0.0.0/8"}, list[1].AllowedIPs)
+
+	rr = call("DELETE", "/maintenance?server=app.example.com&route="+url.QueryEscape("^/api/(.*)"), "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = call("DELETE", "/maintenance?server=app.example.com&route="+url.QueryEscape("^/api/(.*)"), "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = call("PUT", "/maintenance", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	assert.Len(t, store.List(), 1)
+}
+
+func TestServer_maintenanceCtrlToken(t *testing.T) {
+	store, err := maintenance.NewStore(filepath.Join(t.TempDir(), "maintenance.json"))
+	require.NoError(t, err)
+	srv := Server{Maintenance: store, MaintenanceToken: "secret"}
+	h := srv.maintenanceCtrl()
+
+	call := func(method, url, body, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		return rr
+	}
+
+	rr := call("POST", "/maintenance", `{}`, "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, `Bearer realm="reproxy-mgmt"`, rr.Header().Get("WWW-Authenticate"))
+	rr = call("POST", "/maintenance", `{}`, "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = call("POST", "/maintenance", `{}`, "secret")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "bearer scheme required")
+	assert.Empty(t, store.List())
+
+	rr = call("POST", "/maintenance", `{}`, "Bearer secret")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Len(t, store.List(), 1)
+
+	_, err = store.Enable(maintenance.Entry{Server: "example.com", BypassCookie: "bypass=cookie-secret"})
+	require.NoError(t, err)
+	rr = call("GET", "/maintenance", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "list requires token")
+	assert.NotContains(t, rr.Body.String(), "cookie-secret")
+	rr = call("GET", "/maintenance", "", "Bearer secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "bypass=cookie-secret")
+
+	rr = call("DELETE", "/maintenance", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = call("DELETE", "/maintenance", "", "Bearer secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, store.List(), 1)
+}
@@ -0,0 +1,399 @@
+// Package oidc implements OpenID Connect relying party. Users of protected routes redirected to the identity
+// provider with authorization code flow (PKCE), id token of the callback validated and the user kept in
+// encrypted session cookie.
+package oidc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/jwt"
+)
+
+const (
+	stateTTL       = 10 * time.Minute // max time between login redirect and callback
+	maxCookieSize  = 4000             // browsers drop cookies above 4k
+	maxResponseLen = 1 << 20          // max size of provider's metadata and token responses
+)
+
+// CtxScheme key used to retrieve scheme of the client's request from the request context. Set by proxy
+// for requests behind TLS-terminating trusted proxies, scheme of the connection used if not set.
+const CtxScheme = ctxKey("scheme")
+
+type ctxKey string
+
+var (
+	// ErrProvider returned for failed requests to the identity provider
+	ErrProvider = errors.New("identity provider request failed")
+	// ErrInvalidCallback returned for callbacks with invalid state, code or id token
+	ErrInvalidCallback = errors.New("invalid callback")
+)
+
+// Config defines client of the identity provider
+type Config struct {
+	Issuer       string        // issuer url, provider metadata loaded from <issuer>/.well-known/openid-configuration
+	ClientID     string        // client id registered with the provider
+	ClientSecret string        // client secret registered with the provider
+	Scopes       []string      // requested scopes, "openid" added if missing
+	CallbackPath string        // path of redirect uri, the same on all hosts of protected routes
+	CookieName   string        // name of session cookie, login state kept in cookie with "_state" suffix
+	CookieSecret string        // secret to encrypt cookies
+	SessionTTL   time.Duration // session lifetime
+	GroupsClaim  string        // id token claim with user's groups
+	HTTPClient   *http.Client  // client for provider requests, default client with 10s timeout used if nil
+}
+
+// Session is authenticated user kept in the session cookie
+type Session struct {
+	Subject string   `json:"sub"`
+	User    string   `json:"user,omitempty"` // preferred_username claim, subject if not set
+	Email   string   `json:"email,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+// Client is OpenID Connect relying party
+type Client struct {
+	cfg  Config
+	aead cipher.AEAD
+
+	lock     sync.Mutex
+	meta     *metadata
+	verifier *jwt.Verifier
+}
+
+// metadata is a part of provider configuration used by the client
+type metadata struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+// loginState kept in the state cookie between login redirect and callback
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"` // PKCE code verifier
+	Return   string `json:"return"`   // uri of the original request
+	Expires  int64  `json:"exp"`
+}
+
+// NewClient makes client with the config, provider metadata loaded on the first login
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("issuer and client id required")
+	}
+	if len(cfg.CookieSecret) < 16 {
+		return nil, errors.New("cookie secret should be at least 16 characters")
+	}
+	if !strings.HasPrefix(cfg.CallbackPath, "/") {
+		return nil, fmt.Errorf("invalid callback path %q", cfg.CallbackPath)
+	}
+	if !slices.Contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	key := sha256.Sum256([]byte(cfg.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to make cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make gcm: %w", err)
+	}
+	return &Client{cfg: cfg, aead: aead}, nil
+}
+
+// IsCallback checks if the request is a callback from the provider
+func (c *Client) IsCallback(r *http.Request) bool {
+	return r.URL.Path == c.cfg.CallbackPath
+}
+
+// Session returns user of the request's session cookie, false if the cookie is missing, invalid or expired
+func (c *Client) Session(r *http.Request) (Session, bool) {
+	cookie, err := r.Cookie(c.cfg.CookieName)
+	if err != nil {
+		return Session{}, false
+	}
+	var sess Session
+	if err := c.decrypt(cookie.Value, &sess); err != nil {
+		log.Printf("[DEBUG] invalid oidc session cookie, %v", err)
+		return Session{}, false
+	}
+	if time.Now().Unix() > sess.Expires {
+		return Session{}, false
+	}
+	return sess, true
+}
+
+// Login redirects to the provider's authorization endpoint, the request's uri restored after the callback
+func (c *Client) Login(w http.ResponseWriter, r *http.Request) error {
+	meta, err := c.metadata(r.Context())
+	if err != nil {
+		return err
+	}
+	st := loginState{State: randomString(), Nonce: randomString(), Verifier: randomString(),
+		Return: r.URL.RequestURI(), Expires: time.Now().Add(stateTTL).Unix()}
+	value, err := c.encrypt(st)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, c.cookie(r, c.cfg.CookieName+"_state", value, stateTTL))
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.cfg.ClientID},
+		"redirect_uri":          {c.redirectURI(r)},
+		"scope":                 {strings.Join(c.cfg.Scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {pkceChallenge(st.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthURL+sep+params.Encode(), http.StatusFound)
+	return nil
+}
+
+// Callback handles redirect from the provider. Exchanges the code to id token, validates it and sets
+// session cookie. Redirects to the uri of the original request on success.
+func (c *Client) Callback(w http.ResponseWriter, r *http.Request) error {
+	stCookie, err := r.Cookie(c.cfg.CookieName + "_state")
+	if err != nil {
+		return fmt.Errorf("%w, no state cookie", ErrInvalidCallback)
+	}
+	var st loginState
+	if err = c.decrypt(stCookie.Value, &st); err != nil || time.Now().Unix() > st.Expires {
+		return fmt.Errorf("%w, invalid or expired state cookie", ErrInvalidCallback)
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return fmt.Errorf("%w, provider error %q: %s", ErrInvalidCallback, e, q.Get("error_description"))
+	}
+	if q.Get("state") == "" || q.Get("state") != st.State {
+		return fmt.Errorf("%w, state mismatch", ErrInvalidCallback)
+	}
+	if q.Get("code") == "" {
+		return fmt.Errorf("%w, no code", ErrInvalidCallback)
+	}
+
+	claims, err := c.exchange(r, q.Get("code"), st)
+	if err != nil {
+		return err
+	}
+	sess := Session{Subject: claims.String("sub"), User: claims.String("preferred_username"), Email: claims.String("email"),
+		Expires: time.Now().Add(c.cfg.SessionTTL).Unix()}
+	if sess.User == "" {
+		sess.User = sess.Subject
+	}
+	if c.cfg.GroupsClaim != "" {
+		sess.Groups = claims.List(c.cfg.GroupsClaim)
+	}
+	value, err := c.encrypt(sess)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxCookieSize {
+		return fmt.Errorf("%w, session of %q too large, %d bytes", ErrInvalidCallback, sess.User, len(value))
+	}
+
+	http.SetCookie(w, c.cookie(r, c.cfg.CookieName, value, c.cfg.SessionTTL))
+	http.SetCookie(w, c.cookie(r, c.cfg.CookieName+"_state", "", -1))
+	log.Printf("[INFO] oidc login of %q (%s)", sess.User, sess.Email)
+
+	ret := st.Return
+	if !strings.HasPrefix(ret, "/") || strings.HasPrefix(ret, "//") || strings.HasPrefix(ret, "/\\") {
+		ret = "/" // only local redirects allowed
+	}
+	http.Redirect(w, r, ret, http.StatusFound)
+	return nil
+}
+
+// exchange gets id token for the code and validates it, returns claims of the token
+func (c *Client) exchange(r *http.Request, code string, st loginState) (jwt.Claims, error) {
+	meta, err := c.metadata(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURI(r)},
+		"code_verifier": {st.Verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, meta.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w, can't make token request: %w", ErrProvider, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = c.doJSON(req, &tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w, no id token", ErrProvider)
+	}
+
+	claims, err := c.verifier.Verify(r.Context(), tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w, id token rejected: %w", ErrInvalidCallback, err)
+	}
+	if claims.String("iss") != meta.Issuer {
+		return nil, fmt.Errorf("%w, id token issuer %q", ErrInvalidCallback, claims.String("iss"))
+	}
+	if !claims.Contains("aud", c.cfg.ClientID) {
+		return nil, fmt.Errorf("%w, id token audience mismatch", ErrInvalidCallback)
+	}
+	if claims.String("nonce") != st.Nonce {
+		return nil, fmt.Errorf("%w, nonce mismatch", ErrInvalidCallback)
+	}
+	if claims.String("sub") == "" {
+		return nil, fmt.Errorf("%w, no subject in id token", ErrInvalidCallback)
+	}
+	return claims, nil
+}
+
+// metadata returns provider metadata, loaded on the first call. Failed load retried on the next call.
+func (c *Client) metadata(ctx context.Context) (*metadata, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.meta != nil {
+		return c.meta, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(c.cfg.Issuer, "/")+"/.well-known/openid-configuration", http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("%w, can't make discovery request: %w", ErrProvider, err)
+	}
+	var meta metadata
+	if err = c.doJSON(req, &meta); err != nil {
+		return nil, err
+	}
+	if meta.AuthURL == "" || meta.TokenURL == "" || meta.JWKSURL == "" {
+		return nil, fmt.Errorf("%w, incomplete provider metadata", ErrProvider)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(c.cfg.Issuer, "/") {
+		return nil, fmt.Errorf("%w, issuer mismatch %q", ErrProvider, meta.Issuer)
+	}
+	c.meta = &meta
+	c.verifier = &jwt.Verifier{Keys: &jwt.KeySet{Source: meta.JWKSURL, Refresh: time.Hour, Client: c.cfg.HTTPClient},
+		Leeway: time.Minute, RequireExp: true}
+	log.Printf("[INFO] oidc provider %s discovered", meta.Issuer)
+	return c.meta, nil
+}
+
+// doJSON sends request to the provider and decodes json response
+func (c *Client) doJSON(req *http.Request, v any) error {
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w, %s: %w", ErrProvider, req.URL.Path, err)
+	}
+	defer resp.Body.Close() // nolint
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseLen))
+	if err != nil {
+		return fmt.Errorf("%w, %s: %w", ErrProvider, req.URL.Path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w, %s: status %d, %s", ErrProvider, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w, %s: can't decode response: %w", ErrProvider, req.URL.Path, err)
+	}
+	return nil
+}
+
+// redirectURI returns callback url on the host of the request
+func (c *Client) redirectURI(r *http.Request) string {
+	return scheme(r) + "://" + r.Host + c.cfg.CallbackPath
+}
+
+// cookie makes cookie with the value, negative ttl removes the cookie
+func (c *Client) cookie(r *http.Request, name, value string, ttl time.Duration) *http.Cookie {
+	maxAge := int(ttl.Seconds())
+	if ttl < 0 {
+		maxAge = -1
+	}
+	return &http.Cookie{Name: name, Value: value, Path: "/", MaxAge: maxAge, HttpOnly: true,
+		Secure: scheme(r) == "https", SameSite: http.SameSiteLaxMode}
+}
+
+// scheme returns scheme of the client's request set in context by proxy, or the scheme of the connection
+func scheme(r *http.Request) string {
+	if v, ok := r.Context().Value(CtxScheme).(string); ok && v != "" {
+		return v
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// encrypt makes cookie value from json of v, encrypted and authenticated with AES-GCM
+func (c *Client) encrypt(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cookie value: %w", err)
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to make nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// decrypt restores v from cookie value made by encrypt
+func (c *Client) decrypt(value string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+	plain, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], nil)
+	if err != nil {
+		return errors.New("can't decrypt cookie")
+	}
+	if err := json.Unmarshal(plain, v); err != nil {
+		return fmt.Errorf("can't decode cookie: %w", err)
+	}
+	return nil
+}
+
+// pkceChallenge returns S256 code challenge for the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomString returns 256 random bits, base64 encoded
+func randomString() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b) // never returns an error
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,252 @@
+package oidc
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/oidc/oidctest"
+)
+
+func TestClient_LoginFlow(t *testing.T) {
+	idp := oidctest.NewIDP(t, oidctest.Claims(map[string]any{"sub": "u-123", "preferred_username": "alice",
+		"email": "alice@example.com", "groups": []any{"dev", "ops"}}))
+	c := newTestClient(t, idp)
+
+	// unauthenticated request redirected to the provider
+	req := httptest.NewRequest("GET", "https://app.example.com/docs/page?x=1", http.NoBody)
+	req.TLS = &tls.ConnectionState{}
+	_, ok := c.Session(req)
+	assert.False(t, ok)
+	wr := httptest.NewRecorder()
+	require.NoError(t, c.Login(wr, req))
+	require.Equal(t, http.StatusFound, wr.Code)
+	authURL := wr.Header().Get("Location")
+	require.True(t, strings.HasPrefix(authURL, idp.URL()+"/authorize?"), authURL)
+	au, err := url.Parse(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, "https://app.example.com/oauth2/callback", au.Query().Get("redirect_uri"))
+	assert.Equal(t, "openid email", au.Query().Get("scope"))
+	stateCookie := findCookie(t, wr.Result().Cookies(), "sess_state")
+	assert.True(t, stateCookie.Secure)
+	assert.True(t, stateCookie.HttpOnly)
+
+	// provider redirects back with code
+	callbackURL := idp.Authorize(authURL)
+	req = httptest.NewRequest("GET", callbackURL, http.NoBody)
+	req.TLS = &tls.ConnectionState{}
+	req.AddCookie(stateCookie)
+	assert.True(t, c.IsCallback(req))
+	wr = httptest.NewRecorder()
+	require.NoError(t, c.Callback(wr, req))
+	assert.Equal(t, http.StatusFound, wr.Code)
+	assert.Equal(t, "/docs/page?x=1", wr.Header().Get("Location"))
+	sessCookie := findCookie(t, wr.Result().Cookies(), "sess")
+	assert.Equal(t, 3600, sessCookie.MaxAge)
+	assert.Equal(t, -1, findCookie(t, wr.Result().Cookies(), "sess_state").MaxAge, "state cookie removed")
+
+	// session restored from the cookie
+	req = httptest.NewRequest("GET", "https://app.example.com/docs/page", http.NoBody)
+	req.AddCookie(sessCookie)
+	sess, ok := c.Session(req)
+	require.True(t, ok)
+	assert.Equal(t, "u-123", sess.Subject)
+	assert.Equal(t, "alice", sess.User)
+	assert.Equal(t, "alice@example.com", sess.Email)
+	assert.Equal(t, []string{"dev", "ops"}, sess.Groups)
+
+	// callback can't be replayed
+	req = httptest.NewRequest("GET", callbackURL, http.NoBody)
+	req.AddCookie(stateCookie)
+	require.ErrorIs(t, c.Callback(httptest.NewRecorder(), req), ErrProvider)
+}
+
+func TestClient_LoginBehindProxy(t *testing.T) {
+	idp := oidctest.NewIDP(t)
+	c := newTestClient(t, idp)
+
+	req := httptest.NewRequest("GET", "http://app.example.com/docs", http.NoBody)
+	req.TLS = nil // tls terminated by proxy
+	wr := httptest.NewRecorder()
+	require.NoError(t, c.Login(wr, req.WithContext(context.WithValue(req.Context(), CtxScheme, "https"))))
+	au, err := url.Parse(wr.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://app.example.com/oauth2/callback", au.Query().Get("redirect_uri"))
+	assert.True(t, findCookie(t, wr.Result().Cookies(), "sess_state").Secure)
+
+	wr = httptest.NewRecorder()
+	require.NoError(t, c.Login(wr, req))
+	au, err = url.Parse(wr.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://app.example.com/oauth2/callback", au.Query().Get("redirect_uri"), "plain http")
+	assert.False(t, findCookie(t, wr.Result().Cookies(), "sess_state").Secure)
+}
+
+func TestClient_CallbackRejected(t *testing.T) {
+	tbl := []struct {
+		name   string
+		claims map[string]any
+		modify func(callback string, state *http.Cookie) (string, *http.Cookie)
+		err    error
+		errMsg string
+	}{
+		{name: "state mismatch", modify: func(callback string, state *http.Cookie) (string, *http.Cookie) {
+			return strings.Replace(callback, "state=", "state=x", 1), state
+		}, err: ErrInvalidCallback, errMsg: "state mismatch"},
+		{name: "no state cookie", modify: func(callback string, _ *http.Cookie) (string, *http.Cookie) {
+			return callback, nil
+		}, err: ErrInvalidCallback, errMsg: "no state cookie"},
+		{name: "forged state cookie", modify: func(callback string, state *http.Cookie) (string, *http.Cookie) {
+			state.Value = "AAAA" + state.Value[4:]
+			return callback, state
+		}, err: ErrInvalidCallback, errMsg: "invalid or expired state cookie"},
+		{name: "provider error", modify: func(callback string, state *http.Cookie) (string, *http.Cookie) {
+			return "https://app.example.com/oauth2/callback?error=access_denied&error_description=denied", state
+		}, err: ErrInvalidCallback, errMsg: `provider error "access_denied": denied`},
+		{name: "wrong audience", claims: map[string]any{"aud": "other-client"}, err: ErrInvalidCallback,
+			errMsg: "audience mismatch"},
+		{name: "wrong issuer", claims: map[string]any{"iss": "https://evil.example.com"}, err: ErrInvalidCallback,
+			errMsg: "id token issuer"},
+		{name: "wrong nonce", claims: map[string]any{"nonce": "replayed"}, err: ErrInvalidCallback, errMsg: "nonce mismatch"},
+		{name: "expired token", claims: map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, err: ErrInvalidCallback,
+			errMsg: "id token rejected"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := oidctest.NewIDP(t, oidctest.Claims(tt.claims))
+			c := newTestClient(t, idp)
+			wr := httptest.NewRecorder()
+			require.NoError(t, c.Login(wr, httptest.NewRequest("GET", "https://app.example.com/", http.NoBody)))
+			state := findCookie(t, wr.Result().Cookies(), "sess_state")
+			callback := idp.Authorize(wr.Header().Get("Location"))
+			if tt.modify != nil {
+				callback, state = tt.modify(callback, state)
+			}
+			req := httptest.NewRequest("GET", callback, http.NoBody)
+			if state != nil {
+				req.AddCookie(state)
+			}
+			wr = httptest.NewRecorder()
+			err := c.Callback(wr, req)
+			require.ErrorIs(t, err, tt.err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+			assert.Empty(t, wr.Result().Cookies(), "no session set")
+		})
+	}
+}
+
+func TestClient_Session(t *testing.T) {
+	c, err := NewClient(Config{Issuer: "https://idp.example.com", ClientID: "id", CookieName: "sess",
+		CookieSecret: "0123456789abcdef", CallbackPath: "/cb", SessionTTL: time.Hour})
+	require.NoError(t, err)
+
+	value, err := c.encrypt(Session{Subject: "u1", User: "u1", Expires: time.Now().Add(time.Minute).Unix()})
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "sess", Value: value})
+	sess, ok := c.Session(req)
+	require.True(t, ok)
+	assert.Equal(t, "u1", sess.Subject)
+
+	expired, err := c.encrypt(Session{Subject: "u1", Expires: time.Now().Add(-time.Minute).Unix()})
+	require.NoError(t, err)
+	other, err := NewClient(Config{Issuer: "https://idp.example.com", ClientID: "id", CookieName: "sess",
+		CookieSecret: "other-secret-0123", CallbackPath: "/cb"})
+	require.NoError(t, err)
+	foreign, err := other.encrypt(Session{Subject: "u1", Expires: time.Now().Add(time.Minute).Unix()})
+	require.NoError(t, err)
+
+	for _, v := range []string{expired, foreign, "garbage", ""} {
+		req = httptest.NewRequest("GET", "/", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: "sess", Value: v})
+		_, ok = c.Session(req)
+		assert.False(t, ok, v)
+	}
+}
+
+func TestClient_CallbackLocalRedirectOnly(t *testing.T) {
+	idp := oidctest.NewIDP(t)
+	c := newTestClient(t, idp)
+	st := loginState{State: "st", Nonce: "n", Verifier: "v", Return: "//evil.example.com/", Expires: time.Now().Add(time.Minute).Unix()}
+	value, err := c.encrypt(st)
+	require.NoError(t, err)
+
+	wr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "https://app.example.com/", http.NoBody)
+	require.NoError(t, c.Login(wr, req))
+	authURL, err := url.Parse(wr.Header().Get("Location"))
+	require.NoError(t, err)
+	q := authURL.Query()
+	q.Set("state", "st")
+	q.Set("nonce", "n")
+	q.Set("code_challenge", pkceChallenge("v"))
+	authURL.RawQuery = q.Encode()
+
+	req = httptest.NewRequest("GET", idp.Authorize(authURL.String()), http.NoBody)
+	req.AddCookie(&http.Cookie{Name: "sess_state", Value: value})
+	wr = httptest.NewRecorder()
+	require.NoError(t, c.Callback(wr, req))
+	assert.Equal(t, "/", wr.Header().Get("Location"))
+}
+
+func TestClient_ProviderFailed(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	c, err := NewClient(Config{Issuer: ts.URL, ClientID: "id", CookieName: "sess", CookieSecret: "0123456789abcdef",
+		CallbackPath: "/cb"})
+	require.NoError(t, err)
+	err = c.Login(httptest.NewRecorder(), httptest.NewRequest("GET", "/", http.NoBody))
+	require.ErrorIs(t, err, ErrProvider)
+	assert.Contains(t, err.Error(), "status 404")
+}
+
+func TestNewClient(t *testing.T) {
+	tbl := []struct {
+		cfg Config
+		err string
+	}{
+		{cfg: Config{ClientID: "id", CookieSecret: "0123456789abcdef", CallbackPath: "/cb"}, err: "issuer and client id required"},
+		{cfg: Config{Issuer: "https://idp", ClientID: "id", CookieSecret: "short", CallbackPath: "/cb"},
+			err: "cookie secret should be at least 16 characters"},
+		{cfg: Config{Issuer: "https://idp", ClientID: "id", CookieSecret: "0123456789abcdef", CallbackPath: "cb"},
+			err: `invalid callback path "cb"`},
+	}
+	for _, tt := range tbl {
+		_, err := NewClient(tt.cfg)
+		require.EqualError(t, err, tt.err)
+	}
+
+	c, err := NewClient(Config{Issuer: "https://idp", ClientID: "id", CookieSecret: "0123456789abcdef", CallbackPath: "/cb",
+		Scopes: []string{"email"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"openid", "email"}, c.cfg.Scopes)
+}
+
+func newTestClient(t *testing.T, idp *oidctest.IDP) *Client {
+	t.Helper()
+	c, err := NewClient(Config{Issuer: idp.URL(), ClientID: idp.ClientID, ClientSecret: idp.ClientSecret,
+		Scopes: []string{"openid", "email"}, CallbackPath: "/oauth2/callback", CookieName: "sess",
+		CookieSecret: "0123456789abcdef0123456789abcdef", SessionTTL: time.Hour, GroupsClaim: "groups"})
+	require.NoError(t, err)
+	return c
+}
+
+func findCookie(t *testing.T, cookies []*http.Cookie, name string) *http.Cookie {
+	t.Helper()
+	for _, c := range cookies {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("cookie %s not found", name)
+	return nil
+}
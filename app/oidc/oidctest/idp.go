@@ -0,0 +1,176 @@
+// Package oidctest implements a mock OpenID Connect identity provider for tests
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// IDP is a test identity provider supporting discovery, authorization code flow with PKCE and JWKS
+type IDP struct {
+	t      *testing.T
+	url    string
+	key    *rsa.PrivateKey
+	claims map[string]any // claims of issued id tokens, override defaults
+
+	ClientID     string
+	ClientSecret string
+
+	mu    sync.Mutex
+	codes map[string]authRequest // issued codes
+}
+
+type authRequest struct {
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// Option is a function that configures the IDP
+type Option func(*IDP)
+
+// Claims is an option to set claims of issued id tokens, i.e. email or groups. Default claims (iss, aud, sub,
+// nonce, exp, iat) can be overridden too.
+func Claims(claims map[string]any) Option {
+	return func(p *IDP) {
+		for k, v := range claims {
+			p.claims[k] = v
+		}
+	}
+}
+
+// NewIDP creates and starts identity provider for the client "client-id" with secret "client-secret"
+func NewIDP(t *testing.T, opts ...Option) *IDP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &IDP{t: t, key: key, claims: map[string]any{"sub": "user-1"}, codes: map[string]authRequest{},
+		ClientID: "client-id", ClientSecret: "client-secret"}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discoveryHandler)
+	mux.HandleFunc("GET /authorize", p.authorizeHandler)
+	mux.HandleFunc("POST /token", p.tokenHandler)
+	mux.HandleFunc("GET /jwks", p.jwksHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	p.url = srv.URL
+	return p
+}
+
+// URL returns issuer url of the provider
+func (p *IDP) URL() string {
+	return p.url
+}
+
+// Authorize emulates user's login with authorization url, returns callback url with code and state
+func (p *IDP) Authorize(authURL string) string {
+	p.t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	require.NoError(p.t, err)
+	defer resp.Body.Close()
+	require.Equal(p.t, http.StatusFound, resp.StatusCode, "authorize failed")
+	return resp.Header.Get("Location")
+}
+
+func (p *IDP) discoveryHandler(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]string{"issuer": p.url, "authorization_endpoint": p.url + "/authorize",
+		"token_endpoint": p.url + "/token", "jwks_uri": p.url + "/jwks"})
+}
+
+func (p *IDP) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = authRequest{nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+	p.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect uri", http.StatusBadRequest)
+		return
+	}
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *IDP) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != p.ClientID || secret != p.ClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"error": "invalid_client"})
+		return
+	}
+	p.mu.Lock()
+	req, found := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || req.redirectURI != r.PostFormValue("redirect_uri") ||
+		req.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := map[string]any{"iss": p.url, "aud": p.ClientID, "nonce": req.nonce,
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range p.claims {
+		claims[k] = v
+	}
+	writeJSON(w, map[string]string{"access_token": randomString(), "token_type": "Bearer", "id_token": p.sign(claims)})
+}
+
+func (p *IDP) jwksHandler(w http.ResponseWriter, _ *http.Request) {
+	enc := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, map[string]any{"keys": []map[string]string{{"kty": "RSA", "kid": "key-1", "alg": "RS256", "use": "sig",
+		"n": enc(p.key.N.Bytes()), "e": enc([]byte{1, 0, 1})}}})
+}
+
+// sign makes RS256 token with the claims
+func (p *IDP) sign(claims map[string]any) string {
+	hdr, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "key-1"})
+	require.NoError(p.t, err)
+	body, err := json.Marshal(claims)
+	require.NoError(p.t, err)
+	unsigned := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	require.NoError(p.t, err)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
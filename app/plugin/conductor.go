@@ -6,14 +6,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/tracing"
 	"github.com/umputun/reproxy/lib"
 )
 
@@ -24,6 +29,7 @@ import (
 type Conductor struct {
 	Address   string
 	RPCDialer RPCDialer
+	Tracer    *tracing.Tracer // optional, makes span for each plugin call
 
 	plugins []Handler
 	lock    sync.RWMutex
@@ -43,6 +49,12 @@ type conductorCtxtKey string
 // CtxMatch key used to retrieve matching request info from the request context
 const CtxMatch = conductorCtxtKey("match")
 
+// CtxRealIP key used to retrieve resolved client ip from the request context
+const CtxRealIP = conductorCtxtKey("realIP")
+
+// CtxRequestID key used to retrieve request id from the request context
+const CtxRequestID = conductorCtxtKey("requestID")
+
 // RPCDialer is a maker interface dialing to rpc server and returning new RPCClient
 type RPCDialer interface {
 	Dial(network, address string) (RPCClient, error)
@@ -115,8 +127,8 @@ func (c *Conductor) Middleware(next http.Handler) http.Handler {
 				continue
 			}
 
-			var reply lib.Response
-			if err := p.client.Call(p.Method, c.makeRequest(r), &reply); err != nil {
+			reply, err := c.callPlugin(r, p)
+			if err != nil {
 				log.Printf("[WARN] failed to invoke plugin handler %s: %v", p.Method, err)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
@@ -135,6 +147,22 @@ func (c *Conductor) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// callPlugin invokes plugin's handler, wrapped with client span if tracing enabled
+func (c *Conductor) callPlugin(r *http.Request, p Handler) (reply lib.Response, err error) {
+	_, span := c.Tracer.Start(r.Context(), "plugin "+p.Method, trace.SpanKindClient)
+	defer span.End()
+	span.SetAttributes(attribute.String("rpc.system", "netrpc"), attribute.String("rpc.method", p.Method),
+		attribute.String("server.address", p.Address))
+
+	if err = p.client.Call(p.Method, c.makeRequest(r), &reply); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return reply, fmt.Errorf("plugin call failed: %w", err)
+	}
+	span.SetAttributes(attribute.Int("reproxy.plugin.status_code", reply.StatusCode))
+	return reply, nil
+}
+
 // makeRequest creates plugin request from http.Request
 // uses context set by downstream (by proxyHandler)
 func (c *Conductor) makeRequest(r *http.Request) lib.Request {
@@ -146,6 +174,15 @@ func (c *Conductor) makeRequest(r *http.Request) lib.Request {
 		Header:     r.Header,
 	}
 
+	if v, ok := ctx.Value(CtxRealIP).(string); ok {
+		res.RealIP = v
+	} else if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		res.RealIP = ip
+	}
+	if v, ok := ctx.Value(CtxRequestID).(string); ok {
+		res.RequestID = v
+	}
+
 	if v, ok := ctx.Value(CtxMatch).(discovery.MatchedRoute); ok {
 		res.Route = v.Destination
 		res.Match.MatchType = v.Mapper.MatchType.String()
@@ -16,8 +16,13 @@ import (
 	log "github.com/go-pkgz/lgr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/tracing"
 	"github.com/umputun/reproxy/lib"
 )
 
@@ -497,3 +502,44 @@ func TestConductor_MiddlewareReleasesLockDuringCall(t *testing.T) {
 		t.Fatal("middleware did not reach next handler after plugin call returned")
 	}
 }
+
+func TestConductor_callPluginWithTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exp, SampleRatio: 1, BatchTimeout: 10 * time.Millisecond})
+
+	rpcClient := &RPCClientMock{
+		CallFunc: func(serviceMethod string, args any, reply any) error {
+			req := args.(lib.Request)
+			assert.Equal(t, "10.0.0.1", req.RealIP)
+			assert.Equal(t, "req-123", req.RequestID)
+			if serviceMethod == "Test1.Fail" {
+				return errors.New("something failed")
+			}
+			reply.(*lib.Response).StatusCode = 200
+			return nil
+		},
+	}
+	c := Conductor{Tracer: tracer}
+
+	ctx, parent := tracer.Start(context.Background(), "server", trace.SpanKindServer)
+	ctx = context.WithValue(ctx, CtxRealIP, "10.0.0.1")
+	ctx = context.WithValue(ctx, CtxRequestID, "req-123")
+	req := httptest.NewRequest("GET", "http://127.0.0.1", http.NoBody).WithContext(ctx)
+
+	reply, err := c.callPlugin(req, Handler{Address: "127.0.0.1:8001", Method: "Test1.Mw1", Alive: true, client: rpcClient})
+	require.NoError(t, err)
+	assert.Equal(t, 200, reply.StatusCode)
+	_, err = c.callPlugin(req, Handler{Address: "127.0.0.1:8001", Method: "Test1.Fail", Alive: true, client: rpcClient})
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool { return len(exp.GetSpans()) == 2 }, time.Second, 10*time.Millisecond)
+
+	spans := exp.GetSpans()
+	assert.Equal(t, "plugin Test1.Mw1", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Contains(t, spans[0].Attributes, attribute.String("rpc.method", "Test1.Mw1"))
+	assert.Contains(t, spans[0].Attributes, attribute.Int("reproxy.plugin.status_code", 200))
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, "plugin Test1.Fail", spans[1].Name)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// access log formats
+const (
+	AccessLogCombined = "combined" // apache combined log format, default
+	AccessLogJSON     = "json"
+	AccessLogLogfmt   = "logfmt"
+)
+
+// accessRecord is a single structured access log record
+type accessRecord struct {
+	Time             time.Time `json:"ts"`
+	ClientIP         string    `json:"client_ip"`
+	Country          string    `json:"country,omitempty"`
+	RequestID        string    `json:"request_id,omitempty"`
+	Method           string    `json:"method"`
+	Host             string    `json:"host"`
+	URI              string    `json:"uri"`
+	Proto            string    `json:"proto"`
+	Status           int       `json:"status"`
+	BytesIn          int64     `json:"bytes_in"`
+	BytesOut         int64     `json:"bytes_out"`
+	DurationMs       float64   `json:"duration_ms"`
+	Referer          string    `json:"referer,omitempty"`
+	UserAgent        string    `json:"user_agent,omitempty"`
+	Server           string    `json:"server,omitempty"`
+	Route            string    `json:"route,omitempty"`
+	Destination      string    `json:"destination,omitempty"`
+	ProviderID       string    `json:"provider,omitempty"`
+	MatchType        string    `json:"match_type,omitempty"`
+	UpstreamStatus   int       `json:"upstream_status,omitempty"`
+	UpstreamDuration float64   `json:"upstream_duration_ms,omitempty"`
+	WAFTags          string    `json:"waf_tags,omitempty"`
+}
+
+// upstreamInfo collects details of the upstream round trip, filled by upstreamRecorder
+type upstreamInfo struct {
+	status   int
+	duration time.Duration
+}
+
+// structuredLogHandler writes access log records in json or logfmt format, with routing details
+// and upstream status and timing
+func structuredLogHandler(wr io.Writer, format string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			st := time.Now()
+			upstream := &upstreamInfo{}
+			lw := &logResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			body := &countingReader{ReadCloser: r.Body}
+			req := r.WithContext(context.WithValue(r.Context(), ctxUpstream, upstream))
+			if r.Body != nil && r.Body != http.NoBody {
+				req.Body = body
+			}
+
+			next.ServeHTTP(lw, req)
+
+			rec := makeAccessRecord(r, lw)
+			rec.Time = st
+			rec.BytesIn = body.n
+			rec.DurationMs = durationMs(time.Since(st))
+			rec.UpstreamStatus = upstream.status
+			rec.UpstreamDuration = durationMs(upstream.duration)
+
+			line, err := formatAccessRecord(rec, format)
+			if err != nil {
+				log.Printf("[WARN] can't format access log record, %v", err)
+				return
+			}
+			if _, err := wr.Write(line); err != nil {
+				log.Printf("[WARN] can't write access log record, %v", err)
+			}
+		})
+	}
+}
+
+// makeAccessRecord makes access log record from the request and the response info,
+// routing details taken from the matched route in the request's context
+func makeAccessRecord(r *http.Request, lw *logResponseWriter) accessRecord {
+	rec := accessRecord{
+		ClientIP:  realIPFromRequest(r),
+		Country:   countryFromRequest(r),
+		RequestID: requestIDFromRequest(r),
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    lw.status,
+		BytesOut:  lw.size,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		WAFTags:   wafTagsFromRequest(r),
+	}
+	if rec.URI == "" {
+		rec.URI = r.URL.RequestURI()
+	}
+	if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok {
+		rec.Server = match.Mapper.Server
+		rec.Route = match.Mapper.SrcMatch.String()
+		rec.Destination = match.Destination
+		rec.ProviderID = string(match.Mapper.ProviderID)
+		rec.MatchType = match.Mapper.MatchType.String()
+	}
+	return rec
+}
+
+// formatAccessRecord makes a single line of access log in json or logfmt format
+func formatAccessRecord(rec accessRecord, format string) ([]byte, error) {
+	if format == AccessLogJSON {
+		res, err := json.Marshal(rec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal access record: %w", err)
+		}
+		return append(res, '\n'), nil
+	}
+
+	var sb strings.Builder
+	add := func(k, v string, omitEmpty bool) {
+		if omitEmpty && v == "" {
+			return
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(logfmtValue(v))
+	}
+	add("ts", rec.Time.Format(time.RFC3339Nano), false)
+	add("client_ip", rec.ClientIP, false)
+	add("country", rec.Country, true)
+	add("request_id", rec.RequestID, true)
+	add("method", rec.Method, false)
+	add("host", rec.Host, false)
+	add("uri", rec.URI, false)
+	add("proto", rec.Proto, false)
+	add("status", strconv.Itoa(rec.Status), false)
+	add("bytes_in", strconv.FormatInt(rec.BytesIn, 10), false)
+	add("bytes_out", strconv.FormatInt(rec.BytesOut, 10), false)
+	add("duration_ms", strconv.FormatFloat(rec.DurationMs, 'f', -1, 64), false)
+	add("referer", rec.Referer, true)
+	add("user_agent", rec.UserAgent, true)
+	add("server", rec.Server, true)
+	add("route", rec.Route, true)
+	add("destination", rec.Destination, true)
+	add("provider", rec.ProviderID, true)
+	add("match_type", rec.MatchType, true)
+	if rec.UpstreamStatus > 0 {
+		add("upstream_status", strconv.Itoa(rec.UpstreamStatus), false)
+		add("upstream_duration_ms", strconv.FormatFloat(rec.UpstreamDuration, 'f', -1, 64), false)
+	}
+	add("waf_tags", rec.WAFTags, true)
+	sb.WriteByte('\n')
+	return []byte(sb.String()), nil
+}
+
+// logfmtValue quotes value if it has spaces, quotes, equal signs or control characters
+func logfmtValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, c := range v {
+		if c <= ' ' || c == '"' || c == '=' || c == '\\' || c == 0x7f {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// durationMs converts duration to milliseconds with microseconds precision
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// upstreamRecorder wraps upstream round tripper and records status and timing for access log
+type upstreamRecorder struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (u upstreamRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	info, ok := req.Context().Value(ctxUpstream).(*upstreamInfo)
+	if !ok {
+		return u.base.RoundTrip(req) //nolint:wrapcheck // errors of the wrapped round tripper returned as-is
+	}
+	st := time.Now()
+	resp, err := u.base.RoundTrip(req)
+	info.duration = time.Since(st)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // errors of the wrapped round tripper returned as-is
+	}
+	info.status = resp.StatusCode
+	return resp, nil
+}
+
+// countingReader counts bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err //nolint:wrapcheck // errors of the wrapped reader returned as-is
+}
+
+// logResponseWriter wraps http.ResponseWriter and stores status code and size of the response
+type logResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+// WriteHeader stores the first status code and passes it to the wrapped writer
+func (lw *logResponseWriter) WriteHeader(code int) {
+	if !lw.wroteHeader && code >= 200 { // informational responses are not final
+		lw.status, lw.wroteHeader = code, true
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+// Write counts written bytes
+func (lw *logResponseWriter) Write(b []byte) (int, error) {
+	lw.wroteHeader = true
+	n, err := lw.ResponseWriter.Write(b)
+	lw.size += int64(n)
+	return n, err //nolint:wrapcheck // pass errors of the wrapped writer as-is
+}
+
+// Flush delegates to the original writer if it implements http.Flusher
+func (lw *logResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack delegates to the original writer if it implements http.Hijacker
+func (lw *logResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := lw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, buf, err := h.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	if !lw.wroteHeader {
+		lw.status, lw.wroteHeader = http.StatusSwitchingProtocols, true
+	}
+	return conn, buf, nil
+}
+
+// Unwrap returns the original writer, used by http.ResponseController
+func (lw *logResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func Test_formatAccessRecord(t *testing.T) {
+	rec := accessRecord{
+		Time:             time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		ClientIP:         "1.2.3.4",
+		Country:          "US",
+		RequestID:        "req-1",
+		Method:           "POST",
+		Host:             "example.com",
+		URI:              "/api/v1?q=a b",
+		Proto:            "HTTP/1.1",
+		Status:           201,
+		BytesIn:          10,
+		BytesOut:         20,
+		DurationMs:       1.5,
+		UserAgent:        `agent "x"`,
+		Server:           "example.com",
+		Route:            "^/api/(.*)",
+		Destination:      "http://127.0.0.1:8080/v1",
+		ProviderID:       "docker",
+		MatchType:        "proxy",
+		UpstreamStatus:   201,
+		UpstreamDuration: 1.2,
+		WAFTags:          "scanner,sqli",
+	}
+
+	t.Run("json", func(t *testing.T) {
+		line, err := formatAccessRecord(rec, AccessLogJSON)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasSuffix(line, []byte("\n")))
+		var res map[string]any
+		require.NoError(t, json.Unmarshal(line, &res))
+		assert.Equal(t, map[string]any{
+			"ts": "2026-01-02T03:04:05Z", "client_ip": "1.2.3.4", "country": "US", "request_id": "req-1", "method": "POST",
+			"host": "example.com", "uri": "/api/v1?q=a b", "proto": "HTTP/1.1", "status": float64(201),
+			"bytes_in": float64(10), "bytes_out": float64(20), "duration_ms": 1.5, "user_agent": `agent "x"`,
+			"server": "example.com", "route": "^/api/(.*)", "destination": "http://127.0.0.1:8080/v1",
+			"provider": "docker", "match_type": "proxy", "upstream_status": float64(201), "upstream_duration_ms": 1.2,
+			"waf_tags": "scanner,sqli",
+		}, res)
+	})
+
+	t.Run("logfmt", func(t *testing.T) {
+		line, err := formatAccessRecord(rec, AccessLogLogfmt)
+		require.NoError(t, err)
+		assert.Equal(t, `ts=2026-01-02T03:04:05Z client_ip=1.2.3.4 country=US request_id=req-1 method=POST host=example.com `+
+			`uri="/api/v1?q=a b" proto=HTTP/1.1 status=201 bytes_in=10 bytes_out=20 duration_ms=1.5 `+
+			`user_agent="agent \"x\"" server=example.com route=^/api/(.*) destination=http://127.0.0.1:8080/v1 `+
+			`provider=docker match_type=proxy upstream_status=201 upstream_duration_ms=1.2 waf_tags=scanner,sqli`+"\n", string(line))
+	})
+
+	t.Run("logfmt, unmatched", func(t *testing.T) {
+		line, err := formatAccessRecord(accessRecord{Time: rec.Time, Method: "GET", Status: 502}, AccessLogLogfmt)
+		require.NoError(t, err)
+		assert.Equal(t, `ts=2026-01-02T03:04:05Z client_ip="" method=GET host="" uri="" proto="" status=502 `+
+			`bytes_in=0 bytes_out=0 duration_ms=0`+"\n", string(line))
+	})
+}
+
+func Test_structuredLogHandler(t *testing.T) {
+	buf := bytes.Buffer{}
+	rt := upstreamRecorder{base: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		time.Sleep(5 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}, nil
+	})}
+	handler := structuredLogHandler(&buf, AccessLogJSON)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Body.Read(make([]byte, 100))
+		require.NoError(t, err)
+		req, err := http.NewRequestWithContext(r.Context(), "GET", "http://127.0.0.1:8080/v1", http.NoBody)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = w.Write([]byte("response"))
+	}))
+
+	req := httptest.NewRequest("POST", "http://example.com/api/v1?k=v", strings.NewReader("some body"))
+	req.Header.Set("User-Agent", "test-agent")
+	req.RemoteAddr = "1.2.3.4:1234"
+	ctx := context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Destination: "http://127.0.0.1:8080/v1",
+		Mapper: discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), ProviderID: discovery.PIFile,
+			MatchType: discovery.MTProxy}})
+	ctx = context.WithValue(ctx, ctxRequestID, "req-1")
+	ctx = context.WithValue(ctx, ctxCountry, "DE")
+	ctx = context.WithValue(ctx, ctxWAFTags, []string{"scanner"})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(ctx))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var res accessRecord
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+	assert.Equal(t, "1.2.3.4", res.ClientIP)
+	assert.Equal(t, "DE", res.Country)
+	assert.Equal(t, "scanner", res.WAFTags)
+	assert.Equal(t, "req-1", res.RequestID)
+	assert.Equal(t, "POST", res.Method)
+	assert.Equal(t, "example.com", res.Host)
+	assert.Equal(t, "http://example.com/api/v1?k=v", res.URI)
+	assert.Equal(t, http.StatusAccepted, res.Status)
+	assert.Equal(t, int64(9), res.BytesIn)
+	assert.Equal(t, int64(8), res.BytesOut)
+	assert.Equal(t, "test-agent", res.UserAgent)
+	assert.Equal(t, "*", res.Server)
+	assert.Equal(t, "^/api/(.*)", res.Route)
+	assert.Equal(t, "http://127.0.0.1:8080/v1", res.Destination)
+	assert.Equal(t, "file", res.ProviderID)
+	assert.Equal(t, "proxy", res.MatchType)
+	assert.Equal(t, http.StatusAccepted, res.UpstreamStatus)
+	assert.GreaterOrEqual(t, res.UpstreamDuration, 5.0)
+	assert.GreaterOrEqual(t, res.DurationMs, res.UpstreamDuration)
+}
+
+func TestHttp_DoWithStructuredAccessLog(t *testing.T) {
+	port, releasePort := getFreePort(t)
+	buf := &syncBuffer{}
+	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: buf, AccessLogFormat: AccessLogLogfmt, Reporter: &ErrorReporter{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"127.0.0.1,^/api/(.*)," + ds.URL + "/567/$1,"}}}, time.Millisecond*10)
+	go func() {
+		_ = svc.Run(t.Context())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	h.Matcher = svc
+
+	releasePort()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+
+	client := http.Client{}
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/ping")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "server failed to start")
+
+	resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+
+	require.Eventually(t, func() bool { // log record written after the response sent
+		return strings.Contains(buf.String(), "/api/something")
+	}, time.Second, 10*time.Millisecond)
+	line := buf.String()
+	t.Log(line)
+	assert.Contains(t, line, "client_ip=127.0.0.1 method=GET ")
+	assert.Contains(t, line, "uri=/api/something proto=HTTP/1.1 status=418 bytes_in=0 bytes_out=23 ")
+	assert.Contains(t, line, "server=127.0.0.1 route=^/api/(.*) destination="+ds.URL+"/567/something provider=static "+
+		"match_type=proxy upstream_status=418 upstream_duration_ms=")
+}
+
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
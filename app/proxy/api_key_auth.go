@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// APIKeyStore checks api keys, returns name of the client with the key
+type APIKeyStore interface {
+	Lookup(key string) (client string, ok bool)
+}
+
+// apiKeyHandler checks api key of routes with api key policy. Key taken from the route's header or query parameter,
+// missing, unknown and disabled keys rejected with 401, keys of clients not allowed on the route with 403.
+// The key is removed from the request passed upstream, the client name set in the route's forward header instead.
+func (h *Http) apiKeyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || !match.Mapper.APIKey.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy := match.Mapper.APIKey
+		r.Header.Del(policy.Forward) // don't trust client's value of the client name
+
+		key := apiKeyFromRequest(r, policy)
+		if key == "" {
+			reportError(w, r, h.Reporter, http.StatusUnauthorized)
+			return
+		}
+		if h.APIKeys == nil {
+			log.Printf("[WARN] api key required for %s, but api keys file not defined", r.URL.Path)
+			reportError(w, r, h.Reporter, http.StatusUnauthorized)
+			return
+		}
+		client, ok := h.APIKeys.Lookup(key)
+		if !ok {
+			log.Printf("[INFO] unknown or disabled api key on %s from %s", r.URL.Path, realIPFromRequest(r))
+			reportError(w, r, h.Reporter, http.StatusUnauthorized)
+			return
+		}
+		if len(policy.Clients) > 0 && !slices.Contains(policy.Clients, client) {
+			log.Printf("[INFO] api key client %q not allowed on %s", client, r.URL.Path)
+			reportError(w, r, h.Reporter, http.StatusForbidden)
+			return
+		}
+		r.Header.Set(policy.Forward, client)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyFromRequest returns api key from the header or, if not set, from the query parameter of the policy.
+// Both removed from the request.
+func apiKeyFromRequest(r *http.Request, policy discovery.APIKeyPolicy) string {
+	key := r.Header.Get(policy.Header)
+	r.Header.Del(policy.Header)
+	if policy.Query == "" {
+		return key
+	}
+	if q := r.URL.Query(); q.Has(policy.Query) {
+		if key == "" {
+			key = q.Get(policy.Query)
+		}
+		q.Del(policy.Query)
+		r.URL.RawQuery = q.Encode()
+	}
+	return key
+}
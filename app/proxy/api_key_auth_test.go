@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+type apiKeysMock map[string]string
+
+func (m apiKeysMock) Lookup(key string) (string, bool) {
+	client, ok := m[key]
+	return client, ok
+}
+
+func TestHttp_apiKeyHandler(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}, APIKeys: apiKeysMock{"key-1": "billing", "key-2": "reports"}}
+	handler := h.apiKeyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Client", r.Header.Get("X-Api-Client"))
+		w.Header().Set("X-Got-Key", r.Header.Get("X-Api-Key"))
+		w.Header().Set("X-Got-Query", r.URL.RawQuery)
+		_, _ = w.Write([]byte("passed"))
+	}))
+
+	makeReq := func(target, policy string, headers ...string) *http.Request {
+		req := httptest.NewRequest("GET", target, http.NoBody)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		p, err := discovery.ParseAPIKey(policy)
+		require.NoError(t, err)
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"), APIKey: p}}
+		return req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+	}
+
+	tbl := []struct {
+		name   string
+		req    *http.Request
+		code   int
+		client string
+		query  string
+	}{
+		{name: "key in header", req: makeReq("http://example.com/api/items?id=1", "on", "X-Api-Key", "key-1"),
+			code: http.StatusOK, client: "billing", query: "id=1"},
+		{name: "client name not trusted", req: makeReq("http://example.com/api/items", "on", "X-Api-Key", "key-2",
+			"X-Api-Client", "billing"), code: http.StatusOK, client: "reports"},
+		{name: "key in query", req: makeReq("http://example.com/api/items?id=1&api_key=key-2", "query=api_key"),
+			code: http.StatusOK, client: "reports", query: "id=1"},
+		{name: "header preferred over query", req: makeReq("http://example.com/api/items?api_key=bad", "query=api_key",
+			"X-Api-Key", "key-1"), code: http.StatusOK, client: "billing"},
+		{name: "query not accepted", req: makeReq("http://example.com/api/items?api_key=key-1", "on"),
+			code: http.StatusUnauthorized},
+		{name: "custom header and forward", req: makeReq("http://example.com/api/items", "header=X-Token, forward=X-Client",
+			"X-Token", "key-1"), code: http.StatusOK},
+		{name: "no key", req: makeReq("http://example.com/api/items", "on"), code: http.StatusUnauthorized},
+		{name: "unknown key", req: makeReq("http://example.com/api/items", "on", "X-Api-Key", "key-3"),
+			code: http.StatusUnauthorized},
+		{name: "client allowed", req: makeReq("http://example.com/api/items", "clients=reports billing", "X-Api-Key", "key-1"),
+			code: http.StatusOK, client: "billing"},
+		{name: "client not allowed", req: makeReq("http://example.com/api/items", "clients=reports", "X-Api-Key", "key-1"),
+			code: http.StatusForbidden},
+		{name: "route without api key", req: makeReq("http://example.com/api/items?api_key=k", "", "X-Api-Client", "spoofed"),
+			code: http.StatusOK, client: "spoofed", query: "api_key=k"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, tt.req)
+			assert.Equal(t, tt.code, wr.Code)
+			if tt.code != http.StatusOK {
+				assert.NotContains(t, wr.Body.String(), "passed")
+				return
+			}
+			assert.Equal(t, tt.client, wr.Header().Get("X-Got-Client"))
+			assert.Empty(t, wr.Header().Get("X-Got-Key"), "key not passed upstream")
+			assert.Equal(t, tt.query, wr.Header().Get("X-Got-Query"))
+		})
+	}
+
+	t.Run("no api keys store", func(t *testing.T) {
+		noStore := Http{Reporter: &ErrorReporter{}}
+		wr := httptest.NewRecorder()
+		noStore.apiKeyHandler(http.NotFoundHandler()).ServeHTTP(wr, makeReq("http://example.com/api/items", "on",
+			"X-Api-Key", "key-1"))
+		assert.Equal(t, http.StatusUnauthorized, wr.Code)
+	})
+}
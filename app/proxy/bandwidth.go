@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+	"golang.org/x/time/rate"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// BandwidthMetrics defines per-route bandwidth counters reported by proxy handlers.
+// Optional, used if Metrics provider implements it.
+type BandwidthMetrics interface {
+	AddBytesSent(m discovery.URLMapper, n int)
+	AddThrottled(m discovery.URLMapper, d time.Duration)
+}
+
+const (
+	bandwidthChunk          = 32 * 1024        // max size of a single paced write, also the max burst of limiters
+	bandwidthClientTTL      = 10 * time.Minute // idle client limiters dropped after this time
+	bandwidthClientsMaxKeys = 100_000          // max number of client limiters per route, least recently used evicted
+)
+
+// routeBandwidth keeps limiters of a single route, the shared one for the route and one for each client ip
+type routeBandwidth struct {
+	mapper discovery.URLMapper
+	route  *rate.Limiter // nil if route limit not set
+
+	lock    sync.Mutex // makes get-or-create of client limiters atomic
+	clients cache.Cache[string, *rate.Limiter]
+}
+
+// bandwidthHandler paces responses of routes with bandwidth limit. Responses are not rejected, writes are split
+// to chunks and each chunk waits for both route and client limiters. Placed outside of gzip, so limits apply
+// to bytes sent over the wire.
+func (h *Http) bandwidthHandler() func(next http.Handler) http.Handler {
+	var routes sync.Map // map[string]*routeBandwidth, keyed by server\x00srcMatch\x00limits
+	getRoute := func(m discovery.URLMapper) *routeBandwidth {
+		// NUL separator is invalid in hostnames and regex source, avoiding key collisions
+		key := m.Server + "\x00" + m.SrcMatch.String() + "\x00" + strconv.FormatInt(m.Bandwidth.Route, 10) +
+			"\x00" + strconv.FormatInt(m.Bandwidth.Client, 10)
+		if v, ok := routes.Load(key); ok {
+			return v.(*routeBandwidth)
+		}
+		actual, _ := routes.LoadOrStore(key, newRouteBandwidth(m))
+		return actual.(*routeBandwidth)
+	}
+	metrics, _ := h.Metrics.(BandwidthMetrics)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || (match.Mapper.Bandwidth.Route <= 0 && match.Mapper.Bandwidth.Client <= 0) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rb := getRoute(match.Mapper)
+			limiters := make([]*rate.Limiter, 0, 2)
+			if rb.route != nil {
+				limiters = append(limiters, rb.route)
+			}
+			if match.Mapper.Bandwidth.Client > 0 {
+				limiters = append(limiters, rb.client(realIPFromRequest(r)))
+			}
+
+			pw := &pacedResponseWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters,
+				chunk: bandwidthChunk, mapper: match.Mapper, metrics: metrics}
+			for _, l := range limiters {
+				pw.chunk = min(pw.chunk, l.Burst())
+			}
+			next.ServeHTTP(pw, r)
+		})
+	}
+}
+
+func newRouteBandwidth(m discovery.URLMapper) *routeBandwidth {
+	res := &routeBandwidth{mapper: m}
+	if m.Bandwidth.Route > 0 {
+		res.route = newBandwidthLimiter(m.Bandwidth.Route)
+	}
+	if m.Bandwidth.Client > 0 {
+		res.clients = cache.NewCache[string, *rate.Limiter]().WithTTL(bandwidthClientTTL).
+			WithMaxKeys(bandwidthClientsMaxKeys).WithLRU()
+	}
+	return res
+}
+
+// client returns limiter of the client ip, creates a new one if not found
+func (rb *routeBandwidth) client(ip string) *rate.Limiter {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	lim, ok := rb.clients.Get(ip)
+	if !ok {
+		lim = newBandwidthLimiter(rb.mapper.Bandwidth.Client)
+	}
+	rb.clients.Set(ip, lim, 0) // refresh ttl of active client
+	return lim
+}
+
+// newBandwidthLimiter makes limiter with bytes/sec rate and burst of one chunk, but not more than a second of traffic
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(min(bytesPerSec, bandwidthChunk)))
+}
+
+// pacedResponseWriter wraps http.ResponseWriter and delays writes to keep them within limits
+type pacedResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+	chunk    int
+	mapper   discovery.URLMapper
+	metrics  BandwidthMetrics
+}
+
+// Write splits data to chunks and writes each one as soon as all limiters allow it
+func (pw *pacedResponseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), pw.chunk)
+		if err := pw.wait(n); err != nil {
+			return written, err
+		}
+		k, err := pw.ResponseWriter.Write(b[:n])
+		written += k
+		if pw.metrics != nil && k > 0 {
+			pw.metrics.AddBytesSent(pw.mapper, k)
+		}
+		if err != nil {
+			return written, err //nolint:wrapcheck // pass errors of the wrapped writer as-is
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// wait reserves n bytes from all limiters and sleeps for the longest delay. Reservations are canceled
+// if request is done before the delay passed, returning unused bytes to limiters.
+func (pw *pacedResponseWriter) wait(n int) error {
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(pw.limiters))
+	cancelAll := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+
+	var delay time.Duration
+	for _, l := range pw.limiters {
+		r := l.ReserveN(now, n)
+		if !r.OK() { // can't happen as chunk is never larger than burst
+			cancelAll()
+			return fmt.Errorf("can't reserve %d bytes, burst %d", n, l.Burst())
+		}
+		reservations = append(reservations, r)
+		delay = max(delay, r.DelayFrom(now))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	tm := time.NewTimer(delay)
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+		if pw.metrics != nil {
+			pw.metrics.AddThrottled(pw.mapper, delay)
+		}
+		return nil
+	case <-pw.ctx.Done():
+		cancelAll()
+		return fmt.Errorf("bandwidth wait interrupted: %w", pw.ctx.Err())
+	}
+}
+
+// Flush delegates to the original writer if it implements http.Flusher
+func (pw *pacedResponseWriter) Flush() {
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack delegates to the original writer if it implements http.Hijacker. Hijacked connection is not paced.
+func (pw *pacedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := pw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, buf, err := h.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	return conn, buf, nil
+}
+
+// Unwrap returns the original writer, used by http.ResponseController
+func (pw *pacedResponseWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/mgmt"
+)
+
+var _ BandwidthMetrics = (*mgmt.Metrics)(nil)
+
+func TestHttp_bandwidthHandler(t *testing.T) {
+	body := strings.Repeat("x", 200)
+	tbl := []struct {
+		name    string
+		limit   discovery.BandwidthLimit
+		ips     [2]string // client ips of two concurrent requests
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		{name: "route limit shared by clients", limit: discovery.BandwidthLimit{Route: 200},
+			ips: [2]string{"10.0.0.1", "10.0.0.2"}, minTime: 900 * time.Millisecond, maxTime: 3 * time.Second},
+		{name: "client limit, different clients", limit: discovery.BandwidthLimit{Client: 200},
+			ips: [2]string{"10.0.0.1", "10.0.0.2"}, maxTime: 500 * time.Millisecond},
+		{name: "client limit, same client", limit: discovery.BandwidthLimit{Client: 200},
+			ips: [2]string{"10.0.0.1", "10.0.0.1"}, minTime: 900 * time.Millisecond, maxTime: 3 * time.Second},
+		{name: "client limit under route limit", limit: discovery.BandwidthLimit{Route: 1000, Client: 200},
+			ips: [2]string{"10.0.0.1", "10.0.0.1"}, minTime: 900 * time.Millisecond, maxTime: 3 * time.Second},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &bandwidthMetricsRecorder{}
+			h := Http{Metrics: metrics}
+			handler := h.bandwidthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, err := w.Write([]byte(body))
+				assert.NoError(t, err)
+			}))
+			match := discovery.MatchedRoute{Mapper: discovery.URLMapper{Server: "example.com",
+				SrcMatch: *regexp.MustCompile("^/files/(.*)"), Bandwidth: tt.limit}}
+
+			st := time.Now()
+			var wg sync.WaitGroup
+			for _, ip := range tt.ips {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req := httptest.NewRequest("GET", "http://example.com/files/a.bin", http.NoBody)
+					req.RemoteAddr = ip + ":12345"
+					req = req.WithContext(context.WithValue(req.Context(), ctxMatch, match))
+					rr := httptest.NewRecorder()
+					handler.ServeHTTP(rr, req)
+					assert.Equal(t, body, rr.Body.String())
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(st)
+			assert.GreaterOrEqual(t, elapsed, tt.minTime)
+			assert.Less(t, elapsed, tt.maxTime)
+			assert.Equal(t, 2*len(body), metrics.sent())
+			if tt.minTime > 0 {
+				assert.Positive(t, metrics.throttled())
+			} else {
+				assert.Zero(t, metrics.throttled())
+			}
+		})
+	}
+}
+
+func TestHttp_bandwidthHandlerStaticAndProxied(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 40) // 400 bytes
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big.bin"), data, 0o600))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name string
+		next http.Handler
+	}{
+		{name: "static", next: http.StripPrefix("/files", http.FileServer(http.Dir(dir)))},
+		{name: "proxied", next: httputil.NewSingleHostReverseProxy(upstreamURL)},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Http{}
+			handler := h.bandwidthHandler()(tt.next)
+			match := discovery.MatchedRoute{Mapper: discovery.URLMapper{Server: "*",
+				SrcMatch: *regexp.MustCompile("^/files/(.*)"), Bandwidth: discovery.BandwidthLimit{Client: 200}}}
+			req := httptest.NewRequest("GET", "http://example.com/files/big.bin", http.NoBody)
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, match))
+			rr := httptest.NewRecorder()
+
+			st := time.Now()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, data, rr.Body.Bytes())
+			// first 200 bytes sent immediately, the rest paced at 200 bytes/sec
+			assert.GreaterOrEqual(t, time.Since(st), 900*time.Millisecond)
+		})
+	}
+}
+
+func TestHttp_bandwidthHandlerCanceled(t *testing.T) {
+	h := Http{}
+	writeErr := make(chan error, 1)
+	handler := h.bandwidthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write(bytes.Repeat([]byte("x"), 1000))
+		writeErr <- err
+	}))
+	match := discovery.MatchedRoute{Mapper: discovery.URLMapper{Server: "*",
+		SrcMatch: *regexp.MustCompile("^/files/(.*)"), Bandwidth: discovery.BandwidthLimit{Route: 100}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "http://example.com/files/big.bin", http.NoBody)
+	req = req.WithContext(context.WithValue(ctx, ctxMatch, match))
+	rr := httptest.NewRecorder()
+
+	st := time.Now()
+	handler.ServeHTTP(rr, req)
+	assert.Less(t, time.Since(st), time.Second)
+	require.ErrorIs(t, <-writeErr, context.DeadlineExceeded)
+	assert.Equal(t, 100, rr.Body.Len(), "only the first chunk written")
+}
+
+func TestHttp_bandwidthHandlerNoLimit(t *testing.T) {
+	h := Http{}
+	handler := h.bandwidthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isPaced := w.(*pacedResponseWriter)
+		assert.False(t, isPaced)
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/unmatched", http.NoBody))
+	assert.Equal(t, "ok", rr.Body.String())
+
+	req := httptest.NewRequest("GET", "/api/test", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{}))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "ok", rr.Body.String())
+}
+
+// bandwidthMetricsRecorder implements MiddlewareProvider and BandwidthMetrics, records totals
+type bandwidthMetricsRecorder struct {
+	lock       sync.Mutex
+	bytesSent  int
+	throttleDT time.Duration
+}
+
+func (m *bandwidthMetricsRecorder) Middleware(next http.Handler) http.Handler { return next }
+
+func (m *bandwidthMetricsRecorder) AddBytesSent(_ discovery.URLMapper, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bytesSent += n
+}
+
+func (m *bandwidthMetricsRecorder) AddThrottled(_ discovery.URLMapper, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.throttleDT += d
+}
+
+func (m *bandwidthMetricsRecorder) sent() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.bytesSent
+}
+
+func (m *bandwidthMetricsRecorder) throttled() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.throttleDT
+}
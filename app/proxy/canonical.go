@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// CanonicalMatcher returns server-level canonicalization policy for the host, implemented by discovery service
+type CanonicalMatcher interface {
+	CanonicalHost(host string) (discovery.CanonicalHost, bool)
+}
+
+// canonicalHandler redirects requests to the canonical host (www or apex, lower case) and path with the trailing slash
+// added or stripped, as defined by the server's policy. Runs before matchHandler, so routes see canonical requests only.
+// GET and HEAD redirected with 301, other methods with 308 to keep the method and body. The scheme of the redirect
+// is the one of the client, as reported by trusted proxies for requests behind them.
+func (h *Http) canonicalHandler(next http.Handler) http.Handler {
+	cm, ok := h.Matcher.(CanonicalMatcher)
+	if !ok {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port := r.Host, ""
+		if hh, pp, err := net.SplitHostPort(r.Host); err == nil {
+			host, port = hh, pp
+		}
+		if host == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy, found := cm.CanonicalHost(strings.ToLower(host))
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := canonicalHost(host, policy)
+		urlPath := canonicalPath(r.URL.EscapedPath(), policy.Slash)
+		if target == host && urlPath == r.URL.EscapedPath() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme := h.RealIP.scheme(r)
+		if port != "" {
+			target = net.JoinHostPort(target, port)
+		}
+		location := scheme + "://" + target + urlPath
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		log.Printf("[DEBUG] canonical redirect (%d) %s%s to %s", code, r.Host, r.URL.Path, location)
+		http.Redirect(w, r, location, code)
+	})
+}
+
+// canonicalHost returns host changed by policy, ip addresses get lower case only
+func canonicalHost(host string, policy discovery.CanonicalHost) string {
+	res := host
+	if policy.Lowercase {
+		res = strings.ToLower(res)
+	}
+	if net.ParseIP(host) != nil {
+		return res
+	}
+	hasWWW := strings.HasPrefix(strings.ToLower(res), "www.")
+	switch {
+	case policy.Host == discovery.HPApex && hasWWW:
+		res = res[len("www."):]
+	case policy.Host == discovery.HPWWW && !hasWWW:
+		res = "www." + res
+	}
+	return res
+}
+
+// canonicalPath returns path with trailing slash added or stripped. Root path never changed and paths with
+// file extension in the last segment don't get the slash added.
+func canonicalPath(p string, policy discovery.SlashPolicy) string {
+	if p == "" || p == "/" {
+		return p
+	}
+	switch policy {
+	case discovery.SPAdd:
+		if !strings.HasSuffix(p, "/") && path.Ext(p) == "" {
+			return p + "/"
+		}
+	case discovery.SPStrip:
+		if res := strings.TrimRight(p, "/"); res != "" {
+			return res
+		}
+		return "/"
+	}
+	return p
+}
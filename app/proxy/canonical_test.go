@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+var _ CanonicalMatcher = (*discovery.Service)(nil)
+
+type canonicalMatcherMock struct {
+	MatcherMock
+	policies map[string]discovery.CanonicalHost
+}
+
+func (m *canonicalMatcherMock) CanonicalHost(host string) (discovery.CanonicalHost, bool) {
+	c, ok := m.policies[host]
+	return c, ok
+}
+
+func TestHttp_canonicalHandler(t *testing.T) {
+	matcher := &canonicalMatcherMock{policies: map[string]discovery.CanonicalHost{
+		"example.com":     {Host: discovery.HPApex, Lowercase: true},
+		"www.example.com": {Host: discovery.HPApex, Lowercase: true},
+		"example.org":     {Host: discovery.HPWWW, Slash: discovery.SPAdd},
+		"www.example.org": {Host: discovery.HPWWW, Slash: discovery.SPAdd},
+		"api.example.com": {Slash: discovery.SPStrip},
+		"127.0.0.1":       {Host: discovery.HPWWW, Lowercase: true},
+	}}
+	realIP, err := NewRealIP([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	h := Http{Matcher: matcher, RealIP: realIP}
+	handler := h.canonicalHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("passed"))
+	}))
+
+	tbl := []struct {
+		name     string
+		method   string
+		url      string
+		tls      bool
+		remote   string
+		headers  map[string]string
+		code     int
+		location string
+	}{
+		{name: "www to apex", url: "http://www.example.com/path?a=1", code: http.StatusMovedPermanently,
+			location: "http://example.com/path?a=1"},
+		{name: "www to apex with port and tls", url: "https://WWW.Example.com:8443/path", tls: true,
+			code: http.StatusMovedPermanently, location: "https://example.com:8443/path"},
+		{name: "lowercase", url: "http://Example.COM/Path", code: http.StatusMovedPermanently,
+			location: "http://example.com/Path"},
+		{name: "post keeps method", method: "POST", url: "http://www.example.com/form", code: http.StatusPermanentRedirect,
+			location: "http://example.com/form"},
+		{name: "apex already", url: "http://example.com/path", code: http.StatusOK},
+		{name: "apex to www with slash", url: "http://example.org/docs", code: http.StatusMovedPermanently,
+			location: "http://www.example.org/docs/"},
+		{name: "add slash", url: "http://www.example.org/docs?x=y", code: http.StatusMovedPermanently,
+			location: "http://www.example.org/docs/?x=y"},
+		{name: "add slash skips files", url: "http://www.example.org/app.js", code: http.StatusOK},
+		{name: "add slash root", url: "http://www.example.org/", code: http.StatusOK},
+		{name: "strip slash", url: "http://api.example.com/v1/users//", code: http.StatusMovedPermanently,
+			location: "http://api.example.com/v1/users"},
+		{name: "strip slash escaped path", url: "http://api.example.com/a%20b/", code: http.StatusMovedPermanently,
+			location: "http://api.example.com/a%20b"},
+		{name: "strip slash root", url: "http://api.example.com/", code: http.StatusOK},
+		{name: "ip not prefixed with www", url: "http://127.0.0.1:8080/path", code: http.StatusOK},
+		{name: "no policy", url: "http://WWW.other.com/path/", code: http.StatusOK},
+		{name: "https behind trusted proxy", url: "http://www.example.com/path", remote: "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https"}, code: http.StatusMovedPermanently,
+			location: "https://example.com/path"},
+		{name: "forwarded proto behind trusted proxy", url: "http://www.example.com/path", remote: "10.0.0.1:1234",
+			headers: map[string]string{"Forwarded": "for=1.2.3.4;proto=https"}, code: http.StatusMovedPermanently,
+			location: "https://example.com/path"},
+		{name: "proto from untrusted peer ignored", url: "http://www.example.com/path", remote: "1.2.3.4:1234",
+			headers: map[string]string{"X-Forwarded-Proto": "https"}, code: http.StatusMovedPermanently,
+			location: "http://example.com/path"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, tt.url, http.NoBody)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			} else {
+				req.TLS = nil
+			}
+			if tt.remote != "" {
+				req.RemoteAddr = tt.remote
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, req)
+			assert.Equal(t, tt.code, wr.Code)
+			assert.Equal(t, tt.location, wr.Header().Get("Location"))
+			if tt.code == http.StatusOK {
+				assert.Equal(t, "passed", wr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHttp_canonicalHandlerWithoutPolicies(t *testing.T) {
+	h := Http{Matcher: &MatcherMock{}}
+	handler := h.canonicalHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("passed"))
+	}))
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, httptest.NewRequest("GET", "http://www.example.com/path/", http.NoBody))
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "passed", wr.Body.String())
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// RouteMetrics defines per-route gauges reported by proxy handlers. Optional, used if Metrics provider implements it.
+type RouteMetrics interface {
+	SetInFlight(m discovery.URLMapper, val int)
+	SetQueued(m discovery.URLMapper, val int)
+}
+
+// routeSlots limits concurrent requests of a single route
+type routeSlots struct {
+	mapper discovery.URLMapper
+	sem    chan struct{}
+
+	lock     sync.Mutex // guards counters, keeps reported gauges in order of changes
+	inFlight int
+	queued   int
+}
+
+// concurrencyHandler limits number of concurrent requests per route. Requests above the limit wait in the bounded
+// queue up to queue timeout, requests which can't be queued or waited too long are rejected with 503 and Retry-After.
+func (h *Http) concurrencyHandler() func(next http.Handler) http.Handler {
+	var routes sync.Map // map[string]*routeSlots, keyed by server\x00srcMatch\x00limits
+	getSlots := func(m discovery.URLMapper) *routeSlots {
+		// NUL separator is invalid in hostnames and regex source, avoiding key collisions
+		key := m.Server + "\x00" + m.SrcMatch.String() + "\x00" + strconv.Itoa(m.Concurrency.MaxInFlight)
+		if v, ok := routes.Load(key); ok {
+			return v.(*routeSlots)
+		}
+		actual, _ := routes.LoadOrStore(key, &routeSlots{mapper: m, sem: make(chan struct{}, m.Concurrency.MaxInFlight)})
+		return actual.(*routeSlots)
+	}
+	metrics, _ := h.Metrics.(RouteMetrics)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || match.Mapper.Concurrency.MaxInFlight <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			limit := match.Mapper.Concurrency
+			slots := getSlots(match.Mapper)
+			if !slots.acquire(r, limit, metrics) {
+				log.Printf("[INFO] concurrency limit %d reached for %s", limit.MaxInFlight, r.URL.Path)
+				w.Header().Set("Retry-After", retryAfter(limit.Timeout))
+				reportError(w, r, h.Reporter, http.StatusServiceUnavailable)
+				return
+			}
+			defer slots.release(metrics)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// acquire takes a slot, waiting in the queue if allowed. Returns false if the slot can't be taken.
+func (s *routeSlots) acquire(r *http.Request, limit discovery.ConcurrencyLimit, metrics RouteMetrics) bool {
+	select {
+	case s.sem <- struct{}{}:
+		s.addInFlight(1, metrics)
+		return true
+	default:
+	}
+
+	if !s.enqueue(limit.Queue, metrics) {
+		return false
+	}
+	defer s.dequeue(metrics)
+
+	var timeout <-chan time.Time
+	if limit.Timeout > 0 {
+		tm := time.NewTimer(limit.Timeout)
+		defer tm.Stop()
+		timeout = tm.C
+	}
+	select {
+	case s.sem <- struct{}{}:
+		s.addInFlight(1, metrics)
+		return true
+	case <-timeout:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release returns the slot
+func (s *routeSlots) release(metrics RouteMetrics) {
+	s.addInFlight(-1, metrics)
+	<-s.sem
+}
+
+func (s *routeSlots) addInFlight(delta int, metrics RouteMetrics) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inFlight += delta
+	if metrics != nil {
+		metrics.SetInFlight(s.mapper, s.inFlight)
+	}
+}
+
+// enqueue adds request to the queue, returns false if the queue is full
+func (s *routeSlots) enqueue(size int, metrics RouteMetrics) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queued >= size {
+		return false
+	}
+	s.queued++
+	if metrics != nil {
+		metrics.SetQueued(s.mapper, s.queued)
+	}
+	return true
+}
+
+func (s *routeSlots) dequeue(metrics RouteMetrics) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queued--
+	if metrics != nil {
+		metrics.SetQueued(s.mapper, s.queued)
+	}
+}
+
+// retryAfter makes Retry-After value in seconds from the queue timeout, at least 1 second
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
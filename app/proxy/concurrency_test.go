@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/mgmt"
+)
+
+var _ RouteMetrics = (*mgmt.Metrics)(nil)
+
+func TestHttp_concurrencyHandler(t *testing.T) {
+	tbl := []struct {
+		name     string
+		limit    discovery.ConcurrencyLimit
+		waiters  int // requests sent while the first one is in flight
+		release  time.Duration
+		codes    []int // expected codes of waiters
+		retryAft string
+	}{
+		{name: "no queue", limit: discovery.ConcurrencyLimit{MaxInFlight: 1}, waiters: 2,
+			codes: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}, retryAft: "1"},
+		{name: "queued and served", limit: discovery.ConcurrencyLimit{MaxInFlight: 1, Queue: 2, Timeout: time.Second},
+			waiters: 2, release: 50 * time.Millisecond, codes: []int{http.StatusOK, http.StatusOK}},
+		{name: "queue overflow", limit: discovery.ConcurrencyLimit{MaxInFlight: 1, Queue: 1, Timeout: 5 * time.Second},
+			waiters: 2, release: 50 * time.Millisecond, codes: []int{http.StatusOK, http.StatusServiceUnavailable}, retryAft: "5"},
+		{name: "queue timeout", limit: discovery.ConcurrencyLimit{MaxInFlight: 1, Queue: 2, Timeout: 20 * time.Millisecond},
+			waiters: 1, release: 200 * time.Millisecond, codes: []int{http.StatusServiceUnavailable}, retryAft: "1"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &routeMetricsRecorder{}
+			h := Http{Reporter: &ErrorReporter{Nice: true}, Metrics: metrics}
+			started, release := make(chan struct{}, 10), make(chan struct{})
+			handler := h.concurrencyHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			}))
+
+			match := discovery.MatchedRoute{Mapper: discovery.URLMapper{Server: "example.com",
+				SrcMatch: *regexp.MustCompile("^/api/(.*)"), Concurrency: tt.limit}}
+			send := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "http://example.com/api/test", http.NoBody)
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch, match))
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				return rr
+			}
+
+			firstDone := make(chan int)
+			go func() { firstDone <- send().Code }()
+			<-started
+
+			var wg sync.WaitGroup
+			results := make([]*httptest.ResponseRecorder, tt.waiters)
+			for i := range tt.waiters {
+				done := make(chan struct{})
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer close(done)
+					results[i] = send()
+				}()
+				require.Eventually(t, func() bool { // wait for the waiter to be queued or rejected, keeps the order
+					select {
+					case <-done:
+						return true
+					default:
+						return metrics.queued() == i+1
+					}
+				}, time.Second, time.Millisecond)
+			}
+
+			time.Sleep(tt.release)
+			close(release)
+			wg.Wait()
+			assert.Equal(t, http.StatusOK, <-firstDone)
+
+			for i, rr := range results {
+				assert.Equal(t, tt.codes[i], rr.Code, "waiter %d", i)
+				if rr.Code == http.StatusServiceUnavailable {
+					assert.Equal(t, tt.retryAft, rr.Header().Get("Retry-After"))
+					assert.Contains(t, rr.Body.String(), "Service Unavailable")
+				}
+			}
+			assert.Equal(t, 0, metrics.inFlight())
+			assert.Equal(t, 0, metrics.queued())
+			assert.Equal(t, 1, metrics.maxInFlight)
+		})
+	}
+}
+
+func TestHttp_concurrencyHandlerNoLimit(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}}
+	calls := 0
+	handler := h.concurrencyHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unmatched", http.NoBody))
+	req := httptest.NewRequest("GET", "/api/test", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 2, calls)
+}
+
+func TestHttp_concurrencyHandlerNoReporter(t *testing.T) {
+	h := Http{}
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := h.concurrencyHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	match := discovery.MatchedRoute{Mapper: discovery.URLMapper{Server: "no-reporter.example.com",
+		SrcMatch: *regexp.MustCompile("^/api/(.*)"), Concurrency: discovery.ConcurrencyLimit{MaxInFlight: 1}}}
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://no-reporter.example.com/api/test", http.NoBody)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req.WithContext(context.WithValue(req.Context(), ctxMatch, match)))
+		return rr
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send()
+	}()
+	<-started
+	rr := send()
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	close(release)
+	<-done
+}
+
+func Test_retryAfter(t *testing.T) {
+	assert.Equal(t, "1", retryAfter(0))
+	assert.Equal(t, "1", retryAfter(100*time.Millisecond))
+	assert.Equal(t, "2", retryAfter(1500*time.Millisecond))
+	assert.Equal(t, "30", retryAfter(30*time.Second))
+}
+
+// routeMetricsRecorder implements MiddlewareProvider and RouteMetrics, records the last and max values
+type routeMetricsRecorder struct {
+	lock        sync.Mutex
+	lastFlight  int
+	lastQueued  int
+	maxInFlight int
+}
+
+func (m *routeMetricsRecorder) Middleware(next http.Handler) http.Handler { return next }
+
+func (m *routeMetricsRecorder) SetInFlight(_ discovery.URLMapper, val int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastFlight = val
+	m.maxInFlight = max(m.maxInFlight, val)
+}
+
+func (m *routeMetricsRecorder) SetQueued(_ discovery.URLMapper, val int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastQueued = val
+}
+
+func (m *routeMetricsRecorder) inFlight() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastFlight
+}
+
+func (m *routeMetricsRecorder) queued() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastQueued
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// corsHandler applies CORS policy of the matched route. Preflight requests answered by reproxy and not passed
+// to upstream, disallowed preflights rejected with 403. Actual requests from allowed origins get CORS headers,
+// replacing upstream's ones if policy has Override or upstream didn't set them.
+func corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || !match.Mapper.CORS.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy, origin := match.Mapper.CORS, r.Header.Get("Origin")
+		if origin == "" { // not a cross-origin request
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			corsPreflight(w, r, policy, origin)
+			return
+		}
+
+		allowed := policy.AllowOrigin(origin)
+		if !allowed && !policy.Override {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hw := &headerHookWriter{ResponseWriter: w, hook: func(hdr http.Header) {
+			if !policy.Override && hdr.Get("Access-Control-Allow-Origin") != "" {
+				return // upstream's own CORS headers kept
+			}
+			dropCORSHeaders(hdr)
+			if !allowed {
+				return
+			}
+			setCORSOrigin(hdr, policy, origin)
+			if len(policy.Expose) > 0 {
+				hdr.Set("Access-Control-Expose-Headers", strings.Join(policy.Expose, ", "))
+			}
+		}}
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// corsPreflight responds to preflight request with allowed methods and headers or rejects it with 403
+func corsPreflight(w http.ResponseWriter, r *http.Request, policy discovery.CORSPolicy, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+	allowed := policy.AllowOrigin(origin) && policy.AllowMethod(method)
+	for h := range strings.SplitSeq(reqHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" && !policy.AllowHeader(h) {
+			allowed = false
+		}
+	}
+	if !allowed {
+		log.Printf("[DEBUG] cors preflight rejected, origin %s, method %s, headers %q", origin, method, reqHeaders)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	setCORSOrigin(w.Header(), policy, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+	switch {
+	case len(policy.Headers) > 0:
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+	case reqHeaders != "":
+		w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCORSOrigin sets allowed origin, "*" for any origin without credentials, the request's origin otherwise
+func setCORSOrigin(hdr http.Header, policy discovery.CORSPolicy, origin string) {
+	if policy.AnyOrigin() && !policy.Credentials {
+		hdr.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	hdr.Set("Access-Control-Allow-Origin", origin)
+	if policy.Credentials {
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// dropCORSHeaders removes all Access-Control-* response headers
+func dropCORSHeaders(hdr http.Header) {
+	for k := range hdr {
+		if strings.HasPrefix(k, "Access-Control-") {
+			hdr.Del(k)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestCorsHandler(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/own-cors" {
+			w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example.com")
+			w.Header().Set("Access-Control-Max-Age", "10")
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("upstream"))
+	})
+
+	withPolicy := func(t *testing.T, r *http.Request, policy string) *http.Request {
+		var cors discovery.CORSPolicy
+		if policy != "" {
+			var err error
+			cors, err = discovery.ParseCORS(policy)
+			require.NoError(t, err)
+		}
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/(.*)"), CORS: cors}}
+		return r.WithContext(context.WithValue(r.Context(), ctxMatch, m))
+	}
+
+	preflight := func(origin, method, headers string) *http.Request {
+		req := httptest.NewRequest("OPTIONS", "http://api.example.com/items", http.NoBody)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		return req
+	}
+
+	actual := func(path, origin string) *http.Request {
+		req := httptest.NewRequest("GET", "http://api.example.com"+path, http.NoBody)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+
+	t.Run("preflight allowed", func(t *testing.T) {
+		req := withPolicy(t, preflight("https://app.example.com", "PUT", "Content-Type, X-Token"),
+			"origins=https://app.example.com, methods=GET PUT, headers=content-type x-token, max-age=10m, credentials")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusNoContent, wr.Code)
+		assert.Empty(t, wr.Body.String(), "not passed to upstream")
+		assert.Equal(t, "https://app.example.com", wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", wr.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "GET, PUT", wr.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "content-type, x-token", wr.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "600", wr.Header().Get("Access-Control-Max-Age"))
+		assert.Equal(t, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			wr.Header().Values("Vary"))
+	})
+
+	t.Run("preflight echoes requested headers", func(t *testing.T) {
+		req := withPolicy(t, preflight("https://app.example.com", "POST", "X-Custom"), "origins=*")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusNoContent, wr.Code)
+		assert.Equal(t, "*", wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "X-Custom", wr.Header().Get("Access-Control-Allow-Headers"))
+		assert.Empty(t, wr.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("preflight rejected", func(t *testing.T) {
+		policy := "origins=https://app.example.com, methods=GET, headers=x-token"
+		for _, req := range []*http.Request{
+			preflight("https://evil.example.com", "GET", ""),
+			preflight("https://app.example.com", "DELETE", ""),
+			preflight("https://app.example.com", "GET", "X-Token, X-Other"),
+		} {
+			wr := httptest.NewRecorder()
+			corsHandler(upstream).ServeHTTP(wr, withPolicy(t, req, policy))
+			assert.Equal(t, http.StatusForbidden, wr.Code)
+			assert.Empty(t, wr.Header().Get("Access-Control-Allow-Origin"))
+		}
+	})
+
+	t.Run("actual request", func(t *testing.T) {
+		req := withPolicy(t, actual("/items", "https://a.example.org"), "origins=*.example.org, expose=x-total x-page")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "upstream", wr.Body.String())
+		assert.Equal(t, "https://a.example.org", wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "x-total, x-page", wr.Header().Get("Access-Control-Expose-Headers"))
+		assert.Empty(t, wr.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "Origin", wr.Header().Get("Vary"))
+	})
+
+	t.Run("options without request method passed to upstream", func(t *testing.T) {
+		req := httptest.NewRequest("OPTIONS", "http://api.example.com/items", http.NoBody)
+		req.Header.Set("Origin", "https://app.example.com")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, withPolicy(t, req, "origins=*"))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "upstream", wr.Body.String())
+		assert.Equal(t, "*", wr.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		req := withPolicy(t, actual("/items", "https://evil.example.com"), "origins=https://app.example.com")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Empty(t, wr.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("upstream headers kept without override", func(t *testing.T) {
+		req := withPolicy(t, actual("/own-cors", "https://app.example.com"), "origins=https://app.example.com")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, "https://upstream.example.com", wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "10", wr.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("upstream headers replaced with override", func(t *testing.T) {
+		req := withPolicy(t, actual("/own-cors", "https://app.example.com"), "origins=https://app.example.com, credentials, override")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, "https://app.example.com", wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", wr.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Empty(t, wr.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("upstream headers stripped for disallowed origin with override", func(t *testing.T) {
+		req := withPolicy(t, actual("/own-cors", "https://evil.example.com"), "origins=https://app.example.com, override")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Empty(t, wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, wr.Header().Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("no origin header", func(t *testing.T) {
+		req := withPolicy(t, actual("/items", ""), "origins=*")
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, "upstream", wr.Body.String())
+		assert.Empty(t, wr.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, wr.Header().Get("Vary"))
+	})
+
+	t.Run("no policy", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		corsHandler(upstream).ServeHTTP(wr, withPolicy(t, preflight("https://app.example.com", "GET", ""), ""))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "upstream", wr.Body.String())
+		assert.Empty(t, wr.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
@@ -1,26 +1,69 @@
 package proxy
 
 import (
+	"encoding/json"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 // ErrorReporter formats error with a given template
-// Supports go-style template with {{.ErrMessage}} and {{.ErrCode}}
+// Supports go-style template with {{.ErrMessage}}, {{.ErrCode}}, {{.RequestID}}, {{.RetryAfter}},
+// {{.Host}}, {{.Path}} and {{.Route}}.
+// Templates for status codes can be defined in Dir as <code>.html or <class>xx.html (i.e. 404.html or 5xx.html),
+// with per-server overrides in Dir/<server>/ and per-route overrides in the route's ErrorPages directory.
+// Template files and server sub-directories are checked for changes once in errorPagesCheckInterval.
 type ErrorReporter struct {
 	Template string
-	Nice     bool
+	Nice     bool   // html pages and Accept negotiation, plain "Server error" text for not forced formats otherwise
+	Dir      string // directory with templates keyed by status code, optional
 
 	tmpl struct {
 		*template.Template
 		sync.Once
 	}
+	pages   sync.Map // map[string]errorPage, parsed templates keyed by file name, nil template for missing files
+	servers struct {
+		sync.Mutex
+		names   map[string]bool // sub-directories of Dir
+		checked time.Time
+	}
+	checkInterval time.Duration // interval of checks for changes, errorPagesCheckInterval if not set
+}
+
+const errorPagesCheckInterval = 5 * time.Second
+
+// errorPage is a parsed template file with modification time of the file, used to reload changed templates.
+// Missing or broken files cached with nil template, so they are not checked on each error response.
+type errorPage struct {
+	tmpl    *template.Template
+	modTime time.Time
+	checked time.Time
 }
 
-// Report formats and sends error to ResponseWriter
-func (em *ErrorReporter) Report(w http.ResponseWriter, code int) {
+// errorData is a set of template vars, also used to make json and text responses
+type errorData struct {
+	ErrMessage string
+	ErrCode    int
+	RequestID  string
+	RetryAfter string // seconds, set for responses with Retry-After header, i.e. 429 and 503
+	Host       string
+	Path       string
+	Route      string // source match of the matched route, empty for unmatched requests
+}
+
+// Report formats and sends error to ResponseWriter. Format is forced by the matched route or, for nice reporter,
+// negotiated by Accept header, html page used for clients accepting anything.
+func (em *ErrorReporter) Report(w http.ResponseWriter, r *http.Request, code int) {
 	em.tmpl.Do(func() {
 		if em.Template == "" {
 			em.Template = errDefaultTemplate
@@ -33,23 +76,227 @@ func (em *ErrorReporter) Report(w http.ResponseWriter, code int) {
 		em.tmpl.Template = tp
 	})
 
-	if em.tmpl.Template == nil || !em.Nice {
+	host := r.URL.Hostname()
+	if host == "" {
+		host = strings.Split(r.Host, ":")[0] // drop port
+	}
+	data := errorData{
+		ErrMessage: http.StatusText(code),
+		ErrCode:    code,
+		RequestID:  requestIDFromRequest(r),
+		RetryAfter: w.Header().Get("Retry-After"),
+		Host:       host,
+		Path:       r.URL.Path,
+	}
+
+	routeDir, server, format := "", host, discovery.EFAuto
+	if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok {
+		data.Route, routeDir, format = match.Mapper.SrcMatch.String(), match.Mapper.ErrorPages, match.Mapper.ErrorFormat
+		if match.Mapper.Server != "*" && match.Mapper.Server != "" {
+			server = match.Mapper.Server // wildcard and regex servers have templates in the directory named by server
+		}
+	}
+	if format == discovery.EFAuto && em.Nice {
+		format = negotiateErrorFormat(r.Header.Get("Accept"))
+	}
+
+	switch format {
+	case discovery.EFJSON:
+		em.reportJSON(w, data)
+		return
+	case discovery.EFText:
+		em.reportText(w, data)
+		return
+	default:
+	}
+
+	if !em.Nice {
 		http.Error(w, "Server error", code)
 		return
 	}
 
-	data := struct {
-		ErrMessage string
-		ErrCode    int
-	}{
-		ErrMessage: http.StatusText(code),
-		ErrCode:    code,
+	tmpl := em.pageTemplate(code, routeDir, server)
+	if tmpl == nil {
+		tmpl = em.tmpl.Template
+	}
+	if tmpl == nil {
+		http.Error(w, "Server error", code)
+		return
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
 	w.WriteHeader(code)
-	_ = em.tmpl.Execute(w, &data)
+	if err := tmpl.Execute(w, &data); err != nil {
+		log.Printf("[WARN] failed to execute error template %s, %v", tmpl.Name(), err)
+	}
+}
+
+// reportJSON sends RFC 9457 problem details with request id, route and retry after as extension members
+func (em *ErrorReporter) reportJSON(w http.ResponseWriter, data errorData) {
+	problem := struct {
+		Type       string `json:"type"`
+		Title      string `json:"title"`
+		Status     int    `json:"status"`
+		Instance   string `json:"instance,omitempty"`
+		RequestID  string `json:"request_id,omitempty"`
+		Route      string `json:"route,omitempty"`
+		RetryAfter int    `json:"retry_after,omitempty"`
+	}{
+		Type:      "about:blank",
+		Title:     data.ErrMessage,
+		Status:    data.ErrCode,
+		Instance:  data.Path,
+		RequestID: data.RequestID,
+		Route:     data.Route,
+	}
+	if data.RetryAfter != "" {
+		problem.RetryAfter, _ = strconv.Atoi(data.RetryAfter)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(data.ErrCode)
+	if err := json.NewEncoder(w).Encode(&problem); err != nil {
+		log.Printf("[WARN] failed to write error response, %v", err)
+	}
+}
+
+// reportText sends status line with request id, if set
+func (em *ErrorReporter) reportText(w http.ResponseWriter, data errorData) {
+	msg := strconv.Itoa(data.ErrCode) + " " + data.ErrMessage + "\n"
+	if data.RequestID != "" {
+		msg += "Request ID: " + data.RequestID + "\n"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(data.ErrCode)
+	if _, err := io.WriteString(w, msg); err != nil {
+		log.Printf("[WARN] failed to write error response, %v", err)
+	}
+}
+
+// negotiateErrorFormat picks error format by Accept header. Media type with the highest quality wins,
+// the first one for equal quality. Returns EFAuto for empty header or if nothing specific is accepted.
+func negotiateErrorFormat(accept string) discovery.ErrorFormat {
+	res, bestQ := discovery.EFAuto, 0.0
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for p := range strings.SplitSeq(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.EqualFold(k, "q") {
+				if qv, err := strconv.ParseFloat(v, 64); err == nil {
+					q = qv
+				}
+			}
+		}
+		format := discovery.EFAuto
+		switch mt := strings.ToLower(strings.TrimSpace(mediaType)); {
+		case mt == "text/html" || mt == "application/xhtml+xml":
+			format = discovery.EFHTML
+		case mt == "application/json" || mt == "application/problem+json" || strings.HasSuffix(mt, "+json"):
+			format = discovery.EFJSON
+		case mt == "text/plain":
+			format = discovery.EFText
+		}
+		if format != discovery.EFAuto && q > bestQ {
+			res, bestQ = format, q
+		}
+	}
+	return res
+}
+
+// pageTemplate returns template for the code from the route's directory, server's sub-directory of Dir or Dir itself.
+// In each directory <code>.html preferred over <class>xx.html. Returns nil if no template found.
+func (em *ErrorReporter) pageTemplate(code int, routeDir, server string) *template.Template {
+	var dirs []string
+	if routeDir != "" {
+		dirs = append(dirs, routeDir)
+	}
+	if em.Dir != "" {
+		// server can come from the request's host, only existing sub-directories used to prevent escaping from
+		// the directory and caching lookups of arbitrary hosts
+		if server != "" && em.hasServerDir(server) {
+			dirs = append(dirs, filepath.Join(em.Dir, server))
+		}
+		dirs = append(dirs, em.Dir)
+	}
+
+	names := []string{strconv.Itoa(code) + ".html", strconv.Itoa(code/100) + "xx.html"}
+	for _, dir := range dirs {
+		for _, name := range names {
+			if tmpl := em.loadPage(filepath.Join(dir, name)); tmpl != nil {
+				return tmpl
+			}
+		}
+	}
+	return nil
+}
+
+// hasServerDir checks if Dir has sub-directory for the server. The list of sub-directories re-read
+// once in check interval.
+func (em *ErrorReporter) hasServerDir(server string) bool {
+	em.servers.Lock()
+	defer em.servers.Unlock()
+	if em.servers.names == nil || time.Since(em.servers.checked) >= em.pagesCheckInterval() {
+		em.servers.names = map[string]bool{}
+		entries, err := os.ReadDir(em.Dir)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] failed to read error templates directory %s, %v", em.Dir, err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				em.servers.names[e.Name()] = true
+			}
+		}
+		em.servers.checked = time.Now()
+	}
+	return em.servers.names[server]
+}
+
+// loadPage returns parsed template of the file, reparsed if the file changed. Returns nil if the file
+// doesn't exist or can't be parsed. The file checked for changes once in check interval.
+func (em *ErrorReporter) loadPage(fname string) *template.Template {
+	cached, ok := em.pages.Load(fname)
+	if ok && time.Since(cached.(errorPage).checked) < em.pagesCheckInterval() {
+		return cached.(errorPage).tmpl
+	}
+
+	now := time.Now()
+	fi, err := os.Stat(fname)
+	if err != nil || fi.IsDir() {
+		em.pages.Store(fname, errorPage{checked: now})
+		return nil
+	}
+	if ok && cached.(errorPage).tmpl != nil && cached.(errorPage).modTime.Equal(fi.ModTime()) {
+		em.pages.Store(fname, errorPage{tmpl: cached.(errorPage).tmpl, modTime: fi.ModTime(), checked: now})
+		return cached.(errorPage).tmpl
+	}
+
+	em.pages.Store(fname, errorPage{modTime: fi.ModTime(), checked: now}) // not retried until next check if broken
+	data, err := os.ReadFile(fname)                                       //nolint:gosec // file name made from the configured directories
+	if err != nil {
+		log.Printf("[WARN] failed to read error template %s, %v", fname, err)
+		return nil
+	}
+	tmpl, err := template.New(filepath.Base(fname)).Parse(string(data))
+	if err != nil {
+		log.Printf("[WARN] failed to parse error template %s, %v", fname, err)
+		return nil
+	}
+	em.pages.Store(fname, errorPage{tmpl: tmpl, modTime: fi.ModTime(), checked: now})
+	return tmpl
+}
+
+func (em *ErrorReporter) pagesCheckInterval() time.Duration {
+	if em.checkInterval > 0 {
+		return em.checkInterval
+	}
+	return errorPagesCheckInterval
 }
 
 var errDefaultTemplate = `
@@ -65,10 +312,20 @@ var errDefaultTemplate = `
 </style>
 
 <article>
+{{- if eq .ErrCode 503}}
     <h1>We&rsquo;ll be back soon!</h1>
     <div>
         <p>Sorry for the inconvenience but we&rsquo;re performing some maintenance at the moment. We&rsquo;ll be back online shortly!</p>
         <p>&mdash; The Team</p>
+        {{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+    </div>
+{{- else}}
+    <h1>{{.ErrCode}} {{.ErrMessage}}</h1>
+    <div>
+        <p>Sorry for the inconvenience but the request to {{.Path}} can&rsquo;t be served at the moment.</p>
+        <p>&mdash; The Team</p>
+        {{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
     </div>
+{{- end}}
 </article>
 `
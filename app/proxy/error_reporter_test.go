@@ -1,16 +1,25 @@
 package proxy
 
 import (
+	"context"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 func TestErrorReporter_ReportShort(t *testing.T) {
 	er := ErrorReporter{}
 	wr := httptest.NewRecorder()
-	er.Report(wr, 502)
+	er.Report(wr, httptest.NewRequest("GET", "/", http.NoBody), 502)
 	assert.Equal(t, 502, wr.Code)
 	assert.Equal(t, "Server error\n", wr.Body.String())
 }
@@ -18,16 +27,227 @@ func TestErrorReporter_ReportShort(t *testing.T) {
 func TestErrorReporter_ReportNice(t *testing.T) {
 	er := ErrorReporter{Nice: true}
 	wr := httptest.NewRecorder()
-	er.Report(wr, 502)
+	er.Report(wr, httptest.NewRequest("GET", "/", http.NoBody), 502)
 	assert.Equal(t, 502, wr.Code)
 	assert.Contains(t, wr.Body.String(), "<title>Bad Gateway</title>")
-	assert.Contains(t, wr.Body.String(), "<p>Sorry for the inconvenience")
+	assert.Contains(t, wr.Body.String(), "<h1>502 Bad Gateway</h1>")
+	assert.Contains(t, wr.Body.String(), "the request to / can&rsquo;t be served")
+	assert.NotContains(t, wr.Body.String(), "maintenance")
+
+	wr = httptest.NewRecorder()
+	er.Report(wr, httptest.NewRequest("GET", "/", http.NoBody), http.StatusServiceUnavailable)
+	assert.Equal(t, http.StatusServiceUnavailable, wr.Code)
+	assert.Contains(t, wr.Body.String(), "<h1>We&rsquo;ll be back soon!</h1>")
+	assert.Contains(t, wr.Body.String(), "<p>Sorry for the inconvenience but we&rsquo;re performing some maintenance")
 }
 
 func TestErrorReporter_BadTemplate(t *testing.T) {
 	er := ErrorReporter{Nice: true, Template: "xxx {{."}
 	wr := httptest.NewRecorder()
-	er.Report(wr, 502)
+	er.Report(wr, httptest.NewRequest("GET", "/", http.NoBody), 502)
 	assert.Equal(t, 502, wr.Code)
 	assert.Equal(t, "Server error\n", wr.Body.String())
 }
+
+func TestErrorReporter_ReportWithRequestID(t *testing.T) {
+	er := ErrorReporter{Nice: true}
+	wr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), ctxRequestID, "abc-123"))
+	er.Report(wr, req, 502)
+	assert.Equal(t, 502, wr.Code)
+	assert.Contains(t, wr.Body.String(), "Request ID: abc-123")
+}
+
+func TestErrorReporter_ReportWithRetryAfter(t *testing.T) {
+	er := ErrorReporter{Nice: true, Template: "{{.ErrCode}}{{if .RetryAfter}}, retry in {{.RetryAfter}}s{{end}}"}
+	wr := httptest.NewRecorder()
+	wr.Header().Set("Retry-After", "5")
+	er.Report(wr, httptest.NewRequest("GET", "/", http.NoBody), http.StatusTooManyRequests)
+	assert.Equal(t, http.StatusTooManyRequests, wr.Code)
+	assert.Equal(t, "429, retry in 5s", wr.Body.String())
+
+	wr = httptest.NewRecorder()
+	er.Report(wr, httptest.NewRequest("GET", "/", http.NoBody), http.StatusBadGateway)
+	assert.Equal(t, "502", wr.Body.String())
+}
+
+func TestErrorReporter_ReportVars(t *testing.T) {
+	er := ErrorReporter{Nice: true, Template: "{{.ErrCode}} {{.Host}} {{.Path}} [{{.Route}}] {{.RequestID}}"}
+	req := httptest.NewRequest("GET", "http://example.com:8080/api/users?x=1", http.NoBody)
+	wr := httptest.NewRecorder()
+	er.Report(wr, req, http.StatusNotFound)
+	assert.Equal(t, "404 example.com /api/users [] ", wr.Body.String())
+
+	match := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)")}}
+	ctx := context.WithValue(req.Context(), ctxMatch, match)
+	ctx = context.WithValue(ctx, ctxRequestID, "req-1")
+	wr = httptest.NewRecorder()
+	er.Report(wr, req.WithContext(ctx), http.StatusNotFound)
+	assert.Equal(t, "404 example.com /api/users [^/api/(.*)] req-1", wr.Body.String())
+}
+
+func TestErrorReporter_ReportDir(t *testing.T) {
+	dir, routeDir := t.TempDir(), t.TempDir()
+	writeFile := func(name, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o750))
+		require.NoError(t, os.WriteFile(name, []byte(content), 0o600))
+	}
+	writeFile(filepath.Join(dir, "404.html"), "global 404 {{.Path}}")
+	writeFile(filepath.Join(dir, "5xx.html"), "global 5xx {{.ErrCode}}")
+	writeFile(filepath.Join(dir, "503.html"), "global 503")
+	writeFile(filepath.Join(dir, "app.example.com", "404.html"), "app 404")
+	writeFile(filepath.Join(dir, "app.example.com", "5xx.html"), "app 5xx {{.ErrCode}}")
+	writeFile(filepath.Join(dir, "bad.example.com", "404.html"), "bad {{.")
+	writeFile(filepath.Join(dir, "*.example.org", "404.html"), "wildcard 404")
+	writeFile(filepath.Join(routeDir, "502.html"), "route 502 {{.Route}}")
+
+	er := ErrorReporter{Nice: true, Template: "default {{.ErrCode}}", Dir: dir}
+	tbl := []struct {
+		name   string
+		url    string
+		route  string // route's error pages directory
+		server string // server of the matched route
+		code   int
+		body   string
+	}{
+		{name: "global by code", url: "http://example.com/a", code: 404, body: "global 404 /a"},
+		{name: "global by class", url: "http://example.com/a", code: 500, body: "global 5xx 500"},
+		{name: "global code over class", url: "http://example.com/a", code: 503, body: "global 503"},
+		{name: "no template for code", url: "http://example.com/a", code: 429, body: "default 429"},
+		{name: "server by code", url: "http://app.example.com/a", code: 404, body: "app 404"},
+		{name: "server class over global code", url: "http://app.example.com/a", code: 503, body: "app 5xx 503"},
+		{name: "route over server", url: "http://app.example.com/a", route: routeDir, code: 502, body: "route 502 ^/(.*)"},
+		{name: "route falls back to server", url: "http://app.example.com/a", route: routeDir, code: 504, body: "app 5xx 504"},
+		{name: "broken server template", url: "http://bad.example.com/a", code: 404, body: "global 404 /a"},
+		{name: "wildcard server of matched route", url: "http://api.example.org/a", server: "*.example.org", code: 404,
+			body: "wildcard 404"},
+		{name: "default server of matched route", url: "http://app.example.com/a", server: "*", code: 404, body: "app 404"},
+		{name: "no server dir of unmatched", url: "http://api.example.org/a", code: 404, body: "global 404 /a"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, http.NoBody)
+			if tt.route != "" || tt.server != "" {
+				match := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/(.*)"),
+					ErrorPages: tt.route, Server: tt.server}}
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch, match))
+			}
+			wr := httptest.NewRecorder()
+			er.Report(wr, req, tt.code)
+			assert.Equal(t, tt.code, wr.Code)
+			assert.Equal(t, tt.body, wr.Body.String())
+			assert.Equal(t, "text/html; charset=utf-8", wr.Header().Get("Content-Type"))
+		})
+	}
+
+	t.Run("host can't escape the directory", func(t *testing.T) {
+		writeFile(filepath.Join(filepath.Dir(dir), "404.html"), "outside")
+		req := httptest.NewRequest("GET", "/a", http.NoBody)
+		req.Host = ".."
+		wr := httptest.NewRecorder()
+		er.Report(wr, req, 404)
+		assert.Equal(t, "global 404 /a", wr.Body.String())
+	})
+
+	t.Run("changed template reloaded on next check", func(t *testing.T) {
+		fname := filepath.Join(dir, "404.html")
+		writeFile(fname, "updated 404")
+		require.NoError(t, os.Chtimes(fname, time.Now(), time.Now().Add(time.Minute)))
+		wr := httptest.NewRecorder()
+		er.Report(wr, httptest.NewRequest("GET", "http://example.com/a", http.NoBody), 404)
+		assert.Equal(t, "global 404 /a", wr.Body.String(), "not checked yet")
+
+		er.checkInterval = time.Nanosecond
+		wr = httptest.NewRecorder()
+		er.Report(wr, httptest.NewRequest("GET", "http://example.com/a", http.NoBody), 404)
+		assert.Equal(t, "updated 404", wr.Body.String())
+	})
+
+	t.Run("missing template cached till next check", func(t *testing.T) {
+		er.checkInterval = time.Hour
+		wr := httptest.NewRecorder()
+		er.Report(wr, httptest.NewRequest("GET", "http://example.com/a", http.NoBody), 418)
+		assert.Equal(t, "default 418", wr.Body.String())
+
+		writeFile(filepath.Join(dir, "418.html"), "global 418")
+		wr = httptest.NewRecorder()
+		er.Report(wr, httptest.NewRequest("GET", "http://example.com/a", http.NoBody), 418)
+		assert.Equal(t, "default 418", wr.Body.String(), "not checked yet")
+
+		er.checkInterval = time.Nanosecond
+		wr = httptest.NewRecorder()
+		er.Report(wr, httptest.NewRequest("GET", "http://example.com/a", http.NoBody), 418)
+		assert.Equal(t, "global 418", wr.Body.String())
+	})
+}
+
+func TestErrorReporter_ReportFormats(t *testing.T) {
+	tbl := []struct {
+		name   string
+		nice   bool
+		accept string
+		forced discovery.ErrorFormat
+		ctype  string
+		body   string
+	}{
+		{name: "no accept, nice", nice: true, ctype: "text/html; charset=utf-8", body: "html 503"},
+		{name: "no accept, not nice", ctype: "text/plain; charset=utf-8", body: "Server error\n"},
+		{name: "browser", nice: true, accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			ctype: "text/html; charset=utf-8", body: "html 503"},
+		{name: "json", nice: true, accept: "application/json", ctype: "application/problem+json",
+			body: `{"type":"about:blank","title":"Service Unavailable","status":503,"instance":"/api/users",` +
+				`"request_id":"req-1","route":"^/api/(.*)","retry_after":30}` + "\n"},
+		{name: "problem json, not nice", accept: "application/problem+json", ctype: "text/plain; charset=utf-8",
+			body: "Server error\n"},
+		{name: "text, not nice", accept: "text/plain", ctype: "text/plain; charset=utf-8", body: "Server error\n"},
+		{name: "forced json, not nice", accept: "text/html", forced: discovery.EFJSON, ctype: "application/problem+json",
+			body: `{"type":"about:blank","title":"Service Unavailable","status":503,"instance":"/api/users",` +
+				`"request_id":"req-1","route":"^/api/(.*)","retry_after":30}` + "\n"},
+		{name: "text", nice: true, accept: "text/plain", ctype: "text/plain; charset=utf-8",
+			body: "503 Service Unavailable\nRequest ID: req-1\n"},
+		{name: "json preferred by quality", nice: true, accept: "text/html;q=0.5, application/json",
+			ctype: "application/problem+json"},
+		{name: "html first of equal quality", nice: true, accept: "text/html, application/json",
+			ctype: "text/html; charset=utf-8", body: "html 503"},
+		{name: "not acceptable json ignored", nice: true, accept: "application/json;q=0, */*",
+			ctype: "text/html; charset=utf-8", body: "html 503"},
+		{name: "forced json", nice: true, accept: "text/html", forced: discovery.EFJSON, ctype: "application/problem+json"},
+		{name: "forced text", nice: true, accept: "application/json", forced: discovery.EFText,
+			ctype: "text/plain; charset=utf-8", body: "503 Service Unavailable\nRequest ID: req-1\n"},
+		{name: "forced html", nice: true, accept: "application/json", forced: discovery.EFHTML,
+			ctype: "text/html; charset=utf-8", body: "html 503"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			er := ErrorReporter{Nice: tt.nice, Template: "html {{.ErrCode}}"}
+			req := httptest.NewRequest("GET", "http://example.com/api/users", http.NoBody)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			match := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"),
+				ErrorFormat: tt.forced}}
+			ctx := context.WithValue(req.Context(), ctxMatch, match)
+			ctx = context.WithValue(ctx, ctxRequestID, "req-1")
+			wr := httptest.NewRecorder()
+			wr.Header().Set("Retry-After", "30")
+			er.Report(wr, req.WithContext(ctx), http.StatusServiceUnavailable)
+			assert.Equal(t, http.StatusServiceUnavailable, wr.Code)
+			assert.Equal(t, tt.ctype, wr.Header().Get("Content-Type"))
+			if tt.body != "" {
+				assert.Equal(t, tt.body, wr.Body.String())
+			}
+		})
+	}
+}
+
+func Test_negotiateErrorFormat(t *testing.T) {
+	assert.Equal(t, discovery.EFAuto, negotiateErrorFormat(""))
+	assert.Equal(t, discovery.EFAuto, negotiateErrorFormat("*/*"))
+	assert.Equal(t, discovery.EFAuto, negotiateErrorFormat("image/png, */*;q=0.5"))
+	assert.Equal(t, discovery.EFJSON, negotiateErrorFormat("application/vnd.api+json"))
+	assert.Equal(t, discovery.EFJSON, negotiateErrorFormat("Application/JSON; charset=utf-8"))
+	assert.Equal(t, discovery.EFText, negotiateErrorFormat("text/html;q=0.1, text/plain;q=0.9"))
+	assert.Equal(t, discovery.EFText, negotiateErrorFormat("text/plain;q=bad;level=1, text/html"), "invalid q ignored")
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+const (
+	forwardAuthTimeout  = 5 * time.Second // default timeout of auth subrequest
+	forwardAuthMaxBody  = 64 * 1024       // max size of denied response body passed to the client
+	forwardAuthMaxCache = 10_000          // max number of cached decisions, least recently used evicted
+)
+
+// forwardAuthHandler checks requests of routes with forward auth by a subrequest to the auth service.
+// Subrequest is GET to the auth url with configured request headers and X-Forwarded-Method, X-Forwarded-Proto,
+// X-Forwarded-Host, X-Forwarded-Uri and X-Forwarded-For of the original request. 2xx response lets the request
+// through with copied response headers, any other response (i.e. redirect to login page) returned to the client
+// as is. Allowed decisions cached for route's cache ttl, keyed by the request and the sent headers.
+func (h *Http) forwardAuthHandler() func(next http.Handler) http.Handler {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	decisions := cache.NewCache[string, http.Header]().WithMaxKeys(forwardAuthMaxCache).WithLRU()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || !match.Mapper.ForwardAuth.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			fa := match.Mapper.ForwardAuth
+			for _, hdr := range fa.Copy {
+				r.Header.Del(hdr) // copied headers set by the auth service only
+			}
+
+			authReq, err := forwardAuthRequest(r, fa)
+			if err != nil {
+				log.Printf("[WARN] can't make forward auth request to %s, %v", fa.URL, err)
+				reportError(w, r, h.Reporter, http.StatusInternalServerError)
+				return
+			}
+
+			key := ""
+			if fa.CacheTTL > 0 {
+				key = forwardAuthKey(authReq)
+				if copied, found := decisions.Get(key); found {
+					setCopiedHeaders(r, copied)
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			if id := requestIDFromRequest(r); id != "" && h.RequestIDHeader != "" {
+				authReq.Header.Set(h.RequestIDHeader, id) // not a part of the cache key
+			}
+			copied, allowed, err := askForwardAuth(w, client, authReq, fa)
+			if err != nil {
+				log.Printf("[WARN] forward auth request to %s failed, %v", fa.URL, err)
+				reportError(w, r, h.Reporter, http.StatusBadGateway)
+				return
+			}
+			if !allowed {
+				log.Printf("[DEBUG] forward auth denied %s %s", r.Method, r.URL.Path)
+				return
+			}
+			if fa.CacheTTL > 0 {
+				decisions.Set(key, copied, fa.CacheTTL)
+			}
+			setCopiedHeaders(r, copied)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardAuthRequest makes subrequest to the auth service for the original request
+func forwardAuthRequest(r *http.Request, fa discovery.ForwardAuth) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, fa.URL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	for _, hdr := range fa.Headers {
+		for _, v := range r.Header.Values(hdr) {
+			req.Header.Add(hdr, v)
+		}
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", schemeFromRequest(r))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", realIPFromRequest(r))
+	return req, nil
+}
+
+// askForwardAuth sends subrequest to the auth service. Returns auth response headers to copy for allowed request,
+// denied response written to w as is.
+func askForwardAuth(w http.ResponseWriter, client *http.Client, req *http.Request, fa discovery.ForwardAuth) (http.Header, bool, error) {
+	timeout := fa.Timeout
+	if timeout == 0 {
+		timeout = forwardAuthTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, false, fmt.Errorf("auth request failed: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		copyAuthResponse(w, resp)
+		return nil, false, nil
+	}
+	copied := http.Header{}
+	for _, hdr := range fa.Copy {
+		if vals := resp.Header.Values(hdr); len(vals) > 0 {
+			copied[hdr] = vals
+		}
+	}
+	return copied, true, nil
+}
+
+// forwardAuthKey makes cache key of the auth decision from url and headers of the subrequest.
+// Header values hashed to avoid keeping credentials in memory.
+func forwardAuthKey(req *http.Request) string {
+	hh := sha256.New()
+	hh.Write([]byte(req.URL.String()))
+	for _, k := range slices.Sorted(maps.Keys(req.Header)) {
+		hh.Write([]byte{0})
+		hh.Write([]byte(k))
+		for _, v := range req.Header.Values(k) {
+			hh.Write([]byte{0})
+			hh.Write([]byte(v))
+		}
+	}
+	return hex.EncodeToString(hh.Sum(nil))
+}
+
+// copyAuthResponse writes response of the auth service to the client
+func copyAuthResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, vals := range resp.Header {
+		if k == "Content-Length" || k == "Transfer-Encoding" || k == "Connection" {
+			continue
+		}
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, io.LimitReader(resp.Body, forwardAuthMaxBody)); err != nil {
+		log.Printf("[DEBUG] can't copy forward auth response, %v", err)
+	}
+}
+
+// setCopiedHeaders sets headers of auth response to the request passed upstream
+func setCopiedHeaders(r *http.Request, copied http.Header) {
+	for k, vals := range copied {
+		r.Header.Del(k)
+		for _, v := range vals {
+			r.Header.Add(k, v)
+		}
+	}
+}
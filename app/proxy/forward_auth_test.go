@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_forwardAuthHandler(t *testing.T) {
+	var calls atomic.Int32
+	var lastReq atomic.Value
+	authSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		lastReq.Store(r.Clone(context.Background()))
+		switch r.Header.Get("Cookie") {
+		case "session=good":
+			w.Header().Set("X-User", "user1")
+			w.Header().Set("X-Email", "user1@example.com")
+			w.Header().Set("X-Internal", "secret")
+			w.WriteHeader(http.StatusNoContent)
+		case "session=slow":
+			time.Sleep(200 * time.Millisecond)
+		case "":
+			w.Header().Set("Set-Cookie", "return=1")
+			http.Redirect(w, r, "https://sso.example.com/login?rd="+r.Header.Get("X-Forwarded-Uri"), http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":"forbidden"}`))
+		}
+	}))
+	defer authSrv.Close()
+
+	fa, err := discovery.ParseForwardAuth(authSrv.URL + "/verify?app=1, headers=Cookie X-Api-Key, copy=X-User X-Email")
+	require.NoError(t, err)
+
+	h := Http{Reporter: &ErrorReporter{}, RequestIDHeader: "X-Request-Id"}
+	handler := h.forwardAuthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-User", r.Header.Get("X-User"))
+		w.Header().Set("X-Got-Email", r.Header.Get("X-Email"))
+		w.Header().Set("X-Got-Internal", r.Header.Get("X-Internal"))
+		_, _ = w.Write([]byte("passed"))
+	}))
+
+	makeReq := func(cookie string, route discovery.ForwardAuth) *http.Request {
+		req := httptest.NewRequest("POST", "http://app.example.com/api/items?id=1", http.NoBody)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		req.Header.Set("X-User", "spoofed")
+		req.Header.Set("Authorization", "Bearer not-forwarded")
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"), ForwardAuth: route}}
+		ctx := context.WithValue(req.Context(), ctxMatch, m)
+		ctx = context.WithValue(ctx, ctxRealIP, "10.0.0.1")
+		ctx = context.WithValue(ctx, ctxRequestID, "req-123")
+		return req.WithContext(ctx)
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		req := makeReq("session=good", fa)
+		req.TLS = &tls.ConnectionState{}
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "passed", wr.Body.String())
+		assert.Equal(t, "user1", wr.Header().Get("X-Got-User"))
+		assert.Equal(t, "user1@example.com", wr.Header().Get("X-Got-Email"))
+		assert.Empty(t, wr.Header().Get("X-Got-Internal"), "not configured to copy")
+
+		authReq := lastReq.Load().(*http.Request)
+		assert.Equal(t, "GET", authReq.Method)
+		assert.Equal(t, "/verify?app=1", authReq.URL.RequestURI())
+		assert.Equal(t, "POST", authReq.Header.Get("X-Forwarded-Method"))
+		assert.Equal(t, "https", authReq.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "app.example.com", authReq.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "/api/items?id=1", authReq.Header.Get("X-Forwarded-Uri"))
+		assert.Equal(t, "10.0.0.1", authReq.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "req-123", authReq.Header.Get("X-Request-Id"))
+		assert.Empty(t, authReq.Header.Get("Authorization"), "not in the list of headers")
+	})
+
+	t.Run("scheme resolved behind trusted proxy", func(t *testing.T) {
+		req := makeReq("session=proxied", fa)
+		req = req.WithContext(context.WithValue(req.Context(), ctxScheme, "https"))
+		authReq, err := forwardAuthRequest(req, fa)
+		require.NoError(t, err)
+		assert.Equal(t, "https", authReq.Header.Get("X-Forwarded-Proto"))
+
+		authReq, err = forwardAuthRequest(makeReq("session=plain", fa), fa)
+		require.NoError(t, err)
+		assert.Equal(t, "http", authReq.Header.Get("X-Forwarded-Proto"))
+	})
+
+	t.Run("redirect to login returned as is", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("", fa))
+		assert.Equal(t, http.StatusFound, wr.Code)
+		assert.Equal(t, "https://sso.example.com/login?rd=/api/items?id=1", wr.Header().Get("Location"))
+		assert.Equal(t, "return=1", wr.Header().Get("Set-Cookie"))
+		assert.NotContains(t, wr.Body.String(), "passed")
+	})
+
+	t.Run("forbidden returned as is", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("session=bad", fa))
+		assert.Equal(t, http.StatusForbidden, wr.Code)
+		assert.Equal(t, "application/json", wr.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"error":"forbidden"}`, wr.Body.String())
+	})
+
+	t.Run("auth service timeout", func(t *testing.T) {
+		slow := fa
+		slow.Timeout = 50 * time.Millisecond
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("session=slow", slow))
+		assert.Equal(t, http.StatusBadGateway, wr.Code)
+	})
+
+	t.Run("auth service down", func(t *testing.T) {
+		down := fa
+		down.URL = "http://127.0.0.1:1/verify"
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("session=good", down))
+		assert.Equal(t, http.StatusBadGateway, wr.Code)
+	})
+
+	t.Run("route without forward auth", func(t *testing.T) {
+		before := calls.Load()
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("", discovery.ForwardAuth{}))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "spoofed", wr.Header().Get("X-Got-User"))
+		assert.Equal(t, before, calls.Load())
+	})
+
+	t.Run("allowed decision cached", func(t *testing.T) {
+		cached := fa
+		cached.CacheTTL = 100 * time.Millisecond
+		before := calls.Load()
+		for range 3 {
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, makeReq("session=good", cached))
+			assert.Equal(t, http.StatusOK, wr.Code)
+			assert.Equal(t, "user1", wr.Header().Get("X-Got-User"))
+		}
+		assert.Equal(t, before+1, calls.Load())
+
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("session=other", cached))
+		assert.Equal(t, http.StatusForbidden, wr.Code, "other credentials not cached")
+		assert.Equal(t, before+2, calls.Load())
+
+		for range 2 {
+			wr = httptest.NewRecorder()
+			handler.ServeHTTP(wr, makeReq("session=other", cached))
+			assert.Equal(t, http.StatusForbidden, wr.Code)
+		}
+		assert.Equal(t, before+4, calls.Load(), "denied decisions not cached")
+
+		time.Sleep(150 * time.Millisecond)
+		wr = httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("session=good", cached))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, before+5, calls.Load(), "expired decision checked again")
+	})
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// setForwarded appends RFC 7239 Forwarded element for this hop to the request's Forwarded header.
+// The existing header, if any, is preserved, and the new element added to the end of the list.
+func setForwarded(r *http.Request, host, proto string) {
+	elems := []string{"for=" + forwardedNode(remoteAddrIP(r))}
+	if proto != "" {
+		elems = append(elems, "proto="+proto)
+	}
+	if host != "" {
+		elems = append(elems, "host="+forwardedValue(host))
+	}
+	value := strings.Join(elems, ";")
+
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	r.Header.Set("Forwarded", value)
+}
+
+// forwardedNode makes node value for "for" parameter. IPv6 addresses are enclosed in brackets and quoted.
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+// forwardedValue returns value as-is if it is a valid token, quoted string otherwise
+func forwardedValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// parseForwardedFor returns the list of "for" nodes from Forwarded headers, in the order of hops.
+// Ports, brackets and quotes are stripped, unknown and obfuscated identifiers returned as-is.
+func parseForwardedFor(values []string) []string {
+	res := parseForwardedParam(values, "for")
+	for i, v := range res {
+		res[i] = forwardedNodeIP(v)
+	}
+	return res
+}
+
+// parseForwardedParam returns raw values of the parameter from Forwarded headers, in the order of hops
+func parseForwardedParam(values []string, param string) []string {
+	var res []string
+	for _, value := range values {
+		for _, elem := range discovery.SplitQuoted(value, ',') {
+			for _, pair := range discovery.SplitQuoted(elem, ';') {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(k), param) {
+					continue
+				}
+				res = append(res, strings.TrimSpace(v))
+			}
+		}
+	}
+	return res
+}
+
+// forwardedNodeIP extracts ip from node value, i.e. "[2001:db8::1]:4711" or 192.0.2.43:80
+func forwardedNodeIP(v string) string {
+	if len(v) >= 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) {
+		v = strings.ReplaceAll(v[1:len(v)-1], `\`, "")
+	}
+	if strings.HasPrefix(v, "[") {
+		if end := strings.Index(v, "]"); end > 0 {
+			return v[1:end]
+		}
+		return v
+	}
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		return host
+	}
+	return v
+}
+
+// isTokenChar checks if c is allowed in RFC 7230 token
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
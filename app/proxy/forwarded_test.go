@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setForwarded(t *testing.T) {
+	tbl := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		proto      string
+		prior      []string
+		expected   string
+	}{
+		{name: "ipv4", remoteAddr: "192.0.2.60:1234", host: "example.com", proto: "http",
+			expected: "for=192.0.2.60;proto=http;host=example.com"},
+		{name: "ipv6", remoteAddr: "[2001:db8:cafe::17]:1234", host: "example.com", proto: "https",
+			expected: `for="[2001:db8:cafe::17]";proto=https;host=example.com`},
+		{name: "host with port", remoteAddr: "192.0.2.60:1234", host: "example.com:8080", proto: "http",
+			expected: `for=192.0.2.60;proto=http;host="example.com:8080"`},
+		{name: "appended to existing", remoteAddr: "10.0.0.1:1234", host: "example.com", proto: "http",
+			prior:    []string{"for=192.0.2.43", "for=198.51.100.17;proto=https"},
+			expected: "for=192.0.2.43, for=198.51.100.17;proto=https, for=10.0.0.1;proto=http;host=example.com"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.prior {
+				req.Header.Add("Forwarded", v)
+			}
+			setForwarded(req, tt.host, tt.proto)
+			assert.Equal(t, []string{tt.expected}, req.Header.Values("Forwarded"))
+		})
+	}
+}
+
+func Test_parseForwardedFor(t *testing.T) {
+	tbl := []struct {
+		values   []string
+		expected []string
+	}{
+		{[]string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{[]string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{[]string{`For="[2001:db8:cafe::17]:4711"`}, []string{"2001:db8:cafe::17"}},
+		{[]string{`for="192.0.2.43:80"`, "for=unknown"}, []string{"192.0.2.43", "unknown"}},
+		{[]string{`host="a;b,c";for=192.0.2.1`}, []string{"192.0.2.1"}},
+		{[]string{"proto=https"}, nil},
+		{nil, nil},
+	}
+
+	for _, tt := range tbl {
+		assert.Equal(t, tt.expected, parseForwardedFor(tt.values), "%v", tt.values)
+	}
+}
+
+func TestRealIP_resolveForwardedRFC(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", `for=1.1.1.1, for="[2001:db8::1]:80", for=10.0.0.2`)
+
+	ri, err := NewRealIP([]string{"10.0.0.0/8"}, OFForwardedRFC, OFRemoteAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ri.resolve(req))
+
+	ri, err = NewRealIP(nil, OFForwardedRFC, OFRemoteAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", ri.resolve(req))
+
+	assert.Equal(t, "1.1.1.1", NewOnlyFrom(OFForwardedRFC).realIP([]OFLookup{OFForwardedRFC}, req))
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// GeoIP resolves country code and autonomous system number of ip, empty country and zero asn if unknown
+type GeoIP interface {
+	Lookup(ip string) (country string, asn uint)
+}
+
+// geoIPHandler resolves country of the client ip, keeps it in the request context for access log and passes it
+// upstream in GeoIPHeader. Requests to routes with geoip policy rejected with 403 if the client's country or asn
+// not allowed, as well as all requests to such routes if geoip database not defined.
+func (h *Http) geoIPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		policy := match.Mapper.GeoIP
+		if h.GeoIP == nil {
+			if ok && policy.Enabled {
+				log.Printf("[WARN] geoip policy set for %s, but geoip database not defined", r.URL.Path)
+				reportError(w, r, h.Reporter, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := realIPFromRequest(r)
+		country, asn := h.GeoIP.Lookup(ip)
+		if ok && policy.Enabled && !policy.Allow(country, asn) {
+			log.Printf("[INFO] ip %q (country %q, asn %d) rejected for %s", ip, country, asn, r.URL.Path)
+			reportError(w, r, h.Reporter, http.StatusForbidden)
+			return
+		}
+		if h.GeoIPHeader != "" {
+			r.Header.Del(h.GeoIPHeader) // don't trust client's value
+			if country != "" {
+				r.Header.Set(h.GeoIPHeader, country)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxCountry, country)))
+	})
+}
+
+// countryFromRequest returns client's country resolved by geoIPHandler, empty if unknown
+func countryFromRequest(r *http.Request) string {
+	country, _ := r.Context().Value(ctxCountry).(string)
+	return country
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+type geoIPMock map[string]struct {
+	country string
+	asn     uint
+}
+
+func (m geoIPMock) Lookup(ip string) (country string, asn uint) {
+	return m[ip].country, m[ip].asn
+}
+
+func TestHttp_geoIPHandler(t *testing.T) {
+	geo := geoIPMock{"1.1.1.1": {"US", 13335}, "2.2.2.2": {"RU", 64500}, "3.3.3.3": {"DE", 64501}}
+	passed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Country", r.Header.Get("X-Country-Code"))
+		w.Header().Set("X-Got-Ctx", countryFromRequest(r))
+		_, _ = w.Write([]byte("passed"))
+	})
+
+	makeReq := func(ip, policy string, matched bool) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com/api/items", http.NoBody)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-Country-Code", "XX") // spoofed by client
+		if !matched {
+			return req
+		}
+		p, err := discovery.ParseGeoIP(policy)
+		require.NoError(t, err)
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"), GeoIP: p}}
+		return req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+	}
+
+	t.Run("with database", func(t *testing.T) {
+		h := Http{Reporter: &ErrorReporter{}, GeoIP: geo, GeoIPHeader: "X-Country-Code"}
+		handler := h.geoIPHandler(passed)
+		tbl := []struct {
+			name    string
+			req     *http.Request
+			code    int
+			country string
+		}{
+			{"no policy", makeReq("2.2.2.2", "", true), http.StatusOK, "RU"},
+			{"unmatched route", makeReq("1.1.1.1", "", false), http.StatusOK, "US"},
+			{"allowed country", makeReq("1.1.1.1", "allow=US CA", true), http.StatusOK, "US"},
+			{"not allowed country", makeReq("3.3.3.3", "allow=US CA", true), http.StatusForbidden, ""},
+			{"denied country", makeReq("2.2.2.2", "deny=RU", true), http.StatusForbidden, ""},
+			{"allowed asn", makeReq("3.3.3.3", "allow=US, allow-asn=64501", true), http.StatusOK, "DE"},
+			{"denied asn", makeReq("1.1.1.1", "deny-asn=13335", true), http.StatusForbidden, ""},
+			{"unknown ip, deny list", makeReq("4.4.4.4", "deny=RU", true), http.StatusOK, ""},
+			{"unknown ip, allow list", makeReq("4.4.4.4", "allow=US", true), http.StatusForbidden, ""},
+		}
+		for _, tt := range tbl {
+			t.Run(tt.name, func(t *testing.T) {
+				wr := httptest.NewRecorder()
+				handler.ServeHTTP(wr, tt.req)
+				assert.Equal(t, tt.code, wr.Code)
+				if tt.code != http.StatusOK {
+					assert.NotContains(t, wr.Body.String(), "passed")
+					return
+				}
+				assert.Equal(t, tt.country, wr.Header().Get("X-Got-Country"), "spoofed header replaced")
+				assert.Equal(t, tt.country, wr.Header().Get("X-Got-Ctx"))
+			})
+		}
+	})
+
+	t.Run("no header", func(t *testing.T) {
+		h := Http{Reporter: &ErrorReporter{}, GeoIP: geo}
+		wr := httptest.NewRecorder()
+		h.geoIPHandler(passed).ServeHTTP(wr, makeReq("1.1.1.1", "allow=US", true))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "XX", wr.Header().Get("X-Got-Country"), "header not managed")
+		assert.Equal(t, "US", wr.Header().Get("X-Got-Ctx"))
+	})
+
+	t.Run("no database", func(t *testing.T) {
+		h := Http{Reporter: &ErrorReporter{}, GeoIPHeader: "X-Country-Code"}
+		handler := h.geoIPHandler(passed)
+
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("1.1.1.1", "deny=RU", true))
+		assert.Equal(t, http.StatusForbidden, wr.Code, "route with policy rejected")
+
+		wr = httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("1.1.1.1", "", true))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Empty(t, wr.Header().Get("X-Got-Ctx"))
+	})
+}
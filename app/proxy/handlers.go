@@ -7,7 +7,6 @@ import (
 	"errors"
 	"io"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,9 +17,9 @@ import (
 	log "github.com/go-pkgz/lgr"
 	R "github.com/go-pkgz/rest"
 	"github.com/gorilla/handlers"
-	"golang.org/x/crypto/bcrypt"
 
 	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/htpasswd"
 )
 
 func headersHandler(addHeaders, dropHeaders []string) func(next http.Handler) http.Handler {
@@ -53,56 +52,84 @@ func headersHandler(addHeaders, dropHeaders []string) func(next http.Handler) ht
 	}
 }
 
-func maxReqSizeHandler(maxSize int64) func(next http.Handler) http.Handler {
-	if maxSize <= 0 {
-		return passThroughHandler
+// maxReqSizeHandler limits request body size with the global maxSize or the per-route max body size of the
+// matched route. Oversized requests rejected with 413 by reporter before proxying. Query string size limited by maxSize.
+func maxReqSizeHandler(maxSize int64, reporter Reporter) func(next http.Handler) http.Handler {
+	if maxSize > 0 {
+		log.Printf("[DEBUG] request size limited to %d", maxSize)
 	}
-
-	log.Printf("[DEBUG] request size limited to %d", maxSize)
 	return func(next http.Handler) http.Handler {
 
 		fn := func(w http.ResponseWriter, r *http.Request) {
+			limit := maxSize
+			if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok && match.Mapper.MaxBodySize > 0 {
+				limit = match.Mapper.MaxBodySize
+			}
+			if limit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
 
 			// check ContentLength
-			if r.ContentLength > maxSize {
-				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			if r.ContentLength > limit {
+				reportError(w, r, reporter, http.StatusRequestEntityTooLarge)
 				return
 			}
 
 			// check query string size
-			if int64(len(r.URL.RawQuery)) > maxSize {
-				w.WriteHeader(http.StatusRequestURITooLong)
+			if maxSize > 0 && int64(len(r.URL.RawQuery)) > maxSize {
+				reportError(w, r, reporter, http.StatusRequestURITooLong)
 				return
 			}
 
-			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
 			next.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
-func accessLogHandler(wr io.Writer) func(next http.Handler) http.Handler {
+// reportError reports error code with reporter, or just sets status code if reporter not defined
+func reportError(w http.ResponseWriter, r *http.Request, reporter Reporter, code int) {
+	if reporter == nil {
+		w.WriteHeader(code)
+		return
+	}
+	reporter.Report(w, r, code)
+}
+
+// combinedLogHandler writes access log in apache combined format, with request id appended if set
+func combinedLogHandler(wr io.Writer) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		return handlers.CombinedLoggingHandler(wr, next)
+		lh := handlers.CombinedLoggingHandler(wr, next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id := requestIDFromRequest(r); id != "" {
+				handlers.CombinedLoggingHandler(requestIDWriter{wr: wr, id: id}, next).ServeHTTP(w, r)
+				return
+			}
+			lh.ServeHTTP(w, r)
+		})
 	}
 }
 
-func stdoutLogHandler(enable bool, lh func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+// stdoutLogHandler logs minimal request info to stdout, the log middleware made by mk for each record writer
+func stdoutLogHandler(enable bool, mk func(wr io.Writer) func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
 
 	if !enable {
 		return passThroughHandler
 	}
 
 	log.Printf("[DEBUG] stdout logging enabled")
+	lh := logPolicyHandler(stdoutWriter{}, mk)
 	return func(next http.Handler) http.Handler {
+		logged := lh(next)
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			// don't log to stdout GET ~/(.*)/ping$ requests
 			if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/ping") {
 				next.ServeHTTP(w, r)
 				return
 			}
-			lh(next).ServeHTTP(w, r)
+			logged.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(fn)
 	}
@@ -143,28 +170,32 @@ func limiterSystemHandler(reqSec int) func(next http.Handler) http.Handler {
 	}
 }
 
-// limiterUserHandler throttles per-user activity. When the matched route has Throttle > 0,
-// it applies a per-route limiter at that rate keyed by [ip, dst]. Otherwise it falls back
-// to the global limiter at reqSec, keyed by [ip] and, for MTProxy matches only, [ip, dst].
-// A request rejected by either limit returns 429. reqSec = 0 disables the global path while
-// per-route overrides still apply.
-func limiterUserHandler(reqSec int) func(next http.Handler) http.Handler {
-	var routeLimiters sync.Map // map[string]*limiter.Limiter, keyed by server\x00srcMatch\x00rate
+// limiterUserHandler throttles per-user activity. When the matched route has Throttle set,
+// it applies a per-route token bucket limiter keyed by route's throttle key (client ip by default)
+// and dst, ThrottleOverrides change the limit for particular key values. Requests with header and cookie keys,
+// sent by the client as is, have to pass the client ip bucket of the route too. Otherwise it falls back
+// to the global limiter at ThrottleUser, keyed by [ip] and, for MTProxy matches only, [ip, dst].
+// A request rejected by either limit reported as 429 with Retry-After, per-route limiter also sets
+// RateLimit-* headers. ThrottleUser = 0 disables the global path while per-route limits still apply.
+func (h *Http) limiterUserHandler() func(next http.Handler) http.Handler {
+	var routeLimiters sync.Map // map[string]*keyLimiter, keyed by server\x00srcMatch\x00dst\x00limit\x00key
 	var globalLmt *limiter.Limiter
-	if reqSec > 0 {
-		globalLmt = tollbooth.NewLimiter(float64(reqSec), nil)
+	if h.ThrottleUser > 0 {
+		globalLmt = tollbooth.NewLimiter(float64(h.ThrottleUser), nil)
 	}
-	getRouteLimiter := func(m discovery.URLMapper) *limiter.Limiter {
+	ipLookup := tollbooth.NewLimiter(1, nil) // used for client ip lookups only
+	getRouteLimiter := func(m discovery.URLMapper) *keyLimiter {
 		// NUL separator is invalid in hostnames and regex source, avoiding key collisions
-		key := m.Server + "\x00" + m.SrcMatch.String() + "\x00" + strconv.Itoa(m.Throttle)
+		key := m.Server + "\x00" + m.SrcMatch.String() + "\x00" + m.Dst + "\x00" + m.Throttle.String() +
+			"\x00" + m.ThrottleKey.String()
 		if v, ok := routeLimiters.Load(key); ok {
-			return v.(*limiter.Limiter)
+			return v.(*keyLimiter)
 		}
-		actual, _ := routeLimiters.LoadOrStore(key, tollbooth.NewLimiter(float64(m.Throttle), nil))
-		return actual.(*limiter.Limiter)
+		actual, _ := routeLimiters.LoadOrStore(key, newKeyLimiter(m.Throttle, h.ThrottleOverrides))
+		return actual.(*keyLimiter)
 	}
 
-	return func(h http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			var (
 				match   discovery.MatchedRoute
@@ -175,33 +206,42 @@ func limiterUserHandler(reqSec int) func(next http.Handler) http.Handler {
 				matched = true
 			}
 
-			if matched && match.Mapper.Throttle > 0 {
-				lmt := getRouteLimiter(match.Mapper)
-				ip := libstring.RemoteIP(lmt.GetIPLookups(), lmt.GetForwardedForIndexFromBehind(), r)
-				if httpError := tollbooth.LimitByKeys(lmt, []string{ip, match.Mapper.Dst}); httpError != nil {
-					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			if matched && match.Mapper.Throttle.Rate > 0 {
+				ip := userIP(ipLookup, r)
+				kind, value := limiterKey(r, match.Mapper.ThrottleKey, ip)
+				routeLimiter := getRouteLimiter(match.Mapper)
+				status := routeLimiter.allow(kind, value)
+				if status.allowed && unverifiedKey(kind) {
+					if ipStatus := routeLimiter.allow(discovery.TKIP, ip); !ipStatus.allowed {
+						status = ipStatus
+					}
+				}
+				status.setHeaders(w)
+				if !status.allowed {
+					reportError(w, r, h.Reporter, http.StatusTooManyRequests)
 					return
 				}
-				h.ServeHTTP(w, r)
+				next.ServeHTTP(w, r)
 				return
 			}
 
 			if globalLmt == nil {
-				h.ServeHTTP(w, r)
+				next.ServeHTTP(w, r)
 				return
 			}
 			lmt := globalLmt
-			keys := []string{libstring.RemoteIP(lmt.GetIPLookups(), lmt.GetForwardedForIndexFromBehind(), r)}
+			keys := []string{userIP(lmt, r)}
 			if matched {
 				if matchType, ok := r.Context().Value(ctxMatchType).(discovery.MatchType); ok && matchType == discovery.MTProxy {
 					keys = append(keys, match.Mapper.Dst)
 				}
 			}
 			if httpError := tollbooth.LimitByKeys(lmt, keys); httpError != nil {
-				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				w.Header().Set("Retry-After", retryAfter(time.Second))
+				reportError(w, r, h.Reporter, http.StatusTooManyRequests)
 				return
 			}
-			h.ServeHTTP(w, r)
+			next.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(fn)
 	}
@@ -256,17 +296,19 @@ func routeTimeoutHandler(next http.Handler) http.Handler {
 }
 
 // perRouteAuthHandler is middleware for per-route basic authentication.
-// It checks the AuthUsers field of the matched route and validates credentials.
-func perRouteAuthHandler(next http.Handler) http.Handler {
+// It checks the AuthUsers field and the named htpasswd file (AuthFile) of the matched route and validates credentials.
+// If both are set, credentials matching any of them are accepted.
+func (h *Http) perRouteAuthHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var authUsers []string
+		var authFile string
 		reqCtx := r.Context()
 		if reqCtx.Value(ctxMatch) != nil { // route match detected by matchHandler
 			match := reqCtx.Value(ctxMatch).(discovery.MatchedRoute)
-			authUsers = match.Mapper.AuthUsers
+			authUsers, authFile = match.Mapper.AuthUsers, match.Mapper.AuthFile
 		}
 
-		if len(authUsers) == 0 {
+		if len(authUsers) == 0 && authFile == "" {
 			// no per-route auth required
 			next.ServeHTTP(w, r)
 			return
@@ -278,27 +320,44 @@ func perRouteAuthHandler(next http.Handler) http.Handler {
 			return
 		}
 
-		if !validateBasicAuthCredentials(username, password, authUsers) {
+		passed := len(authUsers) > 0 && validateBasicAuthCredentials(username, password, authUsers)
+		if !passed && authFile != "" {
+			if file, found := h.HtpasswdFiles[authFile]; found {
+				passed = file.Match(username, password)
+			} else {
+				log.Printf("[WARN] htpasswd file %q of route %s not defined", authFile, r.URL.Path)
+			}
+		}
+		if !passed {
 			log.Printf("[INFO] auth rejected for user %q on %s", username, r.URL.String())
 			sendBasicAuthUnauthorized(w)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(reqCtx, ctxAuthUser, username)))
 	})
 }
 
 // globalBasicAuthHandler is a middleware that authenticates via global basic auth.
-// It skips authentication if the route has per-route auth configured (AuthUsers is set).
-// allowed is a list of user:bcrypt(passwd) strings generated by `htpasswd -nbB user passwd`
+// It skips authentication if the route has per-route auth configured (AuthUsers, AuthFile, JWT policy, forward auth,
+// oidc or api key is set). allowed is a list of user:hash strings generated by `htpasswd -nbB user passwd`
 func globalBasicAuthHandler(allowed []string) func(next http.Handler) http.Handler {
+	return globalCredentialsHandler(func(username, password string) bool {
+		return validateBasicAuthCredentials(username, password, allowed)
+	})
+}
+
+// globalCredentialsHandler is globalBasicAuthHandler with credentials checked by match func,
+// i.e. by htpasswd file reloaded on change
+func globalCredentialsHandler(match func(username, password string) bool) func(next http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			// skip global auth if route has per-route auth configured
 			reqCtx := r.Context()
 			if reqCtx.Value(ctxMatch) != nil {
-				match := reqCtx.Value(ctxMatch).(discovery.MatchedRoute)
-				if len(match.Mapper.AuthUsers) > 0 {
+				m := reqCtx.Value(ctxMatch).(discovery.MatchedRoute).Mapper
+				if len(m.AuthUsers) > 0 || m.AuthFile != "" || m.JWT.Enabled || m.ForwardAuth.Enabled() ||
+					m.OIDC.Enabled || m.APIKey.Enabled {
 					h.ServeHTTP(w, r)
 					return
 				}
@@ -310,20 +369,20 @@ func globalBasicAuthHandler(allowed []string) func(next http.Handler) http.Handl
 				return
 			}
 
-			if !validateBasicAuthCredentials(username, password, allowed) {
+			if !match(username, password) {
 				log.Printf("[INFO] auth rejected for user %q on %s", username, r.URL.String())
 				sendBasicAuthUnauthorized(w)
 				return
 			}
 
-			h.ServeHTTP(w, r)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxAuthUser, username)))
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
 // validateBasicAuthCredentials checks if username:password matches any of the allowed user:hash pairs.
-// uses constant-time username comparison and bcrypt for password verification.
+// uses constant-time username comparison and bcrypt, APR1-MD5 or SHA-crypt hash for password verification.
 func validateBasicAuthCredentials(username, password string, allowed []string) bool {
 	if username == "" {
 		return false
@@ -341,8 +400,8 @@ func validateBasicAuthCredentials(username, password string, allowed []string) b
 
 		expectedPasswordHash := elems[1]
 		userMatched := subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:])
-		passMatchErr := bcrypt.CompareHashAndPassword([]byte(expectedPasswordHash), []byte(password))
-		if userMatched == 1 && passMatchErr == nil {
+		passMatched := htpasswd.Verify(expectedPasswordHash, password)
+		if userMatched == 1 && passMatched {
 			passed = true // don't stop here, check all allowed to keep the overall time consistent
 		}
 	}
@@ -355,6 +414,14 @@ func sendBasicAuthUnauthorized(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
+// userIP returns client ip resolved by RealIP middleware, or the one detected by limiter's lookups
+func userIP(lmt *limiter.Limiter, r *http.Request) string {
+	if ip, ok := r.Context().Value(ctxRealIP).(string); ok {
+		return ip
+	}
+	return libstring.RemoteIP(lmt.GetIPLookups(), lmt.GetForwardedForIndexFromBehind(), r)
+}
+
 func passThroughHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		next.ServeHTTP(w, r)
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -77,7 +78,7 @@ func Test_headersHandler(t *testing.T) {
 func Test_maxReqSizeHandler(t *testing.T) {
 	t.Run("good size", func(t *testing.T) {
 		wr := httptest.NewRecorder()
-		handler := maxReqSizeHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := maxReqSizeHandler(10, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			t.Logf("req: %v", r)
 		}))
 		req, err := http.NewRequest("POST", "http://example.com", bytes.NewBufferString("123456"))
@@ -88,7 +89,7 @@ func Test_maxReqSizeHandler(t *testing.T) {
 
 	t.Run("too large size", func(t *testing.T) {
 		wr := httptest.NewRecorder()
-		handler := maxReqSizeHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := maxReqSizeHandler(10, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			t.Logf("req: %v", r)
 		}))
 		req, err := http.NewRequest("POST", "http://example.com", bytes.NewBufferString("123456789012345"))
@@ -99,7 +100,7 @@ func Test_maxReqSizeHandler(t *testing.T) {
 
 	t.Run("zero max size", func(t *testing.T) {
 		wr := httptest.NewRecorder()
-		handler := maxReqSizeHandler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := maxReqSizeHandler(0, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			t.Logf("req: %v", r)
 		}))
 		req, err := http.NewRequest("POST", "http://example.com", bytes.NewBufferString("123456"))
@@ -110,7 +111,7 @@ func Test_maxReqSizeHandler(t *testing.T) {
 
 	t.Run("too large request size", func(t *testing.T) {
 		wr := httptest.NewRecorder()
-		handler := maxReqSizeHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := maxReqSizeHandler(10, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			t.Logf("req: %v", r)
 		}))
 		req, err := http.NewRequest("GET", "http://example.com?q=123456789012345", http.NoBody)
@@ -121,7 +122,7 @@ func Test_maxReqSizeHandler(t *testing.T) {
 
 	t.Run("good request size", func(t *testing.T) {
 		wr := httptest.NewRecorder()
-		handler := maxReqSizeHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := maxReqSizeHandler(10, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			t.Logf("req: %v", r)
 		}))
 		req, err := http.NewRequest("GET", "http://example.com?q=12345678", http.NoBody)
@@ -129,6 +130,51 @@ func Test_maxReqSizeHandler(t *testing.T) {
 		handler.ServeHTTP(wr, req)
 		assert.Equal(t, http.StatusOK, wr.Result().StatusCode)
 	})
+
+	withRoute := func(r *http.Request, maxBody int64) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{MaxBodySize: maxBody}}))
+	}
+
+	t.Run("per-route size above global", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler := maxReqSizeHandler(10, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "123456789012345", string(body))
+		}))
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewBufferString("123456789012345"))
+		require.NoError(t, err)
+		handler.ServeHTTP(wr, withRoute(req, 20))
+		assert.Equal(t, http.StatusOK, wr.Result().StatusCode)
+	})
+
+	t.Run("per-route size below global", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler := maxReqSizeHandler(100, &ErrorReporter{Nice: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fatal("should not be called")
+		}))
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewBufferString("123456789012345"))
+		require.NoError(t, err)
+		handler.ServeHTTP(wr, withRoute(req, 10))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, wr.Result().StatusCode)
+		assert.Contains(t, wr.Body.String(), "Request Entity Too Large", "reported by error reporter")
+	})
+
+	t.Run("per-route size without global", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler := maxReqSizeHandler(0, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.ReadAll(r.Body)
+			var maxErr *http.MaxBytesError
+			require.ErrorAs(t, err, &maxErr, "unknown size body limited while reading")
+			assert.Equal(t, int64(10), maxErr.Limit)
+		}))
+		req, err := http.NewRequest("POST", "http://example.com?q=123456789012345", io.NopCloser(bytes.NewBufferString("123456789012345")))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), req.ContentLength)
+		handler.ServeHTTP(wr, withRoute(req, 10))
+		assert.Equal(t, http.StatusOK, wr.Result().StatusCode, "query not limited without global max")
+	})
 }
 
 func Test_signatureHandler(t *testing.T) {
@@ -191,7 +237,7 @@ func Test_limiterSystemHandler(t *testing.T) {
 func Test_limiterClientHandlerNoMatches(t *testing.T) {
 
 	var passed atomic.Int32
-	handler := limiterUserHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := (&Http{ThrottleUser: 10}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		passed.Add(1)
 	}))
 
@@ -217,7 +263,7 @@ func Test_limiterClientHandlerNoMatches(t *testing.T) {
 
 func Test_limiterClientHandlerWithMatches(t *testing.T) {
 	var passed atomic.Int32
-	handler := limiterUserHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := (&Http{ThrottleUser: 10}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		passed.Add(1)
 	}))
 
@@ -340,6 +386,24 @@ func Test_globalBasicAuthHandler_SkipsPerRouteAuth(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rr.Code)
 	})
 
+	t.Run("route has api key policy, global auth skipped", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{APIKey: discovery.APIKeyPolicy{Enabled: true}}}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("route has oidc policy, global auth skipped", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+			discovery.MatchedRoute{Mapper: discovery.URLMapper{OIDC: discovery.OIDCPolicy{Enabled: true}}}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
 	t.Run("route has no per-route auth, global auth applies", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
 		req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
@@ -377,7 +441,7 @@ func Test_perRouteAuthHandler(t *testing.T) {
 
 	for _, tt := range tbl {
 		t.Run(tt.name, func(t *testing.T) {
-			handler := perRouteAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			handler := (&Http{}).perRouteAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
 			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
 			tt.setAuth(req)
@@ -397,7 +461,7 @@ func Test_perRouteAuthHandler(t *testing.T) {
 
 func Test_perRouteAuthHandler_NoContext(t *testing.T) {
 	// test when no context match is set (should pass through)
-	handler := perRouteAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := (&Http{}).perRouteAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
@@ -408,6 +472,73 @@ func Test_perRouteAuthHandler_NoContext(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
 
+func Test_perRouteAuthHandler_AuthFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("passwd1"), bcrypt.MinCost)
+	require.NoError(t, err)
+	h := Http{HtpasswdFiles: map[string]Htpasswd{"admins": htpasswdMock{"admin": "admin-passwd"}}}
+	handler := h.perRouteAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tbl := []struct {
+		name       string
+		mapper     discovery.URLMapper
+		user, pass string
+		code       int
+	}{
+		{name: "file user", mapper: discovery.URLMapper{AuthFile: "admins"}, user: "admin", pass: "admin-passwd",
+			code: http.StatusOK},
+		{name: "file user, wrong password", mapper: discovery.URLMapper{AuthFile: "admins"}, user: "admin", pass: "bad",
+			code: http.StatusUnauthorized},
+		{name: "no credentials", mapper: discovery.URLMapper{AuthFile: "admins"}, code: http.StatusUnauthorized},
+		{name: "unknown file", mapper: discovery.URLMapper{AuthFile: "others"}, user: "admin", pass: "admin-passwd",
+			code: http.StatusUnauthorized},
+		{name: "inline user with file", mapper: discovery.URLMapper{AuthFile: "admins",
+			AuthUsers: []string{"user1:" + string(hash)}}, user: "user1", pass: "passwd1", code: http.StatusOK},
+		{name: "file user with inline users", mapper: discovery.URLMapper{AuthFile: "admins",
+			AuthUsers: []string{"user1:" + string(hash)}}, user: "admin", pass: "admin-passwd", code: http.StatusOK},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: tt.mapper}))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+		})
+	}
+}
+
+func TestHttp_basicAuthHandlerWithFile(t *testing.T) {
+	h := Http{BasicAuthEnabled: true, BasicAuthAllowed: []string{"static:" + "$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0"},
+		BasicAuthFile: htpasswdMock{"user": "passwd"}}
+	handler := h.basicAuthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for user, code := range map[string]int{"user": http.StatusOK, "static": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+		req.SetBasicAuth(user, "passwd")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, code, rr.Code, "file used instead of static list, %s", user)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), ctxMatch,
+		discovery.MatchedRoute{Mapper: discovery.URLMapper{AuthFile: "admins"}}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, "skipped for route with auth file")
+}
+
+// htpasswdMock keeps user -> plain password
+type htpasswdMock map[string]string
+
+func (m htpasswdMock) Match(user, password string) bool {
+	p, ok := m[user]
+	return ok && p == password
+}
+
 func Test_validateBasicAuthCredentials(t *testing.T) {
 	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.DefaultCost)
 	require.NoError(t, err)
@@ -430,6 +561,9 @@ func Test_validateBasicAuthCredentials(t *testing.T) {
 		{name: "empty allowed list", username: "admin", password: "secret", allowed: []string{}, expected: false},
 		{name: "malformed entry", username: "admin", password: "secret", allowed: []string{"no-colon"}, expected: false},
 		{name: "invalid bcrypt hash", username: "admin", password: "secret", allowed: []string{"admin:not-a-valid-bcrypt"}, expected: false},
+		{name: "apr1 hash", username: "admin", password: "passwd", allowed: []string{"admin:$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0"}, expected: true},
+		{name: "sha-crypt hash", username: "admin", password: "Hello world!", allowed: []string{"admin:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"}, expected: true},
+		{name: "apr1 hash, wrong password", username: "admin", password: "secret", allowed: []string{"admin:$apr1$saltsalt$tf5WWcmaURBRPnAR/lW6D0"}, expected: false},
 		{name: "whitespace-only entry", username: "admin", password: "secret", allowed: []string{"   "}, expected: false},
 		{name: "empty username with hash", username: "", password: "secret", allowed: []string{":" + string(hash)}, expected: false},
 		{name: "username with colon rejected (htpasswd limitation)", username: "user:name", password: "secret", allowed: []string{"user:name:" + string(hash)}, expected: false},
@@ -677,11 +811,11 @@ func Test_limiterUserHandler_PerRoute(t *testing.T) {
 
 	t.Run("route throttle fires after burst", func(t *testing.T) {
 		var passed atomic.Int32
-		handler := limiterUserHandler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := (&Http{ThrottleUser: 0}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passed.Add(1)
 			w.WriteHeader(http.StatusOK)
 		}))
-		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/route$"), Dst: "http://up", Throttle: 2}
+		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/route$"), Dst: "http://up", Throttle: discovery.RateLimit{Rate: 2}}
 
 		statuses := make([]int, 0, 3)
 		for range 3 {
@@ -697,12 +831,12 @@ func Test_limiterUserHandler_PerRoute(t *testing.T) {
 
 	t.Run("key isolation across routes", func(t *testing.T) {
 		var passed atomic.Int32
-		handler := limiterUserHandler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := (&Http{ThrottleUser: 0}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passed.Add(1)
 			w.WriteHeader(http.StatusOK)
 		}))
-		mapperA := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/a$"), Dst: "http://upA", Throttle: 1}
-		mapperB := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/b$"), Dst: "http://upB", Throttle: 1}
+		mapperA := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/a$"), Dst: "http://upA", Throttle: discovery.RateLimit{Rate: 1}}
+		mapperB := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/b$"), Dst: "http://upB", Throttle: discovery.RateLimit{Rate: 1}}
 
 		recA := httptest.NewRecorder()
 		handler.ServeHTTP(recA, makeReq("1.2.3.4:1", mapperA, discovery.MTProxy))
@@ -716,11 +850,11 @@ func Test_limiterUserHandler_PerRoute(t *testing.T) {
 
 	t.Run("per-user budget preserved", func(t *testing.T) {
 		var passed atomic.Int32
-		handler := limiterUserHandler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := (&Http{ThrottleUser: 0}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passed.Add(1)
 			w.WriteHeader(http.StatusOK)
 		}))
-		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/multi$"), Dst: "http://up", Throttle: 2}
+		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/multi$"), Dst: "http://up", Throttle: discovery.RateLimit{Rate: 2}}
 
 		statuses := make([]int, 0, 4)
 		for _, ip := range []string{"1.1.1.1:1", "1.1.1.1:1", "2.2.2.2:1", "2.2.2.2:1"} {
@@ -736,11 +870,11 @@ func Test_limiterUserHandler_PerRoute(t *testing.T) {
 
 	t.Run("fallback to global when route throttle is zero", func(t *testing.T) {
 		var passed atomic.Int32
-		handler := limiterUserHandler(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := (&Http{ThrottleUser: 5}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passed.Add(1)
 			w.WriteHeader(http.StatusOK)
 		}))
-		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/glb$"), Dst: "http://up", Throttle: 0}
+		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/glb$"), Dst: "http://up", Throttle: discovery.RateLimit{Rate: 0}}
 
 		statuses := make([]int, 0, 6)
 		for range 6 {
@@ -754,11 +888,11 @@ func Test_limiterUserHandler_PerRoute(t *testing.T) {
 
 	t.Run("per-route works when global is zero", func(t *testing.T) {
 		var passed atomic.Int32
-		handler := limiterUserHandler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := (&Http{ThrottleUser: 0}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passed.Add(1)
 			w.WriteHeader(http.StatusOK)
 		}))
-		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/rg$"), Dst: "http://up", Throttle: 3}
+		mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/rg$"), Dst: "http://up", Throttle: discovery.RateLimit{Rate: 3}}
 
 		statuses := make([]int, 0, 4)
 		for range 4 {
@@ -775,13 +909,13 @@ func Test_limiterUserHandler_PerRoute(t *testing.T) {
 
 	t.Run("rate-change cache key", func(t *testing.T) {
 		var passed atomic.Int32
-		handler := limiterUserHandler(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := (&Http{ThrottleUser: 0}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			passed.Add(1)
 			w.WriteHeader(http.StatusOK)
 		}))
 		src := regexp.MustCompile("^/rate$")
-		mapper2 := discovery.URLMapper{Server: "*", SrcMatch: *src, Dst: "http://up", Throttle: 2}
-		mapper5 := discovery.URLMapper{Server: "*", SrcMatch: *src, Dst: "http://up", Throttle: 5}
+		mapper2 := discovery.URLMapper{Server: "*", SrcMatch: *src, Dst: "http://up", Throttle: discovery.RateLimit{Rate: 2}}
+		mapper5 := discovery.URLMapper{Server: "*", SrcMatch: *src, Dst: "http://up", Throttle: discovery.RateLimit{Rate: 5}}
 
 		first := make([]int, 0, 3)
 		for range 3 {
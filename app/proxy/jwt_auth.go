@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/jwt"
+)
+
+// jwtAuthHandler validates bearer tokens of routes with jwt policy. Missing and invalid tokens, including tokens
+// of other issuer or audience, rejected with 401, tokens without required claims with 403. Both responses have
+// WWW-Authenticate header (RFC 6750). Forwarded claims set as request headers, the same headers sent by client dropped.
+// Claims of the verified token kept in the request context for throttle keys.
+func (h *Http) jwtAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if !ok || !match.Mapper.JWT.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy := match.Mapper.JWT
+		for _, f := range policy.Forward {
+			r.Header.Del(f.Header) // don't trust client's values of forwarded claims
+		}
+
+		token := jwt.BearerToken(r.Header.Get("Authorization"))
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="reproxy"`)
+			reportError(w, r, h.Reporter, http.StatusUnauthorized)
+			return
+		}
+		if h.TokenVerifier == nil {
+			log.Printf("[WARN] jwt required for %s, but neither jwt secret nor jwks defined", r.URL.Path)
+			h.rejectBearer(w, r, http.StatusUnauthorized, "invalid_token", "token can't be verified")
+			return
+		}
+
+		claims, err := h.TokenVerifier.Verify(r.Context(), token)
+		if err != nil {
+			log.Printf("[INFO] jwt rejected on %s, %v", r.URL.Path, err)
+			h.rejectBearer(w, r, http.StatusUnauthorized, "invalid_token", tokenErrorDescription(err))
+			return
+		}
+		if err := checkJWTClaims(policy, claims); err != nil {
+			log.Printf("[INFO] jwt of %q rejected on %s, %v", claims.String("sub"), r.URL.Path, err)
+			var ruleErr *claimRuleError
+			if errors.As(err, &ruleErr) {
+				h.rejectBearer(w, r, http.StatusForbidden, "insufficient_scope", err.Error())
+				return
+			}
+			h.rejectBearer(w, r, http.StatusUnauthorized, "invalid_token", err.Error())
+			return
+		}
+
+		for _, f := range policy.Forward {
+			if vals := claims.List(f.Claim); len(vals) > 0 {
+				r.Header.Set(f.Header, strings.Join(vals, ","))
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxJWTClaims, claims)))
+	})
+}
+
+// rejectBearer responds with error code and WWW-Authenticate header describing the error
+func (h *Http) rejectBearer(w http.ResponseWriter, r *http.Request, code int, errCode, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="reproxy", error=%q, error_description=%q`, errCode, description))
+	reportError(w, r, h.Reporter, code)
+}
+
+// claimRuleError returned for tokens without required claim values
+type claimRuleError struct {
+	name string
+}
+
+func (e *claimRuleError) Error() string {
+	return "required claim " + e.name + " missing or not allowed"
+}
+
+// checkJWTClaims checks issuer, audience and required claims of the policy
+func checkJWTClaims(policy discovery.JWTPolicy, claims jwt.Claims) error {
+	if policy.Issuer != "" && claims.String("iss") != policy.Issuer {
+		return errors.New("invalid issuer")
+	}
+	if len(policy.Audience) > 0 && !slices.ContainsFunc(policy.Audience, func(aud string) bool { return claims.Contains("aud", aud) }) {
+		return errors.New("invalid audience")
+	}
+	for _, rule := range policy.Claims {
+		if _, ok := claims[rule.Name]; !ok {
+			return &claimRuleError{name: rule.Name}
+		}
+		if len(rule.Values) > 0 && !slices.ContainsFunc(rule.Values, func(v string) bool { return claims.Contains(rule.Name, v) }) {
+			return &claimRuleError{name: rule.Name}
+		}
+	}
+	return nil
+}
+
+// tokenErrorDescription returns description of verification error, without details of the token
+func tokenErrorDescription(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrExpired):
+		return "token expired"
+	case errors.Is(err, jwt.ErrMalformed):
+		return "malformed token"
+	default:
+		return "invalid token signature"
+	}
+}
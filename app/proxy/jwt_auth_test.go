@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/jwt"
+)
+
+func TestHttp_jwtAuthHandler(t *testing.T) {
+	tokens := map[string]jwt.Claims{
+		"admin": {"sub": "user1", "iss": "https://idp.example.com", "aud": []any{"api", "web"}, "role": "admin",
+			"email": "user1@example.com", "groups": []any{"dev", "ops"}},
+		"viewer":    {"sub": "user2", "iss": "https://idp.example.com", "aud": "api", "role": "viewer"},
+		"other-iss": {"sub": "user3", "iss": "https://other.example.com", "aud": "api", "role": "admin"},
+		"other-aud": {"sub": "user4", "iss": "https://idp.example.com", "aud": "mobile", "role": "admin"},
+	}
+	verifier := tokenVerifierFunc(func(token string) (jwt.Claims, error) {
+		switch token {
+		case "expired":
+			return nil, jwt.ErrExpired
+		case "garbage":
+			return nil, jwt.ErrMalformed
+		}
+		if c, ok := tokens[token]; ok {
+			return c, nil
+		}
+		return nil, jwt.ErrSignature
+	})
+
+	policy, err := discovery.ParseJWT("iss=https://idp.example.com, aud=api, claim=role:admin editor," +
+		" forward=sub:X-User email:X-Email groups:X-Groups")
+	require.NoError(t, err)
+
+	h := Http{Reporter: &ErrorReporter{}, TokenVerifier: verifier}
+	handler := h.jwtAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-User", r.Header.Get("X-User"))
+		w.Header().Set("X-Got-Email", r.Header.Get("X-Email"))
+		w.Header().Set("X-Got-Groups", r.Header.Get("X-Groups"))
+		if claims, ok := r.Context().Value(ctxJWTClaims).(jwt.Claims); ok {
+			w.Header().Set("X-Got-Claims-Sub", claims.String("sub"))
+		}
+		_, _ = w.Write([]byte("passed"))
+	}))
+
+	tbl := []struct {
+		name   string
+		auth   string
+		code   int
+		authHd string
+	}{
+		{name: "valid", auth: "Bearer admin", code: http.StatusOK},
+		{name: "no token", code: http.StatusUnauthorized, authHd: `Bearer realm="reproxy"`},
+		{name: "basic auth", auth: "Basic dXNlcjpwYXNz", code: http.StatusUnauthorized, authHd: `Bearer realm="reproxy"`},
+		{name: "bad signature", auth: "Bearer forged", code: http.StatusUnauthorized,
+			authHd: `Bearer realm="reproxy", error="invalid_token", error_description="invalid token signature"`},
+		{name: "expired", auth: "Bearer expired", code: http.StatusUnauthorized,
+			authHd: `Bearer realm="reproxy", error="invalid_token", error_description="token expired"`},
+		{name: "malformed", auth: "Bearer garbage", code: http.StatusUnauthorized,
+			authHd: `Bearer realm="reproxy", error="invalid_token", error_description="malformed token"`},
+		{name: "other issuer", auth: "Bearer other-iss", code: http.StatusUnauthorized,
+			authHd: `Bearer realm="reproxy", error="invalid_token", error_description="invalid issuer"`},
+		{name: "other audience", auth: "Bearer other-aud", code: http.StatusUnauthorized,
+			authHd: `Bearer realm="reproxy", error="invalid_token", error_description="invalid audience"`},
+		{name: "required claim not allowed", auth: "Bearer viewer", code: http.StatusForbidden,
+			authHd: `Bearer realm="reproxy", error="insufficient_scope", ` +
+				`error_description="required claim role missing or not allowed"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/api/v1", http.NoBody)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			req.Header.Set("X-User", "spoofed")
+			m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"), JWT: policy}}
+			req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, req)
+			assert.Equal(t, tt.code, wr.Code)
+			assert.Equal(t, tt.authHd, wr.Header().Get("WWW-Authenticate"))
+			if tt.code != http.StatusOK {
+				assert.NotEqual(t, "passed", wr.Body.String())
+				return
+			}
+			assert.Equal(t, "passed", wr.Body.String())
+			assert.Equal(t, "user1", wr.Header().Get("X-Got-User"))
+			assert.Equal(t, "user1@example.com", wr.Header().Get("X-Got-Email"))
+			assert.Equal(t, "dev,ops", wr.Header().Get("X-Got-Groups"))
+			assert.Equal(t, "user1", wr.Header().Get("X-Got-Claims-Sub"), "verified claims in context")
+		})
+	}
+
+	t.Run("route without policy", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/open", http.NoBody)
+		req.Header.Set("X-User", "client-value")
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/open")}}
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "client-value", wr.Header().Get("X-Got-User"))
+	})
+
+	t.Run("forwarded header dropped if claim missing", func(t *testing.T) {
+		tokens["no-email"] = jwt.Claims{"sub": "user5", "iss": "https://idp.example.com", "aud": "api", "role": "editor"}
+		req := httptest.NewRequest("GET", "http://example.com/api/v1", http.NoBody)
+		req.Header.Set("Authorization", "Bearer no-email")
+		req.Header.Set("X-Email", "spoofed@example.com")
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"), JWT: policy}}
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "user5", wr.Header().Get("X-Got-User"))
+		assert.Empty(t, wr.Header().Get("X-Got-Email"))
+	})
+
+	t.Run("no verifier", func(t *testing.T) {
+		hh := Http{Reporter: &ErrorReporter{}}
+		req := httptest.NewRequest("GET", "http://example.com/api/v1", http.NoBody)
+		req.Header.Set("Authorization", "Bearer admin")
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"),
+			JWT: discovery.JWTPolicy{Enabled: true}}}
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+		wr := httptest.NewRecorder()
+		hh.jwtAuthHandler(http.NotFoundHandler()).ServeHTTP(wr, req)
+		assert.Equal(t, http.StatusUnauthorized, wr.Code)
+	})
+}
+
+func TestHttp_jwtAuthWithVerifier(t *testing.T) {
+	// token signed with "secret", {"alg":"HS256","typ":"JWT"} {"sub":"user1","aud":"api"}
+	token := "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOiJ1c2VyMSIsImF1ZCI6ImFwaSJ9." +
+		"CKDJnJttU8HB_Pomjafmxf4dtShcngfqWrX2uDSyHY8"
+	h := Http{Reporter: &ErrorReporter{}, TokenVerifier: &jwt.Verifier{Secret: []byte("secret")}}
+	handler := h.jwtAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-User")))
+	}))
+	m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/api/(.*)"),
+		JWT: discovery.JWTPolicy{Enabled: true, Audience: []string{"api"},
+			Forward: []discovery.JWTForwardedClaim{{Claim: "sub", Header: "X-User"}}}}}
+
+	req := httptest.NewRequest("GET", "http://example.com/api/v1", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+token)
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, req.WithContext(context.WithValue(req.Context(), ctxMatch, m)))
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "user1", wr.Body.String())
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/rest/logger"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// logPolicyHandler applies per-route access log policy of the matched route to the log middleware made by mk.
+// Disabled and sampled out requests skip logging. With errors-only or slow filters the record is
+// buffered and written to wr only if the response matched a filter (or got sampled).
+func logPolicyHandler(wr io.Writer, mk func(wr io.Writer) func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		direct := mk(wr)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+			if !ok || match.Mapper.AccessLog == (discovery.AccessLogPolicy{}) {
+				direct.ServeHTTP(w, r)
+				return
+			}
+
+			policy := match.Mapper.AccessLog
+			if policy.Disabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !policy.ErrorsOnly && policy.Slow == 0 { // sampling only, decided before the request
+				if !sampled(policy.SampleRate) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				direct.ServeHTTP(w, r)
+				return
+			}
+
+			buf := bytes.Buffer{}
+			lw := &logResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			st := time.Now()
+			mk(&buf)(next).ServeHTTP(lw, r)
+			if !keepLogRecord(policy, lw.status, time.Since(st)) {
+				return
+			}
+			if _, err := wr.Write(buf.Bytes()); err != nil {
+				log.Printf("[WARN] can't write access log record, %v", err)
+			}
+		})
+	}
+}
+
+// keepLogRecord checks if the request with given status and duration should be logged by errors-only and slow
+// filters of the policy. Requests not matching any filter are logged only if sampling defined.
+func keepLogRecord(policy discovery.AccessLogPolicy, status int, duration time.Duration) bool {
+	if policy.ErrorsOnly && status >= http.StatusBadRequest {
+		return true
+	}
+	if policy.Slow > 0 && duration >= policy.Slow {
+		return true
+	}
+	return policy.SampleRate > 0 && sampled(policy.SampleRate)
+}
+
+// sampled returns true for the given ratio of calls, ratio 0 or >=1 means always
+func sampled(ratio float64) bool {
+	if ratio <= 0 || ratio >= 1 {
+		return true
+	}
+	return rand.Float64() < ratio //nolint:gosec // no need for crypto rand for sampling
+}
+
+// stdoutRecordHandler makes rest logger middleware writing minimal request info to wr
+func stdoutRecordHandler(wr io.Writer) func(next http.Handler) http.Handler {
+	lf := log.Func(func(format string, args ...any) {
+		if len(args) > 0 {
+			format = fmt.Sprintf(format, args...)
+		}
+		_, _ = io.WriteString(wr, format+"\n")
+	})
+	return logger.New(logger.Log(lf), logger.Prefix("[INFO]")).Handler
+}
+
+// stdoutWriter writes records to the default logger, line by line
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	for line := range strings.SplitSeq(strings.TrimSuffix(string(p), "\n"), "\n") {
+		log.Printf("%s", line)
+	}
+	return len(p), nil
+}
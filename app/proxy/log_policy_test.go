@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func Test_logPolicyHandler(t *testing.T) {
+	tbl := []struct {
+		name   string
+		policy *discovery.AccessLogPolicy // nil for unmatched request
+		status int
+		delay  time.Duration
+		logged bool
+	}{
+		{name: "unmatched", status: http.StatusOK, logged: true},
+		{name: "no policy", policy: &discovery.AccessLogPolicy{}, status: http.StatusOK, logged: true},
+		{name: "disabled", policy: &discovery.AccessLogPolicy{Disabled: true}, status: http.StatusInternalServerError},
+		{name: "disabled with filters", policy: &discovery.AccessLogPolicy{Disabled: true, ErrorsOnly: true},
+			status: http.StatusInternalServerError},
+		{name: "errors only, ok", policy: &discovery.AccessLogPolicy{ErrorsOnly: true}, status: http.StatusOK},
+		{name: "errors only, not found", policy: &discovery.AccessLogPolicy{ErrorsOnly: true},
+			status: http.StatusNotFound, logged: true},
+		{name: "slow, fast request", policy: &discovery.AccessLogPolicy{Slow: time.Second}, status: http.StatusOK},
+		{name: "slow, slow request", policy: &discovery.AccessLogPolicy{Slow: 10 * time.Millisecond},
+			status: http.StatusOK, delay: 20 * time.Millisecond, logged: true},
+		{name: "errors or slow, slow request", policy: &discovery.AccessLogPolicy{ErrorsOnly: true, Slow: 10 * time.Millisecond},
+			status: http.StatusOK, delay: 20 * time.Millisecond, logged: true},
+		{name: "sample all", policy: &discovery.AccessLogPolicy{SampleRate: 1}, status: http.StatusOK, logged: true},
+		{name: "errors only, sample all", policy: &discovery.AccessLogPolicy{ErrorsOnly: true, SampleRate: 1},
+			status: http.StatusOK, logged: true},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			handled := false
+			h := logPolicyHandler(&buf, combinedLogHandler)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handled = true
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte("response"))
+			}))
+
+			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+			if tt.policy != nil {
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{
+					Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/foo"), AccessLog: *tt.policy}}))
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			assert.True(t, handled)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, "response", rr.Body.String())
+			if !tt.logged {
+				assert.Empty(t, buf.String())
+				return
+			}
+			assert.Contains(t, buf.String(), `"GET http://example.com/foo HTTP/1.1" `+strconv.Itoa(tt.status)+" 8")
+		})
+	}
+}
+
+func Test_sampled(t *testing.T) {
+	assert.True(t, sampled(0))
+	assert.True(t, sampled(1))
+
+	count := 0
+	for range 10000 {
+		if sampled(0.2) {
+			count++
+		}
+	}
+	assert.InDelta(t, 2000, count, 300)
+}
+
+func Test_stdoutRecordHandler(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := stdoutRecordHandler(&buf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo?k=v", http.NoBody))
+	assert.True(t, strings.HasPrefix(buf.String(), "[INFO] GET - http://example.com/foo?k=v - example.com - "), buf.String())
+	assert.Contains(t, buf.String(), " - 418 (0) - ")
+	assert.True(t, strings.HasSuffix(buf.String(), "\n"))
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func Test_stdoutLogHandler(t *testing.T) {
+	var records []string
+	mk := func(wr io.Writer) func(next http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				records = append(records, r.URL.Path)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := stdoutLogHandler(true, mk)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, path := range []string{"/foo", "/svc/ping", "/bar"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, http.NoBody))
+	}
+	req := httptest.NewRequest("GET", "/quiet", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{
+		Mapper: discovery.URLMapper{AccessLog: discovery.AccessLogPolicy{Disabled: true}}}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, []string{"/foo", "/bar"}, records, "ping and disabled routes not logged")
+
+	called := false
+	h = stdoutLogHandler(false, mk)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", http.NoBody))
+	assert.True(t, called)
+	require.Len(t, records, 2, "nothing logged with stdout disabled")
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/maintenance"
+)
+
+// MaintenanceMatcher returns maintenance entry applied to the request with given host, matched server and route
+type MaintenanceMatcher interface {
+	Match(host, server, route string) (maintenance.Entry, bool)
+}
+
+// maintenanceHandler rejects requests of routes, servers or all requests in maintenance with 503 and Retry-After.
+// Requests from allowed ips or with bypass cookie of the entry passed through.
+func (h *Http) maintenanceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Maintenance == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.URL.Hostname()
+		if host == "" {
+			host = strings.Split(r.Host, ":")[0] // drop port
+		}
+		server, route := "", ""
+		if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok {
+			server, route = match.Mapper.Server, match.Mapper.SrcMatch.String()
+		}
+
+		entry, ok := h.Maintenance.Match(host, server, route)
+		if !ok || entry.Bypass(r, realIPFromRequest(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Printf("[DEBUG] %s maintenance for %s%s", entry.Scope(), host, r.URL.Path)
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, entry.RetryAfter)))
+		w.Header().Set("Cache-Control", "no-store")
+		reportError(w, r, h.Reporter, http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/maintenance"
+)
+
+func TestHttp_maintenanceHandler(t *testing.T) {
+	store, err := maintenance.NewStore("")
+	require.NoError(t, err)
+	_, err = store.Enable(maintenance.Entry{Server: "app.example.com", Route: "^/api/(.*)", RetryAfter: 120,
+		AllowedIPs: []string{"10.0.0.0/8"}, BypassCookie: "mnt=secret"})
+	require.NoError(t, err)
+	_, err = store.Enable(maintenance.Entry{Server: "down.example.com"})
+	require.NoError(t, err)
+
+	h := Http{Maintenance: store, Reporter: &ErrorReporter{Nice: true}}
+	handler := h.maintenanceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		name     string
+		url      string
+		route    string // matched route, empty for unmatched request
+		remote   string
+		cookie   string
+		code     int
+		retryAft string
+	}{
+		{name: "route in maintenance", url: "http://app.example.com/api/users", route: "^/api/(.*)",
+			remote: "192.168.1.1", code: http.StatusServiceUnavailable, retryAft: "120"},
+		{name: "other route", url: "http://app.example.com/web/index.html", route: "^/web/(.*)",
+			remote: "192.168.1.1", code: http.StatusOK},
+		{name: "allowed ip", url: "http://app.example.com/api/users", route: "^/api/(.*)",
+			remote: "10.1.1.1", code: http.StatusOK},
+		{name: "bypass cookie", url: "http://app.example.com/api/users", route: "^/api/(.*)",
+			remote: "192.168.1.1", cookie: "mnt=secret", code: http.StatusOK},
+		{name: "wrong bypass cookie", url: "http://app.example.com/api/users", route: "^/api/(.*)",
+			remote: "192.168.1.1", cookie: "mnt=bad", code: http.StatusServiceUnavailable, retryAft: "120"},
+		{name: "server in maintenance", url: "http://down.example.com:8080/any", route: "^/(.*)",
+			remote: "10.1.1.1", code: http.StatusServiceUnavailable, retryAft: "60"},
+		{name: "unmatched request of server in maintenance", url: "http://down.example.com/any",
+			remote: "10.1.1.1", code: http.StatusServiceUnavailable, retryAft: "60"},
+		{name: "other server", url: "http://other.example.com/api/users", route: "^/api/(.*)",
+			remote: "192.168.1.1", code: http.StatusOK},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, http.NoBody)
+			req.RemoteAddr = tt.remote + ":12345"
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", tt.cookie)
+			}
+			if tt.route != "" {
+				match := discovery.MatchedRoute{Mapper: discovery.URLMapper{Server: req.URL.Hostname(),
+					SrcMatch: *regexp.MustCompile(tt.route)}}
+				req = req.WithContext(context.WithValue(req.Context(), ctxMatch, match))
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.code, rr.Code)
+			if tt.code != http.StatusServiceUnavailable {
+				assert.Equal(t, "ok", rr.Body.String())
+				return
+			}
+			assert.Equal(t, tt.retryAft, rr.Header().Get("Retry-After"))
+			assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+			assert.Contains(t, rr.Body.String(), "We&rsquo;ll be back soon!")
+		})
+	}
+}
+
+func TestHttp_maintenanceHandlerDisabled(t *testing.T) {
+	h := Http{}
+	handler := h.maintenanceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/api", http.NoBody))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ok", rr.Body.String())
+}
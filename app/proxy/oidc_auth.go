@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/oidc"
+)
+
+// OIDCProvider makes oidc login and keeps sessions of logged-in users
+type OIDCProvider interface {
+	IsCallback(r *http.Request) bool
+	Session(r *http.Request) (oidc.Session, bool)
+	Login(w http.ResponseWriter, r *http.Request) error
+	Callback(w http.ResponseWriter, r *http.Request) error
+}
+
+// identity headers set for upstream of routes with oidc policy, the same as oauth2-proxy sets
+const (
+	oidcUserHeader   = "X-Forwarded-User"
+	oidcEmailHeader  = "X-Forwarded-Email"
+	oidcGroupsHeader = "X-Forwarded-Groups"
+)
+
+// oidcHandler protects routes with oidc policy. Requests without session redirected to the provider's login,
+// except non-GET requests rejected with 401 as they can't be replayed after the login. Callback from the provider
+// handled on unmatched routes and routes with oidc policy. Users not allowed by the policy rejected with 403.
+// Identity of the user passed upstream in X-Forwarded-User, X-Forwarded-Email and X-Forwarded-Groups headers.
+func (h *Http) oidcHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match, matched := r.Context().Value(ctxMatch).(discovery.MatchedRoute)
+		if h.OIDC != nil && (!matched || match.Mapper.OIDC.Enabled) && h.OIDC.IsCallback(r) {
+			h.oidcCallback(w, r)
+			return
+		}
+		if !matched || !match.Mapper.OIDC.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, hdr := range []string{oidcUserHeader, oidcEmailHeader, oidcGroupsHeader} {
+			r.Header.Del(hdr) // don't trust client's identity headers
+		}
+		if h.OIDC == nil {
+			log.Printf("[WARN] oidc login required for %s, but oidc provider not configured", r.URL.Path)
+			reportError(w, r, h.Reporter, http.StatusInternalServerError)
+			return
+		}
+
+		sess, ok := h.OIDC.Session(r)
+		if !ok {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				reportError(w, r, h.Reporter, http.StatusUnauthorized)
+				return
+			}
+			if err := h.OIDC.Login(w, r); err != nil {
+				log.Printf("[WARN] can't start oidc login, %v", err)
+				reportError(w, r, h.Reporter, http.StatusBadGateway)
+			}
+			return
+		}
+
+		if !match.Mapper.OIDC.Allow(sess.User, sess.Email, sess.Groups) {
+			log.Printf("[INFO] oidc user %q (%s) not allowed on %s", sess.User, sess.Email, r.URL.Path)
+			reportError(w, r, h.Reporter, http.StatusForbidden)
+			return
+		}
+		r.Header.Set(oidcUserHeader, sess.User)
+		if sess.Email != "" {
+			r.Header.Set(oidcEmailHeader, sess.Email)
+		}
+		if len(sess.Groups) > 0 {
+			r.Header.Set(oidcGroupsHeader, strings.Join(sess.Groups, ","))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// oidcCallback completes the login, provider failures reported with 502, invalid callbacks with 401
+func (h *Http) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	err := h.OIDC.Callback(w, r)
+	switch {
+	case err == nil:
+	case errors.Is(err, oidc.ErrProvider):
+		log.Printf("[WARN] oidc callback failed, %v", err)
+		reportError(w, r, h.Reporter, http.StatusBadGateway)
+	default:
+		log.Printf("[INFO] oidc callback rejected, %v", err)
+		reportError(w, r, h.Reporter, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/oidc"
+	"github.com/umputun/reproxy/app/oidc/oidctest"
+)
+
+func TestHttp_oidcHandler(t *testing.T) {
+	idp := oidctest.NewIDP(t, oidctest.Claims(map[string]any{"preferred_username": "alice", "email": "alice@example.com",
+		"groups": []any{"dev", "ops"}}))
+	client, err := oidc.NewClient(oidc.Config{Issuer: idp.URL(), ClientID: idp.ClientID, ClientSecret: idp.ClientSecret,
+		Scopes: []string{"openid", "email"}, CallbackPath: "/oauth2/callback", CookieName: "sess",
+		CookieSecret: "0123456789abcdef0123456789abcdef", SessionTTL: time.Hour, GroupsClaim: "groups"})
+	require.NoError(t, err)
+
+	h := Http{Reporter: &ErrorReporter{}, OIDC: client}
+	handler := h.oidcHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-User", r.Header.Get("X-Forwarded-User"))
+		w.Header().Set("X-Got-Email", r.Header.Get("X-Forwarded-Email"))
+		w.Header().Set("X-Got-Groups", r.Header.Get("X-Forwarded-Groups"))
+		_, _ = w.Write([]byte("passed"))
+	}))
+
+	makeReq := func(method, target string, policy *discovery.OIDCPolicy, cookies ...*http.Cookie) *http.Request {
+		req := httptest.NewRequest(method, target, http.NoBody)
+		req.Header.Set("X-Forwarded-User", "spoofed")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if policy == nil {
+			return req
+		}
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/(.*)"), OIDC: *policy}}
+		return req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+	}
+	anyUser := &discovery.OIDCPolicy{Enabled: true}
+
+	// login and get session cookie
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, makeReq("GET", "http://app.example.com/docs?p=1", anyUser))
+	require.Equal(t, http.StatusFound, wr.Code)
+	state := wr.Result().Cookies()[0]
+	callback := idp.Authorize(wr.Header().Get("Location"))
+	wr = httptest.NewRecorder()
+	handler.ServeHTTP(wr, makeReq("GET", callback, nil, state)) // callback path not matched by routes
+	require.Equal(t, http.StatusFound, wr.Code)
+	assert.Equal(t, "/docs?p=1", wr.Header().Get("Location"))
+	var session *http.Cookie
+	for _, c := range wr.Result().Cookies() {
+		if c.Name == "sess" {
+			session = c
+		}
+	}
+	require.NotNil(t, session)
+
+	t.Run("session allowed", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("POST", "http://app.example.com/docs", anyUser, session))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "passed", wr.Body.String())
+		assert.Equal(t, "alice", wr.Header().Get("X-Got-User"))
+		assert.Equal(t, "alice@example.com", wr.Header().Get("X-Got-Email"))
+		assert.Equal(t, "dev,ops", wr.Header().Get("X-Got-Groups"))
+	})
+
+	t.Run("allowed by group", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("GET", "http://app.example.com/", &discovery.OIDCPolicy{Enabled: true,
+			Users: []string{"bob"}, Groups: []string{"ops"}}, session))
+		assert.Equal(t, http.StatusOK, wr.Code)
+	})
+
+	t.Run("user not allowed", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("GET", "http://app.example.com/", &discovery.OIDCPolicy{Enabled: true,
+			Emails: []string{"@corp.example.com"}}, session))
+		assert.Equal(t, http.StatusForbidden, wr.Code)
+		assert.NotContains(t, wr.Body.String(), "passed")
+	})
+
+	t.Run("no session on post", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("POST", "http://app.example.com/docs", anyUser))
+		assert.Equal(t, http.StatusUnauthorized, wr.Code)
+	})
+
+	t.Run("invalid callback", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("GET", "http://app.example.com/oauth2/callback?code=1&state=2", anyUser))
+		assert.Equal(t, http.StatusUnauthorized, wr.Code)
+	})
+
+	t.Run("callback path of route without oidc", func(t *testing.T) {
+		wr := httptest.NewRecorder()
+		handler.ServeHTTP(wr, makeReq("GET", "http://app.example.com/oauth2/callback?code=1", &discovery.OIDCPolicy{}))
+		assert.Equal(t, http.StatusOK, wr.Code)
+		assert.Equal(t, "spoofed", wr.Header().Get("X-Got-User"), "headers of routes without oidc not changed")
+	})
+
+	t.Run("no provider", func(t *testing.T) {
+		noProvider := Http{Reporter: &ErrorReporter{}}
+		wr := httptest.NewRecorder()
+		noProvider.oidcHandler(http.NotFoundHandler()).ServeHTTP(wr, makeReq("GET", "http://app.example.com/", anyUser, session))
+		assert.Equal(t, http.StatusInternalServerError, wr.Code)
+	})
+
+	t.Run("provider down", func(t *testing.T) {
+		down, err := oidc.NewClient(oidc.Config{Issuer: "http://127.0.0.1:1", ClientID: "id", CallbackPath: "/oauth2/callback",
+			CookieName: "sess", CookieSecret: "0123456789abcdef"})
+		require.NoError(t, err)
+		h := Http{Reporter: &ErrorReporter{}, OIDC: down}
+		wr := httptest.NewRecorder()
+		h.oidcHandler(http.NotFoundHandler()).ServeHTTP(wr, makeReq("GET", "http://app.example.com/", anyUser))
+		assert.Equal(t, http.StatusBadGateway, wr.Code)
+	})
+}
@@ -24,6 +24,8 @@ const (
 	OFRemoteAddr OFLookup = "remote-addr"
 	OFRealIP     OFLookup = "real-ip"
 	OFForwarded  OFLookup = "forwarded"
+	// OFForwardedRFC is standard RFC 7239 Forwarded header, unlike OFForwarded using X-Forwarded-For
+	OFForwardedRFC OFLookup = "forwarded-rfc"
 )
 
 // NewOnlyFrom creates OnlyFrom middleware with given lookup methods.
@@ -46,7 +48,10 @@ func (o *OnlyFrom) Handler(next http.Handler) http.Handler {
 			return
 		}
 
-		realIP := o.realIP(o.lookups, r)
+		realIP, ok := reqCtx.Value(ctxRealIP).(string) // resolved by RealIP middleware
+		if !ok {
+			realIP = o.realIP(o.lookups, r)
+		}
 		if realIP != "" && o.matchRemoteIP(realIP, allowedIPs) {
 			next.ServeHTTP(w, r)
 			return
@@ -82,6 +87,12 @@ func (o *OnlyFrom) realIP(ipLookups []OFLookup, r *http.Request) string {
 		if lookup == OFRealIP && realIP != "" {
 			return realIP
 		}
+
+		if lookup == OFForwardedRFC {
+			if nodes := parseForwardedFor(r.Header.Values("Forwarded")); len(nodes) > 0 {
+				return preferPublicIP(nodes)
+			}
+		}
 	}
 
 	return "" // we can't get real ip
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -19,10 +20,10 @@ import (
 
 	log "github.com/go-pkgz/lgr"
 	R "github.com/go-pkgz/rest"
-	"github.com/go-pkgz/rest/logger"
 
 	"github.com/umputun/reproxy/app/discovery"
 	"github.com/umputun/reproxy/app/plugin"
+	"github.com/umputun/reproxy/app/tracing"
 )
 
 // Http is a proxy server for both http and https
@@ -41,6 +42,7 @@ type Http struct { // nolint golint
 	Insecure         bool
 	Version          string
 	AccessLog        io.Writer
+	AccessLogFormat  string // combined (default), json or logfmt
 	StdOutEnabled    bool
 	Signature        bool
 	Timeouts         Timeouts
@@ -48,13 +50,33 @@ type Http struct { // nolint golint
 	Metrics          MiddlewareProvider
 	PluginConductor  MiddlewareProvider
 	Reporter         Reporter
+	ErrorIntercept   bool // replace bodies of upstream 5xx responses and proxy errors with reporter's error page
 	LBSelector       LBSelector
 	OnlyFrom         *OnlyFrom
+	RealIP           *RealIP
+	ForwardedHeader  bool
+	RequestIDHeader  string // request id header, empty disables request id
+	RequestIDTrust   bool   // accept incoming request id
+	Tracer           *tracing.Tracer
 	BasicAuthEnabled bool
 	BasicAuthAllowed []string
+	BasicAuthFile    Htpasswd            // global htpasswd file, used instead of BasicAuthAllowed if set
+	HtpasswdFiles    map[string]Htpasswd // named htpasswd files referenced by routes' auth file
 
-	ThrottleSystem int
-	ThrottleUser   int
+	ThrottleSystem    int
+	ThrottleUser      int
+	ThrottleOverrides map[string]discovery.RateLimit // per-key limits of per-route throttle, key is ip, header, cookie, user or claim value
+	TokenVerifier     TokenVerifier                  // validates bearer tokens for jwt auth, nil rejects all tokens
+	OIDC              OIDCProvider                   // oidc login of routes with oidc policy, nil rejects such routes
+	APIKeys           APIKeyStore                    // api keys of routes with api key policy, nil rejects such routes
+	GeoIP             GeoIP                          // country and asn of client ip, nil rejects routes with geoip policy
+	GeoIPHeader       string                         // request header with client's country passed upstream, empty = not set
+	WAF               WAF                            // request filtering rules, nil disables filtering
+	WAFTagHeader      string                         // request header with tags of matched waf log rules, empty = not set
+
+	Maintenance MaintenanceMatcher // maintenance mode state, nil disables maintenance checks
+
+	SecurityHeaders discovery.SecurityHeaders // global security headers policy, routes can change it
 
 	KeepHost bool
 
@@ -80,7 +102,12 @@ type MiddlewareProvider interface {
 
 // Reporter defines error reporting service
 type Reporter interface {
-	Report(w http.ResponseWriter, code int)
+	Report(w http.ResponseWriter, r *http.Request, code int)
+}
+
+// Htpasswd checks user's password against users of htpasswd file
+type Htpasswd interface {
+	Match(user, password string) bool
 }
 
 // LBSelector defines load balancer strategy
@@ -135,23 +162,40 @@ func (h *Http) Run(ctx context.Context) error {
 
 	handler := R.Wrap(h.proxyHandler(),
 		R.Recoverer(log.Default()),                   // recover on errors
+		h.RealIP.Handler,                             // resolve client ip, respecting trusted proxies
+		h.requestIDHandler,                           // set request id to context, request and response headers
+		h.traceHandler,                               // make server span for the request
 		signatureHandler(h.Signature, h.Version),     // send app signature
 		h.pingHandler,                                // respond to /ping
 		h.healthMiddleware,                           // respond to /health
+		h.canonicalHandler,                           // redirect to canonical host and path
 		h.matchHandler,                               // set matched routes to context
+		h.securityHeadersHandler,                     // add security response headers
+		corsHandler,                                  // answer cors preflight and set cors headers of the route
+		h.maintenanceHandler,                         // reject requests in maintenance mode
 		routeTimeoutHandler,                          // apply per-route request deadline if set on matched mapper
 		h.OnlyFrom.Handler,                           // limit source (remote) IPs if defined
-		perRouteAuthHandler,                          // per-route basic auth (if route has auth configured)
+		h.geoIPHandler,                               // resolve client's country, limit countries and asn if defined
+		h.wafHandler(),                               // check request filtering rules
+		h.forwardAuthHandler(),                       // check request with external auth service
+		h.oidcHandler,                                // oidc login and session check of routes with oidc policy
+		h.apiKeyHandler,                              // check api key of routes with api key policy
+		h.jwtAuthHandler,                             // validate bearer token of routes with jwt policy
+		h.perRouteAuthHandler,                        // per-route basic auth (if route has auth configured)
 		h.basicAuthHandler(),                         // global basic auth (skipped if per-route auth is set)
 		limiterSystemHandler(h.ThrottleSystem),       // limit total requests/sec
-		limiterUserHandler(h.ThrottleUser),           // req/seq per user/route match
+		h.limiterUserHandler(),                       // req/seq per user/route match
+		h.concurrencyHandler(),                       // limit concurrent requests per route
 		h.mgmtHandler(),                              // handles /metrics and /routes for prometheus
 		h.pluginHandler(),                            // prc to external plugins
 		headersHandler(h.ProxyHeaders, h.DropHeader), // add response headers and delete some request headers
-		accessLogHandler(h.AccessLog),                // apache-format log file
-		stdoutLogHandler(h.StdOutEnabled, logger.New(logger.Log(log.Default()), logger.Prefix("[INFO]")).Handler),
-		maxReqSizeHandler(h.MaxBodySize), // limit request max size
-		gzipHandler(h.GzEnabled),         // gzip response
+		h.accessLogHandler(),                         // access log file
+		stdoutLogHandler(h.StdOutEnabled, func(wr io.Writer) func(next http.Handler) http.Handler {
+			return h.logHandler(stdoutRecordHandler(wr))
+		}),
+		maxReqSizeHandler(h.MaxBodySize, h.Reporter), // limit request max size
+		h.bandwidthHandler(),                         // pace responses of routes with bandwidth limit
+		gzipHandler(h.GzEnabled),                     // gzip response
 	)
 
 	// no FQDNs defined, use the list of discovered servers
@@ -235,8 +279,27 @@ const (
 	ctxMatchType = contextKey("type")
 	ctxMatch     = contextKey("match")
 	ctxKeepHost  = contextKey("keepHost")
+	ctxRealIP    = contextKey("realIP")
+	ctxRequestID = contextKey("requestID")
+	ctxUpstream  = contextKey("upstream")
+	ctxOrigReq   = contextKey("origRequest")
+	ctxCountry   = contextKey("country")
+	ctxWAFTags   = contextKey("wafTags")
+	ctxJWTClaims = contextKey("jwtClaims")
+	ctxAuthUser  = contextKey("authUser")
+	ctxScheme    = contextKey("scheme")
 )
 
+// upstreamStatusError returned by ModifyResponse for intercepted upstream responses, handled by ErrorHandler
+type upstreamStatusError struct {
+	code       int
+	retryAfter string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with status %d", e.code)
+}
+
 func (h *Http) proxyHandler() http.HandlerFunc {
 
 	reverseProxy := &httputil.ReverseProxy{
@@ -244,6 +307,7 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 			ctx := r.Context()
 			uu := ctx.Value(ctxURL).(*url.URL)
 			keepHost := ctx.Value(ctxKeepHost).(bool)
+			origHost := r.Host
 			r.Header.Add("X-Forwarded-Host", r.Host)
 			scheme := "http"
 			if h.SSLConfig.SSLMode == SSLAuto || h.SSLConfig.SSLMode == SSLStatic {
@@ -261,20 +325,61 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 				log.Printf("[DEBUG] keep host %s", r.Host)
 			}
 			h.setXRealIP(r)
+			if h.ForwardedHeader {
+				setForwarded(r, origHost, scheme)
+			}
+		},
+		Transport: upstreamRecorder{base: &tracing.Transport{
+			Base: &http.Transport{
+				ResponseHeaderTimeout: h.Timeouts.ResponseHeader,
+				DialContext: (&net.Dialer{
+					Timeout:   h.Timeouts.Dial,
+					KeepAlive: h.Timeouts.KeepAlive,
+				}).DialContext,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          h.UpstreamMaxIdleConns,
+				MaxConnsPerHost:       h.UpstreamMaxConnsPerHost,
+				IdleConnTimeout:       h.Timeouts.IdleConn,
+				TLSHandshakeTimeout:   h.Timeouts.TLSHandshake,
+				ExpectContinueTimeout: h.Timeouts.ExpectContinue,
+				TLSClientConfig:       &tls.Config{InsecureSkipVerify: h.Insecure}, //nolint:gosec // g402: User defined option to disable verification for self-signed certificates
+			},
+			Tracer: h.Tracer,
+		}},
+		ModifyResponse: func(resp *http.Response) error {
+			if h.RequestIDHeader != "" {
+				resp.Header.Del(h.RequestIDHeader) // already set by requestIDHandler, prevent duplicates
+			}
+			if h.ErrorIntercept && resp.StatusCode >= 500 {
+				return &upstreamStatusError{code: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After")}
+			}
+			return nil
 		},
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: h.Timeouts.ResponseHeader,
-			DialContext: (&net.Dialer{
-				Timeout:   h.Timeouts.Dial,
-				KeepAlive: h.Timeouts.KeepAlive,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          h.UpstreamMaxIdleConns,
-			MaxConnsPerHost:       h.UpstreamMaxConnsPerHost,
-			IdleConnTimeout:       h.Timeouts.IdleConn,
-			TLSHandshakeTimeout:   h.Timeouts.TLSHandshake,
-			ExpectContinueTimeout: h.Timeouts.ExpectContinue,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: h.Insecure}, //nolint:gosec // g402: User defined option to disable verification for self-signed certificates
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// error page made for the incoming request, r is the outgoing one with destination's path and host
+			origReq, ok := r.Context().Value(ctxOrigReq).(*http.Request)
+			if !ok {
+				origReq = r
+			}
+			if maxErr := new(http.MaxBytesError); errors.As(err, &maxErr) {
+				log.Printf("[WARN] request body of %s exceeds %d bytes", r.URL.Path, maxErr.Limit)
+				reportError(w, origReq, h.Reporter, http.StatusRequestEntityTooLarge)
+				return
+			}
+			if usErr := new(upstreamStatusError); errors.As(err, &usErr) {
+				log.Printf("[DEBUG] upstream status %d for %s replaced by error page", usErr.code, origReq.URL.Path)
+				if usErr.retryAfter != "" {
+					w.Header().Set("Retry-After", usErr.retryAfter)
+				}
+				reportError(w, origReq, h.Reporter, usErr.code)
+				return
+			}
+			log.Printf("[WARN] http: proxy error: %v", err)
+			if h.ErrorIntercept {
+				reportError(w, origReq, h.Reporter, http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
 		},
 		ErrorLog: log.ToStdLogger(log.Default(), "WARN"),
 	}
@@ -288,7 +393,7 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 				return
 			}
 			log.Printf("[WARN] no match for %s %s", r.URL.Hostname(), r.URL.Path)
-			h.Reporter.Report(w, http.StatusBadGateway)
+			h.Reporter.Report(w, r, http.StatusBadGateway)
 			return
 		}
 
@@ -301,13 +406,11 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 			case discovery.RTNone:
 				uu := r.Context().Value(ctxURL).(*url.URL)
 				log.Printf("[DEBUG] proxy to %s", uu)
-				reverseProxy.ServeHTTP(w, r)
-			case discovery.RTPerm:
-				log.Printf("[DEBUG] redirect (301) to %s", match.Destination)
-				http.Redirect(w, r, match.Destination, http.StatusMovedPermanently)
-			case discovery.RTTemp:
-				log.Printf("[DEBUG] redirect (302) to %s", match.Destination)
-				http.Redirect(w, r, match.Destination, http.StatusFound)
+				reverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxOrigReq, r)))
+			default:
+				location := redirectLocation(r, match)
+				log.Printf("[DEBUG] redirect (%d) to %s", match.Mapper.RedirectType, location)
+				http.Redirect(w, r, location, int(match.Mapper.RedirectType))
 			}
 
 		case discovery.MTStatic:
@@ -315,13 +418,13 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 			ae := strings.Split(match.Destination, ":")
 			if len(ae) != 3 { // shouldn't happen
 				log.Printf("[WARN] unexpected static assets destination: %s", match.Destination)
-				h.Reporter.Report(w, http.StatusInternalServerError)
+				h.Reporter.Report(w, r, http.StatusInternalServerError)
 				return
 			}
 			fs, err := h.fileServer(ae[0], ae[1], ae[2] == "spa", nil)
 			if err != nil {
 				log.Printf("[WARN] file server error, %v", err)
-				h.Reporter.Report(w, http.StatusInternalServerError)
+				h.Reporter.Report(w, r, http.StatusInternalServerError)
 				return
 			}
 			h.CacheControl.Middleware(fs).ServeHTTP(w, r)
@@ -329,6 +432,32 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 	}
 }
 
+// redirectLocation makes location of the redirect from the matched destination. Host-level redirect uses
+// scheme and host of the route's destination with the request path. Query of the request appended
+// for RQKeep, RQDrop removes the query from the location.
+func redirectLocation(r *http.Request, match discovery.MatchedRoute) string {
+	location := match.Destination
+	if match.Mapper.RedirectHost {
+		if u, err := url.Parse(match.Mapper.Dst); err == nil {
+			location = u.Scheme + "://" + u.Host + r.URL.EscapedPath()
+		}
+	}
+
+	switch match.Mapper.RedirectQuery {
+	case discovery.RQKeep:
+		if r.URL.RawQuery != "" {
+			sep := "?"
+			if strings.Contains(location, "?") {
+				sep = "&"
+			}
+			location += sep + r.URL.RawQuery
+		}
+	case discovery.RQDrop:
+		location, _, _ = strings.Cut(location, "?")
+	}
+	return location
+}
+
 // matchHandler is a part of middleware chain. Matches incoming request to one or more matched rules
 // and if match found sets it to the request context. Context used by proxy handler as well as by plugin conductor
 func (h *Http) matchHandler(next http.Handler) http.Handler {
@@ -371,12 +500,13 @@ func (h *Http) matchHandler(next http.Handler) http.Handler {
 		ctx := context.WithValue(r.Context(), ctxMatch, match)        // set match info
 		ctx = context.WithValue(ctx, ctxMatchType, matches.MatchType) // set match type
 		ctx = context.WithValue(ctx, plugin.CtxMatch, match)          // set match info for plugin conductor
+		traceMatch(r, match)
 
 		if matches.MatchType == discovery.MTProxy {
 			uu, err := url.Parse(match.Destination)
 			if err != nil {
 				log.Printf("[WARN] can't parse destination %s, %v", match.Destination, err)
-				h.Reporter.Report(w, http.StatusBadGateway)
+				h.Reporter.Report(w, r, http.StatusBadGateway)
 				return
 			}
 			ctx = context.WithValue(ctx, ctxURL, uu) // set destination url in request's context
@@ -467,9 +597,35 @@ func (h *Http) basicAuthHandler() func(next http.Handler) http.Handler {
 	if !h.BasicAuthEnabled {
 		return passThroughHandler
 	}
+	if h.BasicAuthFile != nil {
+		return globalCredentialsHandler(h.BasicAuthFile.Match)
+	}
 	return globalBasicAuthHandler(h.BasicAuthAllowed)
 }
 
+// accessLogHandler makes access log middleware for the configured format and per-route policies.
+// Combined format sees the resolved client ip via logHandler, structured formats get it from the request context directly.
+func (h *Http) accessLogHandler() func(next http.Handler) http.Handler {
+	if h.AccessLogFormat == AccessLogJSON || h.AccessLogFormat == AccessLogLogfmt {
+		return logPolicyHandler(h.AccessLog, func(wr io.Writer) func(next http.Handler) http.Handler {
+			return structuredLogHandler(wr, h.AccessLogFormat)
+		})
+	}
+	return logPolicyHandler(h.AccessLog, func(wr io.Writer) func(next http.Handler) http.Handler {
+		return h.logHandler(combinedLogHandler(wr))
+	})
+}
+
+// logHandler makes logging middleware to see the resolved client ip if trusted proxies defined
+func (h *Http) logHandler(lh func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	if !h.RealIP.hasTrusted() {
+		return lh
+	}
+	return func(next http.Handler) http.Handler {
+		return logWithRealIP(lh, next)
+	}
+}
+
 func (h *Http) makeHTTPServer(addr string, router http.Handler) *http.Server {
 	return &http.Server{
 		Addr:              addr,
@@ -481,6 +637,12 @@ func (h *Http) makeHTTPServer(addr string, router http.Handler) *http.Server {
 }
 
 func (h *Http) setXRealIP(r *http.Request) {
+	if h.RealIP.hasTrusted() {
+		// client ip already resolved with trusted proxies taken into account
+		r.Header.Set("X-Real-IP", realIPFromRequest(r))
+		return
+	}
+
 	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
 		// use the left-most non-private client IP address
 		// if there is no any non-private IP address, use the left-most address
@@ -31,7 +31,7 @@ func TestHttp_Do(t *testing.T) {
 	port, releasePort := getFreePort(t)
 	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port),
 		AccessLog: io.Discard, Signature: true, ProxyHeaders: []string{"hh1:vv1", "hh2:vv2"}, StdOutEnabled: true,
-		Reporter: &ErrorReporter{Nice: true}}
+		Reporter: &ErrorReporter{Nice: true}, ForwardedHeader: true, RequestIDHeader: "X-Request-Id"}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -40,9 +40,12 @@ func TestHttp_Do(t *testing.T) {
 		w.Header().Add("h1", "v1")
 		assert.Equal(t, "127.0.0.1", r.Header.Get("X-Real-IP"))
 		assert.Equal(t, "127.0.0.1", r.Header.Get("X-Forwarded-For"))
+		assert.Contains(t, r.Header.Get("Forwarded"), "for=127.0.0.1;proto=http;host=")
+		assert.Len(t, r.Header.Get("X-Request-Id"), 32)
 		assert.Empty(t, r.Header.Get("X-Forwarded-Proto")) // ssl auto only
 		assert.Empty(t, r.Header.Get("X-Forwarded-Port"))
 		assert.NotEmpty(t, r.Header.Get("X-Forwarded-URL"), "X-Forwarded-URL header must be set")
+		w.Header().Set("X-Request-Id", "upstream-id") // replaced by reproxy's request id
 		fmt.Fprintf(w, "response %s", r.URL.String())
 	}))
 	defer ds.Close()
@@ -95,6 +98,8 @@ func TestHttp_Do(t *testing.T) {
 		assert.Equal(t, "v1", resp.Header.Get("h1"))
 		assert.Equal(t, "vv1", resp.Header.Get("hh1"))
 		assert.Equal(t, "vv2", resp.Header.Get("hh2"))
+		require.Len(t, resp.Header.Values("X-Request-Id"), 1)
+		assert.Len(t, resp.Header.Get("X-Request-Id"), 32)
 	})
 
 	t.Run("to localhost, good", func(t *testing.T) {
@@ -651,6 +656,10 @@ func TestHttp_DoWithRedirects(t *testing.T) {
 		&provider.Static{Rules: []string{
 			"localhost,^/api/(.*),@perm http://example.com/123/$1,",
 			"127.0.0.1,^/api/(.*),@302 http://example.com/567/$1,",
+			"127.0.0.1,^/v307/(.*),@307 http://example.com/307/$1,",
+			"127.0.0.1,^/v308/(.*),@308:keep-query http://example.com/308/$1?src=rp,",
+			"127.0.0.1,^/drop/(.*),@301:drop-query http://example.com/drop/$1?src=rp,",
+			"localhost,^/old/(.*),@301:host https://new.example.com/ignored,",
 		},
 		}}, time.Millisecond*10)
 
@@ -695,6 +704,34 @@ func TestHttp_DoWithRedirects(t *testing.T) {
 		t.Logf("%+v", resp.Header)
 		assert.Equal(t, "http://example.com/567/something", resp.Header.Get("Location"))
 	})
+
+	tbl := []struct {
+		name, method, url string
+		code              int
+		location          string
+	}{
+		{"307 without query", "POST", "http://127.0.0.1:%d/v307/something?a=1", http.StatusTemporaryRedirect,
+			"http://example.com/307/something"},
+		{"308 keeps query", "PUT", "http://127.0.0.1:%d/v308/something?a=1&b=2", http.StatusPermanentRedirect,
+			"http://example.com/308/something?src=rp&a=1&b=2"},
+		{"308 without query", "GET", "http://127.0.0.1:%d/v308/something", http.StatusPermanentRedirect,
+			"http://example.com/308/something?src=rp"},
+		{"drop query", "GET", "http://127.0.0.1:%d/drop/something?a=1", http.StatusMovedPermanently,
+			"http://example.com/drop/something"},
+		{"host redirect", "GET", "http://localhost:%d/old/some%%20thing?a=1", http.StatusMovedPermanently,
+			"https://new.example.com/old/some%20thing?a=1"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, fmt.Sprintf(tt.url, port), http.NoBody)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, tt.location, resp.Header.Get("Location"))
+		})
+	}
 }
 
 func TestHttp_DoLimitedReq(t *testing.T) {
@@ -763,6 +800,81 @@ func TestHttp_DoLimitedReq(t *testing.T) {
 	})
 }
 
+func TestHttp_DoPerRouteMaxBody(t *testing.T) {
+	port, releasePort := getFreePort(t)
+	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: io.Discard, Reporter: &ErrorReporter{Nice: true}, MaxBodySize: 10}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "response %s %d", r.URL.String(), len(body))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"127.0.0.1,^/upload/(.*)," + ds.URL + "/upload/$1,,,,,1K",
+			"127.0.0.1,^/small/(.*)," + ds.URL + "/small/$1,,,,,5",
+			"127.0.0.1,^/api/(.*)," + ds.URL + "/api/$1,",
+		},
+		}}, time.Millisecond*10)
+
+	go func() {
+		_ = svc.Run(t.Context())
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	h.Matcher, h.Metrics = svc, mgmt.NewMetrics(mgmt.MetricsConfig{})
+
+	releasePort()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	waitForServer(t, fmt.Sprintf("127.0.0.1:%d", port))
+
+	tbl := []struct {
+		name    string
+		path    string
+		body    io.Reader
+		code    int
+		resBody string
+	}{
+		{name: "route above global, allowed", path: "/upload/file", body: bytes.NewBufferString(strings.Repeat("a", 500)),
+			code: http.StatusOK, resBody: "response /upload/file 500"},
+		{name: "route above global, too large", path: "/upload/file", body: bytes.NewBufferString(strings.Repeat("a", 2000)),
+			code: http.StatusRequestEntityTooLarge, resBody: "Request Entity Too Large"},
+		{name: "route above global, too large chunked", path: "/upload/file",
+			body: io.NopCloser(bytes.NewBufferString(strings.Repeat("a", 2000))), code: http.StatusRequestEntityTooLarge,
+			resBody: "Request Entity Too Large"},
+		{name: "route below global, too large", path: "/small/file", body: bytes.NewBufferString("1234567"),
+			code: http.StatusRequestEntityTooLarge, resBody: "Request Entity Too Large"},
+		{name: "global, allowed", path: "/api/something", body: bytes.NewBufferString("1234567"),
+			code: http.StatusOK, resBody: "response /api/something 7"},
+		{name: "global, too large", path: "/api/something", body: bytes.NewBufferString("12345678901"),
+			code: http.StatusRequestEntityTooLarge, resBody: "Request Entity Too Large"},
+	}
+
+	client := http.Client{}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, tt.body)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), tt.resBody)
+		})
+	}
+}
+
 func TestHttp_health(t *testing.T) {
 	port, releasePort := getFreePort(t)
 	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port),
@@ -917,6 +1029,81 @@ func TestHttp_withBasicAuth(t *testing.T) {
 	})
 }
 
+func TestHttp_withErrorIntercept(t *testing.T) {
+	port, releasePort := getFreePort(t)
+	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: io.Discard, Reporter: &ErrorReporter{Nice: true, Template: "error {{.ErrCode}} for {{.Path}}"},
+		ErrorIntercept: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/503":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("internal details"))
+		case "/500":
+			http.Error(w, "stack trace", http.StatusInternalServerError)
+		case "/404":
+			http.Error(w, "upstream not found", http.StatusNotFound)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"*,^/api/(.*)," + ds.URL + "/$1,",
+			"*,^/down/(.*),http://127.0.0.1:1/$1,",
+		}}}, time.Millisecond*10)
+	go func() {
+		_ = svc.Run(t.Context())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	h.Matcher = svc
+
+	releasePort()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	client := http.Client{Timeout: time.Second}
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/ok")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "server did not start")
+
+	tbl := []struct {
+		path     string
+		code     int
+		body     string
+		retryAft string
+	}{
+		{path: "/api/ok", code: http.StatusOK, body: "ok"},
+		{path: "/api/503", code: http.StatusServiceUnavailable, body: "error 503 for /api/503", retryAft: "30"},
+		{path: "/api/500", code: http.StatusInternalServerError, body: "error 500 for /api/500"},
+		{path: "/api/404", code: http.StatusNotFound, body: "upstream not found\n"},
+		{path: "/down/something", code: http.StatusBadGateway, body: "error 502 for /down/something"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, tt.body, string(body))
+			assert.Equal(t, tt.retryAft, resp.Header.Get("Retry-After"))
+		})
+	}
+}
+
 func TestHttp_toHttp(t *testing.T) {
 
 	tbl := []struct {
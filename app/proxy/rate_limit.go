@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+	"golang.org/x/time/rate"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/jwt"
+)
+
+// TokenVerifier validates bearer tokens of routes with jwt auth
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (jwt.Claims, error)
+}
+
+const (
+	keyLimiterTTL     = 10 * time.Minute // idle client buckets dropped after this time
+	keyLimiterMaxKeys = 100_000          // max number of client buckets per route, least recently used evicted
+)
+
+// keyLimiter is a per-route rate limiter with a token bucket for each client key
+type keyLimiter struct {
+	limit     discovery.RateLimit
+	overrides map[string]discovery.RateLimit // per-key limits, replace route's limit for the given key values
+
+	lock    sync.Mutex // makes get-or-create of buckets atomic
+	buckets cache.Cache[string, *rate.Limiter]
+}
+
+// limitStatus describes state of the client bucket after the request
+type limitStatus struct {
+	allowed   bool
+	limit     discovery.RateLimit
+	remaining int
+	reset     time.Duration // time to refill the bucket completely
+	retry     time.Duration // time to get a token, set for rejected requests only
+}
+
+func newKeyLimiter(limit discovery.RateLimit, overrides map[string]discovery.RateLimit) *keyLimiter {
+	return &keyLimiter{limit: limit, overrides: overrides,
+		buckets: cache.NewCache[string, *rate.Limiter]().WithTTL(keyLimiterTTL).WithMaxKeys(keyLimiterMaxKeys).WithLRU()}
+}
+
+// allow takes a token from the bucket of the client. Bucket is identified by the key kind and value,
+// value is also used to look up per-key limit override.
+func (l *keyLimiter) allow(kind discovery.ThrottleKeyKind, value string) limitStatus {
+	limit := l.limit
+	if v, ok := l.overrides[value]; ok {
+		limit = v
+	}
+	if limit.Rate <= 0 { // override with zero rate means unlimited for the key
+		return limitStatus{allowed: true}
+	}
+
+	bucketKey := string(kind) + "\x00" + value + "\x00" + limit.String()
+	l.lock.Lock()
+	lim, ok := l.buckets.Get(bucketKey)
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(limit.PerSecond()), limit.BurstSize())
+	}
+	l.buckets.Set(bucketKey, lim, 0) // refresh ttl of active bucket
+	l.lock.Unlock()
+
+	now := time.Now()
+	res := limitStatus{allowed: lim.AllowN(now, 1), limit: limit}
+	tokens := lim.TokensAt(now)
+	perSec := limit.PerSecond()
+	res.remaining = max(0, int(math.Floor(tokens)))
+	res.reset = time.Duration((float64(limit.BurstSize()) - tokens) / perSec * float64(time.Second))
+	if !res.allowed {
+		res.retry = time.Duration((1 - tokens) / perSec * float64(time.Second))
+	}
+	return res
+}
+
+// setHeaders adds RateLimit-* headers and Retry-After for rejected requests. RateLimit-Limit is the number of
+// requests per window, RateLimit-Policy describes the window and burst.
+func (s limitStatus) setHeaders(w http.ResponseWriter) {
+	if s.limit.Rate == 0 {
+		return
+	}
+	window := s.limit.Window
+	if window <= 0 {
+		window = time.Second
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(s.limit.Rate))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(s.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(s.reset.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", s.limit.Rate,
+		int(math.Ceil(window.Seconds())), s.limit.BurstSize()))
+	if !s.allowed {
+		w.Header().Set("Retry-After", retryAfter(s.retry))
+	}
+}
+
+// limiterKey returns kind and value of the client key defined by the route. Falls back to client ip
+// if the key is not defined or the request has no valid key value. Basic auth user and jwt claims are taken
+// from credentials verified by basic or jwt auth, requests without verified credentials limited by ip.
+func limiterKey(r *http.Request, key discovery.ThrottleKey, ip string) (discovery.ThrottleKeyKind, string) {
+	value := ""
+	switch key.Kind {
+	case discovery.TKHeader:
+		value = r.Header.Get(key.Name)
+	case discovery.TKCookie:
+		if c, err := r.Cookie(key.Name); err == nil {
+			value = c.Value
+		}
+	case discovery.TKBasicAuth:
+		value, _ = r.Context().Value(ctxAuthUser).(string)
+	case discovery.TKJWT:
+		if claims, ok := r.Context().Value(ctxJWTClaims).(jwt.Claims); ok {
+			value = claims.String(key.Name)
+		}
+	default:
+	}
+	if value == "" {
+		return discovery.TKIP, ip
+	}
+	return key.Kind, value
+}
+
+// unverifiedKey checks if the key value is sent by the client as is, not verified by anything. Changing such value
+// with each request gives a new bucket, so requests with these keys have to pass the client ip bucket as well.
+func unverifiedKey(kind discovery.ThrottleKeyKind) bool {
+	return kind == discovery.TKHeader || kind == discovery.TKCookie
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/jwt"
+)
+
+var _ TokenVerifier = (*jwt.Verifier)(nil)
+
+func Test_limiterKey(t *testing.T) {
+	withClaims := func(r *http.Request) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), ctxJWTClaims, jwt.Claims{"sub": "user1", "org": float64(42)}))
+	}
+
+	tbl := []struct {
+		name      string
+		key       discovery.ThrottleKey
+		prepare   func(r *http.Request) *http.Request
+		wantKind  discovery.ThrottleKeyKind
+		wantValue string
+	}{
+		{name: "default", key: discovery.ThrottleKey{}, wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+		{name: "ip", key: discovery.ThrottleKey{Kind: discovery.TKIP}, wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+		{name: "header", key: discovery.ThrottleKey{Kind: discovery.TKHeader, Name: "X-Api-Key"},
+			prepare:  func(r *http.Request) *http.Request { r.Header.Set("X-API-Key", "key1"); return r },
+			wantKind: discovery.TKHeader, wantValue: "key1"},
+		{name: "missing header", key: discovery.ThrottleKey{Kind: discovery.TKHeader, Name: "X-Api-Key"},
+			wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+		{name: "cookie", key: discovery.ThrottleKey{Kind: discovery.TKCookie, Name: "session"},
+			prepare:  func(r *http.Request) *http.Request { r.AddCookie(&http.Cookie{Name: "session", Value: "s1"}); return r },
+			wantKind: discovery.TKCookie, wantValue: "s1"},
+		{name: "missing cookie", key: discovery.ThrottleKey{Kind: discovery.TKCookie, Name: "session"},
+			wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+		{name: "basic auth", key: discovery.ThrottleKey{Kind: discovery.TKBasicAuth},
+			prepare: func(r *http.Request) *http.Request {
+				return r.WithContext(context.WithValue(r.Context(), ctxAuthUser, "bob"))
+			}, wantKind: discovery.TKBasicAuth, wantValue: "bob"},
+		{name: "basic auth not verified", key: discovery.ThrottleKey{Kind: discovery.TKBasicAuth},
+			prepare:  func(r *http.Request) *http.Request { r.SetBasicAuth("bob", "passwd"); return r },
+			wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+		{name: "jwt claim", key: discovery.ThrottleKey{Kind: discovery.TKJWT, Name: "sub"},
+			prepare: withClaims, wantKind: discovery.TKJWT, wantValue: "user1"},
+		{name: "jwt numeric claim", key: discovery.ThrottleKey{Kind: discovery.TKJWT, Name: "org"},
+			prepare: withClaims, wantKind: discovery.TKJWT, wantValue: "42"},
+		{name: "jwt missing claim", key: discovery.ThrottleKey{Kind: discovery.TKJWT, Name: "email"},
+			prepare: withClaims, wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+		{name: "jwt not verified", key: discovery.ThrottleKey{Kind: discovery.TKJWT, Name: "sub"},
+			prepare:  func(r *http.Request) *http.Request { r.Header.Set("Authorization", "Bearer token"); return r },
+			wantKind: discovery.TKIP, wantValue: "1.2.3.4"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+			if tt.prepare != nil {
+				req = tt.prepare(req)
+			}
+			kind, value := limiterKey(req, tt.key, "1.2.3.4")
+			assert.Equal(t, tt.wantKind, kind)
+			assert.Equal(t, tt.wantValue, value)
+		})
+	}
+}
+
+func Test_keyLimiter(t *testing.T) {
+	lmt := newKeyLimiter(discovery.RateLimit{Rate: 2}, map[string]discovery.RateLimit{"vip": {Rate: 5}, "free": {}})
+
+	st := lmt.allow(discovery.TKHeader, "key1")
+	assert.Equal(t, limitStatus{allowed: true, limit: discovery.RateLimit{Rate: 2}, remaining: 1, reset: st.reset}, st)
+	assert.InDelta(t, 500*time.Millisecond, st.reset, float64(50*time.Millisecond))
+	st = lmt.allow(discovery.TKHeader, "key1")
+	assert.True(t, st.allowed)
+	assert.Equal(t, 0, st.remaining)
+	st = lmt.allow(discovery.TKHeader, "key1")
+	assert.False(t, st.allowed)
+	assert.Equal(t, 0, st.remaining)
+	assert.InDelta(t, 500*time.Millisecond, st.retry, float64(50*time.Millisecond))
+
+	assert.True(t, lmt.allow(discovery.TKHeader, "key2").allowed, "separate bucket for other key")
+	assert.True(t, lmt.allow(discovery.TKIP, "key1").allowed, "separate bucket for other kind")
+
+	for i := range 5 {
+		st = lmt.allow(discovery.TKHeader, "vip")
+		require.True(t, st.allowed, "vip request %d", i)
+		assert.Equal(t, 5, st.limit.Rate)
+	}
+	assert.False(t, lmt.allow(discovery.TKHeader, "vip").allowed)
+
+	for range 10 {
+		st = lmt.allow(discovery.TKHeader, "free")
+		require.True(t, st.allowed)
+		assert.Equal(t, 0, st.limit.Rate, "zero override is unlimited")
+	}
+}
+
+func Test_keyLimiterWindowAndBurst(t *testing.T) {
+	lmt := newKeyLimiter(discovery.RateLimit{Rate: 60, Window: time.Minute, Burst: 3}, nil)
+
+	for i := range 3 {
+		st := lmt.allow(discovery.TKIP, "1.1.1.1")
+		require.True(t, st.allowed, "request %d within burst", i)
+		assert.Equal(t, 2-i, st.remaining)
+	}
+	st := lmt.allow(discovery.TKIP, "1.1.1.1")
+	assert.False(t, st.allowed, "burst exhausted")
+	assert.InDelta(t, time.Second, st.retry, float64(50*time.Millisecond), "one token per second")
+	assert.InDelta(t, 3*time.Second, st.reset, float64(50*time.Millisecond), "full bucket in 3 seconds")
+}
+
+func Test_limitStatusHeaders(t *testing.T) {
+	rr := httptest.NewRecorder()
+	limitStatus{allowed: true, limit: discovery.RateLimit{Rate: 10}, remaining: 7, reset: 300 * time.Millisecond}.setHeaders(rr)
+	assert.Equal(t, "10", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "7", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "10;w=1;burst=10", rr.Header().Get("RateLimit-Policy"))
+	assert.Empty(t, rr.Header().Get("Retry-After"))
+
+	rr = httptest.NewRecorder()
+	limitStatus{allowed: false, limit: discovery.RateLimit{Rate: 100, Window: time.Minute, Burst: 20},
+		reset: 12 * time.Second, retry: 600 * time.Millisecond}.setHeaders(rr)
+	assert.Equal(t, "100", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "12", rr.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "100;w=60;burst=20", rr.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	rr = httptest.NewRecorder()
+	limitStatus{allowed: true}.setHeaders(rr)
+	assert.Empty(t, rr.Header(), "no headers for unlimited keys")
+}
+
+func Test_limiterUserHandler_Keys(t *testing.T) {
+	h := Http{ThrottleOverrides: map[string]discovery.RateLimit{"vip-key": {Rate: 3}, "3.3.3.3": {Rate: 3}}}
+	handler := h.limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api$"), Dst: "http://up",
+		Throttle: discovery.RateLimit{Rate: 1}, ThrottleKey: discovery.ThrottleKey{Kind: discovery.TKHeader, Name: "X-Api-Key"}}
+	send := func(remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: mapper}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("1.1.1.1:1", "key1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Reset"))
+
+	rr = send("2.2.2.2:1", "key1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "same key from other ip limited")
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	rr = send("1.1.1.1:1", "key2")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "other key from the same ip limited by ip bucket")
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusTooManyRequests, send("1.1.1.1:1", "").Code, "no key, limited by ip")
+	assert.Equal(t, http.StatusOK, send("4.4.4.4:1", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("4.4.4.4:1", "key3").Code, "key can't bypass ip limit")
+
+	for i := range 3 {
+		rr = send("3.3.3.3:1", "vip-key")
+		assert.Equal(t, http.StatusOK, rr.Code, "vip request %d", i)
+		assert.Equal(t, "3", rr.Header().Get("RateLimit-Limit"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send("3.3.3.3:1", "vip-key").Code)
+}
+
+func Test_limiterUserHandler_JWTKey(t *testing.T) {
+	h := Http{}
+	handler := h.limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api$"), Dst: "http://up",
+		Throttle: discovery.RateLimit{Rate: 1}, ThrottleKey: discovery.ThrottleKey{Kind: discovery.TKJWT, Name: "sub"}}
+	send := func(sub string) int {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req.RemoteAddr = "1.1.1.1:1"
+		ctx := context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: mapper})
+		if sub != "" {
+			ctx = context.WithValue(ctx, ctxJWTClaims, jwt.Claims{"sub": sub})
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req.WithContext(ctx))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("user1"))
+	assert.Equal(t, http.StatusOK, send("user2"), "verified claims from the same ip not limited by ip")
+	assert.Equal(t, http.StatusTooManyRequests, send("user1"))
+	assert.Equal(t, http.StatusOK, send(""), "no verified token, limited by ip")
+	assert.Equal(t, http.StatusTooManyRequests, send(""))
+}
+
+func Test_limiterUserHandler_BasicAuthKey(t *testing.T) {
+	mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api$"), Dst: "http://up",
+		Throttle: discovery.RateLimit{Rate: 1}, ThrottleKey: discovery.ThrottleKey{Kind: discovery.TKBasicAuth}}
+	send := func(handler http.Handler, user, passwd string) int {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req.RemoteAddr = "1.1.1.1:1"
+		req.SetBasicAuth(user, passwd)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: mapper})))
+		return rr.Code
+	}
+
+	t.Run("rotated users without auth limited by ip", func(t *testing.T) {
+		h := Http{}
+		handler := h.limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		assert.Equal(t, http.StatusOK, send(handler, "user1", "passwd"))
+		assert.Equal(t, http.StatusTooManyRequests, send(handler, "user2", "passwd"))
+		assert.Equal(t, http.StatusTooManyRequests, send(handler, "user3", "passwd"))
+	})
+
+	t.Run("verified users", func(t *testing.T) {
+		h := Http{}
+		allowed := []string{"test:$2y$05$zMxDmK65SjcH2vJQNopVSO/nE8ngVLx65RoETyHpez7yTS/8CLEiW",
+			"test2:$2y$05$TLQqHh6VT4JxysdKGPOlJeSkkMsv.Ku/G45i7ssIm80XuouCrES12"}
+		handler := globalBasicAuthHandler(allowed)(h.limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+		assert.Equal(t, http.StatusOK, send(handler, "test", "passwd"))
+		assert.Equal(t, http.StatusOK, send(handler, "test2", "passwd2"), "verified users from the same ip not limited by ip")
+		assert.Equal(t, http.StatusTooManyRequests, send(handler, "test", "passwd"))
+		assert.Equal(t, http.StatusUnauthorized, send(handler, "user3", "passwd"))
+	})
+}
+
+func Test_limiterUserHandler_Reporter(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{Nice: true, Template: "{{.ErrCode}} {{.ErrMessage}}, retry in {{.RetryAfter}}s"}}
+	handler := h.limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mapper := discovery.URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("^/api$"), Dst: "http://up",
+		Throttle: discovery.RateLimit{Rate: 1, Window: 10 * time.Second}}
+
+	var rr *httptest.ResponseRecorder
+	for range 2 {
+		req := httptest.NewRequest("GET", "http://example.com/api", http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), ctxMatch, discovery.MatchedRoute{Mapper: mapper}))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "429 Too Many Requests, retry in 10s", rr.Body.String())
+}
+
+func Test_limiterUserHandler_GlobalRetryAfter(t *testing.T) {
+	handler := (&Http{ThrottleUser: 1}).limiterUserHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	codes := make([]int, 0, 2)
+	for range 2 {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/foo", http.NoBody))
+		codes = append(codes, rr.Code)
+		if rr.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+			assert.Empty(t, rr.Header().Get("RateLimit-Limit"))
+		}
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+type tokenVerifierFunc func(token string) (jwt.Claims, error)
+
+func (f tokenVerifierFunc) Verify(_ context.Context, token string) (jwt.Claims, error) {
+	return f(token)
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/oidc"
+	"github.com/umputun/reproxy/app/plugin"
+)
+
+// RealIP implements middleware resolving the client ip address once per request and storing it in
+// the request context. All other consumers (OnlyFrom, throttling, access logs, plugins and X-Real-IP header)
+// use this resolved value. The scheme of the client's request resolved and stored the same way.
+//
+// If trusted proxies defined, forwarded headers are honored only when the direct peer is one of them,
+// and the client ip is the right-most address in X-Forwarded-For (or Forwarded) not belonging to a trusted proxy.
+// Without trusted proxies, the lookups are applied as-is, which is the legacy (and spoofable) behavior
+// of --remote-lookup-headers.
+type RealIP struct {
+	lookups []OFLookup
+	trusted []*net.IPNet
+}
+
+// NewRealIP makes RealIP with the list of trusted proxies (ips or CIDRs) and lookup methods.
+// Empty lookups means remote address only.
+func NewRealIP(trusted []string, lookups ...OFLookup) (*RealIP, error) {
+	res := &RealIP{lookups: lookups}
+	for _, t := range trusted {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		ipNet, err := discovery.ParseIPNet(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", t, err)
+		}
+		res.trusted = append(res.trusted, ipNet)
+	}
+	return res, nil
+}
+
+// Handler implements middleware interface, sets resolved client ip and scheme to the request context.
+// nil RealIP passes requests through as-is.
+func (ri *RealIP) Handler(next http.Handler) http.Handler {
+	if ri == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ri.resolve(r)
+		ctx := context.WithValue(r.Context(), ctxRealIP, ip)
+		ctx = context.WithValue(ctx, plugin.CtxRealIP, ip) // set real ip for plugin conductor
+		scheme := ri.scheme(r)
+		ctx = context.WithValue(ctx, ctxScheme, scheme)
+		ctx = context.WithValue(ctx, oidc.CtxScheme, scheme) // set scheme for oidc redirect uri and cookies
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolve returns the client ip. nil RealIP or empty lookups resolve to the remote address.
+func (ri *RealIP) resolve(r *http.Request) string {
+	peer := remoteAddrIP(r)
+	if ri == nil || len(ri.lookups) == 0 {
+		return peer
+	}
+
+	if len(ri.trusted) > 0 && !ri.isTrusted(peer) {
+		return peer // headers from untrusted peers are ignored
+	}
+
+	for _, lookup := range ri.lookups {
+		switch lookup {
+		case OFRemoteAddr:
+			return peer
+		case OFRealIP:
+			if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); v != "" && (len(ri.trusted) == 0 || net.ParseIP(v) != nil) {
+				return v
+			}
+		case OFForwarded:
+			forwardedFor := r.Header.Get("X-Forwarded-For")
+			if forwardedFor == "" {
+				continue
+			}
+			if len(ri.trusted) == 0 {
+				return preferPublicIP(strings.Split(forwardedFor, ","))
+			}
+			if ip := ri.rightmostUntrusted(strings.Split(forwardedFor, ",")); ip != "" {
+				return ip
+			}
+		case OFForwardedRFC:
+			nodes := parseForwardedFor(r.Header.Values("Forwarded"))
+			if len(nodes) == 0 {
+				continue
+			}
+			if len(ri.trusted) == 0 {
+				return preferPublicIP(nodes)
+			}
+			if ip := ri.rightmostUntrusted(nodes); ip != "" {
+				return ip
+			}
+		}
+	}
+	return peer
+}
+
+// scheme returns the scheme of the client's request. Behind trusted proxies the proto reported by the direct peer
+// in X-Forwarded-Proto (or Forwarded) header is used, the last one if there are a few. Without trusted proxies
+// or for untrusted peers the headers are ignored and the scheme is defined by the connection.
+func (ri *RealIP) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if !ri.hasTrusted() || !ri.isTrusted(remoteAddrIP(r)) {
+		return "http"
+	}
+	protos := strings.Split(strings.Join(r.Header.Values("X-Forwarded-Proto"), ","), ",")
+	if len(protos) == 1 && strings.TrimSpace(protos[0]) == "" {
+		protos = parseForwardedParam(r.Header.Values("Forwarded"), "proto")
+	}
+	if len(protos) > 0 {
+		if proto := strings.ToLower(strings.Trim(strings.TrimSpace(protos[len(protos)-1]), `"`)); proto == "https" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// rightmostUntrusted walks the list of hops from right to left and returns the first address
+// not belonging to a trusted proxy. If all of them are trusted, the left-most valid one returned.
+func (ri *RealIP) rightmostUntrusted(hops []string) string {
+	leftmost := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(hops[i])
+		if net.ParseIP(ip) == nil {
+			continue // invalid or obfuscated hop, can't be trusted nor used
+		}
+		if !ri.isTrusted(ip) {
+			return ip
+		}
+		leftmost = ip
+	}
+	return leftmost
+}
+
+// hasTrusted returns true if trusted proxies defined
+func (ri *RealIP) hasTrusted() bool {
+	return ri != nil && len(ri.trusted) > 0
+}
+
+func (ri *RealIP) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range ri.trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddrIP returns ip part of the request's remote address, or the remote address as-is if it can't be parsed
+func remoteAddrIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// realIPFromRequest returns the client ip resolved by RealIP middleware,
+// falling back to the remote address if not resolved
+func realIPFromRequest(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxRealIP).(string); ok && v != "" {
+		return v
+	}
+	return remoteAddrIP(r)
+}
+
+// schemeFromRequest returns the scheme of the client's request resolved by RealIP middleware,
+// falling back to the scheme of the connection if not resolved
+func schemeFromRequest(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxScheme).(string); ok && v != "" {
+		return v
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// logWithRealIP wraps logging middleware so it sees the resolved client ip as the remote address,
+// while the rest of the chain keeps receiving the original request
+func logWithRealIP(lh func(next http.Handler) http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orig := r
+		passOrig := http.HandlerFunc(func(ww http.ResponseWriter, _ *http.Request) { next.ServeHTTP(ww, orig) })
+		lh(passOrig).ServeHTTP(w, withRealIPAddr(r))
+	})
+}
+
+// withRealIPAddr returns a shallow copy of the request for logging, with the remote address set
+// to the resolved client ip and forwarded headers dropped, so loggers can't pick a spoofed address
+func withRealIPAddr(r *http.Request) *http.Request {
+	res := r.WithContext(r.Context())
+	port := "0"
+	if _, p, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		port = p
+	}
+	res.RemoteAddr = net.JoinHostPort(realIPFromRequest(r), port)
+	res.Header = r.Header.Clone()
+	res.Header.Del("X-Real-IP")
+	res.Header.Del("X-Forwarded-For")
+	res.Header.Del("CF-Connecting-IP")
+	return res
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/oidc"
+	"github.com/umputun/reproxy/app/plugin"
+)
+
+func TestNewRealIP(t *testing.T) {
+	ri, err := NewRealIP([]string{"10.0.0.0/8", "172.16.0.1", " ::1 ", ""}, OFForwarded)
+	require.NoError(t, err)
+	require.Len(t, ri.trusted, 3)
+	assert.Equal(t, "10.0.0.0/8", ri.trusted[0].String())
+	assert.Equal(t, "172.16.0.1/32", ri.trusted[1].String())
+	assert.Equal(t, "::1/128", ri.trusted[2].String())
+
+	_, err = NewRealIP([]string{"10.0.0.0/33"}, OFForwarded)
+	require.Error(t, err)
+	_, err = NewRealIP([]string{"bad-ip"}, OFForwarded)
+	require.Error(t, err)
+}
+
+func TestRealIP_resolve(t *testing.T) {
+	tbl := []struct {
+		name         string
+		trusted      []string
+		lookups      []OFLookup
+		remoteAddr   string
+		realIP       string
+		forwardedFor string
+		expected     string
+	}{
+		{
+			name:         "no lookups, remote addr only",
+			remoteAddr:   "1.2.3.4:1234",
+			forwardedFor: "5.6.7.8",
+			expected:     "1.2.3.4",
+		},
+		{
+			name:         "legacy, forwarded without trusted",
+			lookups:      []OFLookup{OFRealIP, OFForwarded, OFRemoteAddr},
+			remoteAddr:   "1.2.3.4:1234",
+			forwardedFor: "192.168.1.1, 5.6.7.8, 9.9.9.9",
+			expected:     "5.6.7.8",
+		},
+		{
+			name:       "legacy, real ip without trusted",
+			lookups:    []OFLookup{OFRealIP, OFForwarded, OFRemoteAddr},
+			remoteAddr: "1.2.3.4:1234",
+			realIP:     "5.6.7.8",
+			expected:   "5.6.7.8",
+		},
+		{
+			name:         "untrusted peer, headers ignored",
+			trusted:      []string{"10.0.0.0/8"},
+			lookups:      []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr:   "1.2.3.4:1234",
+			realIP:       "5.6.7.8",
+			forwardedFor: "5.6.7.8",
+			expected:     "1.2.3.4",
+		},
+		{
+			name:         "trusted peer, right-most untrusted hop",
+			trusted:      []string{"10.0.0.0/8"},
+			lookups:      []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "6.6.6.6, 5.6.7.8, 10.0.0.2",
+			expected:     "5.6.7.8",
+		},
+		{
+			name:         "trusted peer, spoofed left-most hop ignored",
+			trusted:      []string{"10.0.0.0/8", "172.16.0.5"},
+			lookups:      []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "1.1.1.1, 192.168.1.10, 172.16.0.5",
+			expected:     "192.168.1.10",
+		},
+		{
+			name:         "trusted peer, all hops trusted",
+			trusted:      []string{"10.0.0.0/8"},
+			lookups:      []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "10.0.0.3, 10.0.0.2",
+			expected:     "10.0.0.3",
+		},
+		{
+			name:         "trusted peer, invalid hops skipped",
+			trusted:      []string{"10.0.0.0/8"},
+			lookups:      []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "5.6.7.8, unknown, 10.0.0.2",
+			expected:     "5.6.7.8",
+		},
+		{
+			name:       "trusted peer, real ip used without forwarded",
+			trusted:    []string{"10.0.0.0/8"},
+			lookups:    []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr: "10.0.0.1:1234",
+			realIP:     "5.6.7.8",
+			expected:   "5.6.7.8",
+		},
+		{
+			name:       "trusted peer, invalid real ip ignored",
+			trusted:    []string{"10.0.0.0/8"},
+			lookups:    []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr: "10.0.0.1:1234",
+			realIP:     "not-an-ip",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:         "trusted ipv6 peer",
+			trusted:      []string{"fd00::/8"},
+			lookups:      []OFLookup{OFForwarded, OFRealIP, OFRemoteAddr},
+			remoteAddr:   "[fd00::1]:1234",
+			forwardedFor: "2001:db8::1, fd00::2",
+			expected:     "2001:db8::1",
+		},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			ri, err := NewRealIP(tt.trusted, tt.lookups...)
+			require.NoError(t, err)
+			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			assert.Equal(t, tt.expected, ri.resolve(req))
+		})
+	}
+}
+
+func TestRealIP_Handler(t *testing.T) {
+	ri, err := NewRealIP([]string{"10.0.0.0/8"}, OFForwarded, OFRealIP, OFRemoteAddr)
+	require.NoError(t, err)
+
+	t.Run("context set", func(t *testing.T) {
+		var called bool
+		h := ri.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			assert.Equal(t, "5.6.7.8", realIPFromRequest(r))
+			assert.Equal(t, "5.6.7.8", r.Context().Value(plugin.CtxRealIP))
+			assert.Equal(t, "https", schemeFromRequest(r))
+			assert.Equal(t, "https", r.Context().Value(oidc.CtxScheme))
+		}))
+		req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "1.1.1.1, 5.6.7.8")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		assert.True(t, called)
+	})
+
+	t.Run("only from uses resolved ip", func(t *testing.T) {
+		onlyFrom := NewOnlyFrom(OFRealIP, OFForwarded, OFRemoteAddr)
+		h := ri.Handler(onlyFrom.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+		req.RemoteAddr = "1.2.3.4:1234" // untrusted peer trying to spoof allowed ip
+		req.Header.Set("X-Real-IP", "5.6.7.8")
+		req = req.WithContext(context.WithValue(req.Context(),
+			ctxMatch, discovery.MatchedRoute{Mapper: discovery.URLMapper{OnlyFromIPs: []string{"5.6.7.8"}}}))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("nil pass through", func(t *testing.T) {
+		var nilRI *RealIP
+		h := nilRI.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Nil(t, r.Context().Value(ctxRealIP))
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/foo", http.NoBody))
+	})
+}
+
+func TestRealIP_logWithRealIP(t *testing.T) {
+	ri, err := NewRealIP([]string{"10.0.0.0/8"}, OFForwarded, OFRealIP, OFRemoteAddr)
+	require.NoError(t, err)
+
+	buf := bytes.Buffer{}
+	lh := func(next http.Handler) http.Handler { return handlers.CombinedLoggingHandler(&buf, next) }
+	h := ri.Handler(logWithRealIP(lh, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// downstream gets the original request
+		assert.Equal(t, "10.0.0.1:1234", r.RemoteAddr)
+		assert.Equal(t, "1.1.1.1, 5.6.7.8", r.Header.Get("X-Forwarded-For"))
+	})))
+
+	req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 5.6.7.8")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Contains(t, buf.String(), "5.6.7.8 - - ")
+}
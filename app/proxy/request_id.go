@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/umputun/reproxy/app/plugin"
+)
+
+const maxRequestIDLen = 128
+
+// requestIDHandler sets request id to the request context, to the request's header passed to upstream
+// and to the response header. Incoming request id accepted if RequestIDTrust enabled and, in case if trusted
+// proxies defined, the request came from one of them. Otherwise, new request id generated.
+func (h *Http) requestIDHandler(next http.Handler) http.Handler {
+	if h.RequestIDHeader == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(h.RequestIDHeader)
+		if !h.RequestIDTrust || !validRequestID(id) || (h.RealIP.hasTrusted() && !h.RealIP.isTrusted(remoteAddrIP(r))) {
+			id = newRequestID()
+		}
+		r.Header.Set(h.RequestIDHeader, id)
+		w.Header().Set(h.RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), ctxRequestID, id)
+		ctx = context.WithValue(ctx, plugin.CtxRequestID, id) // set request id for plugin conductor
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDFromRequest returns request id set by requestIDHandler, empty if not set
+func requestIDFromRequest(r *http.Request) string {
+	if v, ok := r.Context().Value(ctxRequestID).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// newRequestID makes random 128-bit request id, hex-encoded
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b) // crypto/rand.Read never returns an error
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks incoming request id, allowing only limited length and safe characters
+// as it will be used in logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '+', c == '/', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDWriter appends request id to each access log line written by the wrapped writer
+type requestIDWriter struct {
+	wr io.Writer
+	id string
+}
+
+func (w requestIDWriter) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(p)+len(w.id)+3)
+	line = append(line, p...)
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	line = append(line, ` "`...)
+	line = append(line, w.id...)
+	line = append(line, "\"\n"...)
+	if _, err := w.wr.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
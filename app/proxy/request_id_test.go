@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/plugin"
+)
+
+func TestHttp_requestIDHandler(t *testing.T) {
+	trustedRI, err := NewRealIP([]string{"10.0.0.0/8"}, OFForwarded, OFRemoteAddr)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name       string
+		trust      bool
+		realIP     *RealIP
+		remoteAddr string
+		incoming   string
+		keep       bool
+	}{
+		{name: "generated", remoteAddr: "1.2.3.4:1234"},
+		{name: "incoming ignored without trust", remoteAddr: "1.2.3.4:1234", incoming: "req-1"},
+		{name: "incoming accepted with trust", trust: true, remoteAddr: "1.2.3.4:1234", incoming: "req-1", keep: true},
+		{name: "invalid incoming replaced", trust: true, remoteAddr: "1.2.3.4:1234", incoming: "bad id\"", keep: false},
+		{name: "too long incoming replaced", trust: true, remoteAddr: "1.2.3.4:1234", incoming: strings.Repeat("a", 129)},
+		{name: "incoming from trusted proxy", trust: true, realIP: trustedRI, remoteAddr: "10.0.0.1:1234",
+			incoming: "req-1", keep: true},
+		{name: "incoming from untrusted peer", trust: true, realIP: trustedRI, remoteAddr: "1.2.3.4:1234",
+			incoming: "req-1"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Http{RequestIDHeader: "X-Request-Id", RequestIDTrust: tt.trust, RealIP: tt.realIP}
+			var id string
+			handler := h.requestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				id = requestIDFromRequest(r)
+				assert.Equal(t, id, r.Header.Get("X-Request-Id"))
+				assert.Equal(t, id, r.Context().Value(plugin.CtxRequestID))
+			}))
+			req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-Id", tt.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			require.NotEmpty(t, id)
+			assert.Equal(t, id, rr.Header().Get("X-Request-Id"))
+			if tt.keep {
+				assert.Equal(t, tt.incoming, id)
+				return
+			}
+			assert.NotEqual(t, tt.incoming, id)
+			assert.Len(t, id, 32)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h := Http{}
+		handler := h.requestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, requestIDFromRequest(r))
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/foo", http.NoBody))
+		assert.Empty(t, rr.Header().Get("X-Request-Id"))
+	})
+}
+
+func Test_combinedLogHandlerWithRequestID(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := Http{RequestIDHeader: "X-Request-Id", RequestIDTrust: true}
+	handler := h.requestIDHandler(combinedLogHandler(&buf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})))
+
+	req := httptest.NewRequest("GET", "http://example.com/foo", http.NoBody)
+	req.Header.Set("X-Request-Id", "req-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, strings.HasSuffix(buf.String(), `"GET http://example.com/foo HTTP/1.1" 200 2 "" "" "req-123"`+"\n"), buf.String())
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+const (
+	hstsHeader          = "Strict-Transport-Security"
+	cspHeader           = "Content-Security-Policy"
+	cspReportOnlyHeader = "Content-Security-Policy-Report-Only"
+)
+
+// securityPresets defines headers of each preset, strict one breaks sites loading scripts or frames from other origins
+var securityPresets = map[discovery.SecurityPreset]map[string]string{
+	discovery.SHBasic: {
+		hstsHeader:               "max-age=31536000",
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "SAMEORIGIN",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+	},
+	discovery.SHStrict: {
+		hstsHeader:                     "max-age=63072000; includeSubDomains",
+		"X-Content-Type-Options":       "nosniff",
+		"X-Frame-Options":              "DENY",
+		"Referrer-Policy":              "no-referrer",
+		cspHeader:                      "default-src 'self'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'",
+		"Permissions-Policy":           "camera=(), microphone=(), geolocation=()",
+		"Cross-Origin-Opener-Policy":   "same-origin",
+		"Cross-Origin-Resource-Policy": "same-origin",
+	},
+}
+
+// securityHeadersHandler adds security headers of the global policy, changed by the matched route's policy.
+// Headers set by upstream or by other handlers are kept as is. HSTS sent for TLS requests with static or auto
+// ssl mode only.
+func (h *Http) securityHeadersHandler(next http.Handler) http.Handler {
+	global := resolveSecurityHeaders(h.SecurityHeaders, discovery.SecurityHeaders{})
+	tlsMode := h.SSLConfig.SSLMode == SSLStatic || h.SSLConfig.SSLMode == SSLAuto
+	if len(global) > 0 {
+		log.Printf("[DEBUG] security headers %v, hsts enabled: %v", sortedHeaderNames(global), tlsMode)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := global
+		if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok && !match.Mapper.SecurityHeaders.IsZero() {
+			headers = resolveSecurityHeaders(h.SecurityHeaders, match.Mapper.SecurityHeaders)
+		}
+		if len(headers) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		withHSTS := tlsMode && r.TLS != nil
+		hw := &headerHookWriter{ResponseWriter: w, hook: func(hdr http.Header) {
+			for k, v := range headers {
+				if k == hstsHeader && !withHSTS {
+					continue
+				}
+				if hdr.Get(k) == "" {
+					hdr.Set(k, v)
+				}
+			}
+		}}
+		next.ServeHTTP(hw, r)
+	})
+}
+
+// resolveSecurityHeaders makes headers from global policy and route's policy. Route's preset replaces the global one,
+// "off" preset drops all global headers. Overrides and opt-outs applied in order, global first.
+func resolveSecurityHeaders(global, route discovery.SecurityHeaders) map[string]string {
+	res := map[string]string{}
+	apply := func(p discovery.SecurityHeaders) {
+		maps.Copy(res, p.Set)
+		for _, name := range p.Drop {
+			delete(res, name)
+		}
+	}
+
+	preset := global.Preset
+	if route.Preset != discovery.SHInherit {
+		preset = route.Preset
+	}
+	maps.Copy(res, securityPresets[preset])
+	if route.Preset != discovery.SHOff {
+		apply(global)
+	}
+	apply(route)
+
+	if global.ReportOnly || route.ReportOnly {
+		if csp, ok := res[cspHeader]; ok {
+			res[cspReportOnlyHeader] = csp
+			delete(res, cspHeader)
+		}
+	}
+	return res
+}
+
+// headerHookWriter wraps http.ResponseWriter and calls hook with response headers once, right before they are sent
+type headerHookWriter struct {
+	http.ResponseWriter
+	hook    func(http.Header)
+	applied bool
+}
+
+// WriteHeader calls the hook and passes the code to the wrapped writer
+func (hw *headerHookWriter) WriteHeader(code int) {
+	if code >= 200 { // informational responses are not final
+		hw.apply()
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+// Write calls the hook for implicit 200 and passes data to the wrapped writer
+func (hw *headerHookWriter) Write(b []byte) (int, error) {
+	hw.apply()
+	return hw.ResponseWriter.Write(b) //nolint:wrapcheck // pass errors of the wrapped writer as-is
+}
+
+func (hw *headerHookWriter) apply() {
+	if hw.applied {
+		return
+	}
+	hw.applied = true
+	hw.hook(hw.ResponseWriter.Header())
+}
+
+// Flush delegates to the original writer if it implements http.Flusher
+func (hw *headerHookWriter) Flush() {
+	hw.apply()
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack delegates to the original writer if it implements http.Hijacker
+func (hw *headerHookWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := hw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, buf, err := h.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	return conn, buf, nil
+}
+
+// Unwrap returns the original writer, used by http.ResponseController
+func (hw *headerHookWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
+
+// sortedHeaderNames returns sorted names of the headers, used for logging
+func sortedHeaderNames(headers map[string]string) []string {
+	return slices.Sorted(maps.Keys(headers))
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func Test_resolveSecurityHeaders(t *testing.T) {
+	tbl := []struct {
+		name   string
+		global discovery.SecurityHeaders
+		route  discovery.SecurityHeaders
+		want   map[string]string
+	}{
+		{name: "nothing", want: map[string]string{}},
+		{name: "global preset", global: discovery.SecurityHeaders{Preset: discovery.SHBasic},
+			want: securityPresets[discovery.SHBasic]},
+		{name: "global overrides and opt-outs",
+			global: discovery.SecurityHeaders{Preset: discovery.SHBasic, Set: map[string]string{"X-Frame-Options": "DENY"},
+				Drop: []string{"Referrer-Policy", "Strict-Transport-Security"}},
+			want: map[string]string{"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY"}},
+		{name: "route preset replaces global one, global overrides kept",
+			global: discovery.SecurityHeaders{Preset: discovery.SHStrict, Set: map[string]string{"Referrer-Policy": "same-origin"}},
+			route:  discovery.SecurityHeaders{Preset: discovery.SHBasic},
+			want: map[string]string{"Strict-Transport-Security": "max-age=31536000", "X-Content-Type-Options": "nosniff",
+				"X-Frame-Options": "SAMEORIGIN", "Referrer-Policy": "same-origin"}},
+		{name: "route off",
+			global: discovery.SecurityHeaders{Preset: discovery.SHStrict, Set: map[string]string{"Referrer-Policy": "same-origin"}},
+			route:  discovery.SecurityHeaders{Preset: discovery.SHOff, Set: map[string]string{"X-Frame-Options": "DENY"}},
+			want:   map[string]string{"X-Frame-Options": "DENY"}},
+		{name: "route opt-out of global override",
+			global: discovery.SecurityHeaders{Set: map[string]string{"X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer"}},
+			route:  discovery.SecurityHeaders{Drop: []string{"X-Frame-Options"}},
+			want:   map[string]string{"Referrer-Policy": "no-referrer"}},
+		{name: "report only",
+			global: discovery.SecurityHeaders{Set: map[string]string{"Content-Security-Policy": "default-src 'self'"}},
+			route:  discovery.SecurityHeaders{ReportOnly: true},
+			want:   map[string]string{"Content-Security-Policy-Report-Only": "default-src 'self'"}},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, resolveSecurityHeaders(tt.global, tt.route))
+		})
+	}
+}
+
+func TestHttp_securityHeadersHandler(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/own-frame" {
+			w.Header().Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	withRoute := func(r *http.Request, sh discovery.SecurityHeaders) *http.Request {
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/(.*)"), SecurityHeaders: sh}}
+		return r.WithContext(context.WithValue(r.Context(), ctxMatch, m))
+	}
+
+	t.Run("basic preset without tls", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHBasic}, SSLConfig: SSLConfig{SSLMode: SSLStatic}}
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(upstream).ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/", http.NoBody))
+		assert.Equal(t, "nosniff", wr.Header().Get("X-Content-Type-Options"))
+		assert.Equal(t, "SAMEORIGIN", wr.Header().Get("X-Frame-Options"))
+		assert.Empty(t, wr.Header().Get("Strict-Transport-Security"), "no hsts for plain http")
+	})
+
+	t.Run("hsts with tls and static ssl", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHBasic}, SSLConfig: SSLConfig{SSLMode: SSLStatic}}
+		req := httptest.NewRequest("GET", "https://example.com/", http.NoBody)
+		req.TLS = &tls.ConnectionState{}
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, "max-age=31536000", wr.Header().Get("Strict-Transport-Security"))
+	})
+
+	t.Run("no hsts with tls terminated without ssl mode", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHBasic}}
+		req := httptest.NewRequest("GET", "https://example.com/", http.NoBody)
+		req.TLS = &tls.ConnectionState{}
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(upstream).ServeHTTP(wr, req)
+		assert.Empty(t, wr.Header().Get("Strict-Transport-Security"))
+		assert.Equal(t, "nosniff", wr.Header().Get("X-Content-Type-Options"))
+	})
+
+	t.Run("upstream header kept", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHStrict}}
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(upstream).ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/own-frame", http.NoBody))
+		assert.Equal(t, "ALLOW-FROM https://example.com", wr.Header().Get("X-Frame-Options"))
+		assert.Equal(t, "no-referrer", wr.Header().Get("Referrer-Policy"))
+	})
+
+	t.Run("route override and report only", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHStrict}}
+		req := withRoute(httptest.NewRequest("GET", "http://example.com/", http.NoBody),
+			discovery.SecurityHeaders{ReportOnly: true, Set: map[string]string{"X-Frame-Options": "SAMEORIGIN"}})
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(upstream).ServeHTTP(wr, req)
+		assert.Equal(t, "SAMEORIGIN", wr.Header().Get("X-Frame-Options"))
+		assert.Empty(t, wr.Header().Get("Content-Security-Policy"))
+		assert.Equal(t, securityPresets[discovery.SHStrict]["Content-Security-Policy"],
+			wr.Header().Get("Content-Security-Policy-Report-Only"))
+	})
+
+	t.Run("route opt-out of all headers", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHStrict}}
+		req := withRoute(httptest.NewRequest("GET", "http://example.com/", http.NoBody), discovery.SecurityHeaders{Preset: discovery.SHOff})
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(upstream).ServeHTTP(wr, req)
+		assert.Empty(t, wr.Header().Get("X-Frame-Options"))
+		assert.Empty(t, wr.Header().Get("X-Content-Type-Options"))
+		assert.Equal(t, "ok", wr.Body.String())
+	})
+
+	t.Run("headers on implicit status", func(t *testing.T) {
+		h := Http{SecurityHeaders: discovery.SecurityHeaders{Preset: discovery.SHBasic}}
+		wr := httptest.NewRecorder()
+		h.securityHeadersHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("implicit"))
+		})).ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/", http.NoBody))
+		assert.Equal(t, "nosniff", wr.Header().Get("X-Content-Type-Options"))
+	})
+}
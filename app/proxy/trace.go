@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// traceHandler makes server span for the request and records client ip and request id
+func (h *Http) traceHandler(next http.Handler) http.Handler {
+	if h.Tracer == nil {
+		return next
+	}
+	return h.Tracer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("client.address", realIPFromRequest(r)))
+		if id := requestIDFromRequest(r); id != "" {
+			span.SetAttributes(attribute.String("reproxy.request_id", id))
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// traceMatch records matched route info in the server span and names it by the route pattern
+func traceMatch(r *http.Request, match discovery.MatchedRoute) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+	span.SetName(r.Method + " " + match.Mapper.SrcMatch.String())
+	span.SetAttributes(
+		attribute.String("http.route", match.Mapper.SrcMatch.String()),
+		attribute.String("reproxy.server", match.Mapper.Server),
+		attribute.String("reproxy.destination", match.Destination),
+		attribute.String("reproxy.provider", string(match.Mapper.ProviderID)),
+	)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+	"github.com/umputun/reproxy/app/tracing"
+)
+
+func TestHttp_DoWithTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exp, SampleRatio: 1, BatchTimeout: 10 * time.Millisecond})
+	spans := func() (res tracetest.SpanStubs) {
+		for _, s := range exp.GetSpans() {
+			if s.SpanContext.TraceID().String() == "4bf92f3577b34da6a3ce929d0e0e4736" { // skip spans of ping requests
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+
+	port, releasePort := getFreePort(t)
+	h := Http{Timeouts: Timeouts{ResponseHeader: 200 * time.Millisecond}, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: io.Discard, Reporter: &ErrorReporter{}, Tracer: tracer, RequestIDHeader: "X-Request-Id"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var upstreamTraceparent string
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"127.0.0.1,^/api/(.*)," + ds.URL + "/567/$1,"}}}, time.Millisecond*10)
+	go func() {
+		_ = svc.Run(t.Context())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	h.Matcher = svc
+
+	releasePort()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+
+	client := http.Client{}
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/ping")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "server failed to start")
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Eventually(t, func() bool { return len(spans()) == 2 }, time.Second, 10*time.Millisecond)
+
+	clientSpan, serverSpan := spans()[0], spans()[1] // client span ended first
+	assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind)
+	assert.Equal(t, trace.SpanKindServer, serverSpan.SpanKind)
+
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", serverSpan.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", serverSpan.Parent.SpanID().String())
+	assert.Equal(t, serverSpan.SpanContext.SpanID(), clientSpan.Parent.SpanID())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+clientSpan.SpanContext.SpanID().String()+"-01", upstreamTraceparent)
+
+	assert.Equal(t, "GET ^/api/(.*)", serverSpan.Name)
+	attrs := map[string]any{}
+	for _, a := range serverSpan.Attributes {
+		attrs[string(a.Key)] = a.Value.AsInterface()
+	}
+	assert.Equal(t, "^/api/(.*)", attrs["http.route"])
+	assert.Equal(t, "127.0.0.1", attrs["reproxy.server"])
+	assert.Equal(t, ds.URL+"/567/something", attrs["reproxy.destination"])
+	assert.Equal(t, "127.0.0.1", attrs["client.address"])
+	assert.Equal(t, resp.Header.Get("X-Request-Id"), attrs["reproxy.request_id"])
+	assert.Equal(t, int64(http.StatusOK), attrs["http.response.status_code"])
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/waf"
+)
+
+// WAF checks requests against request filtering rules of the sets and, if global is true, the global rules
+type WAF interface {
+	Check(r *http.Request, clientIP string, sets []string, global bool) waf.Decision
+}
+
+// WAFMetrics defines counter of matched waf rules. Optional, used if Metrics provider implements it.
+type WAFMetrics interface {
+	AddWAFHit(rule string, action string)
+}
+
+// wafHandler checks requests against the global rules and rule sets of the matched route. Requests denied by a rule
+// rejected with the rule's status, tags of matched log rules passed upstream in WAFTagHeader and kept in the request
+// context for access log. Each matched rule counted in metrics.
+func (h *Http) wafHandler() func(next http.Handler) http.Handler {
+	metrics, _ := h.Metrics.(WAFMetrics)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.WAF == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var policy discovery.WAFPolicy
+			if match, ok := r.Context().Value(ctxMatch).(discovery.MatchedRoute); ok {
+				policy = match.Mapper.WAF
+			}
+
+			ip := realIPFromRequest(r)
+			decision := h.WAF.Check(r, ip, policy.Sets, !policy.SkipGlobal)
+			for _, m := range decision.Matched {
+				if metrics != nil {
+					metrics.AddWAFHit(m.Rule, string(m.Action))
+				}
+				if m.Action == waf.ActionLog {
+					log.Printf("[INFO] waf rule %q tagged %s %s from %s as %q", m.Rule, r.Method, r.URL.Path, ip, m.Tag)
+				}
+			}
+			if decision.Deny {
+				rule := decision.Matched[len(decision.Matched)-1].Rule
+				log.Printf("[INFO] waf rule %q denied %s %s from %s", rule, r.Method, r.URL.Path, ip)
+				reportError(w, r, h.Reporter, decision.Status)
+				return
+			}
+
+			if h.WAFTagHeader != "" {
+				r.Header.Del(h.WAFTagHeader) // don't trust client's value
+			}
+			tags := decision.Tags()
+			if len(tags) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if h.WAFTagHeader != "" {
+				r.Header.Set(h.WAFTagHeader, strings.Join(tags, ","))
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxWAFTags, tags)))
+		})
+	}
+}
+
+// wafTagsFromRequest returns tags of matched waf log rules, empty if none
+func wafTagsFromRequest(r *http.Request) string {
+	tags, _ := r.Context().Value(ctxWAFTags).([]string)
+	return strings.Join(tags, ",")
+}
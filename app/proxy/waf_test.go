@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/waf"
+)
+
+type wafMetricsRecorder struct {
+	lock sync.Mutex
+	hits map[string]int // rule:action -> count
+}
+
+func (m *wafMetricsRecorder) Middleware(next http.Handler) http.Handler { return next }
+
+func (m *wafMetricsRecorder) AddWAFHit(rule, action string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.hits[rule+":"+action]++
+}
+
+func TestHttp_wafHandler(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "waf.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+global:
+  - {name: env-files, path: '/\.env', action: deny, status: 404}
+  - {name: scanners, user-agent: sqlmap, action: log, tag: scanner}
+  - {name: bad-query, query: 'union select', action: log}
+sets:
+  wordpress:
+    - {name: wp-login, path: '^/wp-login\.php', action: deny}
+  internal:
+    - {name: office, ip: [10.0.0.0/8], action: allow}
+`), 0o600))
+	rules, err := waf.NewRules(file)
+	require.NoError(t, err)
+
+	metrics := &wafMetricsRecorder{hits: map[string]int{}}
+	h := Http{Reporter: &ErrorReporter{}, WAF: rules, WAFTagHeader: "X-Waf-Tags", Metrics: metrics}
+	handler := h.wafHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Got-Tags", r.Header.Get("X-Waf-Tags"))
+		w.Header().Set("X-Got-Ctx", wafTagsFromRequest(r))
+		_, _ = w.Write([]byte("passed"))
+	}))
+
+	makeReq := func(target, ip, policy string, headers ...string) *http.Request {
+		req := httptest.NewRequest("GET", target, http.NoBody)
+		req.RemoteAddr = ip + ":1234"
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		if policy == "-" { // unmatched route
+			return req
+		}
+		p, err := discovery.ParseWAF(policy)
+		require.NoError(t, err)
+		m := discovery.MatchedRoute{Mapper: discovery.URLMapper{SrcMatch: *regexp.MustCompile("^/(.*)"), WAF: p}}
+		return req.WithContext(context.WithValue(req.Context(), ctxMatch, m))
+	}
+
+	tbl := []struct {
+		name string
+		req  *http.Request
+		code int
+		tags string
+	}{
+		{"no match", makeReq("http://example.com/index.html", "1.2.3.4", ""), http.StatusOK, ""},
+		{"tags not trusted", makeReq("http://example.com/index.html", "1.2.3.4", "", "X-Waf-Tags", "spoofed"), http.StatusOK, ""},
+		{"global deny", makeReq("http://example.com/.env", "1.2.3.4", ""), http.StatusNotFound, ""},
+		{"global deny, unmatched route", makeReq("http://example.com/.env", "1.2.3.4", "-"), http.StatusNotFound, ""},
+		{"global rules skipped", makeReq("http://example.com/.env", "1.2.3.4", "skip-global"), http.StatusOK, ""},
+		{"tagged", makeReq("http://example.com/a?q=1+union+select", "1.2.3.4", "", "User-Agent", "sqlmap"),
+			http.StatusOK, "scanner,bad-query"},
+		{"set deny", makeReq("http://example.com/wp-login.php", "1.2.3.4", "sets=wordpress"), http.StatusForbidden, ""},
+		{"set not referred", makeReq("http://example.com/wp-login.php", "1.2.3.4", "sets=internal"), http.StatusOK, ""},
+		{"set allow", makeReq("http://example.com/.env", "10.1.1.1", "sets=internal"), http.StatusOK, ""},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			wr := httptest.NewRecorder()
+			handler.ServeHTTP(wr, tt.req)
+			assert.Equal(t, tt.code, wr.Code)
+			if tt.code != http.StatusOK {
+				assert.NotContains(t, wr.Body.String(), "passed")
+				return
+			}
+			assert.Equal(t, tt.tags, wr.Header().Get("X-Got-Tags"))
+			assert.Equal(t, tt.tags, wr.Header().Get("X-Got-Ctx"))
+		})
+	}
+
+	assert.Equal(t, map[string]int{"env-files:deny": 2, "scanners:log": 1, "bad-query:log": 1, "wp-login:deny": 1,
+		"office:allow": 1}, metrics.hits)
+}
+
+func TestHttp_wafHandlerDisabled(t *testing.T) {
+	h := Http{Reporter: &ErrorReporter{}, WAFTagHeader: "X-Waf-Tags"}
+	handler := h.wafHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("passed"))
+	}))
+	wr := httptest.NewRecorder()
+	handler.ServeHTTP(wr, httptest.NewRequest("GET", "http://example.com/.env", http.NoBody))
+	assert.Equal(t, http.StatusOK, wr.Code)
+	assert.Equal(t, "passed", wr.Body.String())
+}
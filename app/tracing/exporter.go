@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// NewOTLPExporter makes exporter sending spans to OpenTelemetry collector over OTLP/HTTP.
+// Endpoint is the collector url, i.e. http://localhost:4318, /v1/traces added if no path set.
+// Headers are extra request headers, i.e. for authentication.
+func NewOTLPExporter(ctx context.Context, endpoint string, headers map[string]string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q, should be http or https url", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()), otlptracehttp.WithHeaders(headers))
+	if err != nil {
+		return nil, fmt.Errorf("failed to make otlp exporter: %w", err)
+	}
+	return exp, nil
+}
+
+// NewStdoutExporter makes exporter writing spans as json, useful for local debugging
+func NewStdoutExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, fmt.Errorf("failed to make stdout exporter: %w", err)
+	}
+	return exp, nil
+}
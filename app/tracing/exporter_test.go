@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewOTLPExporter(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		var err error
+		body, err = io.ReadAll(r.Body)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	exp, err := NewOTLPExporter(context.Background(), ts.URL, map[string]string{"X-Api-Key": "secret"})
+	require.NoError(t, err)
+	tr := NewTracer(Config{Exporter: exp, SampleRatio: 1, Service: "reproxy", Version: "v1"})
+	ctx, parent := tr.Start(context.Background(), "parent", trace.SpanKindServer)
+	_, span := tr.Start(ctx, "child", trace.SpanKindClient)
+	span.End()
+	require.NoError(t, tr.Shutdown(context.Background()))
+
+	var req coltracepb.ExportTraceServiceRequest
+	require.NoError(t, proto.Unmarshal(body, &req))
+	require.Len(t, req.GetResourceSpans(), 1)
+	rs := req.GetResourceSpans()[0]
+	assert.Equal(t, "service.name", rs.GetResource().GetAttributes()[0].GetKey())
+	assert.Equal(t, "reproxy", rs.GetResource().GetAttributes()[0].GetValue().GetStringValue())
+	require.Len(t, rs.GetScopeSpans(), 1)
+	require.Len(t, rs.GetScopeSpans()[0].GetSpans(), 1)
+	s := rs.GetScopeSpans()[0].GetSpans()[0]
+	assert.Equal(t, "child", s.GetName())
+	assert.Equal(t, parent.SpanContext().TraceID().String(), trace.TraceID(s.GetTraceId()).String())
+	assert.Equal(t, parent.SpanContext().SpanID().String(), trace.SpanID(s.GetParentSpanId()).String())
+}
+
+func TestNewOTLPExporter_CustomPath(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/custom/traces", r.URL.Path)
+		called = true
+	}))
+	defer ts.Close()
+
+	exp, err := NewOTLPExporter(context.Background(), ts.URL+"/custom/traces", nil)
+	require.NoError(t, err)
+	tr := NewTracer(Config{Exporter: exp, SampleRatio: 1})
+	_, span := tr.Start(context.Background(), "s", trace.SpanKindServer)
+	span.End()
+	require.NoError(t, tr.Shutdown(context.Background()))
+	assert.True(t, called)
+}
+
+func TestNewOTLPExporter_InvalidEndpoint(t *testing.T) {
+	_, err := NewOTLPExporter(context.Background(), "localhost:4318", nil)
+	require.Error(t, err)
+	_, err = NewOTLPExporter(context.Background(), "http://local host", nil)
+	require.Error(t, err)
+}
+
+func TestNewStdoutExporter(t *testing.T) {
+	buf := bytes.Buffer{}
+	exp, err := NewStdoutExporter(&buf)
+	require.NoError(t, err)
+	tr := NewTracer(Config{Exporter: exp, SampleRatio: 1})
+	_, span := tr.Start(context.Background(), "s1", trace.SpanKindServer)
+	span.End()
+	require.NoError(t, tr.Shutdown(context.Background()))
+
+	var rec map[string]any
+	require.NoError(t, json.NewDecoder(&buf).Decode(&rec))
+	assert.Equal(t, "s1", rec["Name"])
+	assert.Equal(t, span.SpanContext().TraceID().String(), rec["SpanContext"].(map[string]any)["TraceID"])
+}
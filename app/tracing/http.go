@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware makes server span for each request, continuing the trace from incoming traceparent header.
+// The span stored in the request context, to be used as a parent by downstream handlers.
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.Start(ctx, r.Method, trace.SpanKindServer)
+		defer span.End()
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.scheme", scheme),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("server.address", strings.Split(r.Host, ":")[0]),
+			attribute.String("network.protocol.version", fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)),
+		)
+		if ua := r.UserAgent(); ua != "" {
+			span.SetAttributes(attribute.String("user_agent.original", ua))
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// Transport wraps http.RoundTripper, makes client span for each round trip
+// and injects trace context into the outgoing request headers
+type Transport struct {
+	Base   http.RoundTripper
+	Tracer *Tracer
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Tracer == nil {
+		return base.RoundTrip(req)
+	}
+
+	ctx, span := t.Tracer.Start(req.Context(), req.Method, trace.SpanKindClient)
+	defer span.End()
+	span.SetAttributes(attribute.String("http.request.method", req.Method), attribute.String("server.address", req.URL.Hostname()))
+	if port := req.URL.Port(); port != "" {
+		span.SetAttributes(attribute.String("server.port", port))
+	}
+	u := *req.URL
+	u.User = nil // don't leak credentials to the tracing backend
+	span.SetAttributes(attribute.String("url.full", u.String()))
+
+	req = req.Clone(ctx) // round tripper should not modify the original request
+	t.Tracer.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err //nolint:wrapcheck // errors of the wrapped round tripper returned as-is
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// statusWriter wraps http.ResponseWriter and stores status code
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader stores the first status code and passes it to the wrapped writer
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.status, sw.wroteHeader = code, true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Write marks header as written with 200, if not written yet
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b) //nolint:wrapcheck // pass errors of the wrapped writer as-is
+}
+
+// Flush delegates to the original writer if it implements http.Flusher
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack delegates to the original writer if it implements http.Hijacker
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, buf, err := h.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	return conn, buf, nil
+}
+
+// Unwrap returns the original writer, used by http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,88 @@
+// Package tracing implements distributed tracing with OpenTelemetry.
+// It supports W3C trace context propagation, ratio-based sampling of root spans,
+// and export over OTLP/HTTP or to stdout for local debugging.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const scopeName = "github.com/umputun/reproxy"
+
+// Config defines tracer parameters. Zero values replaced by defaults.
+type Config struct {
+	Exporter     sdktrace.SpanExporter
+	SampleRatio  float64       // ratio of sampled root spans, 0..1. Child spans follow the parent's decision
+	Service      string        // service.name resource attribute
+	Version      string        // service.version resource attribute
+	BatchTimeout time.Duration // max delay before export of incomplete batch, default 5s
+}
+
+// Tracer makes spans and exports sampled ones in batches. nil Tracer is a valid no-op tracer.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer makes tracer with the given config. Shutdown should be called to export the remaining spans.
+func NewTracer(cfg Config) *Tracer {
+	if cfg.Exporter == nil {
+		return newTracer(cfg, nil)
+	}
+	var batchOpts []sdktrace.BatchSpanProcessorOption
+	if cfg.BatchTimeout > 0 {
+		batchOpts = append(batchOpts, sdktrace.WithBatchTimeout(cfg.BatchTimeout))
+	}
+	return newTracer(cfg, sdktrace.NewBatchSpanProcessor(cfg.Exporter, batchOpts...))
+}
+
+// newTracer makes tracer passing ended spans to the processor, nil processor drops them
+func newTracer(cfg Config, processor sdktrace.SpanProcessor) *Tracer {
+	attrs := []attribute.KeyValue{attribute.String("service.name", cfg.Service)}
+	if cfg.Version != "" {
+		attrs = append(attrs, attribute.String("service.version", cfg.Version))
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+	}
+	if processor != nil {
+		opts = append(opts, sdktrace.WithSpanProcessor(processor))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+	return &Tracer{
+		provider:   provider,
+		tracer:     provider.Tracer(scopeName, trace.WithInstrumentationVersion(cfg.Version)),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// Start makes a new span, child of the span (or remote span context) in ctx, and returns ctx with it.
+// Root spans sampled according to the sample ratio.
+func (t *Tracer) Start(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// Shutdown exports the remaining spans and stops the tracer
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	if err := t.provider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shutdown tracer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer_Start(t *testing.T) {
+	tr, rec := newTestTracer(1)
+
+	ctx, root := tr.Start(context.Background(), "root", trace.SpanKindServer)
+	assert.True(t, root.SpanContext().IsValid())
+	assert.True(t, root.SpanContext().IsSampled())
+	assert.Equal(t, root, trace.SpanFromContext(ctx))
+
+	_, child := tr.Start(ctx, "child", trace.SpanKindClient)
+	child.End()
+	root.End()
+
+	spans := rec.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].Name())
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind())
+	assert.Equal(t, root.SpanContext().TraceID(), spans[0].SpanContext().TraceID())
+	assert.Equal(t, root.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.False(t, spans[1].Parent().IsValid())
+}
+
+func TestTracer_StartRemoteParent(t *testing.T) {
+	tr, rec := newTestTracer(0) // parent's decision wins over ratio
+	h := propagation.HeaderCarrier{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), h)
+
+	_, span := tr.Start(ctx, "server", trace.SpanKindServer)
+	span.End()
+	require.Len(t, rec.Ended(), 1)
+	s := rec.Ended()[0]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", s.Parent().SpanID().String())
+	assert.True(t, s.SpanContext().IsSampled())
+}
+
+func TestTracer_Sampling(t *testing.T) {
+	tbl := []struct {
+		ratio    float64
+		min, max int
+	}{
+		{ratio: 0, min: 0, max: 0},
+		{ratio: 1, min: 1000, max: 1000},
+		{ratio: 0.5, min: 400, max: 600},
+		{ratio: 0.1, min: 50, max: 150},
+	}
+	for _, tt := range tbl {
+		tr, rec := newTestTracer(tt.ratio)
+		for range 1000 {
+			_, span := tr.Start(context.Background(), "s", trace.SpanKindInternal)
+			span.End()
+		}
+		assert.GreaterOrEqual(t, len(rec.Ended()), tt.min, "ratio %v", tt.ratio)
+		assert.LessOrEqual(t, len(rec.Ended()), tt.max, "ratio %v", tt.ratio)
+	}
+}
+
+func TestTracer_Shutdown(t *testing.T) {
+	exp := &testExporter{}
+	tr := NewTracer(Config{Exporter: exp, SampleRatio: 1, Service: "reproxy", Version: "v1", BatchTimeout: time.Hour})
+	for _, name := range []string{"s1", "s2", "s3"} {
+		_, span := tr.Start(context.Background(), name, trace.SpanKindInternal)
+		span.End()
+	}
+	assert.Empty(t, exp.exported(), "batch not exported before timeout")
+
+	require.NoError(t, tr.Shutdown(context.Background())) // incomplete batch flushed on shutdown
+	spans := exp.exported()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "s1", spans[0].Name())
+	attrs := map[string]string{}
+	for _, a := range spans[0].Resource().Attributes() {
+		attrs[string(a.Key)] = a.Value.Emit()
+	}
+	assert.Equal(t, map[string]string{"service.name": "reproxy", "service.version": "v1"}, attrs)
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tr *Tracer
+	ctx, span := tr.Start(context.Background(), "s", trace.SpanKindInternal)
+	assert.False(t, span.IsRecording())
+	assert.False(t, trace.SpanFromContext(ctx).SpanContext().IsValid())
+	span.End()
+	assert.NoError(t, tr.Shutdown(context.Background()))
+}
+
+// newTestTracer makes tracer recording ended spans synchronously
+func newTestTracer(ratio float64) (*Tracer, *tracetest.SpanRecorder) {
+	rec := tracetest.NewSpanRecorder()
+	return newTracer(Config{SampleRatio: ratio}, rec), rec
+}
+
+// testExporter collects exported spans
+type testExporter struct {
+	lock  sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *testExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *testExporter) exported() []sdktrace.ReadOnlySpan {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.spans
+}
+
+func (e *testExporter) Shutdown(context.Context) error { return nil }
@@ -0,0 +1,346 @@
+// Package waf implements request filtering rules, loaded from yaml file and reloaded on change.
+// Rules match request's path, query, headers, user agent, method and client ip, and allow, deny or tag the request.
+package waf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Action of the matched rule
+type Action string
+
+// enum of rule actions
+const (
+	ActionAllow Action = "allow" // pass the request, skip the rest of the rules
+	ActionDeny  Action = "deny"  // reject the request with the rule's status
+	ActionLog   Action = "log"   // log and tag the request, continue with the next rules
+)
+
+// Rule defines conditions and action of a filtering rule, as defined in the rules file.
+// All defined conditions have to match, string conditions are regular expressions.
+type Rule struct {
+	Name      string            `yaml:"name"`
+	Path      string            `yaml:"path"`       // url path
+	Query     string            `yaml:"query"`      // unescaped query string
+	Method    string            `yaml:"method"`     // request method
+	UserAgent string            `yaml:"user-agent"` // User-Agent header
+	Headers   map[string]string `yaml:"headers"`    // header name -> regex of any of header's values
+	IPs       []string          `yaml:"ip"`         // ips or CIDRs of the client
+	Action    Action            `yaml:"action"`
+	Status    int               `yaml:"status"` // response status of deny action, 403 by default
+	Tag       string            `yaml:"tag"`    // tag of log action, rule's name by default
+}
+
+// Match is a rule matched the request
+type Match struct {
+	Rule   string
+	Action Action
+	Tag    string // tag of log action
+}
+
+// Decision is the result of request check
+type Decision struct {
+	Deny    bool
+	Status  int     // response status of denied request
+	Matched []Match // all matched rules, in order of evaluation
+}
+
+// Tags returns tags of matched log rules
+func (d Decision) Tags() []string {
+	res := []string{}
+	for _, m := range d.Matched {
+		if m.Action == ActionLog {
+			res = append(res, m.Tag)
+		}
+	}
+	return res
+}
+
+// Rules keeps global rules and named rule sets of the rules file
+type Rules struct {
+	path string
+
+	lock   sync.RWMutex
+	global []rule
+	sets   map[string][]rule
+}
+
+// rule is a compiled Rule
+type rule struct {
+	name      string
+	path      *regexp.Regexp
+	query     *regexp.Regexp
+	method    *regexp.Regexp
+	userAgent *regexp.Regexp
+	headers   map[string]*regexp.Regexp
+	nets      []*net.IPNet
+	action    Action
+	status    int
+	tag       string
+}
+
+// NewRules makes Rules and loads them from the file
+func NewRules(path string) (*Rules, error) {
+	res := &Rules{path: path}
+	if err := res.Load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Load reads rules from the file, replacing the current ones. Rules kept unchanged on error.
+func (rs *Rules) Load() error {
+	data, err := os.ReadFile(rs.path) //nolint:gosec // path is from the options
+	if err != nil {
+		return fmt.Errorf("failed to read waf rules file %s: %w", rs.path, err)
+	}
+	var file struct {
+		Global []Rule            `yaml:"global"`
+		Sets   map[string][]Rule `yaml:"sets"`
+	}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse waf rules file %s: %w", rs.path, err)
+	}
+
+	names := map[string]bool{}
+	compileAll := func(rules []Rule) ([]rule, error) {
+		res := make([]rule, 0, len(rules))
+		for i, r := range rules {
+			cr, err := compile(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid waf rule #%d (%s) in %s: %w", i+1, r.Name, rs.path, err)
+			}
+			if names[cr.name] {
+				return nil, fmt.Errorf("duplicate waf rule %q in %s", cr.name, rs.path)
+			}
+			names[cr.name] = true
+			res = append(res, cr)
+		}
+		return res, nil
+	}
+	global, err := compileAll(file.Global)
+	if err != nil {
+		return err
+	}
+	sets := make(map[string][]rule, len(file.Sets))
+	for name, rules := range file.Sets {
+		if sets[name], err = compileAll(rules); err != nil {
+			return err
+		}
+	}
+
+	rs.lock.Lock()
+	rs.global, rs.sets = global, sets
+	rs.lock.Unlock()
+	return nil
+}
+
+// Len returns number of global rules and rules of all sets
+func (rs *Rules) Len() int {
+	rs.lock.RLock()
+	defer rs.lock.RUnlock()
+	res := len(rs.global)
+	for _, s := range rs.sets {
+		res += len(s)
+	}
+	return res
+}
+
+// Check evaluates rules of the sets, in order of the sets, and then global rules, if global is true.
+// The first matched allow or deny rule stops the evaluation, log rules are collected and the evaluation continues.
+// Unknown sets are ignored.
+func (rs *Rules) Check(r *http.Request, clientIP string, sets []string, global bool) Decision {
+	rs.lock.RLock()
+	groups := make([][]rule, 0, len(sets)+1)
+	for _, name := range sets {
+		groups = append(groups, rs.sets[name])
+	}
+	if global {
+		groups = append(groups, rs.global)
+	}
+	rs.lock.RUnlock()
+
+	req := makeRequestInfo(r, clientIP)
+	res := Decision{}
+	for _, group := range groups {
+		for _, rl := range group {
+			if !rl.match(req) {
+				continue
+			}
+			res.Matched = append(res.Matched, Match{Rule: rl.name, Action: rl.action, Tag: rl.tag})
+			switch rl.action {
+			case ActionAllow:
+				return res
+			case ActionDeny:
+				res.Deny, res.Status = true, rl.status
+				return res
+			}
+		}
+	}
+	return res
+}
+
+// compile checks the rule and compiles its conditions
+func compile(r Rule) (res rule, err error) {
+	res = rule{name: strings.TrimSpace(r.Name), action: Action(strings.ToLower(string(r.Action))), status: r.Status, tag: r.Tag}
+	if res.name == "" {
+		return rule{}, errors.New("no name")
+	}
+	switch res.action {
+	case ActionAllow, ActionLog:
+	case ActionDeny:
+		if res.status == 0 {
+			res.status = http.StatusForbidden
+		}
+		if res.status < 400 || res.status > 599 {
+			return rule{}, fmt.Errorf("invalid status %d, should be 4xx or 5xx", res.status)
+		}
+	default:
+		return rule{}, fmt.Errorf("invalid action %q, should be allow, deny or log", r.Action)
+	}
+	if res.tag == "" {
+		res.tag = res.name
+	}
+
+	compileRx := func(field, rx string) (*regexp.Regexp, error) {
+		if rx == "" {
+			return nil, nil
+		}
+		c, err := regexp.Compile(rx)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s regex: %w", field, err)
+		}
+		return c, nil
+	}
+	if res.path, err = compileRx("path", r.Path); err != nil {
+		return rule{}, err
+	}
+	if res.query, err = compileRx("query", r.Query); err != nil {
+		return rule{}, err
+	}
+	if res.method, err = compileRx("method", r.Method); err != nil {
+		return rule{}, err
+	}
+	if res.userAgent, err = compileRx("user-agent", r.UserAgent); err != nil {
+		return rule{}, err
+	}
+	if len(r.Headers) > 0 {
+		res.headers = make(map[string]*regexp.Regexp, len(r.Headers))
+		for k, v := range r.Headers {
+			if v == "" {
+				return rule{}, fmt.Errorf("empty regex of header %s", k)
+			}
+			if res.headers[http.CanonicalHeaderKey(k)], err = compileRx("header "+k, v); err != nil {
+				return rule{}, err
+			}
+		}
+	}
+	for _, ip := range r.IPs {
+		ipNet, err := discovery.ParseIPNet(ip)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid ip %q", ip)
+		}
+		res.nets = append(res.nets, ipNet)
+	}
+	if res.path == nil && res.query == nil && res.method == nil && res.userAgent == nil && len(res.headers) == 0 &&
+		len(res.nets) == 0 {
+		return rule{}, errors.New("no conditions")
+	}
+	return res, nil
+}
+
+// requestInfo keeps request fields matched by rules
+type requestInfo struct {
+	path   string
+	query  string
+	method string
+	header http.Header
+	ip     net.IP
+}
+
+func makeRequestInfo(r *http.Request, clientIP string) requestInfo {
+	return requestInfo{path: r.URL.Path, query: unescapeQuery(r.URL.RawQuery), method: r.Method, header: r.Header,
+		ip: net.ParseIP(clientIP)}
+}
+
+// unescapeQuery decodes query string, keeping invalid escapes as is, so malformed escapes can't hide the rest of it
+func unescapeQuery(q string) string {
+	if res, err := url.QueryUnescape(q); err == nil {
+		return res
+	}
+	var sb strings.Builder
+	for i := 0; i < len(q); i++ {
+		switch {
+		case q[i] == '+':
+			sb.WriteByte(' ')
+		case q[i] == '%' && i+2 < len(q):
+			if v, err := url.PathUnescape(q[i : i+3]); err == nil {
+				sb.WriteString(v)
+				i += 2
+				continue
+			}
+			sb.WriteByte(q[i])
+		default:
+			sb.WriteByte(q[i])
+		}
+	}
+	return sb.String()
+}
+
+// match checks if all conditions of the rule match the request
+func (rl rule) match(req requestInfo) bool {
+	if rl.path != nil && !rl.path.MatchString(req.path) {
+		return false
+	}
+	if rl.query != nil && !rl.query.MatchString(req.query) {
+		return false
+	}
+	if rl.method != nil && !rl.method.MatchString(req.method) {
+		return false
+	}
+	if rl.userAgent != nil && !rl.userAgent.MatchString(req.header.Get("User-Agent")) {
+		return false
+	}
+	for k, rx := range rl.headers {
+		if !matchAny(rx, req.header.Values(k)) {
+			return false
+		}
+	}
+	if len(rl.nets) > 0 {
+		if req.ip == nil {
+			return false
+		}
+		inNets := false
+		for _, n := range rl.nets {
+			if n.Contains(req.ip) {
+				inNets = true
+				break
+			}
+		}
+		if !inNets {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(rx *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if rx.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
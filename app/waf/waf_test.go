@@ -0,0 +1,163 @@
+package waf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `
+global:
+  - {name: env-files, path: '/\.(env|git)', action: deny, status: 404}
+  - {name: sqli, query: '(?i)union\s+select|or\s+1=1', action: deny}
+  - {name: scanners, user-agent: '(?i)sqlmap|nikto', action: log, tag: scanner}
+  - {name: office, ip: [10.0.0.0/8, "192.168.1.10"], path: '^/admin', action: allow}
+  - {name: admin, path: '^/admin', action: deny}
+sets:
+  wordpress:
+    - {name: wp-login, path: '^/wp-login\.php', method: '^POST$', action: deny, status: 429}
+    - {name: wp-debug, headers: {x-debug: '^1$'}, action: log}
+  api:
+    - {name: api-probe, path: '^/api/', user-agent: curl, action: allow}
+`
+
+func TestRules_Check(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "waf.yml")
+	require.NoError(t, os.WriteFile(file, []byte(testRules), 0o600))
+	rs, err := NewRules(file)
+	require.NoError(t, err)
+	assert.Equal(t, 8, rs.Len())
+
+	makeReq := func(method, target string, headers ...string) *http.Request {
+		req := httptest.NewRequest(method, target, http.NoBody)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+
+	tbl := []struct {
+		name   string
+		req    *http.Request
+		ip     string
+		sets   []string
+		global bool
+		res    Decision
+	}{
+		{name: "no match", req: makeReq("GET", "/index.html"), ip: "1.2.3.4", global: true, res: Decision{}},
+		{name: "env file", req: makeReq("GET", "/app/.env"), ip: "1.2.3.4", global: true,
+			res: Decision{Deny: true, Status: 404, Matched: []Match{{Rule: "env-files", Action: ActionDeny, Tag: "env-files"}}}},
+		{name: "global rules skipped", req: makeReq("GET", "/app/.env"), ip: "1.2.3.4", res: Decision{}},
+		{name: "sqli in escaped query", req: makeReq("GET", "/items?id=1%20UNION%20%20SELECT%20*"), ip: "1.2.3.4", global: true,
+			res: Decision{Deny: true, Status: 403, Matched: []Match{{Rule: "sqli", Action: ActionDeny, Tag: "sqli"}}}},
+		{name: "malformed query", req: makeReq("GET", "/items?q=%zz+or+1=1"), ip: "1.2.3.4", global: true,
+			res: Decision{Deny: true, Status: 403, Matched: []Match{{Rule: "sqli", Action: ActionDeny, Tag: "sqli"}}}},
+		{name: "scanner tagged", req: makeReq("GET", "/", "User-Agent", "sqlmap/1.0"), ip: "1.2.3.4", global: true,
+			res: Decision{Matched: []Match{{Rule: "scanners", Action: ActionLog, Tag: "scanner"}}}},
+		{name: "scanner tagged and denied", req: makeReq("GET", "/admin", "User-Agent", "Nikto"), ip: "1.2.3.4", global: true,
+			res: Decision{Deny: true, Status: 403, Matched: []Match{{Rule: "scanners", Action: ActionLog, Tag: "scanner"},
+				{Rule: "admin", Action: ActionDeny, Tag: "admin"}}}},
+		{name: "admin from office net", req: makeReq("GET", "/admin"), ip: "10.1.2.3", global: true,
+			res: Decision{Matched: []Match{{Rule: "office", Action: ActionAllow, Tag: "office"}}}},
+		{name: "admin from office ip", req: makeReq("GET", "/admin"), ip: "192.168.1.10", global: true,
+			res: Decision{Matched: []Match{{Rule: "office", Action: ActionAllow, Tag: "office"}}}},
+		{name: "admin from other ip", req: makeReq("GET", "/admin"), ip: "192.168.1.11", global: true,
+			res: Decision{Deny: true, Status: 403, Matched: []Match{{Rule: "admin", Action: ActionDeny, Tag: "admin"}}}},
+		{name: "admin, no client ip", req: makeReq("GET", "/admin"), ip: "", global: true,
+			res: Decision{Deny: true, Status: 403, Matched: []Match{{Rule: "admin", Action: ActionDeny, Tag: "admin"}}}},
+		{name: "wp login post", req: makeReq("POST", "/wp-login.php"), ip: "1.2.3.4", sets: []string{"wordpress"},
+			res: Decision{Deny: true, Status: 429, Matched: []Match{{Rule: "wp-login", Action: ActionDeny, Tag: "wp-login"}}}},
+		{name: "wp login get", req: makeReq("GET", "/wp-login.php"), ip: "1.2.3.4", sets: []string{"wordpress"}, res: Decision{}},
+		{name: "wp login not in set", req: makeReq("POST", "/wp-login.php"), ip: "1.2.3.4", sets: []string{"api"}, global: true,
+			res: Decision{}},
+		{name: "header tagged", req: makeReq("GET", "/", "X-Debug", "1"), ip: "1.2.3.4", sets: []string{"wordpress", "unknown"},
+			res: Decision{Matched: []Match{{Rule: "wp-debug", Action: ActionLog, Tag: "wp-debug"}}}},
+		{name: "set allow skips global", req: makeReq("GET", "/api/.env", "User-Agent", "curl/8"), ip: "1.2.3.4",
+			sets: []string{"api"}, global: true,
+			res: Decision{Matched: []Match{{Rule: "api-probe", Action: ActionAllow, Tag: "api-probe"}}}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.res, rs.Check(tt.req, tt.ip, tt.sets, tt.global))
+		})
+	}
+}
+
+func TestRules_Load(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "waf.yml")
+	require.NoError(t, os.WriteFile(file, []byte(testRules), 0o600))
+	rs, err := NewRules(file)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(file, []byte("global:\n  - {name: all-env, path: '\\.env$', action: deny}\n"), 0o600))
+	require.NoError(t, rs.Load())
+	assert.Equal(t, 1, rs.Len())
+	assert.False(t, rs.Check(httptest.NewRequest("GET", "/.git", http.NoBody), "", nil, true).Deny)
+	assert.True(t, rs.Check(httptest.NewRequest("GET", "/x/.env", http.NoBody), "", nil, true).Deny)
+
+	// broken file keeps current rules
+	require.NoError(t, os.WriteFile(file, []byte("global:\n  - {name: bad, path: '(', action: deny}\n"), 0o600))
+	require.ErrorContains(t, rs.Load(), "invalid waf rule #1 (bad) in "+file+": invalid path regex")
+	assert.Equal(t, 1, rs.Len())
+
+	_, err = NewRules("/no-such-file.yml")
+	require.ErrorContains(t, err, "failed to read waf rules file /no-such-file.yml")
+}
+
+func TestRules_LoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tbl := []struct {
+		name, data, err string
+	}{
+		{"not yaml", "global: [", "failed to parse waf rules file"},
+		{"no name", "global:\n  - {path: /a, action: deny}\n", "no name"},
+		{"bad action", "global:\n  - {name: a, path: /a, action: block}\n", `invalid action "block"`},
+		{"no action", "global:\n  - {name: a, path: /a}\n", `invalid action ""`},
+		{"bad status", "global:\n  - {name: a, path: /a, action: deny, status: 302}\n", "invalid status 302"},
+		{"no conditions", "global:\n  - {name: a, action: deny}\n", "no conditions"},
+		{"bad query", "global:\n  - {name: a, query: '[', action: deny}\n", "invalid query regex"},
+		{"bad method", "global:\n  - {name: a, method: '(', action: deny}\n", "invalid method regex"},
+		{"bad user agent", "global:\n  - {name: a, user-agent: '(', action: deny}\n", "invalid user-agent regex"},
+		{"bad header", "global:\n  - {name: a, headers: {x-a: '('}, action: deny}\n", "invalid header x-a regex"},
+		{"empty header", "global:\n  - {name: a, headers: {x-a: ''}, action: deny}\n", "empty regex of header x-a"},
+		{"bad ip", "global:\n  - {name: a, ip: [10.0.0.0/33], action: deny}\n", `invalid ip "10.0.0.0/33"`},
+		{"duplicate", "global:\n  - {name: a, path: /a, action: deny}\nsets:\n  s1:\n    - {name: a, path: /b, action: log}\n",
+			`duplicate waf rule "a"`},
+		{"bad set rule", "sets:\n  s1:\n    - {name: a, action: log}\n", "invalid waf rule #1 (a)"},
+	}
+	for i, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "waf"+string(rune('a'+i))+".yml")
+			require.NoError(t, os.WriteFile(file, []byte(tt.data), 0o600))
+			_, err := NewRules(file)
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestDecision_Tags(t *testing.T) {
+	assert.Equal(t, []string{}, Decision{}.Tags())
+	d := Decision{Matched: []Match{{Rule: "a", Action: ActionLog, Tag: "scanner"}, {Rule: "b", Action: ActionAllow, Tag: "b"},
+		{Rule: "c", Action: ActionLog, Tag: "c"}}}
+	assert.Equal(t, []string{"scanner", "c"}, d.Tags())
+}
+
+func Test_unescapeQuery(t *testing.T) {
+	tbl := []struct{ in, out string }{
+		{"a=1&b=x%20y", "a=1&b=x y"},
+		{"q=a+b", "q=a b"},
+		{"q=%zz+or%201=1", "q=%zz or 1=1"},
+		{"q=%2", "q=%2"},
+		{"q=%", "q=%"},
+		{"", ""},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.out, unescapeQuery(tt.in), tt.in)
+	}
+}
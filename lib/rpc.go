@@ -8,9 +8,11 @@ import (
 type Request struct {
 	URL        string
 	RemoteAddr string
+	RealIP     string // client ip, resolved with trusted proxies taken into account
 	Host       string
 	Header     http.Header
 	Route      string // final destination
+	RequestID  string // request id, empty if disabled
 	Match      struct {
 		Server         string
 		Src            string